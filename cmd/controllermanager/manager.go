@@ -18,6 +18,7 @@ package main
 
 import (
 	"flag"
+	"os"
 
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
@@ -25,6 +26,11 @@ import (
 	"github.com/pdettori/cymba/pkg/controllers"
 	"github.com/pdettori/cymba/pkg/controllers/deployment"
 	"github.com/pdettori/cymba/pkg/controllers/pod"
+	"github.com/pdettori/cymba/pkg/controllers/podautoscaler"
+	"github.com/pdettori/cymba/pkg/controllers/replicaset"
+	"github.com/pdettori/cymba/pkg/controllers/statefulset"
+	"github.com/pdettori/cymba/pkg/controllers/volume"
+	"github.com/pdettori/cymba/pkg/podman"
 )
 
 const numThreads = 1
@@ -55,7 +61,26 @@ func main() {
 	go deployment.NewController(r, stopCh).Start(numThreads)
 	klog.Infof("Deployment controller launched")
 
-	pod.NewController(r, stopCh).Start(numThreads)
+	go replicaset.NewController(r, stopCh).Start(numThreads)
+	klog.Infof("Replica set controller launched")
+
+	go statefulset.NewController(r, stopCh).Start(numThreads)
+	klog.Infof("Stateful set controller launched")
+
+	runtime, err := podman.NewRuntime()
+	if err != nil {
+		klog.Errorf("%s", err)
+		klog.Error("Please check your podman socket service is started with `systemctl --user status podman.socket`")
+		os.Exit(1)
+	}
+
+	go volume.NewController(r, runtime, stopCh).Start(numThreads)
+	klog.Infof("Persistent volume claim controller launched")
+
+	go podautoscaler.NewController(r, runtime, stopCh).Start(numThreads)
+	klog.Infof("Horizontal pod autoscaler controller launched")
+
+	pod.NewController(r, runtime, stopCh).Start(numThreads)
 	deployment.NewController(r, stopCh).Start(numThreads)
 
 	<-stopCh
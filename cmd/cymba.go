@@ -21,16 +21,23 @@ import (
 	"flag"
 	"os"
 	"os/signal"
+	"path/filepath"
 
 	"k8s.io/klog/v2"
 
 	"github.com/kcp-dev/kcp/pkg/server"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"github.com/pdettori/cymba/pkg/apiproxy"
 	"github.com/pdettori/cymba/pkg/controllers"
 	"github.com/pdettori/cymba/pkg/controllers/deployment"
 	"github.com/pdettori/cymba/pkg/controllers/pod"
+	"github.com/pdettori/cymba/pkg/controllers/podautoscaler"
+	"github.com/pdettori/cymba/pkg/controllers/replicaset"
+	"github.com/pdettori/cymba/pkg/controllers/statefulset"
+	"github.com/pdettori/cymba/pkg/controllers/volume"
 	"github.com/pdettori/cymba/pkg/crd"
+	"github.com/pdettori/cymba/pkg/podman"
 	genericapiserver "k8s.io/apiserver/pkg/server"
 )
 
@@ -40,12 +47,16 @@ func main() {
 	var startControllerManager bool
 	flag.BoolVar(&startControllerManager, "controller-manager", true,
 		"start controller manager with server")
+	var apiProxyListen string
+	flag.StringVar(&apiProxyListen, "api-proxy-listen", ":6444",
+		"address:port of the proxy serving the pod subresources backed by podman, empty to disable it")
 	flag.Parse()
 
 	// Setup signal handler for a cleaner shutdown
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Kill, os.Interrupt)
 	defer cancel()
-	srv := server.NewServer(server.DefaultConfig())
+	cfg := server.DefaultConfig()
+	srv := server.NewServer(cfg)
 
 	// Register a post-start hook that connects to the api-server
 	if startControllerManager {
@@ -62,7 +73,42 @@ func main() {
 			go deployment.NewController(context.LoopbackClientConfig, stopCh).Start(numThreads)
 			klog.Infof("Deployment controller launched")
 
-			pod.NewController(context.LoopbackClientConfig, stopCh).Start(numThreads)
+			go replicaset.NewController(context.LoopbackClientConfig, stopCh).Start(numThreads)
+			klog.Infof("Replica set controller launched")
+
+			go statefulset.NewController(context.LoopbackClientConfig, stopCh).Start(numThreads)
+			klog.Infof("Stateful set controller launched")
+
+			runtime, err := podman.NewRuntime()
+			if err != nil {
+				klog.Errorf("%s", err)
+				klog.Error("Please check your podman socket service is started with `systemctl --user status podman.socket`")
+				os.Exit(1)
+			}
+
+			if apiProxyListen != "" {
+				proxy, err := apiproxy.NewProxy(context.LoopbackClientConfig, runtime)
+				if err != nil {
+					return err
+				}
+				// the proxy serves with the self-signed certificate of kcp
+				certDir := filepath.Join(cfg.RootDirectory, cfg.EtcdDirectory)
+				go func() {
+					err := proxy.Run(ctx, apiProxyListen, filepath.Join(certDir, "apiserver.crt"), filepath.Join(certDir, "apiserver.key"))
+					if err != nil {
+						klog.Errorf("API proxy failed: %s", err)
+					}
+				}()
+				klog.Infof("API proxy listening on %s", apiProxyListen)
+			}
+
+			go volume.NewController(context.LoopbackClientConfig, runtime, stopCh).Start(numThreads)
+			klog.Infof("Persistent volume claim controller launched")
+
+			go podautoscaler.NewController(context.LoopbackClientConfig, runtime, stopCh).Start(numThreads)
+			klog.Infof("Horizontal pod autoscaler controller launched")
+
+			pod.NewController(context.LoopbackClientConfig, runtime, stopCh).Start(numThreads)
 
 			return nil
 		})
@@ -3,8 +3,16 @@ module github.com/pdettori/cymba
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.4.1
+	github.com/containernetworking/plugins v0.9.1
 	github.com/containers/podman/v3 v3.4.4
+	github.com/containers/storage v1.37.0
+	github.com/docker/distribution v2.7.1+incompatible
+	github.com/docker/docker v20.10.11+incompatible
 	github.com/kcp-dev/kcp v0.0.0-20211201184224-7655908c9dcb
+	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/runtime-spec v1.0.3-0.20210326190908-1c3f411f0417
+	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.7.0
 	k8s.io/api v0.22.2
 	k8s.io/apiextensions-apiserver v0.22.2
@@ -12,6 +20,8 @@ require (
 	k8s.io/apiserver v0.20.6
 	k8s.io/client-go v0.22.2
 	k8s.io/klog/v2 v2.9.0
+	k8s.io/kubernetes v1.22.2
+	k8s.io/utils v0.0.0-20210819203725-bdf08cb9a70a
 	sigs.k8s.io/controller-runtime v0.10.3
 )
 
@@ -0,0 +1,273 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdettori/cymba/pkg/podman"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	authorizationv1client "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// podSubresources are the pod subresources served by the proxy, with the verb on which
+// callers are authorized for them, as in the kube-apiserver
+var podSubresources = map[string]string{"log": "get", "exec": "create", "attach": "create", "portforward": "create"}
+
+// podSubresourcePath matches the path of a pod subresource, optionally prefixed by the
+// logical cluster of kcp
+var podSubresourcePath = regexp.MustCompile(`^(/clusters/[^/]+)?/api/v1/namespaces/([^/]+)/pods/([^/]+)/([^/]+)$`)
+
+// Proxy serves the pod subresources backed by podman, which kcp cannot serve as pods are
+// custom resources, and proxies all the other requests to kcp. Callers are authorized by
+// kcp with self subject access reviews for the subresources, then get the pod from kcp,
+// with their credentials.
+type Proxy struct {
+	config  *rest.Config
+	runtime podman.PodmanRuntime
+	kcp     *httputil.ReverseProxy
+}
+
+// NewProxy returns a new Proxy for the kcp server of the given loopback config, serving
+// the pod subresources with the given podman runtime
+func NewProxy(cfg *rest.Config, rt podman.PodmanRuntime) (*Proxy, error) {
+	config := rest.AnonymousClientConfig(cfg)
+	target, err := url.Parse(config.Host)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := rest.TransportFor(config)
+	if err != nil {
+		return nil, err
+	}
+	kcp := httputil.NewSingleHostReverseProxy(target)
+	kcp.Transport = transport
+	// watches are streamed to the caller
+	kcp.FlushInterval = -1
+	return &Proxy{config: config, runtime: rt, kcp: kcp}, nil
+}
+
+// Run serves the proxy on the given address with the given certificate until ctx is done
+func (p *Proxy) Run(ctx context.Context, addr, certFile, keyFile string) error {
+	srv := &http.Server{Addr: addr, Handler: p}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	err := srv.ListenAndServeTLS(certFile, keyFile)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m := podSubresourcePath.FindStringSubmatch(r.URL.Path)
+	if m == nil || podSubresources[m[4]] == "" {
+		p.kcp.ServeHTTP(w, r)
+		return
+	}
+	cluster, namespace, name, subresource := m[1], m[2], m[3], m[4]
+	// streams are upgraded from POST requests, or from GET requests for websockets
+	allowed := r.Method == http.MethodGet || r.Method == http.MethodPost && subresource != "log"
+	if !allowed {
+		writeStatus(w, apierrors.NewMethodNotSupported(corev1.Resource("pods/"+subresource), r.Method))
+		return
+	}
+	config := p.configFor(r, cluster)
+	if err := authorize(r.Context(), config, namespace, name, subresource); err != nil {
+		writeStatus(w, err)
+		return
+	}
+	client, err := corev1client.NewForConfig(config)
+	if err != nil {
+		writeStatus(w, apierrors.NewInternalError(err))
+		return
+	}
+	pod, err := client.Pods(namespace).Get(r.Context(), name, metav1.GetOptions{})
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	switch subresource {
+	case "log":
+		p.serveLogs(w, r, pod)
+	case "exec":
+		p.serveExec(w, r, pod)
+	case "attach":
+		p.serveAttach(w, r, pod)
+	case "portforward":
+		p.servePortForward(w, r, pod)
+	}
+}
+
+func (p *Proxy) serveLogs(w http.ResponseWriter, r *http.Request, pod *corev1.Pod) {
+	opts, err := getPodLogOptions(r.URL.Query())
+	if err != nil {
+		writeStatus(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	if _, err := podman.CheckLogOptions(pod, opts); err != nil {
+		writeStatus(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+
+	lw := &logWriter{w: w}
+	err = podman.GetContainerLogs(r.Context(), p.runtime, pod, opts, lw)
+	if err != nil && !lw.written {
+		writeStatus(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	if err != nil && r.Context().Err() == nil {
+		klog.Errorf("error streaming logs of pod %s/%s: %s", pod.Namespace, pod.Name, err)
+	}
+}
+
+// configFor returns a client config for kcp with the bearer token of a request, in the
+// logical cluster of the request
+func (p *Proxy) configFor(r *http.Request, cluster string) *rest.Config {
+	config := rest.CopyConfig(p.config)
+	config.Host += cluster
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		config.BearerToken = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return config
+}
+
+// authorize checks with a self subject access review that the caller of a request may
+// use a subresource of a pod, before any stream is opened. Reading a pod does not allow
+// to run commands in its containers or to connect to its ports.
+func authorize(ctx context.Context, config *rest.Config, namespace, name, subresource string) error {
+	client, err := authorizationv1client.NewForConfig(config)
+	if err != nil {
+		return apierrors.NewInternalError(err)
+	}
+	verb := podSubresources[subresource]
+	review, err := client.SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        verb,
+				Resource:    "pods",
+				Subresource: subresource,
+				Name:        name,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	if !review.Status.Allowed {
+		reason := fmt.Sprintf("cannot %s resource \"pods/%s\" in API group \"\" in the namespace %q", verb, subresource, namespace)
+		if review.Status.Reason != "" {
+			reason += ": " + review.Status.Reason
+		}
+		return apierrors.NewForbidden(corev1.Resource("pods"), name, errors.New(reason))
+	}
+	return nil
+}
+
+// getPodLogOptions returns the log options of the query of a pods/log request
+func getPodLogOptions(query url.Values) (*corev1.PodLogOptions, error) {
+	opts := &corev1.PodLogOptions{Container: query.Get("container")}
+	for _, b := range []struct {
+		name  string
+		value *bool
+	}{
+		{"follow", &opts.Follow}, {"previous", &opts.Previous}, {"timestamps", &opts.Timestamps},
+	} {
+		if v := query.Get(b.name); v != "" {
+			parsed, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s: %s", v, b.name, err)
+			}
+			*b.value = parsed
+		}
+	}
+	for _, i := range []struct {
+		name  string
+		value **int64
+	}{
+		{"sinceSeconds", &opts.SinceSeconds}, {"tailLines", &opts.TailLines}, {"limitBytes", &opts.LimitBytes},
+	} {
+		if v := query.Get(i.name); v != "" {
+			parsed, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s: %s", v, i.name, err)
+			}
+			*i.value = &parsed
+		}
+	}
+	if v := query.Get("sinceTime"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for sinceTime: %s", v, err)
+		}
+		sinceTime := metav1.NewTime(t)
+		opts.SinceTime = &sinceTime
+	}
+	return opts, nil
+}
+
+// writeStatus writes an error as a status response, as in the kube-apiserver
+func writeStatus(w http.ResponseWriter, err error) {
+	var status metav1.Status
+	if s, ok := err.(apierrors.APIStatus); ok {
+		status = s.Status()
+	} else {
+		status = apierrors.NewInternalError(err).Status()
+	}
+	status.Kind, status.APIVersion = "Status", "v1"
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(status.Code))
+	json.NewEncoder(w).Encode(status)
+}
+
+// logWriter writes logs as plain text, flushing them so they can be followed
+type logWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (l *logWriter) Write(b []byte) (int, error) {
+	if !l.written {
+		l.w.Header().Set("Content-Type", "text/plain")
+		l.w.WriteHeader(http.StatusOK)
+		l.written = true
+	}
+	n, err := l.w.Write(b)
+	if f, ok := l.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
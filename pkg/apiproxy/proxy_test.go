@@ -0,0 +1,286 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pdettori/cymba/pkg/podman"
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/client-go/transport/spdy"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	token = "secret"
+	// readerToken is the token of a caller which may only read pods
+	readerToken = "reader"
+)
+
+func newTestPod() *corev1.Pod {
+	return &corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{Name: "mypod", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "busybox", Image: "busybox:1.25"}},
+		},
+	}
+}
+
+// newFakeKCP returns a server which serves a pod to the callers with the tokens, in the
+// admin cluster and in the logical cluster "user". The callers with the reader token are
+// only allowed to get pods and their subresources.
+func newFakeKCP(t *testing.T, pod *corev1.Pod) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if auth != "Bearer "+token && auth != "Bearer "+readerToken {
+			writeStatus(w, apierrors.NewUnauthorized("Unauthorized"))
+			return
+		}
+		switch r.URL.Path {
+		case "/apis/authorization.k8s.io/v1/selfsubjectaccessreviews", "/clusters/user/apis/authorization.k8s.io/v1/selfsubjectaccessreviews":
+			review := &authorizationv1.SelfSubjectAccessReview{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(review))
+			attrs := review.Spec.ResourceAttributes
+			review.TypeMeta = metav1.TypeMeta{APIVersion: "authorization.k8s.io/v1", Kind: "SelfSubjectAccessReview"}
+			review.Status.Allowed = attrs != nil && attrs.Resource == "pods" && (auth == "Bearer "+token || attrs.Verb == "get")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			assert.NoError(t, json.NewEncoder(w).Encode(review))
+		case "/api/v1/namespaces/default/pods/mypod", "/clusters/user/api/v1/namespaces/default/pods/mypod":
+			w.Header().Set("Content-Type", "application/json")
+			assert.NoError(t, json.NewEncoder(w).Encode(pod))
+		case "/api/v1/namespaces/default/pods":
+			w.Header().Set("Content-Type", "application/json")
+			assert.NoError(t, json.NewEncoder(w).Encode(corev1.PodList{Items: []corev1.Pod{*pod}}))
+		default:
+			writeStatus(w, apierrors.NewNotFound(corev1.Resource("pods"), "other"))
+		}
+	}))
+}
+
+func get(t *testing.T, url, bearer string) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+bearer)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return 0, ""
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestPodLogs(t *testing.T) {
+	rt := podman.NewFakeRuntime()
+	pod := newTestPod()
+	_, err := podman.NewPodManager(rt, &record.FakeRecorder{}).CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, rt.WriteContainerLog("default_mypod_busybox", false, "hello"))
+	assert.NoError(t, rt.WriteContainerLog("default_mypod_busybox", true, "world"))
+
+	kcp := newFakeKCP(t, pod)
+	defer kcp.Close()
+	proxy, err := NewProxy(&rest.Config{Host: kcp.URL, BearerToken: "loopback"}, rt)
+	assert.NoError(t, err)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	code, body := get(t, srv.URL+"/api/v1/namespaces/default/pods/mypod/log", token)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "hello\nworld\n", body)
+
+	code, body = get(t, srv.URL+"/clusters/user/api/v1/namespaces/default/pods/mypod/log?container=busybox&tailLines=1", token)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "world\n", body)
+
+	// callers are authorized by kcp
+	code, _ = get(t, srv.URL+"/api/v1/namespaces/default/pods/mypod/log", "other")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, body = get(t, srv.URL+"/api/v1/namespaces/default/pods/mypod/log", readerToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "hello\nworld\n", body)
+
+	code, _ = get(t, srv.URL+"/api/v1/namespaces/default/pods/other/log", token)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body = get(t, srv.URL+"/api/v1/namespaces/default/pods/mypod/log?container=nginx", token)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, "container nginx is not valid for pod mypod")
+
+	code, body = get(t, srv.URL+"/api/v1/namespaces/default/pods/mypod/log?tailLines=last", token)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Contains(t, body, `invalid value \"last\" for tailLines`)
+
+	// other requests are proxied to kcp
+	code, body = get(t, srv.URL+"/api/v1/namespaces/default/pods", token)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Contains(t, body, `"name":"mypod"`)
+}
+
+func TestGetPodLogOptions(t *testing.T) {
+	opts, err := getPodLogOptions(map[string][]string{
+		"container":  {"busybox"},
+		"follow":     {"true"},
+		"timestamps": {"1"},
+		"limitBytes": {"100"},
+		"sinceTime":  {"2021-12-01T10:00:00Z"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "busybox", opts.Container)
+	assert.True(t, opts.Follow)
+	assert.False(t, opts.Previous)
+	assert.True(t, opts.Timestamps)
+	assert.Equal(t, int64(100), *opts.LimitBytes)
+	assert.Nil(t, opts.TailLines)
+	assert.Equal(t, "2021-12-01T10:00:00Z", opts.SinceTime.UTC().Format("2006-01-02T15:04:05Z"))
+
+	_, err = getPodLogOptions(map[string][]string{"previous": {"maybe"}})
+	assert.Error(t, err)
+}
+
+func newStreamingTestProxy(t *testing.T, rt *podman.FakeRuntime) (*httptest.Server, *rest.Config, func()) {
+	pod := newTestPod()
+	_, err := podman.NewPodManager(rt, &record.FakeRecorder{}).CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	kcp := newFakeKCP(t, pod)
+	proxy, err := NewProxy(&rest.Config{Host: kcp.URL, BearerToken: "loopback"}, rt)
+	assert.NoError(t, err)
+	srv := httptest.NewServer(proxy)
+	return srv, &rest.Config{Host: srv.URL, BearerToken: token}, func() {
+		srv.Close()
+		kcp.Close()
+	}
+}
+
+func TestPodExec(t *testing.T) {
+	rt := podman.NewFakeRuntime()
+	rt.ExecOutputs["cat"] = "input: "
+	rt.ExecExitCodes["false"] = 3
+	srv, config, cleanup := newStreamingTestProxy(t, rt)
+	defer cleanup()
+
+	exec := func(cmd string, stdin io.Reader, stdout io.Writer) error {
+		u, err := url.Parse(srv.URL + "/api/v1/namespaces/default/pods/mypod/exec")
+		assert.NoError(t, err)
+		u.RawQuery = url.Values{"command": {cmd}, "stdin": {"true"}, "stdout": {"true"}, "stderr": {"true"}}.Encode()
+		executor, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, u)
+		assert.NoError(t, err)
+		return executor.Stream(remotecommand.StreamOptions{Stdin: stdin, Stdout: stdout, Stderr: io.Discard})
+	}
+
+	var stdout bytes.Buffer
+	assert.NoError(t, exec("cat", strings.NewReader("hello"), &stdout))
+	assert.Equal(t, "input: hello", stdout.String())
+	execs, err := rt.ExecCommands("default_mypod_busybox")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cat"}, execs)
+
+	err = exec("false", strings.NewReader(""), io.Discard)
+	exitErr, ok := err.(utilexec.ExitError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, 3, exitErr.ExitStatus())
+	}
+}
+
+func TestPodExecForbidden(t *testing.T) {
+	rt := podman.NewFakeRuntime()
+	srv, config, cleanup := newStreamingTestProxy(t, rt)
+	defer cleanup()
+	config.BearerToken = readerToken
+
+	u, err := url.Parse(srv.URL + "/api/v1/namespaces/default/pods/mypod/exec")
+	assert.NoError(t, err)
+	u.RawQuery = url.Values{"command": {"cat"}, "stdout": {"true"}}.Encode()
+	executor, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, u)
+	assert.NoError(t, err)
+	err = executor.Stream(remotecommand.StreamOptions{Stdout: io.Discard})
+	assert.Error(t, err)
+
+	// the caller is denied before any stream is opened
+	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+readerToken)
+	resp, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		assert.Contains(t, string(body), `cannot create resource \"pods/exec\"`)
+	}
+
+	execs, err := rt.ExecCommands("default_mypod_busybox")
+	assert.NoError(t, err)
+	assert.Empty(t, execs)
+}
+
+func TestPodPortForward(t *testing.T) {
+	rt := podman.NewFakeRuntime()
+	rt.PortHandlers[8080] = func(c net.Conn) {
+		defer c.Close()
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err == nil {
+			c.Write([]byte("pong"))
+		}
+	}
+	srv, config, cleanup := newStreamingTestProxy(t, rt)
+	defer cleanup()
+
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	assert.NoError(t, err)
+	u, err := url.Parse(srv.URL + "/api/v1/namespaces/default/pods/mypod/portforward")
+	assert.NoError(t, err)
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, u)
+	stopCh, readyCh := make(chan struct{}), make(chan struct{})
+	defer close(stopCh)
+	fw, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, []string{"0:8080"}, stopCh, readyCh, io.Discard, io.Discard)
+	assert.NoError(t, err)
+	go fw.ForwardPorts()
+	<-readyCh
+	ports, err := fw.GetPorts()
+	assert.NoError(t, err)
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", ports[0].Local))
+	assert.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("ping"))
+	assert.NoError(t, err)
+	b, err := io.ReadAll(c)
+	assert.NoError(t, err)
+	assert.Equal(t, "pong", string(b))
+}
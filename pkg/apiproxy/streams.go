@@ -0,0 +1,143 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pdettori/cymba/pkg/podman"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	remotecommandconsts "k8s.io/apimachinery/pkg/util/remotecommand"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/kubernetes/pkg/kubelet/cri/streaming/portforward"
+	remotecommandserver "k8s.io/kubernetes/pkg/kubelet/cri/streaming/remotecommand"
+)
+
+// streamIdleTimeout closes idle streams, as in the kubelet
+const streamIdleTimeout = 4 * time.Hour
+
+// serveExec serves pods/exec with the SPDY and websocket protocols of the kubelet
+func (p *Proxy) serveExec(w http.ResponseWriter, r *http.Request, pod *corev1.Pod) {
+	query := r.URL.Query()
+	streamOpts, err := getStreamOptions(query)
+	if err == nil && len(query[corev1.ExecCommandParam]) == 0 {
+		err = errors.New("you must specify at least 1 command")
+	}
+	if err != nil {
+		writeStatus(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	remotecommandserver.ServeExec(w, r, &podStreamer{ctx: r.Context(), runtime: p.runtime, pod: pod}, pod.Name, pod.UID,
+		query.Get("container"), query[corev1.ExecCommandParam], streamOpts, streamIdleTimeout,
+		remotecommandconsts.DefaultStreamCreationTimeout, remotecommandconsts.SupportedStreamingProtocols)
+}
+
+// serveAttach serves pods/attach with the SPDY and websocket protocols of the kubelet
+func (p *Proxy) serveAttach(w http.ResponseWriter, r *http.Request, pod *corev1.Pod) {
+	query := r.URL.Query()
+	streamOpts, err := getStreamOptions(query)
+	if err != nil {
+		writeStatus(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	remotecommandserver.ServeAttach(w, r, &podStreamer{ctx: r.Context(), runtime: p.runtime, pod: pod}, pod.Name, pod.UID,
+		query.Get("container"), streamOpts, streamIdleTimeout,
+		remotecommandconsts.DefaultStreamCreationTimeout, remotecommandconsts.SupportedStreamingProtocols)
+}
+
+// servePortForward serves pods/portforward with the SPDY and websocket protocols of the
+// kubelet
+func (p *Proxy) servePortForward(w http.ResponseWriter, r *http.Request, pod *corev1.Pod) {
+	portForwardOpts, err := portforward.NewV4Options(r)
+	if err != nil {
+		writeStatus(w, apierrors.NewBadRequest(err.Error()))
+		return
+	}
+	portforward.ServePortForward(w, r, &podStreamer{ctx: r.Context(), runtime: p.runtime, pod: pod}, pod.Name, pod.UID,
+		portForwardOpts, streamIdleTimeout, remotecommandconsts.DefaultStreamCreationTimeout, portforward.SupportedProtocols)
+}
+
+// getStreamOptions returns the streams requested by the query of a pods/exec or
+// pods/attach request. Stderr is merged into stdout with a TTY.
+func getStreamOptions(query url.Values) (*remotecommandserver.Options, error) {
+	opts := &remotecommandserver.Options{}
+	for _, b := range []struct {
+		name  string
+		value *bool
+	}{
+		{"stdin", &opts.Stdin}, {"stdout", &opts.Stdout}, {"stderr", &opts.Stderr}, {"tty", &opts.TTY},
+	} {
+		if v := query.Get(b.name); v != "" {
+			parsed, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q for %s: %s", v, b.name, err)
+			}
+			*b.value = parsed
+		}
+	}
+	if opts.TTY {
+		opts.Stderr = false
+	}
+	if !opts.Stdin && !opts.Stdout && !opts.Stderr {
+		return nil, errors.New("you must specify at least 1 of stdin, stdout, stderr")
+	}
+	return opts, nil
+}
+
+// podStreamer runs the streams of the kubelet streaming server in the podman containers
+// of a pod, until the request is done
+type podStreamer struct {
+	ctx     context.Context
+	runtime podman.PodmanRuntime
+	pod     *corev1.Pod
+}
+
+func (s *podStreamer) ExecInContainer(name string, uid types.UID, container string, cmd []string, in io.Reader, out, errOut io.WriteCloser,
+	tty bool, resize <-chan remotecommand.TerminalSize, timeout time.Duration) error {
+	return podman.ExecInContainer(s.ctx, s.runtime, s.pod, container, cmd, newStreams(in, out, errOut, tty, resize))
+}
+
+func (s *podStreamer) AttachContainer(name string, uid types.UID, container string, in io.Reader, out, errOut io.WriteCloser,
+	tty bool, resize <-chan remotecommand.TerminalSize) error {
+	return podman.AttachToContainer(s.ctx, s.runtime, s.pod, container, newStreams(in, out, errOut, tty, resize))
+}
+
+func (s *podStreamer) PortForward(name string, uid types.UID, port int32, stream io.ReadWriteCloser) error {
+	return podman.PortForward(s.ctx, s.runtime, s.pod, port, stream)
+}
+
+// newStreams returns the podman streams of the streams of the kubelet streaming server,
+// which are nil when not requested
+func newStreams(in io.Reader, out, errOut io.WriteCloser, tty bool, resize <-chan remotecommand.TerminalSize) *podman.Streams {
+	streams := &podman.Streams{Stdin: in, TTY: tty, Resize: resize}
+	if out != nil {
+		streams.Stdout = out
+	}
+	if errOut != nil {
+		streams.Stderr = errOut
+	}
+	return streams
+}
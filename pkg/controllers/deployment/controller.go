@@ -22,8 +22,8 @@ import (
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
-	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/informers"
@@ -32,16 +32,21 @@ import (
 	appsv1lister "k8s.io/client-go/listers/apps/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 
 	clusterclient "github.com/kcp-dev/kcp/pkg/client/clientset/versioned"
 	"github.com/kcp-dev/kcp/pkg/client/informers/externalversions"
+	"github.com/pdettori/cymba/pkg/controllers"
 )
 
 const resyncPeriod = 30 * time.Second
 const controllerName = "deployment"
 
+// eventSource is the component of the events recorded on deployments
+const eventSource = "deployment-controller"
+
 // NewController returns a new Controller which handles deployments
 func NewController(cfg *rest.Config, stopCh <-chan struct{}) *Controller {
 	client := appsv1client.NewForConfigOrDie(cfg)
@@ -55,6 +60,7 @@ func NewController(cfg *rest.Config, stopCh <-chan struct{}) *Controller {
 		client:     client,
 		kubeClient: kubeClient,
 		stopCh:     stopCh,
+		recorder:   controllers.NewEventRecorder(kubeClient, eventSource, stopCh),
 	}
 	csif.WaitForCacheSync(stopCh)
 	csif.Start(stopCh)
@@ -65,16 +71,16 @@ func NewController(cfg *rest.Config, stopCh <-chan struct{}) *Controller {
 		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
 		//DeleteFunc: func(obj interface{}) { c.enqueue(obj) },
 	})
-	sif.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    func(obj interface{}) { c.enqueue(obj) },
-		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
-		//DeleteFunc: func(obj interface{}) { c.enqueue(obj) },
+	// the deployment controlling a replica set is synced when the replica set changes
+	sif.Apps().V1().ReplicaSets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueueController(obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueueController(obj) },
+		DeleteFunc: func(obj interface{}) { c.enqueueController(obj) },
 	})
-	sif.WaitForCacheSync(stopCh)
-	sif.Start(stopCh)
-
 	c.indexer = sif.Apps().V1().Deployments().Informer().GetIndexer()
 	c.lister = sif.Apps().V1().Deployments().Lister()
+	sif.WaitForCacheSync(stopCh)
+	sif.Start(stopCh)
 
 	return c
 }
@@ -82,11 +88,12 @@ func NewController(cfg *rest.Config, stopCh <-chan struct{}) *Controller {
 // Controller defines the struct for Controller
 type Controller struct {
 	queue      workqueue.RateLimitingInterface
-	client     *appsv1client.AppsV1Client
+	client     appsv1client.AppsV1Interface
 	kubeClient kubernetes.Interface
 	stopCh     <-chan struct{}
 	indexer    cache.Indexer
 	lister     appsv1lister.DeploymentLister
+	recorder   record.EventRecorder
 }
 
 func (c *Controller) enqueue(obj interface{}) {
@@ -98,6 +105,47 @@ func (c *Controller) enqueue(obj interface{}) {
 	c.queue.Add(key)
 }
 
+func (c *Controller) enqueueAfter(obj interface{}, duration time.Duration) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.queue.AddAfter(key, duration)
+}
+
+// enqueueController enqueues the deployment controlling a replica set, or the
+// deployments which may adopt an orphan replica set
+func (c *Controller) enqueueController(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	rs, ok := obj.(*appsv1.ReplicaSet)
+	if !ok {
+		return
+	}
+	if ref := metav1.GetControllerOf(rs); ref != nil {
+		if ref.Kind == controllerKind.Kind {
+			c.queue.Add(rs.Namespace + "/" + ref.Name)
+		}
+		return
+	}
+	if rs.DeletionTimestamp != nil {
+		return
+	}
+	deployments, err := c.lister.Deployments(rs.Namespace).List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, d := range deployments {
+		selector, err := metav1.LabelSelectorAsSelector(d.Spec.Selector)
+		if err == nil && !selector.Empty() && selector.Matches(labels.Set(rs.Labels)) {
+			c.enqueue(d)
+		}
+	}
+}
+
 // Start starts the controller
 func (c *Controller) Start(numThreads int) {
 	defer c.queue.ShutDown()
@@ -146,18 +194,7 @@ func (c *Controller) process(key string) error {
 		return nil
 	}
 	current := obj.(*appsv1.Deployment).DeepCopy()
-	previous := current.DeepCopy()
-
-	ctx := context.TODO()
-	if err := c.reconcile(ctx, current); err != nil {
-		return err
-	}
-
-	// If the object being reconciled changed as a result, update it.
-	if !equality.Semantic.DeepEqual(previous, current) {
-		_, uerr := c.client.Deployments(current.Namespace).Update(ctx, current, metav1.UpdateOptions{})
-		return uerr
-	}
 
-	return err
+	// reconcile updates the deployment and its replica sets as it changes them
+	return c.reconcile(context.TODO(), current)
 }
@@ -18,30 +18,40 @@ package deployment
 
 import (
 	"context"
-	"fmt"
+	"sort"
+	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
-	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	"github.com/pdettori/cymba/pkg/controllers"
+	"github.com/pdettori/cymba/pkg/controllers/replicaset"
 )
 
 const (
 	deployFinalizer = "controller.deployment.kcp.dev/finalizer"
-	ownedByLabel    = "kcp.dev/owned-by"
+
+	// defaults of the deployment spec, as in the API server
+	defaultRevisionHistoryLimit = 10
+	defaultMaxSurge             = "25%"
+	defaultMaxUnavailable       = "25%"
+
+	// reasons of the events recorded on deployments, as in the kube-controller-manager
+	eventScalingReplicaSet = "ScalingReplicaSet"
+	eventFailedCreate      = "FailedCreate"
 )
 
 func (c *Controller) reconcile(ctx context.Context, deployment *appsv1.Deployment) error {
 	klog.Infof("reconciling deployment %q", deployment.Name)
 
-	// check current status (does pod exist ?)
-	childPods, err := c.kubeClient.CoreV1().Pods(deployment.Namespace).List(ctx, v1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", ownedByLabel, deployment.Name)})
+	rsList, err := c.getReplicaSets(ctx, deployment)
 	if err != nil {
-		klog.Error(err, "unable to list child Pods")
+		klog.Error(err, "unable to list child replica sets")
 		return err
 	}
 
@@ -52,21 +62,24 @@ func (c *Controller) reconcile(ctx context.Context, deployment *appsv1.Deploymen
 		// registering our finalizer.
 		if !controllers.ContainsString(deployment.GetFinalizers(), deployFinalizer) {
 			controllerutil.AddFinalizer(deployment, deployFinalizer)
-			_, err := c.client.Deployments(deployment.Namespace).Update(ctx, deployment, v1.UpdateOptions{})
+			updated, err := c.client.Deployments(deployment.Namespace).Update(ctx, deployment, v1.UpdateOptions{})
 			if err != nil {
 				return err
 			}
+			deployment = updated
 		}
 	} else {
 		// The object is being deleted
 		if controllers.ContainsString(deployment.GetFinalizers(), deployFinalizer) {
-			// our finalizer is present, so lets handle any external dependency
-			for _, pod := range childPods.Items {
-				klog.Info("Attempting to delete pod:", "name", pod.Name)
-				if err := c.kubeClient.CoreV1().Pods(deployment.Namespace).Delete(ctx, pod.Name, v1.DeleteOptions{}); err != nil {
+			// our finalizer is present, so lets delete the replica sets, which delete
+			// their pods in turn
+			for _, rs := range rsList {
+				klog.Info("Attempting to delete replica set:", "name", rs.Name)
+				err := c.client.ReplicaSets(deployment.Namespace).Delete(ctx, rs.Name, v1.DeleteOptions{})
+				if err != nil && !apierrors.IsNotFound(err) {
 					// if fail to delete the external dependency here, return with error
 					// so that it can be retried
-					klog.Error(err, "Error deleting pod", "name", pod.Name)
+					klog.Error(err, "Error deleting replica set", "name", rs.Name)
 					return err
 				}
 			}
@@ -82,98 +95,141 @@ func (c *Controller) reconcile(ctx context.Context, deployment *appsv1.Deploymen
 		return nil
 	}
 
-	actual := len(childPods.Items) // TODO make sure you do not include pods being terminated here
-	desired := int(*deployment.Spec.Replicas)
+	newRS, oldRSs := findNewReplicaSet(deployment, rsList)
 
-	if desired > actual {
-		n := desired - actual
-		klog.Info("Need to create new pods", "n", n)
-		for i := 0; i < n; i++ {
-			klog.Info("Creating pod replica", "#", i)
-			p := genPodSpec(deployment)
-			_, err := c.kubeClient.CoreV1().Pods(deployment.Namespace).Create(ctx, &p, v1.CreateOptions{})
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	} else if desired < actual {
-		n := actual - desired
-		klog.Info("Need to remove pods", "n", n)
-		for i := 0; i < n; i++ {
-			klog.Info("Deleting pod replica", "#", i)
-			p := childPods.Items[i]
-			err := c.kubeClient.CoreV1().Pods(deployment.Namespace).Delete(ctx, p.Name, v1.DeleteOptions{})
-			if err != nil {
-				return err
-			}
-		}
-		return nil
+	// a paused deployment is scaled, but its template changes are not rolled out
+	if deployment.Spec.Paused {
+		return c.sync(ctx, deployment, newRS, oldRSs)
 	}
-	// if desired == actual we are all happy
-
-	updateDeployStatus(childPods, deployment)
+	switch deployment.Spec.Strategy.Type {
+	case appsv1.RecreateDeploymentStrategyType:
+		return c.rolloutRecreate(ctx, deployment, newRS, oldRSs)
+	default:
+		return c.rolloutRolling(ctx, deployment, newRS, oldRSs)
+	}
+}
 
-	_, err = c.client.Deployments(deployment.Namespace).UpdateStatus(ctx, deployment, v1.UpdateOptions{})
+// sync scales the active replica set of a paused deployment, and updates its status
+func (c *Controller) sync(ctx context.Context, d *appsv1.Deployment, newRS *appsv1.ReplicaSet, oldRSs []*appsv1.ReplicaSet) error {
+	newRS, err := c.getNewReplicaSet(ctx, d, newRS, oldRSs, false)
 	if err != nil {
 		return err
 	}
+	if rs := findActiveOrLatest(newRS, oldRSs); rs != nil {
+		if _, err := c.scaleReplicaSet(ctx, d, rs, getReplicas(d)); err != nil {
+			return err
+		}
+	}
+	if err := c.cleanupDeployment(ctx, d, oldRSs); err != nil {
+		return err
+	}
+	return c.syncDeploymentStatus(ctx, d, newRS, oldRSs)
+}
 
+// cleanupDeployment deletes the oldest replica sets of a deployment which are scaled
+// down, beyond its revision history limit
+func (c *Controller) cleanupDeployment(ctx context.Context, d *appsv1.Deployment, oldRSs []*appsv1.ReplicaSet) error {
+	limit := int32(defaultRevisionHistoryLimit)
+	if d.Spec.RevisionHistoryLimit != nil {
+		limit = *d.Spec.RevisionHistoryLimit
+	}
+	cleanable := []*appsv1.ReplicaSet{}
+	for _, rs := range oldRSs {
+		if rs.DeletionTimestamp == nil && replicaset.GetReplicas(rs) == 0 && rs.Status.Replicas == 0 {
+			cleanable = append(cleanable, rs)
+		}
+	}
+	diff := len(cleanable) - int(limit)
+	if diff <= 0 {
+		return nil
+	}
+	sort.SliceStable(cleanable, func(i, j int) bool { return getRevision(cleanable[i]) < getRevision(cleanable[j]) })
+	for _, rs := range cleanable[:diff] {
+		klog.Infof("deleting old replica set %q of deployment %q", rs.Name, d.Name)
+		err := c.client.ReplicaSets(rs.Namespace).Delete(ctx, rs.Name, v1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
 	return nil
 }
 
-// genPodSpec generates the spec for each pod
-func genPodSpec(d *appsv1.Deployment) corev1.Pod {
-	klog.Infof("Generating pod spec for %s %s %s", d.APIVersion, d.Kind, d.Name)
-	p := corev1.Pod{
-		TypeMeta: v1.TypeMeta{
-			Kind:       "Pod",
-			APIVersion: "v1",
-		},
-		ObjectMeta: v1.ObjectMeta{
-			GenerateName: d.Name + "-",
-			Namespace:    d.Namespace,
-			Labels:       map[string]string{ownedByLabel: d.Name},
-			OwnerReferences: []v1.OwnerReference{
-				{
-					APIVersion:         "apps/v1",
-					Kind:               "Deployment",
-					Name:               d.Name,
-					UID:                d.UID,
-					Controller:         bool2ptr(true),
-					BlockOwnerDeletion: bool2ptr(true),
-				},
-			},
-		},
-		Spec: d.Spec.Template.Spec,
-	}
-	return p
+// syncDeploymentStatus updates the status and the conditions of a deployment from the
+// status of its replica sets
+func (c *Controller) syncDeploymentStatus(ctx context.Context, d *appsv1.Deployment, newRS *appsv1.ReplicaSet, oldRSs []*appsv1.ReplicaSet) error {
+	status := calculateStatus(d, newRS, oldRSs)
+	// a rollout in progress is checked again once its progress deadline elapsed
+	if next := setProgressingCondition(d, &status, newRS, time.Now()); next > 0 {
+		c.enqueueAfter(d, next)
+	}
+	if equality.Semantic.DeepEqual(d.Status, status) {
+		return nil
+	}
+	d = d.DeepCopy()
+	d.Status = status
+	_, err := c.client.Deployments(d.Namespace).UpdateStatus(ctx, d, v1.UpdateOptions{})
+	return err
 }
 
-func updateDeployStatus(pods *corev1.PodList, deploy *appsv1.Deployment) {
-	deploy.Status.ObservedGeneration = deploy.Generation
-	var availableReplicas int32
-	var readyReplicas int32
-	var replicas int32
-	var updatedReplicas int32
-
-	for _, p := range pods.Items {
-		replicas++
-		if p.Status.Phase == "Running" {
-			// TODO - this will need some revisiting
-			availableReplicas++
-			readyReplicas++
-			updatedReplicas++
+// calculateStatus returns the status of a deployment with the given replica sets
+func calculateStatus(d *appsv1.Deployment, newRS *appsv1.ReplicaSet, oldRSs []*appsv1.ReplicaSet) appsv1.DeploymentStatus {
+	status := appsv1.DeploymentStatus{
+		ObservedGeneration: d.Generation,
+		CollisionCount:     d.Status.CollisionCount,
+		Conditions:         d.Status.DeepCopy().Conditions,
+	}
+	for _, rs := range append(oldRSs, newRS) {
+		if rs == nil {
+			continue
 		}
+		status.Replicas += rs.Status.Replicas
+		status.ReadyReplicas += rs.Status.ReadyReplicas
+		status.AvailableReplicas += rs.Status.AvailableReplicas
+	}
+	if newRS != nil {
+		status.UpdatedReplicas = newRS.Status.Replicas
+	}
+	if unavailable := getReplicas(d) - status.AvailableReplicas; unavailable > 0 {
+		status.UnavailableReplicas = unavailable
 	}
-	deploy.Status.AvailableReplicas = availableReplicas
-	deploy.Status.ReadyReplicas = readyReplicas
-	deploy.Status.Replicas = replicas
-	deploy.Status.UpdatedReplicas = updatedReplicas
+	setAvailableCondition(d, &status)
+	setReplicaFailureCondition(&status, newRS, oldRSs)
+	return status
 }
 
-func bool2ptr(b bool) *bool {
-	return &b
+// getReplicas returns the desired replicas of a deployment, which default to 1
+func getReplicas(d *appsv1.Deployment) int32 {
+	if d.Spec.Replicas == nil {
+		return 1
+	}
+	return *d.Spec.Replicas
+}
+
+// resolveFenceposts returns the maximum surge and the maximum unavailable pods of a
+// rolling update, which cannot both be zero
+func resolveFenceposts(d *appsv1.Deployment) (int32, int32, error) {
+	maxSurge, maxUnavailable := intstr.FromString(defaultMaxSurge), intstr.FromString(defaultMaxUnavailable)
+	if ru := d.Spec.Strategy.RollingUpdate; ru != nil {
+		if ru.MaxSurge != nil {
+			maxSurge = *ru.MaxSurge
+		}
+		if ru.MaxUnavailable != nil {
+			maxUnavailable = *ru.MaxUnavailable
+		}
+	}
+	replicas := int(getReplicas(d))
+	surge, err := intstr.GetScaledValueFromIntOrPercent(&maxSurge, replicas, true)
+	if err != nil {
+		return 0, 0, err
+	}
+	unavailable, err := intstr.GetScaledValueFromIntOrPercent(&maxUnavailable, replicas, false)
+	if err != nil {
+		return 0, 0, err
+	}
+	if surge == 0 && unavailable == 0 {
+		unavailable = 1
+	}
+	return int32(surge), int32(unavailable), nil
 }
 
 // IgnoreConflict returns nil on Conflict errors, originating from updating when finalizer is deleted
@@ -0,0 +1,399 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployment
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/pdettori/cymba/pkg/controllers"
+	"github.com/pdettori/cymba/pkg/controllers/replicaset"
+	"github.com/pdettori/cymba/pkg/controllers/testutil"
+)
+
+func newTestDeployment(replicas int32) *appsv1.Deployment {
+	labels := map[string]string{"app": "web"}
+	return &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default", UID: "0a1b2c3d"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &v1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{Labels: labels},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx:1.20"}}},
+			},
+		},
+	}
+}
+
+func newTestController(objects ...runtime.Object) *Controller {
+	kubeClient := testutil.NewClientset(objects...)
+	return &Controller{
+		queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		client:     kubeClient.AppsV1(),
+		kubeClient: kubeClient,
+		recorder:   record.NewFakeRecorder(1000),
+	}
+}
+
+// reconcileDeployment reconciles the current version of a deployment
+func reconcileDeployment(t *testing.T, c *Controller) *appsv1.Deployment {
+	ctx := context.TODO()
+	d, err := c.client.Deployments("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, c.reconcile(ctx, d))
+	d, err = c.client.Deployments("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	return d
+}
+
+func updateDeployment(t *testing.T, c *Controller, update func(d *appsv1.Deployment)) {
+	ctx := context.TODO()
+	d, err := c.client.Deployments("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	update(d)
+	_, err = c.client.Deployments("default").Update(ctx, d, v1.UpdateOptions{})
+	assert.NoError(t, err)
+}
+
+// listReplicaSets returns the replica sets of the deployment, oldest first
+func listReplicaSets(t *testing.T, c *Controller) []*appsv1.ReplicaSet {
+	d, err := c.client.Deployments("default").Get(context.TODO(), "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	rsList, err := c.getReplicaSets(context.TODO(), d)
+	assert.NoError(t, err)
+	return rsList
+}
+
+// runReplicaSets reports all the desired pods of the replica sets as available, as the
+// replica set controller does once the pods are ready
+func runReplicaSets(t *testing.T, c *Controller) {
+	for _, rs := range listReplicaSets(t, c) {
+		replicas := replicaset.GetReplicas(rs)
+		rs.Status = appsv1.ReplicaSetStatus{Replicas: replicas, ReadyReplicas: replicas, AvailableReplicas: replicas}
+		_, err := c.client.ReplicaSets("default").UpdateStatus(context.TODO(), rs, v1.UpdateOptions{})
+		assert.NoError(t, err)
+	}
+}
+
+// rollout runs a rollout to completion, checking that the pods stay within the maximum
+// surge and the maximum unavailable pods
+func rollout(t *testing.T, c *Controller, maxTotal, minAvailable int32) *appsv1.Deployment {
+	for i := 0; i < 20; i++ {
+		d := reconcileDeployment(t, c)
+		rsList := listReplicaSets(t, c)
+		var total, available int32
+		for _, rs := range rsList {
+			total += replicaset.GetReplicas(rs)
+			if a := rs.Status.AvailableReplicas; a < replicaset.GetReplicas(rs) {
+				available += a
+			} else {
+				available += replicaset.GetReplicas(rs)
+			}
+		}
+		assert.LessOrEqual(t, total, maxTotal)
+		assert.GreaterOrEqual(t, available, minAvailable)
+		newRS, oldRSs := findNewReplicaSet(d, rsList)
+		if isComplete(d, newRS, oldRSs) {
+			return reconcileDeployment(t, c)
+		}
+		runReplicaSets(t, c)
+	}
+	t.Fatal("rollout did not complete")
+	return nil
+}
+
+func TestRollingUpdate(t *testing.T) {
+	c := newTestController(newTestDeployment(4))
+
+	d := reconcileDeployment(t, c)
+	assert.Contains(t, d.Finalizers, deployFinalizer)
+	rsList := listReplicaSets(t, c)
+	if !assert.Len(t, rsList, 1) {
+		return
+	}
+	first := rsList[0]
+	hash := computeHash(&d.Spec.Template, nil)
+	assert.Equal(t, "web-"+hash, first.Name)
+	assert.Equal(t, hash, first.Spec.Template.Labels[appsv1.DefaultDeploymentUniqueLabelKey])
+	assert.Equal(t, hash, first.Spec.Selector.MatchLabels[appsv1.DefaultDeploymentUniqueLabelKey])
+	assert.Equal(t, int32(4), replicaset.GetReplicas(first))
+	assert.Equal(t, "web", first.Labels[controllers.OwnedByLabel])
+	assert.Equal(t, "1", first.Annotations[revisionAnnotation])
+	assert.Equal(t, "1", d.Annotations[revisionAnnotation])
+	events := c.recorder.(*record.FakeRecorder).Events
+	assert.Equal(t, "Normal ScalingReplicaSet Scaled up replica set "+first.Name+" to 4", <-events)
+
+	runReplicaSets(t, c)
+	d = reconcileDeployment(t, c)
+	status := d.Status.DeepCopy()
+	status.Conditions = nil
+	assert.Equal(t, appsv1.DeploymentStatus{Replicas: 4, UpdatedReplicas: 4, ReadyReplicas: 4, AvailableReplicas: 4}, *status)
+
+	// a new template is rolled out with at most one pod over and one pod under the
+	// desired replicas
+	updateDeployment(t, c, func(d *appsv1.Deployment) {
+		d.Spec.Template.Spec.Containers[0].Image = "nginx:1.21"
+		d.Annotations["kubernetes.io/change-cause"] = "upgrade nginx"
+	})
+	d = rollout(t, c, 5, 3)
+	rsList = listReplicaSets(t, c)
+	if !assert.Len(t, rsList, 2) {
+		return
+	}
+	assert.Equal(t, int32(0), replicaset.GetReplicas(rsList[0]))
+	assert.Equal(t, int32(4), replicaset.GetReplicas(rsList[1]))
+	assert.Equal(t, "nginx:1.21", rsList[1].Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "2", rsList[1].Annotations[revisionAnnotation])
+	assert.Equal(t, "upgrade nginx", rsList[1].Annotations["kubernetes.io/change-cause"])
+	assert.Equal(t, "2", d.Annotations[revisionAnnotation])
+	assert.Equal(t, int32(4), d.Status.UpdatedReplicas)
+
+	// a rollback reuses the replica set of the restored template as the latest revision
+	updateDeployment(t, c, func(d *appsv1.Deployment) {
+		d.Spec.Template = *first.Spec.Template.DeepCopy()
+		delete(d.Spec.Template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+	})
+	d = rollout(t, c, 5, 3)
+	rsList = listReplicaSets(t, c)
+	if !assert.Len(t, rsList, 2) {
+		return
+	}
+	assert.Equal(t, first.Name, rsList[0].Name)
+	assert.Equal(t, int32(4), replicaset.GetReplicas(rsList[0]))
+	assert.Equal(t, "3", rsList[0].Annotations[revisionAnnotation])
+	assert.Equal(t, "3", d.Annotations[revisionAnnotation])
+}
+
+func TestRollingUpdateWithMaxSurge(t *testing.T) {
+	deployment := newTestDeployment(3)
+	maxSurge, maxUnavailable := intstr.FromInt(3), intstr.FromInt(0)
+	deployment.Spec.Strategy.RollingUpdate = &appsv1.RollingUpdateDeployment{MaxSurge: &maxSurge, MaxUnavailable: &maxUnavailable}
+	c := newTestController(deployment)
+	reconcileDeployment(t, c)
+	runReplicaSets(t, c)
+
+	updateDeployment(t, c, func(d *appsv1.Deployment) { d.Spec.Template.Spec.Containers[0].Image = "nginx:1.21" })
+	reconcileDeployment(t, c)
+	rsList := listReplicaSets(t, c)
+	if assert.Len(t, rsList, 2) {
+		// all the new pods are created at once, and no old pod is deleted until they are available
+		assert.Equal(t, int32(3), replicaset.GetReplicas(rsList[0]))
+		assert.Equal(t, int32(3), replicaset.GetReplicas(rsList[1]))
+	}
+	rollout(t, c, 6, 3)
+}
+
+func TestRecreate(t *testing.T) {
+	deployment := newTestDeployment(2)
+	deployment.Spec.Strategy.Type = appsv1.RecreateDeploymentStrategyType
+	c := newTestController(deployment)
+	reconcileDeployment(t, c)
+	runReplicaSets(t, c)
+
+	// the new replica set is created once the old pods are gone
+	updateDeployment(t, c, func(d *appsv1.Deployment) { d.Spec.Template.Spec.Containers[0].Image = "nginx:1.21" })
+	reconcileDeployment(t, c)
+	rsList := listReplicaSets(t, c)
+	if assert.Len(t, rsList, 1) {
+		assert.Equal(t, int32(0), replicaset.GetReplicas(rsList[0]))
+	}
+	reconcileDeployment(t, c)
+	assert.Len(t, listReplicaSets(t, c), 1)
+
+	// a terminating pod of the old replica set is still running
+	now := v1.Now()
+	pod := &corev1.Pod{ObjectMeta: v1.ObjectMeta{
+		Name: "web-terminating", Namespace: "default", DeletionTimestamp: &now,
+		Labels:          rsList[0].Spec.Selector.MatchLabels,
+		OwnerReferences: []v1.OwnerReference{*v1.NewControllerRef(rsList[0], appsv1.SchemeGroupVersion.WithKind("ReplicaSet"))},
+	}}
+	_, err := c.kubeClient.CoreV1().Pods("default").Create(context.TODO(), pod, v1.CreateOptions{})
+	assert.NoError(t, err)
+	runReplicaSets(t, c)
+	reconcileDeployment(t, c)
+	assert.Len(t, listReplicaSets(t, c), 1)
+
+	assert.NoError(t, c.kubeClient.CoreV1().Pods("default").Delete(context.TODO(), pod.Name, v1.DeleteOptions{}))
+	reconcileDeployment(t, c)
+	rsList = listReplicaSets(t, c)
+	if assert.Len(t, rsList, 2) {
+		assert.Equal(t, int32(2), replicaset.GetReplicas(rsList[1]))
+		assert.Equal(t, "nginx:1.21", rsList[1].Spec.Template.Spec.Containers[0].Image)
+	}
+}
+
+func TestRevisionHistoryLimit(t *testing.T) {
+	deployment := newTestDeployment(1)
+	limit := int32(1)
+	deployment.Spec.RevisionHistoryLimit = &limit
+	c := newTestController(deployment)
+	rollout(t, c, 2, 0)
+
+	for _, image := range []string{"nginx:1.21", "nginx:1.22", "nginx:1.23"} {
+		updateDeployment(t, c, func(d *appsv1.Deployment) { d.Spec.Template.Spec.Containers[0].Image = image })
+		rollout(t, c, 2, 0)
+	}
+	rsList := listReplicaSets(t, c)
+	if assert.Len(t, rsList, 2) {
+		assert.Equal(t, "nginx:1.22", rsList[0].Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, "nginx:1.23", rsList[1].Spec.Template.Spec.Containers[0].Image)
+	}
+}
+
+func TestPausedDeployment(t *testing.T) {
+	c := newTestController(newTestDeployment(2))
+	rollout(t, c, 3, 0)
+
+	// a paused deployment is scaled without rolling out its template
+	updateDeployment(t, c, func(d *appsv1.Deployment) {
+		replicas := int32(3)
+		d.Spec.Paused = true
+		d.Spec.Replicas = &replicas
+		d.Spec.Template.Spec.Containers[0].Image = "nginx:1.21"
+	})
+	reconcileDeployment(t, c)
+	rsList := listReplicaSets(t, c)
+	if assert.Len(t, rsList, 1) {
+		assert.Equal(t, int32(3), replicaset.GetReplicas(rsList[0]))
+		assert.Equal(t, "nginx:1.20", rsList[0].Spec.Template.Spec.Containers[0].Image)
+	}
+
+	// the template is rolled out once resumed
+	updateDeployment(t, c, func(d *appsv1.Deployment) { d.Spec.Paused = false })
+	rollout(t, c, 4, 2)
+	rsList = listReplicaSets(t, c)
+	if assert.Len(t, rsList, 2) {
+		assert.Equal(t, int32(3), replicaset.GetReplicas(rsList[1]))
+		assert.Equal(t, "nginx:1.21", rsList[1].Spec.Template.Spec.Containers[0].Image)
+	}
+}
+
+func TestDeleteDeployment(t *testing.T) {
+	c := newTestController(newTestDeployment(2))
+	reconcileDeployment(t, c)
+	assert.Len(t, listReplicaSets(t, c), 1)
+
+	updateDeployment(t, c, func(d *appsv1.Deployment) {
+		now := v1.Now()
+		d.DeletionTimestamp = &now
+	})
+	d := reconcileDeployment(t, c)
+	assert.NotContains(t, d.Finalizers, deployFinalizer)
+	assert.Empty(t, listReplicaSets(t, c))
+}
+
+func TestAdoptReplicaSet(t *testing.T) {
+	deployment := newTestDeployment(2)
+	hash := computeHash(&deployment.Spec.Template, nil)
+	template := deployment.Spec.Template.DeepCopy()
+	template.Labels = map[string]string{"app": "web", appsv1.DefaultDeploymentUniqueLabelKey: hash}
+	replicas := int32(2)
+	orphan := &appsv1.ReplicaSet{
+		ObjectMeta: v1.ObjectMeta{Name: "web-" + hash, Namespace: "default", UID: "orphan", Labels: template.Labels},
+		Spec: appsv1.ReplicaSetSpec{
+			Replicas: &replicas,
+			Selector: &v1.LabelSelector{MatchLabels: template.Labels},
+			Template: *template,
+		},
+	}
+	c := newTestController(deployment, orphan)
+
+	// the orphan replica set with the template of the deployment is adopted as its new
+	// replica set
+	d := reconcileDeployment(t, c)
+	rsList := listReplicaSets(t, c)
+	if assert.Len(t, rsList, 1) {
+		assert.Equal(t, orphan.Name, rsList[0].Name)
+		assert.True(t, v1.IsControlledBy(rsList[0], d))
+		assert.Equal(t, "web", rsList[0].Labels[controllers.OwnedByLabel])
+		assert.Equal(t, "1", rsList[0].Annotations[revisionAnnotation])
+	}
+}
+
+func TestDeploymentConditions(t *testing.T) {
+	c := newTestController(newTestDeployment(2))
+	d := reconcileDeployment(t, c)
+	available := getCondition(d.Status, appsv1.DeploymentAvailable)
+	if assert.NotNil(t, available) {
+		assert.Equal(t, corev1.ConditionFalse, available.Status)
+		assert.Equal(t, reasonMinimumReplicasUnavailable, available.Reason)
+	}
+	progressing := getCondition(d.Status, appsv1.DeploymentProgressing)
+	if assert.NotNil(t, progressing) {
+		assert.Equal(t, corev1.ConditionTrue, progressing.Status)
+		assert.Equal(t, reasonNewRSCreated, progressing.Reason)
+	}
+
+	// the conditions are set once the rollout is complete
+	runReplicaSets(t, c)
+	d = reconcileDeployment(t, c)
+	assert.Equal(t, corev1.ConditionTrue, getCondition(d.Status, appsv1.DeploymentAvailable).Status)
+	progressing = getCondition(d.Status, appsv1.DeploymentProgressing)
+	assert.Equal(t, corev1.ConditionTrue, progressing.Status)
+	assert.Equal(t, reasonNewRSAvailable, progressing.Reason)
+	assert.Equal(t, fmt.Sprintf("ReplicaSet %q has successfully progressed.", listReplicaSets(t, c)[0].Name), progressing.Message)
+
+	// a rollout which made no progress within its deadline times out
+	updateDeployment(t, c, func(d *appsv1.Deployment) { d.Spec.Template.Spec.Containers[0].Image = "nginx:1.21" })
+	d = reconcileDeployment(t, c)
+	progressing = getCondition(d.Status, appsv1.DeploymentProgressing)
+	assert.Equal(t, reasonNewRSCreated, progressing.Reason)
+	progressing.LastUpdateTime = v1.NewTime(time.Now().Add(-11 * time.Minute))
+	_, err := c.client.Deployments("default").UpdateStatus(context.TODO(), d, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	d = reconcileDeployment(t, c)
+	progressing = getCondition(d.Status, appsv1.DeploymentProgressing)
+	assert.Equal(t, corev1.ConditionFalse, progressing.Status)
+	assert.Equal(t, reasonTimedOut, progressing.Reason)
+
+	// the failure of a replica set to create its pods is reported on the deployment
+	rs := listReplicaSets(t, c)[1]
+	rs.Status.Conditions = []appsv1.ReplicaSetCondition{{
+		Type: appsv1.ReplicaSetReplicaFailure, Status: corev1.ConditionTrue,
+		Reason: "FailedCreate", Message: "quota exceeded",
+	}}
+	_, err = c.client.ReplicaSets("default").UpdateStatus(context.TODO(), rs, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	d = reconcileDeployment(t, c)
+	failure := getCondition(d.Status, appsv1.DeploymentReplicaFailure)
+	if assert.NotNil(t, failure) {
+		assert.Equal(t, "FailedCreate", failure.Reason)
+		assert.Equal(t, "quota exceeded", failure.Message)
+	}
+
+	// the progress of a paused deployment is unknown
+	updateDeployment(t, c, func(d *appsv1.Deployment) { d.Spec.Paused = true })
+	d = reconcileDeployment(t, c)
+	progressing = getCondition(d.Status, appsv1.DeploymentProgressing)
+	assert.Equal(t, corev1.ConditionUnknown, progressing.Status)
+	assert.Equal(t, reasonPaused, progressing.Reason)
+	updateDeployment(t, c, func(d *appsv1.Deployment) { d.Spec.Paused = false })
+	d = reconcileDeployment(t, c)
+	assert.Equal(t, reasonResumed, getCondition(d.Status, appsv1.DeploymentProgressing).Reason)
+}
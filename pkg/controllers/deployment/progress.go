@@ -0,0 +1,253 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployment
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// default of the progress deadline of the deployment spec, as in the API server
+	defaultProgressDeadlineSeconds = 600
+
+	// reasons of the deployment conditions, as in the kube-controller-manager
+	reasonMinimumReplicasAvailable   = "MinimumReplicasAvailable"
+	reasonMinimumReplicasUnavailable = "MinimumReplicasUnavailable"
+	reasonNewRSAvailable             = "NewReplicaSetAvailable"
+	reasonReplicaSetUpdated          = "ReplicaSetUpdated"
+	reasonFailedRSCreate             = "ReplicaSetCreateError"
+	reasonNewRSCreated               = "NewReplicaSetCreated"
+	reasonTimedOut                   = "ProgressDeadlineExceeded"
+	reasonPaused                     = "DeploymentPaused"
+	reasonResumed                    = "DeploymentResumed"
+)
+
+// setAvailableCondition sets the Available condition of a deployment, which is true when
+// at most the maximum unavailable pods of a rolling update are unavailable, and when all
+// the pods are available otherwise
+func setAvailableCondition(d *appsv1.Deployment, status *appsv1.DeploymentStatus) {
+	if status.AvailableReplicas >= getReplicas(d)-maxUnavailable(d) {
+		setCondition(status, newCondition(appsv1.DeploymentAvailable, corev1.ConditionTrue,
+			reasonMinimumReplicasAvailable, "Deployment has minimum availability."))
+	} else {
+		setCondition(status, newCondition(appsv1.DeploymentAvailable, corev1.ConditionFalse,
+			reasonMinimumReplicasUnavailable, "Deployment does not have minimum availability."))
+	}
+}
+
+// setReplicaFailureCondition copies the ReplicaFailure condition of the replica sets of a
+// deployment, preferring the one of its new replica set
+func setReplicaFailureCondition(status *appsv1.DeploymentStatus, newRS *appsv1.ReplicaSet, oldRSs []*appsv1.ReplicaSet) {
+	for _, rs := range append([]*appsv1.ReplicaSet{newRS}, oldRSs...) {
+		if rs == nil {
+			continue
+		}
+		for _, c := range rs.Status.Conditions {
+			if c.Type != appsv1.ReplicaSetReplicaFailure {
+				continue
+			}
+			setCondition(status, appsv1.DeploymentCondition{
+				Type:               appsv1.DeploymentReplicaFailure,
+				Status:             c.Status,
+				LastUpdateTime:     c.LastTransitionTime,
+				LastTransitionTime: c.LastTransitionTime,
+				Reason:             c.Reason,
+				Message:            c.Message,
+			})
+			return
+		}
+	}
+	removeCondition(status, appsv1.DeploymentReplicaFailure)
+}
+
+// setProgressingCondition sets the Progressing condition of a deployment: unknown while
+// it is paused, true while its pods are replaced or once its rollout is complete, and
+// false when its rollout made no progress within its progress deadline. It returns the
+// time after which the deadline of a rollout in progress elapses, or zero if there is none
+func setProgressingCondition(d *appsv1.Deployment, status *appsv1.DeploymentStatus, newRS *appsv1.ReplicaSet, now time.Time) time.Duration {
+	current := getCondition(*status, appsv1.DeploymentProgressing)
+	if d.Spec.Paused {
+		if current == nil || current.Reason != reasonPaused {
+			setCondition(status, newCondition(appsv1.DeploymentProgressing, corev1.ConditionUnknown,
+				reasonPaused, "Deployment is paused"))
+		}
+		return 0
+	}
+	if current != nil && current.Reason == reasonPaused {
+		// the progress deadline restarts when the deployment is resumed
+		setCondition(status, newCondition(appsv1.DeploymentProgressing, corev1.ConditionUnknown,
+			reasonResumed, "Deployment is resumed"))
+	}
+	deadline := progressDeadline(d)
+	if deadline == 0 {
+		removeCondition(status, appsv1.DeploymentProgressing)
+		return 0
+	}
+
+	subject := fmt.Sprintf("Deployment %q", d.Name)
+	if newRS != nil {
+		subject = fmt.Sprintf("ReplicaSet %q", newRS.Name)
+	}
+	current = getCondition(*status, appsv1.DeploymentProgressing)
+	if current != nil && current.Reason == reasonNewRSAvailable && status.Replicas == status.UpdatedReplicas {
+		return 0
+	}
+	switch {
+	case isStatusComplete(d, status):
+		setCondition(status, newCondition(appsv1.DeploymentProgressing, corev1.ConditionTrue,
+			reasonNewRSAvailable, fmt.Sprintf("%s has successfully progressed.", subject)))
+		return 0
+	case isProgressing(d, status):
+		condition := newCondition(appsv1.DeploymentProgressing, corev1.ConditionTrue,
+			reasonReplicaSetUpdated, fmt.Sprintf("%s is progressing.", subject))
+		// the update time of the condition is the start of the progress deadline
+		if current != nil && current.Status == corev1.ConditionTrue {
+			condition.LastTransitionTime = current.LastTransitionTime
+		}
+		removeCondition(status, appsv1.DeploymentProgressing)
+		setCondition(status, condition)
+	case isTimedOut(status, deadline, now):
+		setCondition(status, newCondition(appsv1.DeploymentProgressing, corev1.ConditionFalse,
+			reasonTimedOut, fmt.Sprintf("%s has timed out progressing.", subject)))
+		return 0
+	}
+
+	current = getCondition(*status, appsv1.DeploymentProgressing)
+	if current == nil || current.Reason == reasonTimedOut {
+		return 0
+	}
+	// the deployment is checked again once its progress deadline elapsed
+	if next := current.LastUpdateTime.Add(deadline).Sub(now); next > time.Second {
+		return next
+	}
+	return time.Second
+}
+
+// progressDeadline returns the progress deadline of a deployment, or zero if it has none
+func progressDeadline(d *appsv1.Deployment) time.Duration {
+	seconds := int32(defaultProgressDeadlineSeconds)
+	if d.Spec.ProgressDeadlineSeconds != nil {
+		seconds = *d.Spec.ProgressDeadlineSeconds
+	}
+	if seconds == math.MaxInt32 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// isStatusComplete checks if all the pods of a deployment are updated and available
+func isStatusComplete(d *appsv1.Deployment, status *appsv1.DeploymentStatus) bool {
+	replicas := getReplicas(d)
+	return status.UpdatedReplicas == replicas && status.Replicas == replicas &&
+		status.AvailableReplicas == replicas && status.ObservedGeneration >= d.Generation
+}
+
+// isProgressing checks if the pods of a deployment progressed since its last status:
+// more pods are updated, ready or available, or less old pods are left
+func isProgressing(d *appsv1.Deployment, status *appsv1.DeploymentStatus) bool {
+	old := d.Status
+	return status.UpdatedReplicas > old.UpdatedReplicas ||
+		status.Replicas-status.UpdatedReplicas < old.Replicas-old.UpdatedReplicas ||
+		status.ReadyReplicas > old.ReadyReplicas ||
+		status.AvailableReplicas > old.AvailableReplicas
+}
+
+// isTimedOut checks if a deployment made no progress within its progress deadline
+func isTimedOut(status *appsv1.DeploymentStatus, deadline time.Duration, now time.Time) bool {
+	current := getCondition(*status, appsv1.DeploymentProgressing)
+	if current == nil {
+		return false
+	}
+	switch current.Reason {
+	case reasonNewRSAvailable:
+		return false
+	case reasonTimedOut:
+		return true
+	}
+	return current.LastUpdateTime.Add(deadline).Before(now)
+}
+
+// maxUnavailable returns the maximum unavailable pods of a deployment, which is zero
+// unless it is rolled out with a rolling update
+func maxUnavailable(d *appsv1.Deployment) int32 {
+	replicas := getReplicas(d)
+	if d.Spec.Strategy.Type == appsv1.RecreateDeploymentStrategyType || replicas == 0 {
+		return 0
+	}
+	_, unavailable, err := resolveFenceposts(d)
+	if err != nil {
+		return 0
+	}
+	if unavailable > replicas {
+		return replicas
+	}
+	return unavailable
+}
+
+func newCondition(conditionType appsv1.DeploymentConditionType, status corev1.ConditionStatus, reason, message string) appsv1.DeploymentCondition {
+	now := metav1.Now()
+	return appsv1.DeploymentCondition{
+		Type:               conditionType,
+		Status:             status,
+		LastUpdateTime:     now,
+		LastTransitionTime: now,
+		Reason:             reason,
+		Message:            message,
+	}
+}
+
+func getCondition(status appsv1.DeploymentStatus, conditionType appsv1.DeploymentConditionType) *appsv1.DeploymentCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// setCondition sets a condition of a deployment, unless it has the same status and
+// reason, keeping its transition time when its status did not change
+func setCondition(status *appsv1.DeploymentStatus, condition appsv1.DeploymentCondition) {
+	current := getCondition(*status, condition.Type)
+	if current != nil && current.Status == condition.Status && current.Reason == condition.Reason {
+		return
+	}
+	if current != nil && current.Status == condition.Status {
+		condition.LastTransitionTime = current.LastTransitionTime
+	}
+	removeCondition(status, condition.Type)
+	status.Conditions = append(status.Conditions, condition)
+}
+
+func removeCondition(status *appsv1.DeploymentStatus, conditionType appsv1.DeploymentConditionType) {
+	if getCondition(*status, conditionType) == nil {
+		return
+	}
+	conditions := []appsv1.DeploymentCondition{}
+	for _, c := range status.Conditions {
+		if c.Type != conditionType {
+			conditions = append(conditions, c)
+		}
+	}
+	status.Conditions = conditions
+}
@@ -0,0 +1,388 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployment
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/klog/v2"
+	hashutil "k8s.io/kubernetes/pkg/util/hash"
+
+	"github.com/pdettori/cymba/pkg/controllers"
+	"github.com/pdettori/cymba/pkg/controllers/replicaset"
+)
+
+// controllerKind is the kind of the controller of the replica sets
+var controllerKind = appsv1.SchemeGroupVersion.WithKind("Deployment")
+
+const (
+	// revisionAnnotation is the revision of a deployment and of its replica sets, read by
+	// kubectl rollout history and undo
+	revisionAnnotation = "deployment.kubernetes.io/revision"
+	// lastAppliedAnnotation is the last configuration applied by kubectl, which is not
+	// copied to the replica sets
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+// getReplicaSets returns the replica sets controlled by a deployment, oldest first,
+// adopting the orphan replica sets matching its selector and releasing the replica sets
+// which do not match it anymore
+func (c *Controller) getReplicaSets(ctx context.Context, d *appsv1.Deployment) ([]*appsv1.ReplicaSet, error) {
+	selector, err := metav1.LabelSelectorAsSelector(d.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []metav1.Object{}
+	for _, labelSelector := range []string{selector.String(), labels.Set{controllers.OwnedByLabel: d.Name}.String()} {
+		list, err := c.client.ReplicaSets(d.Namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			candidates = append(candidates, &list.Items[i])
+		}
+	}
+	claimed, err := controllers.ClaimObjects(d, controllerKind, selector, candidates, func(obj metav1.Object) error {
+		rs := obj.(*appsv1.ReplicaSet)
+		updated, err := c.client.ReplicaSets(rs.Namespace).Update(ctx, rs, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		*rs = *updated
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rsList := []*appsv1.ReplicaSet{}
+	for _, obj := range claimed {
+		rsList = append(rsList, obj.(*appsv1.ReplicaSet))
+	}
+	sort.SliceStable(rsList, func(i, j int) bool {
+		return rsList[i].CreationTimestamp.Before(&rsList[j].CreationTimestamp)
+	})
+	return rsList, nil
+}
+
+// findNewReplicaSet returns the replica set of a deployment with its current template,
+// if any, and its other replica sets
+func findNewReplicaSet(d *appsv1.Deployment, rsList []*appsv1.ReplicaSet) (*appsv1.ReplicaSet, []*appsv1.ReplicaSet) {
+	var newRS *appsv1.ReplicaSet
+	oldRSs := []*appsv1.ReplicaSet{}
+	for _, rs := range rsList {
+		if newRS == nil && equalIgnoreHash(&rs.Spec.Template, &d.Spec.Template) {
+			newRS = rs
+			continue
+		}
+		oldRSs = append(oldRSs, rs)
+	}
+	return newRS, oldRSs
+}
+
+// getNewReplicaSet returns the replica set of a deployment with its current template,
+// creating it if needed and create is set. The new replica set gets the revision
+// following the revisions of the old ones, so a replica set whose template is restored
+// by a rollback becomes the latest revision again.
+func (c *Controller) getNewReplicaSet(ctx context.Context, d *appsv1.Deployment, newRS *appsv1.ReplicaSet,
+	oldRSs []*appsv1.ReplicaSet, create bool) (*appsv1.ReplicaSet, error) {
+	revision := maxRevision(oldRSs) + 1
+	if newRS != nil {
+		updated := newRS.DeepCopy()
+		setReplicaSetAnnotations(d, updated, revision)
+		if !equality.Semantic.DeepEqual(newRS.Annotations, updated.Annotations) {
+			rs, err := c.client.ReplicaSets(d.Namespace).Update(ctx, updated, metav1.UpdateOptions{})
+			if err != nil {
+				return nil, err
+			}
+			newRS = rs
+		}
+		return newRS, c.setDeploymentRevision(ctx, d, newRS)
+	}
+	if !create {
+		return nil, nil
+	}
+
+	hash := computeHash(&d.Spec.Template, d.Status.CollisionCount)
+	template := d.Spec.Template.DeepCopy()
+	template.Labels = controllers.WithLabel(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey, hash)
+	selector := d.Spec.Selector.DeepCopy()
+	selector.MatchLabels = controllers.WithLabel(selector.MatchLabels, appsv1.DefaultDeploymentUniqueLabelKey, hash)
+	replicas, err := newReplicaSetReplicas(d, oldRSs)
+	if err != nil {
+		return nil, err
+	}
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            d.Name + "-" + hash,
+			Namespace:       d.Namespace,
+			Labels:          controllers.WithLabel(template.Labels, controllers.OwnedByLabel, d.Name),
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(d, controllerKind)},
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Replicas:        &replicas,
+			MinReadySeconds: d.Spec.MinReadySeconds,
+			Selector:        selector,
+			Template:        *template,
+		},
+	}
+	setReplicaSetAnnotations(d, rs, revision)
+
+	created, err := c.client.ReplicaSets(d.Namespace).Create(ctx, rs, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		existing, getErr := c.client.ReplicaSets(d.Namespace).Get(ctx, rs.Name, metav1.GetOptions{})
+		if getErr != nil {
+			return nil, getErr
+		}
+		if metav1.IsControlledBy(existing, d) && equalIgnoreHash(&existing.Spec.Template, &d.Spec.Template) {
+			return existing, nil
+		}
+		// another replica set has the name of the new one, the hash changes with the
+		// collision count on the next sync
+		d = d.DeepCopy()
+		collisionCount := int32(1)
+		if d.Status.CollisionCount != nil {
+			collisionCount = *d.Status.CollisionCount + 1
+		}
+		d.Status.CollisionCount = &collisionCount
+		if _, err := c.client.Deployments(d.Namespace).UpdateStatus(ctx, d, metav1.UpdateOptions{}); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("hash collision for replica set %q of deployment %q", rs.Name, d.Name)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("Failed to create new replica set %q: %v", rs.Name, err)
+		c.recorder.Event(d, corev1.EventTypeWarning, eventFailedCreate, msg)
+		d = d.DeepCopy()
+		setCondition(&d.Status, newCondition(appsv1.DeploymentProgressing, corev1.ConditionFalse, reasonFailedRSCreate, msg))
+		if _, updateErr := c.client.Deployments(d.Namespace).UpdateStatus(ctx, d, metav1.UpdateOptions{}); updateErr != nil {
+			klog.Errorf("unable to update the status of deployment %q: %v", d.Name, updateErr)
+		}
+		return nil, err
+	}
+	if replicas > 0 {
+		c.recorder.Eventf(d, corev1.EventTypeNormal, eventScalingReplicaSet, "Scaled up replica set %s to %d", created.Name, replicas)
+	}
+	// the progress deadline of the rollout starts with the new replica set
+	if progressDeadline(d) > 0 {
+		updated := d.DeepCopy()
+		setCondition(&updated.Status, newCondition(appsv1.DeploymentProgressing, corev1.ConditionTrue,
+			reasonNewRSCreated, fmt.Sprintf("Created new replica set %q", created.Name)))
+		u, err := c.client.Deployments(d.Namespace).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+		if err != nil {
+			return nil, err
+		}
+		d.ObjectMeta, d.Status = u.ObjectMeta, u.Status
+	}
+	return created, c.setDeploymentRevision(ctx, d, created)
+}
+
+// setDeploymentRevision sets the revision of the new replica set on its deployment
+func (c *Controller) setDeploymentRevision(ctx context.Context, d *appsv1.Deployment, newRS *appsv1.ReplicaSet) error {
+	revision := newRS.Annotations[revisionAnnotation]
+	if d.Annotations[revisionAnnotation] == revision {
+		return nil
+	}
+	updated := d.DeepCopy()
+	updated.Annotations = controllers.WithAnnotation(updated.Annotations, revisionAnnotation, revision)
+	u, err := c.client.Deployments(d.Namespace).Update(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	// later updates of the status are done on the updated deployment
+	d.ObjectMeta = u.ObjectMeta
+	return nil
+}
+
+// newReplicaSetReplicas returns the replicas of a new replica set of a deployment,
+// which surges over the desired replicas in a rolling update
+func newReplicaSetReplicas(d *appsv1.Deployment, oldRSs []*appsv1.ReplicaSet) (int32, error) {
+	replicas := getReplicas(d)
+	if d.Spec.Strategy.Type == appsv1.RecreateDeploymentStrategyType {
+		return replicas, nil
+	}
+	maxSurge, _, err := resolveFenceposts(d)
+	if err != nil {
+		return 0, err
+	}
+	scaleUp := replicas + maxSurge - getReplicaCount(oldRSs)
+	if scaleUp <= 0 {
+		return 0, nil
+	}
+	if scaleUp > replicas {
+		return replicas, nil
+	}
+	return scaleUp, nil
+}
+
+// scaleReplicaSet sets the replicas of a replica set of a deployment, and returns
+// whether it was scaled
+func (c *Controller) scaleReplicaSet(ctx context.Context, d *appsv1.Deployment, rs *appsv1.ReplicaSet, replicas int32) (bool, error) {
+	current := replicaset.GetReplicas(rs)
+	if current == replicas {
+		return false, nil
+	}
+	updated := rs.DeepCopy()
+	updated.Spec.Replicas = &replicas
+	u, err := c.client.ReplicaSets(rs.Namespace).Update(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		return false, err
+	}
+	*rs = *u
+	direction := "up"
+	if replicas < current {
+		direction = "down"
+	}
+	c.recorder.Eventf(d, corev1.EventTypeNormal, eventScalingReplicaSet, "Scaled %s replica set %s to %d", direction, rs.Name, replicas)
+	return true, nil
+}
+
+// findActiveOrLatest returns the only replica set of a deployment with replicas, or
+// the latest one if none has replicas. It returns nil if several have replicas.
+func findActiveOrLatest(newRS *appsv1.ReplicaSet, oldRSs []*appsv1.ReplicaSet) *appsv1.ReplicaSet {
+	all := oldRSs
+	if newRS != nil {
+		all = append(all[:len(all):len(all)], newRS)
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	active := []*appsv1.ReplicaSet{}
+	for _, rs := range all {
+		if replicaset.GetReplicas(rs) > 0 {
+			active = append(active, rs)
+		}
+	}
+	switch len(active) {
+	case 0:
+		if newRS != nil {
+			return newRS
+		}
+		return all[len(all)-1]
+	case 1:
+		return active[0]
+	default:
+		return nil
+	}
+}
+
+// getReplicaCount returns the desired replicas of replica sets
+func getReplicaCount(rsList []*appsv1.ReplicaSet) int32 {
+	var count int32
+	for _, rs := range rsList {
+		if rs != nil {
+			count += replicaset.GetReplicas(rs)
+		}
+	}
+	return count
+}
+
+// getStatusReplicaCount returns the current replicas of replica sets
+func getStatusReplicaCount(rsList []*appsv1.ReplicaSet) int32 {
+	var count int32
+	for _, rs := range rsList {
+		if rs != nil {
+			count += rs.Status.Replicas
+		}
+	}
+	return count
+}
+
+// getAvailableReplicaCount returns the available replicas of replica sets
+func getAvailableReplicaCount(rsList []*appsv1.ReplicaSet) int32 {
+	var count int32
+	for _, rs := range rsList {
+		if rs != nil {
+			count += rs.Status.AvailableReplicas
+		}
+	}
+	return count
+}
+
+// computeHash returns the hash of a pod template, which names the replica set with the
+// template and labels its pods. The collision count changes the hash when another
+// replica set has the same name.
+func computeHash(template *corev1.PodTemplateSpec, collisionCount *int32) string {
+	hasher := fnv.New32a()
+	hashutil.DeepHashObject(hasher, *template)
+	if collisionCount != nil {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint32(b, uint32(*collisionCount))
+		hasher.Write(b)
+	}
+	return rand.SafeEncodeString(fmt.Sprint(hasher.Sum32()))
+}
+
+// equalIgnoreHash compares pod templates, ignoring the pod template hash label
+func equalIgnoreHash(t1, t2 *corev1.PodTemplateSpec) bool {
+	t1, t2 = t1.DeepCopy(), t2.DeepCopy()
+	delete(t1.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+	delete(t2.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+	if len(t1.Labels) == 0 {
+		t1.Labels = nil
+	}
+	if len(t2.Labels) == 0 {
+		t2.Labels = nil
+	}
+	return equality.Semantic.DeepEqual(t1, t2)
+}
+
+// setReplicaSetAnnotations copies the annotations of a deployment to its new replica
+// set, such as the change cause shown by kubectl rollout history, and sets the
+// revision of the replica set if it is older than the given one
+func setReplicaSetAnnotations(d *appsv1.Deployment, rs *appsv1.ReplicaSet, revision int64) {
+	for k, v := range d.Annotations {
+		if k == revisionAnnotation || k == lastAppliedAnnotation {
+			continue
+		}
+		rs.Annotations = controllers.WithAnnotation(rs.Annotations, k, v)
+	}
+	if getRevision(rs) < revision {
+		rs.Annotations = controllers.WithAnnotation(rs.Annotations, revisionAnnotation, strconv.FormatInt(revision, 10))
+	}
+}
+
+// getRevision returns the revision of a replica set, or zero if it has none
+func getRevision(rs *appsv1.ReplicaSet) int64 {
+	revision, err := strconv.ParseInt(rs.Annotations[revisionAnnotation], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return revision
+}
+
+// maxRevision returns the latest revision of replica sets
+func maxRevision(rsList []*appsv1.ReplicaSet) int64 {
+	var max int64
+	for _, rs := range rsList {
+		if revision := getRevision(rs); revision > max {
+			max = revision
+		}
+	}
+	return max
+}
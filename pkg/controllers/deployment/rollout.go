@@ -0,0 +1,229 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package deployment
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/pdettori/cymba/pkg/controllers/replicaset"
+)
+
+// rolloutRolling rolls out the template of a deployment by scaling up its new replica
+// set and scaling down the old ones, keeping the pods within the maximum surge and the
+// maximum unavailable pods of the rolling update
+func (c *Controller) rolloutRolling(ctx context.Context, d *appsv1.Deployment, newRS *appsv1.ReplicaSet, oldRSs []*appsv1.ReplicaSet) error {
+	newRS, err := c.getNewReplicaSet(ctx, d, newRS, oldRSs, true)
+	if err != nil {
+		return err
+	}
+	allRSs := append(oldRSs[:len(oldRSs):len(oldRSs)], newRS)
+
+	// the replica sets are scaled one step at a time, the next step is taken when their
+	// status changes
+	scaledUp, err := c.reconcileNewReplicaSet(ctx, d, allRSs, newRS)
+	if err != nil {
+		return err
+	}
+	if scaledUp {
+		return c.syncDeploymentStatus(ctx, d, newRS, oldRSs)
+	}
+	scaledDown, err := c.reconcileOldReplicaSets(ctx, d, allRSs, oldRSs, newRS)
+	if err != nil {
+		return err
+	}
+	if scaledDown {
+		return c.syncDeploymentStatus(ctx, d, newRS, oldRSs)
+	}
+
+	if isComplete(d, newRS, oldRSs) {
+		if err := c.cleanupDeployment(ctx, d, oldRSs); err != nil {
+			return err
+		}
+	}
+	return c.syncDeploymentStatus(ctx, d, newRS, oldRSs)
+}
+
+// rolloutRecreate rolls out the template of a deployment by scaling down its old replica
+// sets, then scaling up the new one once all the old pods are gone
+func (c *Controller) rolloutRecreate(ctx context.Context, d *appsv1.Deployment, newRS *appsv1.ReplicaSet, oldRSs []*appsv1.ReplicaSet) error {
+	newRS, err := c.getNewReplicaSet(ctx, d, newRS, oldRSs, false)
+	if err != nil {
+		return err
+	}
+	scaledDown := false
+	for _, rs := range oldRSs {
+		scaled, err := c.scaleReplicaSet(ctx, d, rs, 0)
+		if err != nil {
+			return err
+		}
+		scaledDown = scaledDown || scaled
+	}
+	if scaledDown {
+		return c.syncDeploymentStatus(ctx, d, newRS, oldRSs)
+	}
+	running, err := c.oldPodsRunning(ctx, oldRSs)
+	if err != nil {
+		return err
+	}
+	if running {
+		return c.syncDeploymentStatus(ctx, d, newRS, oldRSs)
+	}
+
+	if newRS == nil {
+		newRS, err = c.getNewReplicaSet(ctx, d, newRS, oldRSs, true)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := c.scaleReplicaSet(ctx, d, newRS, getReplicas(d)); err != nil {
+		return err
+	}
+
+	if isComplete(d, newRS, oldRSs) {
+		if err := c.cleanupDeployment(ctx, d, oldRSs); err != nil {
+			return err
+		}
+	}
+	return c.syncDeploymentStatus(ctx, d, newRS, oldRSs)
+}
+
+// reconcileNewReplicaSet scales the new replica set of a deployment towards its desired
+// replicas, within the maximum surge
+func (c *Controller) reconcileNewReplicaSet(ctx context.Context, d *appsv1.Deployment, allRSs []*appsv1.ReplicaSet, newRS *appsv1.ReplicaSet) (bool, error) {
+	replicas := getReplicas(d)
+	current := replicaset.GetReplicas(newRS)
+	if current == replicas {
+		return false, nil
+	}
+	if current > replicas {
+		return c.scaleReplicaSet(ctx, d, newRS, replicas)
+	}
+	maxSurge, _, err := resolveFenceposts(d)
+	if err != nil {
+		return false, err
+	}
+	scaleUp := replicas + maxSurge - getReplicaCount(allRSs)
+	if scaleUp <= 0 {
+		return false, nil
+	}
+	if scaleUp > replicas-current {
+		scaleUp = replicas - current
+	}
+	return c.scaleReplicaSet(ctx, d, newRS, current+scaleUp)
+}
+
+// reconcileOldReplicaSets scales down the old replica sets of a deployment, keeping at
+// least the desired replicas minus the maximum unavailable pods available. The pods of
+// the old replica sets which are not available are scaled down first.
+func (c *Controller) reconcileOldReplicaSets(ctx context.Context, d *appsv1.Deployment, allRSs, oldRSs []*appsv1.ReplicaSet,
+	newRS *appsv1.ReplicaSet) (bool, error) {
+	if getReplicaCount(oldRSs) == 0 {
+		return false, nil
+	}
+	_, maxUnavailable, err := resolveFenceposts(d)
+	if err != nil {
+		return false, err
+	}
+	minAvailable := getReplicas(d) - maxUnavailable
+	newRSUnavailable := replicaset.GetReplicas(newRS) - newRS.Status.AvailableReplicas
+	maxScaledDown := getReplicaCount(allRSs) - minAvailable - newRSUnavailable
+	if maxScaledDown <= 0 {
+		return false, nil
+	}
+
+	var scaledDown int32
+	for _, rs := range oldRSs {
+		if scaledDown >= maxScaledDown {
+			break
+		}
+		current := replicaset.GetReplicas(rs)
+		unhealthy := current - rs.Status.AvailableReplicas
+		if current == 0 || unhealthy <= 0 {
+			continue
+		}
+		if unhealthy > maxScaledDown-scaledDown {
+			unhealthy = maxScaledDown - scaledDown
+		}
+		if _, err := c.scaleReplicaSet(ctx, d, rs, current-unhealthy); err != nil {
+			return false, err
+		}
+		scaledDown += unhealthy
+	}
+
+	// available pods are scaled down as long as enough pods remain available
+	available := getAvailableReplicaCount(allRSs)
+	if available > minAvailable {
+		toScaleDown := available - minAvailable
+		var total int32
+		for _, rs := range oldRSs {
+			if total >= toScaleDown {
+				break
+			}
+			current := replicaset.GetReplicas(rs)
+			if current == 0 {
+				continue
+			}
+			count := current
+			if count > toScaleDown-total {
+				count = toScaleDown - total
+			}
+			if _, err := c.scaleReplicaSet(ctx, d, rs, current-count); err != nil {
+				return false, err
+			}
+			total += count
+		}
+		scaledDown += total
+	}
+	return scaledDown > 0, nil
+}
+
+// isComplete checks if all the desired replicas of a deployment are updated and
+// available, and no old pods are left
+func isComplete(d *appsv1.Deployment, newRS *appsv1.ReplicaSet, oldRSs []*appsv1.ReplicaSet) bool {
+	replicas := getReplicas(d)
+	return newRS != nil && replicaset.GetReplicas(newRS) == replicas && newRS.Status.Replicas == replicas &&
+		newRS.Status.AvailableReplicas == replicas && getReplicaCount(oldRSs) == 0 && getStatusReplicaCount(oldRSs) == 0
+}
+
+// oldPodsRunning checks if old replica sets still have pods which did not terminate,
+// including the terminating pods which are not counted as their replicas
+func (c *Controller) oldPodsRunning(ctx context.Context, oldRSs []*appsv1.ReplicaSet) (bool, error) {
+	if getStatusReplicaCount(oldRSs) > 0 {
+		return true, nil
+	}
+	for _, rs := range oldRSs {
+		selector, err := metav1.LabelSelectorAsSelector(rs.Spec.Selector)
+		if err != nil {
+			return false, err
+		}
+		pods, err := c.kubeClient.CoreV1().Pods(rs.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return false, err
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if metav1.IsControlledBy(pod, rs) && pod.Status.Phase != corev1.PodFailed && pod.Status.Phase != corev1.PodSucceeded {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+// eventCorrelatorOptions aggregate and rate limit the events, so that controllers do not
+// flood the embedded API server: similar events of an object are aggregated once there
+// are more than 10 of them in 10 minutes, and each object gets a burst of 25 events then
+// one event every 5 minutes, as in the kube-controller-manager and the kubelet.
+var eventCorrelatorOptions = record.CorrelatorOptions{
+	MaxEvents:            10,
+	MaxIntervalInSeconds: 600,
+	BurstSize:            25,
+	QPS:                  1. / 300.,
+}
+
+// NewEventRecorder returns a recorder of the events of a component, which writes them to
+// the API server until stopCh is closed
+func NewEventRecorder(kubeClient kubernetes.Interface, component string, stopCh <-chan struct{}) record.EventRecorder {
+	broadcaster := record.NewBroadcasterWithCorrelatorOptions(eventCorrelatorOptions)
+	broadcaster.StartStructuredLogging(4)
+	broadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	go func() {
+		<-stopCh
+		broadcaster.Shutdown()
+	}()
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: component, Host: HostName()})
+}
+
+// HostName returns the name of the podman host, which is the node of the pods
+func HostName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		klog.Errorf("error getting host name: %v", err)
+		return "localhost"
+	}
+	return host
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// OwnedByLabel labels the objects created or adopted by a controller with the name of the
+// controller. It only indexes the objects which may not match the selector of their
+// controller anymore, objects are selected by the selector and the controller reference.
+const OwnedByLabel = "kcp.dev/owned-by"
+
+// ClaimObjects returns the objects controlled by a controller among the candidate
+// objects, with the semantics of the controller references of the kube-controller-manager:
+// orphans matching the selector of the controller are adopted, and the objects it
+// controls which do not match it anymore are released. Adopted and released objects are
+// written with update, and objects controlled by other controllers are left alone.
+func ClaimObjects(controller metav1.Object, gvk schema.GroupVersionKind, selector labels.Selector,
+	candidates []metav1.Object, update func(metav1.Object) error) ([]metav1.Object, error) {
+	claimed := []metav1.Object{}
+	seen := map[types.UID]bool{}
+	deleting := controller.GetDeletionTimestamp() != nil
+	for _, obj := range candidates {
+		if seen[obj.GetUID()] {
+			continue
+		}
+		seen[obj.GetUID()] = true
+		// an empty selector matches no object, as in the kube-controller-manager
+		matches := !selector.Empty() && selector.Matches(labels.Set(obj.GetLabels()))
+		ref := metav1.GetControllerOf(obj)
+		switch {
+		case ref != nil && ref.UID != controller.GetUID():
+			continue
+		case ref != nil && matches:
+			claimed = append(claimed, obj)
+		case ref != nil:
+			// a controller being deleted does not release its objects, which are deleted
+			if deleting {
+				continue
+			}
+			releaseObject(obj, controller.GetUID())
+			if err := update(obj); err != nil && !apierrors.IsNotFound(err) {
+				return nil, err
+			}
+		case matches && !deleting && obj.GetDeletionTimestamp() == nil:
+			adoptObject(obj, controller, gvk)
+			if err := update(obj); err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+				return nil, err
+			}
+			claimed = append(claimed, obj)
+		}
+	}
+	return claimed, nil
+}
+
+// adoptObject sets a controller as the controller of an orphan object
+func adoptObject(obj, controller metav1.Object, gvk schema.GroupVersionKind) {
+	obj.SetOwnerReferences(append(obj.GetOwnerReferences(), *metav1.NewControllerRef(controller, gvk)))
+	obj.SetLabels(WithLabel(obj.GetLabels(), OwnedByLabel, controller.GetName()))
+}
+
+// releaseObject removes the reference to a controller from an object
+func releaseObject(obj metav1.Object, uid types.UID) {
+	refs := []metav1.OwnerReference{}
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID != uid {
+			refs = append(refs, ref)
+		}
+	}
+	obj.SetOwnerReferences(refs)
+	obj.SetLabels(withoutLabel(obj.GetLabels(), OwnedByLabel))
+}
+
+// WithLabel returns a copy of labels with a key set to a value
+func WithLabel(objLabels map[string]string, key, value string) map[string]string {
+	return withKey(objLabels, key, value)
+}
+
+// WithAnnotation returns a copy of annotations with a key set to a value
+func WithAnnotation(annotations map[string]string, key, value string) map[string]string {
+	return withKey(annotations, key, value)
+}
+
+// withoutLabel returns a copy of labels without a key
+func withoutLabel(objLabels map[string]string, key string) map[string]string {
+	copied := map[string]string{}
+	for k, v := range objLabels {
+		if k != key {
+			copied[k] = v
+		}
+	}
+	return copied
+}
+
+// withKey returns a copy of a map with a key set to a value
+func withKey(m map[string]string, key, value string) map[string]string {
+	copied := map[string]string{}
+	for k, v := range m {
+		copied[k] = v
+	}
+	copied[key] = value
+	return copied
+}
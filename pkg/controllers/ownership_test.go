@@ -0,0 +1,100 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var replicaSetKind = appsv1.SchemeGroupVersion.WithKind("ReplicaSet")
+
+func newTestPod(name string, podLabels map[string]string, controller metav1.Object) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name), Labels: podLabels}}
+	if controller != nil {
+		pod.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(controller, replicaSetKind)}
+		pod.Labels = WithLabel(pod.Labels, OwnedByLabel, controller.GetName())
+	}
+	return pod
+}
+
+func TestClaimObjects(t *testing.T) {
+	rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "0a1b2c3d"}}
+	other := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default", UID: "4e5f6a7b"}}
+	web := map[string]string{"app": "web"}
+	owned := newTestPod("owned", web, rs)
+	orphan := newTestPod("orphan", web, nil)
+	released := newTestPod("released", map[string]string{"app": "debug"}, rs)
+	foreign := newTestPod("foreign", web, other)
+	unrelated := newTestPod("unrelated", map[string]string{"app": "db"}, nil)
+	deleted := newTestPod("deleted", web, nil)
+	now := metav1.Now()
+	deleted.DeletionTimestamp = &now
+
+	updated := []string{}
+	update := func(obj metav1.Object) error {
+		updated = append(updated, obj.GetName())
+		return nil
+	}
+	selector := labels.SelectorFromSet(web)
+	candidates := []metav1.Object{owned, orphan, foreign, unrelated, deleted, owned, released}
+	claimed, err := ClaimObjects(rs, replicaSetKind, selector, candidates, update)
+	assert.NoError(t, err)
+	assert.Equal(t, []metav1.Object{owned, orphan}, claimed)
+	assert.Equal(t, []string{"orphan", "released"}, updated)
+
+	// the orphan is adopted and the pod which does not match anymore is released
+	assert.True(t, metav1.IsControlledBy(orphan, rs))
+	assert.Equal(t, "web", orphan.Labels[OwnedByLabel])
+	assert.Empty(t, released.OwnerReferences)
+	assert.NotContains(t, released.Labels, OwnedByLabel)
+	assert.True(t, metav1.IsControlledBy(foreign, other))
+
+	// a controller being deleted neither adopts nor releases pods
+	rs.DeletionTimestamp = &now
+	updated = []string{}
+	candidates = []metav1.Object{newTestPod("orphan", web, nil), newTestPod("released", map[string]string{"app": "debug"}, rs)}
+	claimed, err = ClaimObjects(rs, replicaSetKind, selector, candidates, update)
+	assert.NoError(t, err)
+	assert.Empty(t, claimed)
+	assert.Empty(t, updated)
+
+	// nothing is adopted with an empty selector
+	rs.DeletionTimestamp = nil
+	claimed, err = ClaimObjects(rs, replicaSetKind, labels.Everything(), []metav1.Object{newTestPod("orphan", web, nil)}, update)
+	assert.NoError(t, err)
+	assert.Empty(t, claimed)
+
+	// pods deleted meanwhile are skipped, other errors are returned
+	claimed, err = ClaimObjects(rs, replicaSetKind, selector, []metav1.Object{newTestPod("orphan", web, nil)}, func(metav1.Object) error {
+		return apierrors.NewNotFound(corev1.Resource("pods"), "orphan")
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, claimed)
+	_, err = ClaimObjects(rs, replicaSetKind, selector, []metav1.Object{newTestPod("orphan", web, nil)}, func(metav1.Object) error {
+		return errors.New("conflict")
+	})
+	assert.EqualError(t, err, "conflict")
+}
@@ -19,7 +19,6 @@ package pod
 import (
 	"context"
 	"fmt"
-	"os"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -33,31 +32,45 @@ import (
 	corev1lister "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 
 	clusterclient "github.com/kcp-dev/kcp/pkg/client/clientset/versioned"
 	"github.com/kcp-dev/kcp/pkg/client/informers/externalversions"
+	"github.com/pdettori/cymba/pkg/controllers"
 	"github.com/pdettori/cymba/pkg/podman"
 )
 
 const resyncPeriod = 30 * time.Second
 const controllerName = "pod"
 
-// NewController returns a new Controller which handles pods
-func NewController(cfg *rest.Config, stopCh <-chan struct{}) *Controller {
+// eventSource is the component of the events recorded on pods
+const eventSource = "cymba"
+
+// NewController returns a new Controller which handles pods, running them with the given podman runtime
+func NewController(cfg *rest.Config, rt podman.PodmanRuntime, stopCh <-chan struct{}) *Controller {
 	client := corev1client.NewForConfigOrDie(cfg)
 	kubeClient := kubernetes.NewForConfigOrDie(cfg)
 	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
 
 	csif := externalversions.NewSharedInformerFactoryWithOptions(clusterclient.NewForConfigOrDie(cfg), resyncPeriod)
 
+	recorder := controllers.NewEventRecorder(kubeClient, eventSource, stopCh)
+
+	// the events of the containers are recorded while podman runs them
 	c := &Controller{
 		queue:      queue,
 		client:     client,
 		kubeClient: kubeClient,
 		stopCh:     stopCh,
+		runtime:    rt,
+		pods:       podman.NewPodManager(rt, recorder),
+		recorder:   recorder,
+		nodeName:   controllers.HostName(),
 	}
+	// probe results changing the pod status are reported without waiting for the resync
+	c.probes = podman.NewProbeManager(c.pods, func(p *corev1.Pod) { c.enqueue(p) })
 	csif.WaitForCacheSync(stopCh)
 	csif.Start(stopCh)
 
@@ -66,19 +79,14 @@ func NewController(cfg *rest.Config, stopCh <-chan struct{}) *Controller {
 		AddFunc:    func(obj interface{}) { c.enqueue(obj) },
 		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
 	})
+	// keep the files of ConfigMap and Secret volumes in sync with their sources
+	sif.Core().V1().ConfigMaps().Informer().AddEventHandler(c.enqueueReferencingPods(referencesConfigMap))
+	sif.Core().V1().Secrets().Informer().AddEventHandler(c.enqueueReferencingPods(referencesSecret))
+	c.lister = sif.Core().V1().Pods().Lister()
 	sif.WaitForCacheSync(stopCh)
 	sif.Start(stopCh)
 
 	c.indexer = sif.Core().V1().Pods().Informer().GetIndexer()
-	c.lister = sif.Core().V1().Pods().Lister()
-
-	connection, err := podman.GetConnection()
-	if err != nil {
-		klog.Errorf("%s", err)
-		klog.Error("Please check your podman socket service is started with `systemctl --user status podman.socket`")
-		os.Exit(1)
-	}
-	c.pConn = connection
 
 	return c
 }
@@ -86,12 +94,16 @@ func NewController(cfg *rest.Config, stopCh <-chan struct{}) *Controller {
 // Controller defines the struct for Controller
 type Controller struct {
 	queue      workqueue.RateLimitingInterface
-	client     *corev1client.CoreV1Client
+	client     corev1client.CoreV1Interface
 	kubeClient kubernetes.Interface
 	stopCh     <-chan struct{}
 	indexer    cache.Indexer
 	lister     corev1lister.PodLister
-	pConn      context.Context
+	runtime    podman.PodmanRuntime
+	pods       *podman.PodManager
+	probes     *podman.ProbeManager
+	recorder   record.EventRecorder
+	nodeName   string
 }
 
 func (c *Controller) enqueue(obj interface{}) {
@@ -103,6 +115,15 @@ func (c *Controller) enqueue(obj interface{}) {
 	c.queue.Add(key)
 }
 
+func (c *Controller) enqueueAfter(obj interface{}, duration time.Duration) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.queue.AddAfter(key, duration)
+}
+
 // Start starts the controller
 func (c *Controller) Start(numThreads int) {
 	defer c.queue.ShutDown()
@@ -0,0 +1,210 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pod
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+
+	"github.com/pdettori/cymba/pkg/podman"
+)
+
+// envResolver resolves ConfigMap and Secret references in the environment of a pod
+// containers, caching the objects read from the API server
+type envResolver struct {
+	ctx        context.Context
+	c          *Controller
+	namespace  string
+	configMaps map[string]*corev1.ConfigMap
+	secrets    map[string]*corev1.Secret
+	// errors are the errors getting the objects, by kind and name
+	errors map[string]error
+}
+
+// resolvePodEnv returns a copy of the pod where envFrom sources are expanded into env
+// entries and configMapKeyRef and secretKeyRef references are replaced by their values,
+// with the names of these entries, whose values are not expanded. Downward API
+// references are left to be resolved when the containers are created.
+func (c *Controller) resolvePodEnv(ctx context.Context, pod *corev1.Pod) (*corev1.Pod, podman.ResolvedEnv, error) {
+	r := &envResolver{
+		ctx:        ctx,
+		c:          c,
+		namespace:  pod.Namespace,
+		configMaps: map[string]*corev1.ConfigMap{},
+		secrets:    map[string]*corev1.Secret{},
+		errors:     map[string]error{},
+	}
+	resolved := pod.DeepCopy()
+	resolvedEnv := podman.ResolvedEnv{}
+	for _, containers := range [][]corev1.Container{resolved.Spec.InitContainers, resolved.Spec.Containers} {
+		for i := range containers {
+			env, names, err := r.resolveContainerEnv(&containers[i])
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to resolve environment of container %s: %w", containers[i].Name, err)
+			}
+			containers[i].Env = env
+			containers[i].EnvFrom = nil
+			resolvedEnv[containers[i].Name] = names
+		}
+	}
+	return resolved, resolvedEnv, nil
+}
+
+// resolveContainerEnv returns the container env, with envFrom sources first so that
+// env entries take precedence over them, and the names of the entries resolved from
+// ConfigMaps and Secrets. A name is resolved if its last entry is.
+func (r *envResolver) resolveContainerEnv(container *corev1.Container) ([]corev1.EnvVar, map[string]bool, error) {
+	env := []corev1.EnvVar{}
+	resolved := map[string]bool{}
+	for _, from := range container.EnvFrom {
+		var data map[string]string
+		switch {
+		case from.ConfigMapRef != nil:
+			cm, err := r.getConfigMap(from.ConfigMapRef.Name, from.ConfigMapRef.Optional)
+			if err != nil {
+				return nil, nil, err
+			}
+			if cm != nil {
+				data = cm.Data
+			}
+		case from.SecretRef != nil:
+			secret, err := r.getSecret(from.SecretRef.Name, from.SecretRef.Optional)
+			if err != nil {
+				return nil, nil, err
+			}
+			if secret != nil {
+				data = map[string]string{}
+				for k, v := range secret.Data {
+					data[k] = string(v)
+				}
+			}
+		}
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			name := from.Prefix + k
+			if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+				klog.Infof("skipping invalid env var name %q in container %s: %v", name, container.Name, errs)
+				continue
+			}
+			env = append(env, corev1.EnvVar{Name: name, Value: data[k]})
+			resolved[name] = true
+		}
+	}
+
+	for _, e := range container.Env {
+		if e.ValueFrom == nil {
+			env = append(env, e)
+			delete(resolved, e.Name)
+			continue
+		}
+		switch {
+		case e.ValueFrom.ConfigMapKeyRef != nil:
+			ref := e.ValueFrom.ConfigMapKeyRef
+			cm, err := r.getConfigMap(ref.Name, ref.Optional)
+			if err != nil {
+				return nil, nil, err
+			}
+			value, ok := "", false
+			if cm != nil {
+				value, ok = cm.Data[ref.Key]
+			}
+			if !ok {
+				if isOptional(ref.Optional) {
+					continue
+				}
+				return nil, nil, fmt.Errorf("couldn't find key %s in ConfigMap %s/%s", ref.Key, r.namespace, ref.Name)
+			}
+			env = append(env, corev1.EnvVar{Name: e.Name, Value: value})
+			resolved[e.Name] = true
+		case e.ValueFrom.SecretKeyRef != nil:
+			ref := e.ValueFrom.SecretKeyRef
+			secret, err := r.getSecret(ref.Name, ref.Optional)
+			if err != nil {
+				return nil, nil, err
+			}
+			var value []byte
+			ok := false
+			if secret != nil {
+				value, ok = secret.Data[ref.Key]
+			}
+			if !ok {
+				if isOptional(ref.Optional) {
+					continue
+				}
+				return nil, nil, fmt.Errorf("couldn't find key %s in Secret %s/%s", ref.Key, r.namespace, ref.Name)
+			}
+			env = append(env, corev1.EnvVar{Name: e.Name, Value: string(value)})
+			resolved[e.Name] = true
+		default:
+			env = append(env, e)
+			delete(resolved, e.Name)
+		}
+	}
+	return env, resolved, nil
+}
+
+// getConfigMap gets a ConfigMap, returning nil if it is optional and not found. The
+// error is cached with the ConfigMap, so that a missing ConfigMap is not found by the
+// required references following an optional one.
+func (r *envResolver) getConfigMap(name string, optional *bool) (*corev1.ConfigMap, error) {
+	cm, ok := r.configMaps[name]
+	err := r.errors["configmap/"+name]
+	if !ok {
+		cm, err = r.c.client.ConfigMaps(r.namespace).Get(r.ctx, name, v1.GetOptions{})
+		r.configMaps[name], r.errors["configmap/"+name] = cm, err
+	}
+	if err != nil {
+		if apierrors.IsNotFound(err) && isOptional(optional) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return cm, nil
+}
+
+// getSecret gets a Secret, returning nil if it is optional and not found. The error is
+// cached with the Secret, as for ConfigMaps.
+func (r *envResolver) getSecret(name string, optional *bool) (*corev1.Secret, error) {
+	secret, ok := r.secrets[name]
+	err := r.errors["secret/"+name]
+	if !ok {
+		secret, err = r.c.client.Secrets(r.namespace).Get(r.ctx, name, v1.GetOptions{})
+		r.secrets[name], r.errors["secret/"+name] = secret, err
+	}
+	if err != nil {
+		if apierrors.IsNotFound(err) && isOptional(optional) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return secret, nil
+}
+
+func isOptional(optional *bool) bool {
+	return optional != nil && *optional
+}
@@ -18,6 +18,7 @@ package pod
 
 import (
 	"context"
+	"time"
 
 	"github.com/pdettori/cymba/pkg/controllers"
 	"github.com/pdettori/cymba/pkg/podman"
@@ -29,6 +30,10 @@ import (
 
 const (
 	podFinalizer = "controller.podman.kcp.dev/finalizer"
+
+	// initContainersPollPeriod is the period at which pods are checked while their init
+	// containers run, to start the next ones without waiting for the resync
+	initContainersPollPeriod = 2 * time.Second
 )
 
 func (c *Controller) reconcile(ctx context.Context, pod *corev1.Pod) error {
@@ -50,7 +55,8 @@ func (c *Controller) reconcile(ctx context.Context, pod *corev1.Pod) error {
 		// The object is being deleted
 		if controllers.ContainsString(pod.GetFinalizers(), podFinalizer) {
 			// our finalizer is present, so lets handle any external dependency
-			_, err := podman.RemovePod(c.pConn, pod)
+			c.probes.RemovePod(pod)
+			_, err := c.pods.RemovePod(pod)
 			if err != nil {
 				// if fail to delete the external dependency here, return with error
 				// so that it can be retried
@@ -69,26 +75,161 @@ func (c *Controller) reconcile(ctx context.Context, pod *corev1.Pod) error {
 		return nil
 	}
 
+	// evicted and rejected pods are not restarted, and keep their status
+	if pod.Status.Phase == corev1.PodFailed &&
+		(pod.Status.Reason == podman.EvictedReason || pod.Status.Reason == podman.UnsupportedSecurityContextReason) {
+		c.probes.RemovePod(pod)
+		return nil
+	}
+
+	// restart the exited containers according to the restart policy, and check again
+	// once the restart back-off of the containers waiting for it expires
+	next, err := c.pods.RestartContainers(pod)
+	if err != nil {
+		return err
+	}
+	if next > 0 {
+		c.enqueueAfter(pod, next)
+	}
+
 	// check current status (does pod exist ?)
-	if err := podman.GetPodStatus(c.pConn, pod); err != nil {
+	if err := c.pods.GetPodStatus(pod); err != nil {
 		klog.Info("Error getting pod", "error", err)
 		if podman.IsPodNotFound(err) {
-			// create pod
-			_, err = podman.CreatePod(c.pConn, pod)
+			// reject the pod if its security context cannot be honored on the host
+			message, err := podman.CheckSecurityContext(c.runtime, pod)
 			if err != nil {
 				return err
 			}
+			if message != "" {
+				klog.Infof("rejecting pod %q: %s", pod.Name, message)
+				podman.RejectPod(pod, message)
+				_, err = c.client.Pods(pod.Namespace).UpdateStatus(ctx, pod, v1.UpdateOptions{})
+				return err
+			}
+
+			// create pod, with the containers environment, the claims and the pull secrets
+			// resolved from the API server
+			if err := c.projectVolumes(ctx, pod); err != nil {
+				return err
+			}
+			resolved, env, err := c.resolvePodEnv(ctx, pod)
+			if err != nil {
+				return err
+			}
+			if err := c.resolvePodVolumes(ctx, resolved); err != nil {
+				return err
+			}
+			keyring, err := c.getPullKeyring(ctx, pod)
+			if err != nil {
+				return err
+			}
+			c.recorder.Eventf(pod, corev1.EventTypeNormal, podman.EventScheduled,
+				"Successfully assigned %s/%s to %s", pod.Namespace, pod.Name, c.nodeName)
+			_, err = c.pods.CreatePod(resolved, env, keyring)
+			if err != nil {
+				return err
+			}
+			if len(pod.Spec.InitContainers) > 0 {
+				c.enqueueAfter(pod, initContainersPollPeriod)
+			}
 			return nil
 		}
 		// requeue if any other error
 		return err
 	}
 
+	// retry creating the containers that could not be created, such as containers
+	// whose image pull failed
+	if hasUncreatedContainers(pod) {
+		resolved, env, err := c.resolvePodEnv(ctx, pod)
+		if err != nil {
+			return err
+		}
+		if err := c.resolvePodVolumes(ctx, resolved); err != nil {
+			return err
+		}
+		keyring, err := c.getPullKeyring(ctx, pod)
+		if err != nil {
+			return err
+		}
+		if err := c.pods.CreateContainers(resolved, env, keyring); err != nil {
+			return err
+		}
+		if err := c.pods.GetPodStatus(pod); err != nil {
+			return err
+		}
+	}
+
+	if isInitializing(pod) {
+		c.enqueueAfter(pod, initContainersPollPeriod)
+	}
+
+	// evict the pod if its containers exceed their ephemeral storage limits
+	message, err := podman.CheckEphemeralStorage(c.runtime, pod)
+	if err != nil {
+		return err
+	}
+	if message != "" {
+		klog.Infof("evicting pod %q: %s", pod.Name, message)
+		if err := podman.EvictPod(c.runtime, pod, message); err != nil {
+			return err
+		}
+	}
+
+	// run the probes of the containers while the pod is running
+	c.probes.UpdatePod(pod)
+
+	// refresh the files of ConfigMap and Secret volumes
+	if err := c.projectVolumes(ctx, pod); err != nil {
+		return err
+	}
+
+	// record the loopback addresses of the ports published on rootless hosts
+	ports, err := podman.GetPublishedPorts(c.runtime, pod)
+	if err != nil {
+		return err
+	}
+	if pod.Annotations[podman.PublishedPortsAnnotation] != ports {
+		pod.Annotations = controllers.WithAnnotation(pod.Annotations, podman.PublishedPortsAnnotation, ports)
+		if ports == "" {
+			delete(pod.Annotations, podman.PublishedPortsAnnotation)
+		}
+		updated, err := c.client.Pods(pod.Namespace).Update(ctx, pod, v1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		pod.ObjectMeta = updated.ObjectMeta
+	}
+
 	// using the controller runtime client with pod to update the status generated an error
-	_, err := c.client.Pods(pod.Namespace).UpdateStatus(ctx, pod, v1.UpdateOptions{})
+	_, err = c.client.Pods(pod.Namespace).UpdateStatus(ctx, pod, v1.UpdateOptions{})
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// isInitializing checks if a pending pod is waiting for its init containers to complete
+func isInitializing(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodPending {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodInitialized {
+			return c.Status == corev1.ConditionFalse
+		}
+	}
+	return false
+}
+
+// hasUncreatedContainers checks if the status of a pod reports containers that were not created
+func hasUncreatedContainers(pod *corev1.Pod) bool {
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.ContainerID == "" {
+			return true
+		}
+	}
+	return false
+}
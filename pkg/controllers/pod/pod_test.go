@@ -0,0 +1,309 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pod
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/pdettori/cymba/pkg/podman"
+)
+
+func newTestPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "mypod",
+			Namespace: "default",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    "busybox",
+					Image:   "busybox:1.25",
+					Command: []string{"sleep", "86400"},
+				},
+			},
+		},
+	}
+}
+
+func newTestController(rt podman.PodmanRuntime, objects ...*corev1.Pod) *Controller {
+	kubeClient := fake.NewSimpleClientset()
+	for _, o := range objects {
+		kubeClient.Tracker().Add(o)
+	}
+	pods := podman.NewPodManager(rt, &record.FakeRecorder{})
+	return &Controller{
+		queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		client:     kubeClient.CoreV1(),
+		kubeClient: kubeClient,
+		runtime:    rt,
+		pods:       pods,
+		probes:     podman.NewProbeManager(pods, func(*corev1.Pod) {}),
+		recorder:   record.NewFakeRecorder(100),
+		nodeName:   "podman-host",
+	}
+}
+
+func TestReconcileCreatesAndRemovesPod(t *testing.T) {
+	ctx := context.TODO()
+	rt := podman.NewFakeRuntime()
+	pod := newTestPod()
+	c := newTestController(rt, pod)
+
+	// first pass adds the finalizer and creates the podman pod
+	assert.NoError(t, c.reconcile(ctx, pod))
+	assert.Contains(t, pod.Finalizers, podFinalizer)
+	pr, err := podman.GetPod(rt, pod)
+	assert.NoError(t, err)
+	assert.Equal(t, "Running", pr.State)
+	events := c.recorder.(*record.FakeRecorder).Events
+	assert.Equal(t, "Normal Scheduled Successfully assigned default/mypod to podman-host", <-events)
+
+	// second pass reports the status
+	assert.NoError(t, c.reconcile(ctx, pod))
+	updated, err := c.client.Pods(pod.Namespace).Get(ctx, pod.Name, v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, updated.Status.ContainerStatuses, len(pod.Spec.Containers))
+
+	// deletion removes the podman pod and the finalizer
+	now := v1.Now()
+	pod.DeletionTimestamp = &now
+	assert.NoError(t, c.reconcile(ctx, pod))
+	assert.NotContains(t, pod.Finalizers, podFinalizer)
+	_, err = podman.GetPod(rt, pod)
+	assert.True(t, podman.IsPodNotFound(err))
+}
+
+func TestResolvePodEnv(t *testing.T) {
+	ctx := context.TODO()
+	optional := true
+	pod := newTestPod()
+	pod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{
+		{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "config"}}},
+		{Prefix: "S_", SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "secret"}}},
+	}
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{
+		{Name: "LITERAL", Value: "value"},
+		{Name: "FROM_CM", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "config"}, Key: "b"}}},
+		{Name: "FROM_SECRET", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "secret"}, Key: "password"}}},
+		{Name: "MISSING", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}, Key: "x", Optional: &optional}}},
+		{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+	}
+
+	c := newTestController(podman.NewFakeRuntime(), pod)
+	c.kubeClient.(*fake.Clientset).Tracker().Add(&corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Name: "config", Namespace: pod.Namespace},
+		Data:       map[string]string{"a": "1", "b": "2", "not-valid=": "x"},
+	})
+	c.kubeClient.(*fake.Clientset).Tracker().Add(&corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "secret", Namespace: pod.Namespace},
+		Data:       map[string][]byte{"password": []byte("pa$$word"), "template": []byte("$(LITERAL)")},
+	})
+
+	resolved, resolvedEnv, err := c.resolvePodEnv(ctx, pod)
+	assert.NoError(t, err)
+	assert.Empty(t, resolved.Spec.Containers[0].EnvFrom)
+	env := resolved.Spec.Containers[0].Env
+	names := []string{}
+	for _, e := range env {
+		names = append(names, e.Name)
+	}
+	assert.Equal(t, []string{"a", "b", "S_password", "S_template", "LITERAL", "FROM_CM", "FROM_SECRET", "POD_NAME"}, names)
+	assert.Equal(t, corev1.EnvVar{Name: "S_password", Value: "pa$$word"}, env[2])
+	assert.Equal(t, corev1.EnvVar{Name: "S_template", Value: "$(LITERAL)"}, env[3])
+	assert.Equal(t, corev1.EnvVar{Name: "FROM_CM", Value: "2"}, env[5])
+	assert.Equal(t, corev1.EnvVar{Name: "FROM_SECRET", Value: "pa$$word"}, env[6])
+	// the values resolved from ConfigMaps and Secrets are not to be expanded
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "S_password": true, "S_template": true, "FROM_CM": true, "FROM_SECRET": true},
+		resolvedEnv[pod.Spec.Containers[0].Name])
+	assert.NotNil(t, env[7].ValueFrom.FieldRef)
+	// the original pod is not modified
+	assert.Len(t, pod.Spec.Containers[0].EnvFrom, 2)
+
+	// a required reference to a missing object is an error, even after an optional
+	// reference to the same object
+	pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "busybox", Env: pod.Spec.Containers[0].Env[3:4]}}
+	pod.Spec.Containers[0].EnvFrom = append(pod.Spec.Containers[0].EnvFrom, corev1.EnvFromSource{
+		SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}},
+	})
+	_, _, err = c.resolvePodEnv(ctx, pod)
+	assert.True(t, apierrors.IsNotFound(errors.Unwrap(err)))
+}
+
+func TestProjectVolumes(t *testing.T) {
+	ctx := context.TODO()
+	os.Setenv("CYMBA_VOLUMES_DIR", t.TempDir())
+	defer os.Unsetenv("CYMBA_VOLUMES_DIR")
+
+	mode := int32(0600)
+	optional := true
+	pod := newTestPod()
+	pod.Spec.Volumes = []corev1.Volume{
+		{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "config"},
+			Items:                []corev1.KeyToPath{{Key: "a", Path: "dir/a.conf", Mode: &mode}},
+		}}},
+		{Name: "secret", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "secret"}}},
+		{Name: "missing", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "missing", Optional: &optional}}},
+	}
+	c := newTestController(podman.NewFakeRuntime(), pod)
+	c.kubeClient.(*fake.Clientset).Tracker().Add(&corev1.ConfigMap{
+		ObjectMeta: v1.ObjectMeta{Name: "config", Namespace: pod.Namespace},
+		Data:       map[string]string{"a": "1", "b": "2"},
+	})
+	secret := &corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "secret", Namespace: pod.Namespace},
+		Data:       map[string][]byte{"password": []byte("pa$$word"), "template": []byte("$(LITERAL)")},
+	}
+	c.kubeClient.(*fake.Clientset).Tracker().Add(secret)
+
+	assert.NoError(t, c.projectVolumes(ctx, pod))
+	info, err := os.Stat(filepath.Join(podman.VolumeDir(pod, "config"), "dir", "a.conf"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.NoFileExists(t, filepath.Join(podman.VolumeDir(pod, "config"), "b"))
+	assert.DirExists(t, podman.VolumeDir(pod, "missing"))
+
+	// changes of the source object are projected on the next reconcile
+	secret.Data["password"] = []byte("changed")
+	_, err = c.client.Secrets(pod.Namespace).Update(ctx, secret, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, c.projectVolumes(ctx, pod))
+	data, err := ioutil.ReadFile(filepath.Join(podman.VolumeDir(pod, "secret"), "password"))
+	assert.NoError(t, err)
+	assert.Equal(t, "changed", string(data))
+
+	// a required missing object is an error
+	pod.Spec.Volumes[2].Secret.Optional = nil
+	assert.Error(t, c.projectVolumes(ctx, pod))
+}
+
+func TestReconcileMountsClaim(t *testing.T) {
+	ctx := context.TODO()
+	rt := podman.NewFakeRuntime()
+	pod := newTestPod()
+	pod.Spec.Volumes = []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{
+		PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data", ReadOnly: true}}}}
+	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}
+	c := newTestController(rt, pod)
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{Name: "data", Namespace: pod.Namespace},
+	}
+	c.kubeClient.(*fake.Clientset).Tracker().Add(claim)
+
+	// the pod is not created while the claim is not bound
+	assert.Error(t, c.reconcile(ctx, pod))
+	_, err := podman.GetPod(rt, pod)
+	assert.True(t, podman.IsPodNotFound(err))
+
+	claim.Spec.VolumeName = "pvc-data"
+	claim.Status.Phase = corev1.ClaimBound
+	c.kubeClient.(*fake.Clientset).Tracker().Update(corev1.SchemeGroupVersion.WithResource("persistentvolumeclaims"), claim, pod.Namespace)
+	c.kubeClient.(*fake.Clientset).Tracker().Add(&corev1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{Name: "pvc-data"},
+		Spec: corev1.PersistentVolumeSpec{PersistentVolumeSource: corev1.PersistentVolumeSource{
+			CSI: &corev1.CSIPersistentVolumeSource{Driver: podman.PersistentVolumeDriver, VolumeHandle: "pvc-data"}}},
+	})
+	assert.NoError(t, c.reconcile(ctx, pod))
+	s, err := rt.ContainerSpec("default_mypod_busybox")
+	assert.NoError(t, err)
+	assert.Len(t, s.Volumes, 1)
+	assert.Equal(t, "pvc-data", s.Volumes[0].Name)
+	assert.Equal(t, "/data", s.Volumes[0].Dest)
+	assert.Equal(t, []string{"ro"}, s.Volumes[0].Options)
+	// the pod spec is not modified
+	assert.NotNil(t, pod.Spec.Volumes[0].PersistentVolumeClaim)
+}
+
+func TestReconcilePullsWithServiceAccountSecrets(t *testing.T) {
+	ctx := context.TODO()
+	rt := podman.NewFakeRuntime()
+	rt.PullAuth["docker.io/library/busybox:1.25"] = podman.RegistryAuth{Username: "hub", Password: "secret"}
+	pod := newTestPod()
+	c := newTestController(rt, pod)
+	c.kubeClient.(*fake.Clientset).Tracker().Add(&corev1.ServiceAccount{
+		ObjectMeta:       v1.ObjectMeta{Name: "default", Namespace: pod.Namespace},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: "hub"}, {Name: "missing"}},
+	})
+	c.kubeClient.(*fake.Clientset).Tracker().Add(&corev1.Secret{
+		ObjectMeta: v1.ObjectMeta{Name: "hub", Namespace: pod.Namespace},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(
+			`{"auths": {"https://index.docker.io/v1/": {"username": "hub", "password": "secret"}}}`)},
+	})
+
+	assert.NoError(t, c.reconcile(ctx, pod))
+	assert.NoError(t, c.reconcile(ctx, pod))
+	updated, err := c.client.Pods(pod.Namespace).Get(ctx, pod.Name, v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotNil(t, updated.Status.ContainerStatuses[0].State.Running)
+}
+
+func TestReconcileRejectsUnsupportedSecurityContext(t *testing.T) {
+	ctx := context.TODO()
+	rt := podman.NewFakeRuntime()
+	pod := newTestPod()
+	pod.Spec.SecurityContext = &corev1.PodSecurityContext{Sysctls: []corev1.Sysctl{{Name: "vm.swappiness", Value: "10"}}}
+	c := newTestController(rt, pod)
+
+	assert.NoError(t, c.reconcile(ctx, pod))
+	_, err := podman.GetPod(rt, pod)
+	assert.True(t, podman.IsPodNotFound(err))
+	updated, err := c.client.Pods(pod.Namespace).Get(ctx, pod.Name, v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.PodFailed, updated.Status.Phase)
+	assert.Equal(t, podman.UnsupportedSecurityContextReason, updated.Status.Reason)
+	assert.Equal(t, `sysctl "vm.swappiness" is not namespaced and cannot be set in a pod`, updated.Status.Message)
+
+	// rejected pods are not created on later passes
+	assert.NoError(t, c.reconcile(ctx, updated))
+	_, err = podman.GetPod(rt, pod)
+	assert.True(t, podman.IsPodNotFound(err))
+}
+
+func TestReconcileRecordsPublishedPorts(t *testing.T) {
+	ctx := context.TODO()
+	rt := podman.NewFakeRuntime()
+	rt.HostInfo.Host.Security.Rootless = true
+	pod := newTestPod()
+	pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 80}}
+	c := newTestController(rt, pod)
+
+	// the loopback addresses of the ports published on rootless hosts are recorded
+	assert.NoError(t, c.reconcile(ctx, pod))
+	assert.NoError(t, c.reconcile(ctx, pod))
+	updated, err := c.client.Pods(pod.Namespace).Get(ctx, pod.Name, v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Regexp(t, `^80/tcp=127\.0\.0\.1:[1-9][0-9]*$`, updated.Annotations[podman.PublishedPortsAnnotation])
+	assert.Len(t, updated.Status.ContainerStatuses, 1)
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pod
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/pdettori/cymba/pkg/podman"
+)
+
+const defaultServiceAccountName = "default"
+
+// getPullKeyring returns a keyring with the credentials of the pull secrets of a pod,
+// and of its service account as there is no admission plugin adding them to the pod.
+// Missing secrets are skipped, so that images not requiring them can still be pulled.
+func (c *Controller) getPullKeyring(ctx context.Context, pod *corev1.Pod) (*podman.Keyring, error) {
+	names := []string{}
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		names = append(names, ref.Name)
+	}
+
+	saName := pod.Spec.ServiceAccountName
+	if saName == "" {
+		saName = defaultServiceAccountName
+	}
+	sa, err := c.client.ServiceAccounts(pod.Namespace).Get(ctx, saName, v1.GetOptions{})
+	switch {
+	case err == nil:
+		for _, ref := range sa.ImagePullSecrets {
+			names = append(names, ref.Name)
+		}
+	case !apierrors.IsNotFound(err):
+		return nil, err
+	}
+
+	keyring := podman.NewKeyring()
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		secret, err := c.client.Secrets(pod.Namespace).Get(ctx, name, v1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			klog.Infof("pull secret %q of pod %q not found, images are pulled without it", name, pod.Name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := keyring.AddSecret(secret); err != nil {
+			klog.Infof("skipping pull secret %q of pod %q: %v", name, pod.Name, err)
+		}
+	}
+	return keyring, nil
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pod
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/pdettori/cymba/pkg/podman"
+)
+
+// projectVolumes writes the files of the ConfigMap and Secret volumes of a pod on the
+// host. It is called before the pod is created and on each reconcile of a running
+// pod, so that the files are kept in sync with their source objects.
+func (c *Controller) projectVolumes(ctx context.Context, pod *corev1.Pod) error {
+	for _, vol := range pod.Spec.Volumes {
+		var files []podman.ProjectedFile
+		var err error
+		switch {
+		case vol.ConfigMap != nil:
+			files, err = c.getConfigMapFiles(ctx, pod.Namespace, vol.ConfigMap)
+		case vol.Secret != nil:
+			files, err = c.getSecretFiles(ctx, pod.Namespace, vol.Secret)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("volume %s: %w", vol.Name, err)
+		}
+		if err := podman.WriteVolumeFiles(pod, vol.Name, files); err != nil {
+			return fmt.Errorf("volume %s: %w", vol.Name, err)
+		}
+	}
+	return nil
+}
+
+// resolvePodVolumes replaces the persistentVolumeClaim volumes of a pod with the
+// source of the persistent volumes bound to the claims, as volumes that podman can
+// mount. It fails while a claim is not bound, so that the pod creation is retried.
+func (c *Controller) resolvePodVolumes(ctx context.Context, pod *corev1.Pod) error {
+	for i := range pod.Spec.Volumes {
+		vol := &pod.Spec.Volumes[i]
+		if vol.PersistentVolumeClaim == nil {
+			continue
+		}
+		claimName := vol.PersistentVolumeClaim.ClaimName
+		claim, err := c.client.PersistentVolumeClaims(pod.Namespace).Get(ctx, claimName, v1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("volume %s: %w", vol.Name, err)
+		}
+		if claim.Status.Phase != corev1.ClaimBound || claim.Spec.VolumeName == "" {
+			return fmt.Errorf("volume %s: claim %s is not bound", vol.Name, claimName)
+		}
+		pv, err := c.client.PersistentVolumes().Get(ctx, claim.Spec.VolumeName, v1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("volume %s: %w", vol.Name, err)
+		}
+		source, err := getPersistentVolumeSource(pv)
+		if err != nil {
+			return fmt.Errorf("volume %s: %w", vol.Name, err)
+		}
+		if vol.PersistentVolumeClaim.ReadOnly {
+			setMountsReadOnly(pod, vol.Name)
+		}
+		vol.VolumeSource = source
+	}
+	return nil
+}
+
+// getPersistentVolumeSource returns the pod volume source mounting a persistent volume
+func getPersistentVolumeSource(pv *corev1.PersistentVolume) (corev1.VolumeSource, error) {
+	switch {
+	case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == podman.PersistentVolumeDriver:
+		return corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{
+			Driver:           podman.PersistentVolumeDriver,
+			VolumeAttributes: map[string]string{podman.VolumeHandleAttribute: pv.Spec.CSI.VolumeHandle},
+		}}, nil
+	case pv.Spec.HostPath != nil:
+		return corev1.VolumeSource{HostPath: pv.Spec.HostPath.DeepCopy()}, nil
+	case pv.Spec.Local != nil:
+		return corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: pv.Spec.Local.Path}}, nil
+	}
+	return corev1.VolumeSource{}, fmt.Errorf("persistent volume %s has an unsupported volume type", pv.Name)
+}
+
+// setMountsReadOnly makes all the mounts of a volume read-only
+func setMountsReadOnly(pod *corev1.Pod, volume string) {
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for i := range containers {
+			for j := range containers[i].VolumeMounts {
+				if containers[i].VolumeMounts[j].Name == volume {
+					containers[i].VolumeMounts[j].ReadOnly = true
+				}
+			}
+		}
+	}
+}
+
+func (c *Controller) getConfigMapFiles(ctx context.Context, namespace string, source *corev1.ConfigMapVolumeSource) ([]podman.ProjectedFile, error) {
+	data := map[string][]byte{}
+	cm, err := c.client.ConfigMaps(namespace).Get(ctx, source.Name, v1.GetOptions{})
+	switch {
+	case err == nil:
+		for k, v := range cm.Data {
+			data[k] = []byte(v)
+		}
+		for k, v := range cm.BinaryData {
+			data[k] = v
+		}
+	case !apierrors.IsNotFound(err) || !isOptional(source.Optional):
+		return nil, err
+	}
+	return getVolumeFiles(data, source.Items, source.DefaultMode, isOptional(source.Optional))
+}
+
+func (c *Controller) getSecretFiles(ctx context.Context, namespace string, source *corev1.SecretVolumeSource) ([]podman.ProjectedFile, error) {
+	data := map[string][]byte{}
+	secret, err := c.client.Secrets(namespace).Get(ctx, source.SecretName, v1.GetOptions{})
+	switch {
+	case err == nil:
+		data = secret.Data
+	case !apierrors.IsNotFound(err) || !isOptional(source.Optional):
+		return nil, err
+	}
+	return getVolumeFiles(data, source.Items, source.DefaultMode, isOptional(source.Optional))
+}
+
+// getVolumeFiles maps the data of a ConfigMap or Secret to files, with all keys mapped
+// to files with the same name unless items are specified
+func getVolumeFiles(data map[string][]byte, items []corev1.KeyToPath, defaultMode *int32, optional bool) ([]podman.ProjectedFile, error) {
+	mode := corev1.ConfigMapVolumeSourceDefaultMode
+	if defaultMode != nil {
+		mode = *defaultMode
+	}
+	files := []podman.ProjectedFile{}
+	if len(items) == 0 {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			files = append(files, podman.ProjectedFile{Path: k, Data: data[k], Mode: mode})
+		}
+		return files, nil
+	}
+	for _, item := range items {
+		v, ok := data[item.Key]
+		if !ok {
+			if optional {
+				continue
+			}
+			return nil, fmt.Errorf("couldn't find key %s", item.Key)
+		}
+		m := mode
+		if item.Mode != nil {
+			m = *item.Mode
+		}
+		files = append(files, podman.ProjectedFile{Path: item.Path, Data: v, Mode: m})
+	}
+	return files, nil
+}
+
+// enqueueReferencingPods returns an event handler enqueuing the pods with volumes
+// referencing a changed ConfigMap or Secret
+func (c *Controller) enqueueReferencingPods(references func(*corev1.Volume, string) bool) cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) {
+			object, err := meta.Accessor(obj)
+			if err != nil {
+				runtime.HandleError(err)
+				return
+			}
+			pods, err := c.lister.Pods(object.GetNamespace()).List(labels.Everything())
+			if err != nil {
+				runtime.HandleError(err)
+				return
+			}
+			for _, pod := range pods {
+				for i := range pod.Spec.Volumes {
+					if references(&pod.Spec.Volumes[i], object.GetName()) {
+						c.enqueue(pod)
+						break
+					}
+				}
+			}
+		},
+	}
+}
+
+func referencesConfigMap(vol *corev1.Volume, name string) bool {
+	return vol.ConfigMap != nil && vol.ConfigMap.Name == name
+}
+
+func referencesSecret(vol *corev1.Volume, name string) bool {
+	return vol.Secret != nil && vol.Secret.SecretName == name
+}
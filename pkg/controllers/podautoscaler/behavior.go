@@ -0,0 +1,285 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podautoscaler
+
+import (
+	"math"
+	"time"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// timestampedRecommendation is a number of replicas recommended by an autoscaler
+type timestampedRecommendation struct {
+	recommendation int32
+	timestamp      time.Time
+}
+
+// timestampedScaleEvent is a change of the number of replicas made by an autoscaler
+type timestampedScaleEvent struct {
+	replicaChange int32
+	timestamp     time.Time
+}
+
+// getBehavior returns the scaling behavior of an autoscaler, with the defaults of the API
+// server for the rules which are not set: scale up without stabilization by at most 4 pods
+// or 100% every 15 seconds, and scale down to the highest recommendation of the last 5
+// minutes by at most 100% every 15 seconds
+func getBehavior(hpa *autoscalingv2.HorizontalPodAutoscaler) autoscalingv2.HorizontalPodAutoscalerBehavior {
+	behavior := autoscalingv2.HorizontalPodAutoscalerBehavior{}
+	if hpa.Spec.Behavior != nil {
+		behavior = *hpa.Spec.Behavior.DeepCopy()
+	}
+	behavior.ScaleUp = withDefaultRules(behavior.ScaleUp, 0, []autoscalingv2.HPAScalingPolicy{
+		{Type: autoscalingv2.PodsScalingPolicy, Value: 4, PeriodSeconds: 15},
+		{Type: autoscalingv2.PercentScalingPolicy, Value: 100, PeriodSeconds: 15},
+	})
+	behavior.ScaleDown = withDefaultRules(behavior.ScaleDown, 300, []autoscalingv2.HPAScalingPolicy{
+		{Type: autoscalingv2.PercentScalingPolicy, Value: 100, PeriodSeconds: 15},
+	})
+	return behavior
+}
+
+func withDefaultRules(rules *autoscalingv2.HPAScalingRules, window int32, policies []autoscalingv2.HPAScalingPolicy) *autoscalingv2.HPAScalingRules {
+	if rules == nil {
+		rules = &autoscalingv2.HPAScalingRules{}
+	}
+	if rules.StabilizationWindowSeconds == nil {
+		rules.StabilizationWindowSeconds = &window
+	}
+	if rules.SelectPolicy == nil {
+		selectPolicy := autoscalingv2.MaxPolicySelect
+		rules.SelectPolicy = &selectPolicy
+	}
+	if len(rules.Policies) == 0 {
+		rules.Policies = policies
+	}
+	return rules
+}
+
+// normalizeDesiredReplicas returns the replicas an autoscaler scales its target to from
+// the replicas proposed by its metrics: the proposal is stabilized with the recent
+// recommendations, then limited by the scaling policies and the replica bounds
+func (c *Controller) normalizeDesiredReplicas(key string, hpa *autoscalingv2.HorizontalPodAutoscaler,
+	status *autoscalingv2.HorizontalPodAutoscalerStatus, current, proposed, minReplicas int32, now time.Time) int32 {
+	behavior := getBehavior(hpa)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// the autoscaler does not scale down right after the controller started
+	if _, ok := c.recommendations[key]; !ok {
+		c.recommendations[key] = []timestampedRecommendation{{recommendation: current, timestamp: now}}
+	}
+	stabilized := c.stabilizeRecommendation(key, behavior, current, proposed, now)
+	switch {
+	case stabilized < proposed:
+		setCondition(status, autoscalingv2.ScalingActive, corev1.ConditionTrue, "ScaleUpStabilized",
+			"recent recommendations were lower than current one, applying the lowest recent recommendation")
+	case stabilized > proposed:
+		setCondition(status, autoscalingv2.ScalingActive, corev1.ConditionTrue, "ScaleDownStabilized",
+			"recent recommendations were higher than current one, applying the highest recent recommendation")
+	}
+
+	desired, reason, message := c.limitScaleRate(key, behavior, current, stabilized, minReplicas, hpa.Spec.MaxReplicas, now)
+	if desired == stabilized {
+		setCondition(status, autoscalingv2.ScalingLimited, corev1.ConditionFalse, reason, message)
+	} else {
+		setCondition(status, autoscalingv2.ScalingLimited, corev1.ConditionTrue, reason, message)
+	}
+	return desired
+}
+
+// stabilizeRecommendation records the proposed replicas of an autoscaler, and returns the
+// current replicas bounded by the lowest recommendation of the scale up stabilization
+// window and by the highest recommendation of the scale down stabilization window
+func (c *Controller) stabilizeRecommendation(key string, behavior autoscalingv2.HorizontalPodAutoscalerBehavior,
+	current, proposed int32, now time.Time) int32 {
+	upCutoff := now.Add(-time.Duration(*behavior.ScaleUp.StabilizationWindowSeconds) * time.Second)
+	downCutoff := now.Add(-time.Duration(*behavior.ScaleDown.StabilizationWindowSeconds) * time.Second)
+	upRecommendation, downRecommendation := proposed, proposed
+	recommendations := []timestampedRecommendation{}
+	for _, r := range c.recommendations[key] {
+		if r.timestamp.After(upCutoff) && r.recommendation < upRecommendation {
+			upRecommendation = r.recommendation
+		}
+		if r.timestamp.After(downCutoff) && r.recommendation > downRecommendation {
+			downRecommendation = r.recommendation
+		}
+		if r.timestamp.After(upCutoff) || r.timestamp.After(downCutoff) {
+			recommendations = append(recommendations, r)
+		}
+	}
+	c.recommendations[key] = append(recommendations, timestampedRecommendation{recommendation: proposed, timestamp: now})
+
+	recommendation := current
+	if recommendation < upRecommendation {
+		recommendation = upRecommendation
+	}
+	if recommendation > downRecommendation {
+		recommendation = downRecommendation
+	}
+	return recommendation
+}
+
+// limitScaleRate limits the change of the replicas of an autoscaler to the rate allowed by
+// its scaling policies and to its replica bounds, and returns the reason and the message
+// of its ScalingLimited condition
+func (c *Controller) limitScaleRate(key string, behavior autoscalingv2.HorizontalPodAutoscalerBehavior,
+	current, desired, minReplicas, maxReplicas int32, now time.Time) (int32, string, string) {
+	upEvents := pruneScaleEvents(c.scaleUpEvents[key], behavior.ScaleUp, now)
+	downEvents := pruneScaleEvents(c.scaleDownEvents[key], behavior.ScaleDown, now)
+	c.scaleUpEvents[key], c.scaleDownEvents[key] = upEvents, downEvents
+	if desired > current {
+		limit := scaleUpLimit(current, upEvents, downEvents, behavior.ScaleUp, now)
+		if limit < current {
+			limit = current
+		}
+		if limit < maxReplicas {
+			if desired > limit {
+				return limit, "ScaleUpLimit", "the desired replica count is increasing faster than the maximum scale rate"
+			}
+		} else if desired > maxReplicas {
+			return maxReplicas, "TooManyReplicas", "the desired replica count is more than the maximum replica count"
+		}
+	} else if desired < current {
+		limit := scaleDownLimit(current, upEvents, downEvents, behavior.ScaleDown, now)
+		if limit > current {
+			limit = current
+		}
+		if limit > minReplicas {
+			if desired < limit {
+				return limit, "ScaleDownLimit", "the desired replica count is decreasing faster than the maximum scale rate"
+			}
+		} else if desired < minReplicas {
+			return minReplicas, "TooFewReplicas", "the desired replica count is less than the minimum replica count"
+		}
+	}
+	return desired, "DesiredWithinRange", "the desired count is within the acceptable range"
+}
+
+// recordScaleEvent records a change of the replicas of an autoscaler for its scaling policies
+func (c *Controller) recordScaleEvent(key string, current, desired int32, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if desired > current {
+		c.scaleUpEvents[key] = append(c.scaleUpEvents[key], timestampedScaleEvent{replicaChange: desired - current, timestamp: now})
+	} else if desired < current {
+		c.scaleDownEvents[key] = append(c.scaleDownEvents[key], timestampedScaleEvent{replicaChange: current - desired, timestamp: now})
+	}
+}
+
+// pruneScaleEvents drops the scale events older than the longest period of the policies
+func pruneScaleEvents(events []timestampedScaleEvent, rules *autoscalingv2.HPAScalingRules, now time.Time) []timestampedScaleEvent {
+	var longest int32
+	for _, policy := range rules.Policies {
+		if policy.PeriodSeconds > longest {
+			longest = policy.PeriodSeconds
+		}
+	}
+	cutoff := now.Add(-time.Duration(longest) * time.Second)
+	kept := []timestampedScaleEvent{}
+	for _, e := range events {
+		if e.timestamp.After(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// replicaChangeInPeriod returns the replicas changed by the scale events of the last period
+func replicaChangeInPeriod(events []timestampedScaleEvent, periodSeconds int32, now time.Time) int32 {
+	cutoff := now.Add(-time.Duration(periodSeconds) * time.Second)
+	var change int32
+	for _, e := range events {
+		if e.timestamp.After(cutoff) {
+			change += e.replicaChange
+		}
+	}
+	return change
+}
+
+// scaleUpLimit returns the highest replicas allowed by the scale up policies, relative to
+// the replicas at the start of their period
+func scaleUpLimit(current int32, upEvents, downEvents []timestampedScaleEvent, rules *autoscalingv2.HPAScalingRules, now time.Time) int32 {
+	if *rules.SelectPolicy == autoscalingv2.DisabledPolicySelect {
+		return current
+	}
+	// the Max policy allows the highest change, the Min policy the lowest one
+	var result int32 = math.MinInt32
+	selectPolicy := max
+	if *rules.SelectPolicy == autoscalingv2.MinPolicySelect {
+		result = math.MaxInt32
+		selectPolicy = min
+	}
+	for _, policy := range rules.Policies {
+		start := current - replicaChangeInPeriod(upEvents, policy.PeriodSeconds, now) + replicaChangeInPeriod(downEvents, policy.PeriodSeconds, now)
+		var proposed int32
+		switch policy.Type {
+		case autoscalingv2.PodsScalingPolicy:
+			proposed = start + policy.Value
+		case autoscalingv2.PercentScalingPolicy:
+			proposed = int32(math.Ceil(float64(start) * (1 + float64(policy.Value)/100)))
+		default:
+			continue
+		}
+		result = selectPolicy(result, proposed)
+	}
+	return result
+}
+
+// scaleDownLimit returns the lowest replicas allowed by the scale down policies, relative
+// to the replicas at the start of their period
+func scaleDownLimit(current int32, upEvents, downEvents []timestampedScaleEvent, rules *autoscalingv2.HPAScalingRules, now time.Time) int32 {
+	if *rules.SelectPolicy == autoscalingv2.DisabledPolicySelect {
+		return current
+	}
+	var result int32 = math.MaxInt32
+	selectPolicy := min
+	if *rules.SelectPolicy == autoscalingv2.MinPolicySelect {
+		result = math.MinInt32
+		selectPolicy = max
+	}
+	for _, policy := range rules.Policies {
+		start := current - replicaChangeInPeriod(upEvents, policy.PeriodSeconds, now) + replicaChangeInPeriod(downEvents, policy.PeriodSeconds, now)
+		var proposed int32
+		switch policy.Type {
+		case autoscalingv2.PodsScalingPolicy:
+			proposed = start - policy.Value
+		case autoscalingv2.PercentScalingPolicy:
+			proposed = int32(float64(start) * (1 - float64(policy.Value)/100))
+		default:
+			continue
+		}
+		result = selectPolicy(result, proposed)
+	}
+	return result
+}
+
+func max(a, b int32) int32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podautoscaler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	// autoscaling/v2 is served by the CRD, but the client-go 0.22 of the kcp fork has no
+	// types, client nor informer for it, so the autoscalers are read and updated through
+	// v2beta2, which is the storage version and has the same schema
+	autoscalingv2 "k8s.io/api/autoscaling/v2beta2"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	autoscalingv2client "k8s.io/client-go/kubernetes/typed/autoscaling/v2beta2"
+	autoscalingv2lister "k8s.io/client-go/listers/autoscaling/v2beta2"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	"github.com/pdettori/cymba/pkg/controllers"
+	"github.com/pdettori/cymba/pkg/podman"
+)
+
+const resyncPeriod = 30 * time.Second
+const controllerName = "horizontalpodautoscaler"
+
+// syncPeriod is the period at which the metrics of the autoscalers are sampled and their
+// targets scaled, as in the kube-controller-manager
+const syncPeriod = 15 * time.Second
+
+// eventSource is the component of the events recorded on autoscalers
+const eventSource = "horizontal-pod-autoscaler"
+
+// NewController returns a new Controller which scales deployments from the resource usage
+// of their podman containers
+func NewController(cfg *rest.Config, rt podman.PodmanRuntime, stopCh <-chan struct{}) *Controller {
+	client := autoscalingv2client.NewForConfigOrDie(cfg)
+	kubeClient := kubernetes.NewForConfigOrDie(cfg)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	c := &Controller{
+		queue:           queue,
+		client:          client,
+		kubeClient:      kubeClient,
+		stopCh:          stopCh,
+		recorder:        controllers.NewEventRecorder(kubeClient, eventSource, stopCh),
+		runtime:         rt,
+		recommendations: map[string][]timestampedRecommendation{},
+		scaleUpEvents:   map[string][]timestampedScaleEvent{},
+		scaleDownEvents: map[string][]timestampedScaleEvent{},
+		cpuSamples:      map[string]cpuSample{},
+	}
+
+	sif := informers.NewSharedInformerFactoryWithOptions(kubeClient, resyncPeriod)
+	sif.Autoscaling().V2beta2().HorizontalPodAutoscalers().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue(obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+	})
+	c.indexer = sif.Autoscaling().V2beta2().HorizontalPodAutoscalers().Informer().GetIndexer()
+	c.lister = sif.Autoscaling().V2beta2().HorizontalPodAutoscalers().Lister()
+	sif.WaitForCacheSync(stopCh)
+	sif.Start(stopCh)
+
+	return c
+}
+
+// Controller defines the struct for Controller
+type Controller struct {
+	queue      workqueue.RateLimitingInterface
+	client     autoscalingv2client.AutoscalingV2beta2Interface
+	kubeClient kubernetes.Interface
+	stopCh     <-chan struct{}
+	indexer    cache.Indexer
+	lister     autoscalingv2lister.HorizontalPodAutoscalerLister
+	recorder   record.EventRecorder
+	runtime    podman.PodmanRuntime
+
+	// mu guards the state kept across the syncs of the autoscalers
+	mu sync.Mutex
+	// recommendations are the recent replica recommendations of each autoscaler, within
+	// its stabilization windows
+	recommendations map[string][]timestampedRecommendation
+	// scaleUpEvents and scaleDownEvents are the recent scalings of each autoscaler, within
+	// the periods of its scaling policies
+	scaleUpEvents   map[string][]timestampedScaleEvent
+	scaleDownEvents map[string][]timestampedScaleEvent
+	// cpuSamples are the last CPU usage samples of the containers, by container ID, from
+	// which the CPU usage rate of the next samples is computed
+	cpuSamples map[string]cpuSample
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+// Start starts the controller
+func (c *Controller) Start(numThreads int) {
+	defer c.queue.ShutDown()
+	for i := 0; i < numThreads; i++ {
+		go wait.Until(c.startWorker, time.Second, c.stopCh)
+	}
+	klog.Infof("Starting horizontal pod autoscaler workers")
+	<-c.stopCh
+	klog.Infof("Stopping horizontal pod autoscaler workers")
+}
+
+func (c *Controller) startWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	// Wait until there is a new item in the working queue
+	k, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	key := k.(string)
+
+	// No matter what, tell the queue we're done with this key, to unblock
+	// other workers.
+	defer c.queue.Done(key)
+
+	if err := c.process(key); err != nil {
+		runtime.HandleError(fmt.Errorf("%q controller failed to sync %q, err: %w", controllerName, key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) process(key string) error {
+	obj, exists, err := c.indexer.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		klog.Infof("Object with key %q was deleted", key)
+		c.forget(key)
+		return nil
+	}
+	current := obj.(*autoscalingv2.HorizontalPodAutoscaler).DeepCopy()
+
+	// autoscalers are synced periodically, as the usage of their pods changes without
+	// changing any object
+	c.queue.AddAfter(key, syncPeriod)
+
+	// reconcile scales the target of the autoscaler and updates its status
+	return c.reconcile(context.TODO(), current)
+}
+
+// forget drops the state kept for a deleted autoscaler
+func (c *Controller) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.recommendations, key)
+	delete(c.scaleUpEvents, key)
+	delete(c.scaleDownEvents, key)
+}
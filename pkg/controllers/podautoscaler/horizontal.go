@@ -0,0 +1,189 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podautoscaler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// reasons of the events recorded on autoscalers, as in the kube-controller-manager
+	eventSuccessfulRescale            = "SuccessfulRescale"
+	eventFailedRescale                = "FailedRescale"
+	eventFailedGetScale               = "FailedGetScale"
+	eventFailedGetResourceMetric      = "FailedGetResourceMetric"
+	eventFailedComputeMetricsReplicas = "FailedComputeMetricsReplicas"
+)
+
+// targetKind is the kind of the targets which can be scaled
+var targetKind = appsv1.SchemeGroupVersion.WithKind("Deployment")
+
+func (c *Controller) reconcile(ctx context.Context, hpa *autoscalingv2.HorizontalPodAutoscaler) error {
+	klog.Infof("reconciling horizontal pod autoscaler %q", hpa.Name)
+
+	key, err := cache.MetaNamespaceKeyFunc(hpa)
+	if err != nil {
+		return err
+	}
+	status := hpa.Status.DeepCopy()
+	status.ObservedGeneration = &hpa.Generation
+
+	ref := hpa.Spec.ScaleTargetRef
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil || gv.Group != targetKind.Group || ref.Kind != targetKind.Kind {
+		msg := fmt.Sprintf("the HPA controller was unable to get the target's current scale: scaling %s %q is not supported", ref.Kind, ref.Name)
+		c.recorder.Event(hpa, corev1.EventTypeWarning, eventFailedGetScale, msg)
+		setCondition(status, autoscalingv2.AbleToScale, corev1.ConditionFalse, "FailedGetScale", msg)
+		return c.updateStatus(ctx, hpa, status)
+	}
+	d, err := c.kubeClient.AppsV1().Deployments(hpa.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		msg := fmt.Sprintf("the HPA controller was unable to get the target's current scale: %v", err)
+		c.recorder.Event(hpa, corev1.EventTypeWarning, eventFailedGetScale, msg)
+		setCondition(status, autoscalingv2.AbleToScale, corev1.ConditionFalse, "FailedGetScale", msg)
+		if updateErr := c.updateStatus(ctx, hpa, status); updateErr != nil {
+			return updateErr
+		}
+		return err
+	}
+	setCondition(status, autoscalingv2.AbleToScale, corev1.ConditionTrue, "SucceededGetScale",
+		"the HPA controller was able to get the target's current scale")
+
+	current := getReplicas(d)
+	status.CurrentReplicas = current
+	minReplicas := getMinReplicas(hpa)
+	now := time.Now()
+	desired := current
+	rescaleReason := ""
+	switch {
+	case current == 0 && minReplicas != 0:
+		// an autoscaler is disabled by scaling its target to zero
+		setCondition(status, autoscalingv2.ScalingActive, corev1.ConditionFalse, "ScalingDisabled",
+			"scaling is disabled since the replica count of the target is zero")
+		desired = 0
+	case current > hpa.Spec.MaxReplicas:
+		rescaleReason = "Current number of replicas above Spec.MaxReplicas"
+		desired = hpa.Spec.MaxReplicas
+	case current < minReplicas:
+		rescaleReason = "Current number of replicas below Spec.MinReplicas"
+		desired = minReplicas
+	default:
+		proposed, metricName, metricStatuses, err := c.computeReplicasForMetrics(ctx, hpa, d, status, current)
+		status.CurrentMetrics = metricStatuses
+		if err != nil {
+			// the autoscaler is synced again once more metrics are sampled
+			klog.Infof("horizontal pod autoscaler %q could not compute replicas: %v", hpa.Name, err)
+			return c.updateStatus(ctx, hpa, status)
+		}
+		desired = c.normalizeDesiredReplicas(key, hpa, status, current, proposed, minReplicas, now)
+		if desired > current {
+			rescaleReason = fmt.Sprintf("%s above target", metricName)
+		} else if desired < current {
+			rescaleReason = "All metrics below target"
+		}
+	}
+
+	if desired != current {
+		scale := &autoscalingv1.Scale{
+			ObjectMeta: metav1.ObjectMeta{Name: d.Name, Namespace: d.Namespace},
+			Spec:       autoscalingv1.ScaleSpec{Replicas: desired},
+		}
+		if _, err := c.kubeClient.AppsV1().Deployments(d.Namespace).UpdateScale(ctx, d.Name, scale, metav1.UpdateOptions{}); err != nil {
+			msg := fmt.Sprintf("the HPA controller was unable to update the target scale: %v", err)
+			c.recorder.Eventf(hpa, corev1.EventTypeWarning, eventFailedRescale, "New size: %d; reason: %s; error: %v", desired, rescaleReason, err)
+			setCondition(status, autoscalingv2.AbleToScale, corev1.ConditionFalse, "FailedUpdateScale", msg)
+			if updateErr := c.updateStatus(ctx, hpa, status); updateErr != nil {
+				return updateErr
+			}
+			return err
+		}
+		setCondition(status, autoscalingv2.AbleToScale, corev1.ConditionTrue, "SucceededRescale",
+			fmt.Sprintf("the HPA controller was able to update the target scale to %d", desired))
+		c.recorder.Eventf(hpa, corev1.EventTypeNormal, eventSuccessfulRescale, "New size: %d; reason: %s", desired, rescaleReason)
+		c.recordScaleEvent(key, current, desired, now)
+		lastScaleTime := metav1.NewTime(now)
+		status.LastScaleTime = &lastScaleTime
+		klog.Infof("horizontal pod autoscaler %q scaled deployment %q from %d to %d replicas: %s", hpa.Name, d.Name, current, desired, rescaleReason)
+	}
+	status.DesiredReplicas = desired
+	return c.updateStatus(ctx, hpa, status)
+}
+
+// updateStatus updates the status of an autoscaler when it changed
+func (c *Controller) updateStatus(ctx context.Context, hpa *autoscalingv2.HorizontalPodAutoscaler, status *autoscalingv2.HorizontalPodAutoscalerStatus) error {
+	if equality.Semantic.DeepEqual(&hpa.Status, status) {
+		return nil
+	}
+	hpa = hpa.DeepCopy()
+	hpa.Status = *status
+	_, err := c.client.HorizontalPodAutoscalers(hpa.Namespace).UpdateStatus(ctx, hpa, metav1.UpdateOptions{})
+	return err
+}
+
+// setCondition sets a condition of an autoscaler, keeping its transition time when its
+// status does not change
+func setCondition(status *autoscalingv2.HorizontalPodAutoscalerStatus, conditionType autoscalingv2.HorizontalPodAutoscalerConditionType,
+	conditionStatus corev1.ConditionStatus, reason, message string) {
+	for i := range status.Conditions {
+		condition := &status.Conditions[i]
+		if condition.Type != conditionType {
+			continue
+		}
+		if condition.Status != conditionStatus {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		condition.Status = conditionStatus
+		condition.Reason = reason
+		condition.Message = message
+		return
+	}
+	status.Conditions = append(status.Conditions, autoscalingv2.HorizontalPodAutoscalerCondition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// getReplicas returns the desired replicas of a deployment, which default to 1
+func getReplicas(d *appsv1.Deployment) int32 {
+	if d.Spec.Replicas == nil {
+		return 1
+	}
+	return *d.Spec.Replicas
+}
+
+// getMinReplicas returns the minimum replicas of an autoscaler, which default to 1
+func getMinReplicas(hpa *autoscalingv2.HorizontalPodAutoscaler) int32 {
+	if hpa.Spec.MinReplicas == nil {
+		return 1
+	}
+	return *hpa.Spec.MinReplicas
+}
@@ -0,0 +1,329 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podautoscaler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/pdettori/cymba/pkg/controllers/testutil"
+	"github.com/pdettori/cymba/pkg/podman"
+)
+
+func newTestDeployment(replicas int32) *appsv1.Deployment {
+	labels := map[string]string{"app": "web"}
+	return &appsv1.Deployment{
+		ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default", UID: "0a1b2c3d"},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &v1.LabelSelector{MatchLabels: labels},
+		},
+	}
+}
+
+func newTestAutoscaler(minReplicas, maxReplicas int32, metrics ...autoscalingv2.MetricSpec) *autoscalingv2.HorizontalPodAutoscaler {
+	return &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "Deployment", Name: "web"},
+			MinReplicas:    &minReplicas,
+			MaxReplicas:    maxReplicas,
+			Metrics:        metrics,
+		},
+	}
+}
+
+func cpuUtilization(utilization int32) autoscalingv2.MetricSpec {
+	return autoscalingv2.MetricSpec{
+		Type: autoscalingv2.ResourceMetricSourceType,
+		Resource: &autoscalingv2.ResourceMetricSource{
+			Name:   corev1.ResourceCPU,
+			Target: autoscalingv2.MetricTarget{Type: autoscalingv2.UtilizationMetricType, AverageUtilization: &utilization},
+		},
+	}
+}
+
+func memoryAverageValue(value string) autoscalingv2.MetricSpec {
+	quantity := resource.MustParse(value)
+	return autoscalingv2.MetricSpec{
+		Type: autoscalingv2.ResourceMetricSourceType,
+		Resource: &autoscalingv2.ResourceMetricSource{
+			Name:   corev1.ResourceMemory,
+			Target: autoscalingv2.MetricTarget{Type: autoscalingv2.AverageValueMetricType, AverageValue: &quantity},
+		},
+	}
+}
+
+// newTestPod returns a running and ready pod of the deployment, with a container
+// requesting 100m of CPU
+func newTestPod(name string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "web"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{
+			Name:  "app",
+			Image: "nginx",
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+			},
+		}}},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+// newTestController returns a controller with a fake client, which scales deployments
+// through their scale subresource as the API server does
+func newTestController(rt podman.PodmanRuntime, objects ...runtime.Object) *Controller {
+	kubeClient := testutil.NewClientset(objects...)
+	kubeClient.PrependReactor("update", "deployments", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		update := action.(clienttesting.UpdateAction)
+		if update.GetSubresource() != "scale" {
+			return false, nil, nil
+		}
+		scale := update.GetObject().(*autoscalingv1.Scale)
+		obj, err := kubeClient.Tracker().Get(appsv1.SchemeGroupVersion.WithResource("deployments"), scale.Namespace, scale.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		d := obj.(*appsv1.Deployment)
+		d.Spec.Replicas = &scale.Spec.Replicas
+		if err := kubeClient.Tracker().Update(appsv1.SchemeGroupVersion.WithResource("deployments"), d, d.Namespace); err != nil {
+			return true, nil, err
+		}
+		return true, scale, nil
+	})
+	return &Controller{
+		queue:           workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		client:          kubeClient.AutoscalingV2beta2(),
+		kubeClient:      kubeClient,
+		recorder:        record.NewFakeRecorder(100),
+		runtime:         rt,
+		recommendations: map[string][]timestampedRecommendation{},
+		scaleUpEvents:   map[string][]timestampedScaleEvent{},
+		scaleDownEvents: map[string][]timestampedScaleEvent{},
+		cpuSamples:      map[string]cpuSample{},
+	}
+}
+
+// startPods creates the podman pods of the given pods
+func startPods(t *testing.T, rt *podman.FakeRuntime, pods ...*corev1.Pod) {
+	m := podman.NewPodManager(rt, &record.FakeRecorder{})
+	for _, pod := range pods {
+		_, err := m.CreatePod(pod, nil, nil)
+		assert.NoError(t, err)
+	}
+}
+
+// setMemoryUsage sets the memory usage of the container of the given pods
+func setMemoryUsage(t *testing.T, rt *podman.FakeRuntime, memUsage uint64, names ...string) {
+	for _, name := range names {
+		assert.NoError(t, rt.SetContainerUsage(fmt.Sprintf("default_%s_app", name), 0, memUsage))
+	}
+}
+
+// setCPUUsage sets the CPU usage rate of the container of the given pods, by recording a
+// sample of their CPU time one minute ago
+func setCPUUsage(t *testing.T, c *Controller, rt *podman.FakeRuntime, millicores uint64, names ...string) {
+	for _, name := range names {
+		container := fmt.Sprintf("default_%s_app", name)
+		data, err := rt.InspectContainer(container)
+		assert.NoError(t, err)
+		c.cpuSamples[data.ID] = cpuSample{usage: podman.ContainerUsage{ContainerID: data.ID, Timestamp: time.Now().Add(-time.Minute)}}
+		assert.NoError(t, rt.SetContainerUsage(container, millicores*60*1000000, 0))
+	}
+}
+
+// reconcileAutoscaler reconciles the current version of the autoscaler, and returns it
+// with the replicas of the deployment
+func reconcileAutoscaler(t *testing.T, c *Controller) (*autoscalingv2.HorizontalPodAutoscaler, int32) {
+	ctx := context.TODO()
+	hpa, err := c.client.HorizontalPodAutoscalers("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, c.reconcile(ctx, hpa))
+	hpa, err = c.client.HorizontalPodAutoscalers("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	d, err := c.kubeClient.AppsV1().Deployments("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	return hpa, *d.Spec.Replicas
+}
+
+func getCondition(hpa *autoscalingv2.HorizontalPodAutoscaler, conditionType autoscalingv2.HorizontalPodAutoscalerConditionType) *autoscalingv2.HorizontalPodAutoscalerCondition {
+	for i := range hpa.Status.Conditions {
+		if hpa.Status.Conditions[i].Type == conditionType {
+			return &hpa.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func TestReconcileScalesUpOnCPU(t *testing.T) {
+	rt := podman.NewFakeRuntime()
+	pods := []*corev1.Pod{newTestPod("web-1"), newTestPod("web-2")}
+	c := newTestController(rt, newTestDeployment(2), newTestAutoscaler(1, 10, cpuUtilization(50)), pods[0], pods[1])
+	startPods(t, rt, pods...)
+
+	// the CPU usage rate is not known from a single sample
+	assert.NoError(t, rt.SetContainerUsage("default_web-1_app", 1000000000, 0))
+	assert.NoError(t, rt.SetContainerUsage("default_web-2_app", 1000000000, 0))
+	hpa, replicas := reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(2), replicas)
+	assert.Equal(t, corev1.ConditionFalse, getCondition(hpa, autoscalingv2.ScalingActive).Status)
+	assert.Equal(t, "FailedGetResourceMetric", getCondition(hpa, autoscalingv2.ScalingActive).Reason)
+
+	// 200m used out of 50m targeted would need 8 replicas, the scale up is limited to 4
+	// pods or 100% every 15 seconds
+	setCPUUsage(t, c, rt, 200, "web-1", "web-2")
+	hpa, replicas = reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(6), replicas)
+	assert.Equal(t, int32(6), hpa.Status.DesiredReplicas)
+	assert.Equal(t, int32(2), hpa.Status.CurrentReplicas)
+	assert.NotNil(t, hpa.Status.LastScaleTime)
+	assert.Equal(t, "ScaleUpLimit", getCondition(hpa, autoscalingv2.ScalingLimited).Reason)
+	assert.Equal(t, corev1.ConditionTrue, getCondition(hpa, autoscalingv2.ScalingActive).Status)
+	if assert.Len(t, hpa.Status.CurrentMetrics, 1) {
+		value := hpa.Status.CurrentMetrics[0].Resource.Current
+		assert.InDelta(t, 200, value.AverageValue.MilliValue(), 1)
+		assert.InDelta(t, 200, *value.AverageUtilization, 1)
+	}
+	events := c.recorder.(*record.FakeRecorder).Events
+	assert.Contains(t, <-events, "FailedGetResourceMetric")
+	assert.Contains(t, <-events, "FailedComputeMetricsReplicas")
+	assert.Equal(t, "Normal SuccessfulRescale New size: 6; reason: cpu resource above target", <-events)
+}
+
+func TestReconcileScalesOnMemory(t *testing.T) {
+	rt := podman.NewFakeRuntime()
+	pods := []*corev1.Pod{newTestPod("web-1"), newTestPod("web-2")}
+	c := newTestController(rt, newTestDeployment(2), newTestAutoscaler(1, 3, memoryAverageValue("64Mi")), pods[0], pods[1])
+	startPods(t, rt, pods...)
+
+	// twice the target would need 4 replicas, more than the maximum
+	setMemoryUsage(t, rt, 128*1024*1024, "web-1", "web-2")
+	hpa, replicas := reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(3), replicas)
+	assert.Equal(t, "TooManyReplicas", getCondition(hpa, autoscalingv2.ScalingLimited).Reason)
+
+	// usage within the tolerance of the target does not change the replicas
+	pod := newTestPod("web-3")
+	_, err := c.kubeClient.CoreV1().Pods("default").Create(context.TODO(), pod, v1.CreateOptions{})
+	assert.NoError(t, err)
+	startPods(t, rt, pod)
+	setMemoryUsage(t, rt, 68*1024*1024, "web-1", "web-2", "web-3")
+	hpa, replicas = reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(3), replicas)
+	assert.Equal(t, "DesiredWithinRange", getCondition(hpa, autoscalingv2.ScalingLimited).Reason)
+}
+
+func TestReconcileStabilizesScaleDown(t *testing.T) {
+	rt := podman.NewFakeRuntime()
+	pods := []*corev1.Pod{newTestPod("web-1"), newTestPod("web-2")}
+	c := newTestController(rt, newTestDeployment(2), newTestAutoscaler(1, 10, memoryAverageValue("64Mi")), pods[0], pods[1])
+	startPods(t, rt, pods...)
+
+	// the replicas are not scaled down within 5 minutes of a higher recommendation
+	setMemoryUsage(t, rt, 16*1024*1024, "web-1", "web-2")
+	hpa, replicas := reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(2), replicas)
+	assert.Equal(t, "ScaleDownStabilized", getCondition(hpa, autoscalingv2.ScalingActive).Reason)
+
+	c.mu.Lock()
+	c.recommendations["default/web"][0].timestamp = time.Now().Add(-6 * time.Minute)
+	c.mu.Unlock()
+	hpa, replicas = reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(1), replicas)
+	assert.Equal(t, "ValidMetricFound", getCondition(hpa, autoscalingv2.ScalingActive).Reason)
+}
+
+func TestReconcileScalingPolicies(t *testing.T) {
+	rt := podman.NewFakeRuntime()
+	window := int32(0)
+	hpa := newTestAutoscaler(1, 10, memoryAverageValue("64Mi"))
+	hpa.Spec.Behavior = &autoscalingv2.HorizontalPodAutoscalerBehavior{
+		ScaleUp: &autoscalingv2.HPAScalingRules{
+			Policies: []autoscalingv2.HPAScalingPolicy{{Type: autoscalingv2.PodsScalingPolicy, Value: 1, PeriodSeconds: 60}},
+		},
+		ScaleDown: &autoscalingv2.HPAScalingRules{StabilizationWindowSeconds: &window},
+	}
+	pods := []*corev1.Pod{newTestPod("web-1"), newTestPod("web-2")}
+	c := newTestController(rt, newTestDeployment(2), hpa, pods[0], pods[1])
+	startPods(t, rt, pods...)
+
+	// the replicas are scaled up by one pod per minute
+	setMemoryUsage(t, rt, 256*1024*1024, "web-1", "web-2")
+	_, replicas := reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(3), replicas)
+	_, replicas = reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(3), replicas)
+
+	// the replicas are scaled down without stabilization, to the minimum
+	setMemoryUsage(t, rt, 1024*1024, "web-1", "web-2")
+	_, replicas = reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(1), replicas)
+}
+
+func TestReconcileReplicaBounds(t *testing.T) {
+	rt := podman.NewFakeRuntime()
+	c := newTestController(rt, newTestDeployment(12), newTestAutoscaler(2, 10, cpuUtilization(50)))
+
+	// the replicas are brought within the bounds without metrics
+	hpa, replicas := reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(10), replicas)
+	assert.Equal(t, int32(10), hpa.Status.DesiredReplicas)
+	events := c.recorder.(*record.FakeRecorder).Events
+	assert.Equal(t, "Normal SuccessfulRescale New size: 10; reason: Current number of replicas above Spec.MaxReplicas", <-events)
+
+	d, err := c.kubeClient.AppsV1().Deployments("default").Get(context.TODO(), "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	replicas = 1
+	d.Spec.Replicas = &replicas
+	_, err = c.kubeClient.AppsV1().Deployments("default").Update(context.TODO(), d, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	_, replicas = reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(2), replicas)
+
+	// scaling the deployment to zero disables the autoscaler
+	replicas = 0
+	d.Spec.Replicas = &replicas
+	_, err = c.kubeClient.AppsV1().Deployments("default").Update(context.TODO(), d, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	hpa, replicas = reconcileAutoscaler(t, c)
+	assert.Equal(t, int32(0), replicas)
+	assert.Equal(t, "ScalingDisabled", getCondition(hpa, autoscalingv2.ScalingActive).Reason)
+
+	// only deployments can be scaled
+	hpa.Spec.ScaleTargetRef = autoscalingv2.CrossVersionObjectReference{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "web"}
+	assert.NoError(t, c.reconcile(context.TODO(), hpa))
+	hpa, err = c.client.HorizontalPodAutoscalers("default").Get(context.TODO(), "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "FailedGetScale", getCondition(hpa, autoscalingv2.AbleToScale).Reason)
+}
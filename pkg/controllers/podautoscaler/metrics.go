@@ -0,0 +1,388 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podautoscaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2beta2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/pdettori/cymba/pkg/controllers/replicaset"
+	"github.com/pdettori/cymba/pkg/podman"
+)
+
+const (
+	// tolerance is the ratio of the usage to the target below which the replicas are not
+	// changed, as in the kube-controller-manager
+	tolerance = 0.1
+
+	// cpuSampleWindow is the minimum time between the two CPU usage samples the CPU usage
+	// rate of a container is computed from
+	cpuSampleWindow = 10 * time.Second
+	// cpuSampleExpiry is the time after which the CPU usage samples of the containers which
+	// are not sampled anymore are dropped
+	cpuSampleExpiry = 10 * syncPeriod
+)
+
+// errNoMetrics is returned when none of the pods of the target of an autoscaler has metrics
+var errNoMetrics = errors.New("did not receive metrics for any ready pods")
+
+// computeReplicasForMetrics returns the highest replicas proposed by the metrics of an
+// autoscaler, with the name of the metric proposing them and the current value of the
+// metrics, and sets its ScalingActive condition
+func (c *Controller) computeReplicasForMetrics(ctx context.Context, hpa *autoscalingv2.HorizontalPodAutoscaler, d *appsv1.Deployment,
+	status *autoscalingv2.HorizontalPodAutoscalerStatus, current int32) (int32, string, []autoscalingv2.MetricStatus, error) {
+	selector, err := metav1.LabelSelectorAsSelector(d.Spec.Selector)
+	if err != nil || selector.Empty() {
+		msg := "the HPA target's scale is missing a selector"
+		if err != nil {
+			msg = fmt.Sprintf("the HPA target's selector is invalid: %v", err)
+		}
+		c.recorder.Event(hpa, corev1.EventTypeWarning, "InvalidSelector", msg)
+		setCondition(status, autoscalingv2.ScalingActive, corev1.ConditionFalse, "InvalidSelector", msg)
+		return 0, "", nil, errors.New(msg)
+	}
+	list, err := c.kubeClient.CoreV1().Pods(d.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return 0, "", nil, err
+	}
+	pods := []*corev1.Pod{}
+	for i := range list.Items {
+		pods = append(pods, &list.Items[i])
+	}
+
+	statuses := make([]autoscalingv2.MetricStatus, len(hpa.Spec.Metrics))
+	var replicas int32
+	var metricName string
+	var invalid int
+	var invalidErr error
+	for i, spec := range hpa.Spec.Metrics {
+		proposed, name, metricStatus, err := c.computeReplicasForMetric(hpa, spec, pods, current)
+		if err != nil {
+			if invalidErr == nil {
+				invalidErr = err
+			}
+			invalid++
+			continue
+		}
+		statuses[i] = metricStatus
+		if replicas == 0 || proposed > replicas {
+			replicas, metricName = proposed, name
+		}
+	}
+	// the target is not scaled down without the value of all its metrics
+	if invalid == len(hpa.Spec.Metrics) || (invalid > 0 && replicas < current) {
+		err := fmt.Errorf("invalid metrics (%d invalid out of %d), first error is: %w", invalid, len(hpa.Spec.Metrics), invalidErr)
+		c.recorder.Event(hpa, corev1.EventTypeWarning, eventFailedComputeMetricsReplicas, err.Error())
+		setCondition(status, autoscalingv2.ScalingActive, corev1.ConditionFalse, "FailedGetResourceMetric",
+			fmt.Sprintf("the HPA was unable to compute the replica count: %v", invalidErr))
+		return 0, "", statuses, err
+	}
+	setCondition(status, autoscalingv2.ScalingActive, corev1.ConditionTrue, "ValidMetricFound",
+		fmt.Sprintf("the HPA was able to successfully calculate a replica count from %s", metricName))
+	return replicas, metricName, statuses, nil
+}
+
+// computeReplicasForMetric returns the replicas proposed by a metric of an autoscaler, with
+// the name and the current value of the metric. Only the resource metrics of the pods and
+// of their containers are sampled from podman.
+func (c *Controller) computeReplicasForMetric(hpa *autoscalingv2.HorizontalPodAutoscaler, spec autoscalingv2.MetricSpec,
+	pods []*corev1.Pod, current int32) (int32, string, autoscalingv2.MetricStatus, error) {
+	var name corev1.ResourceName
+	var container string
+	var target autoscalingv2.MetricTarget
+	switch {
+	case spec.Type == autoscalingv2.ResourceMetricSourceType && spec.Resource != nil:
+		name, target = spec.Resource.Name, spec.Resource.Target
+	case spec.Type == autoscalingv2.ContainerResourceMetricSourceType && spec.ContainerResource != nil:
+		name, target, container = spec.ContainerResource.Name, spec.ContainerResource.Target, spec.ContainerResource.Container
+	default:
+		err := fmt.Errorf("unsupported metric source type %q, only %s and %s metrics are sampled from podman",
+			spec.Type, autoscalingv2.ResourceMetricSourceType, autoscalingv2.ContainerResourceMetricSourceType)
+		c.recorder.Event(hpa, corev1.EventTypeWarning, eventFailedGetResourceMetric, err.Error())
+		return 0, "", autoscalingv2.MetricStatus{}, err
+	}
+
+	metricName := fmt.Sprintf("%s resource", name)
+	if container != "" {
+		metricName = fmt.Sprintf("%s container resource", name)
+	}
+	replicas, value, err := c.computeResourceReplicas(pods, name, container, target, current)
+	if err != nil {
+		c.recorder.Eventf(hpa, corev1.EventTypeWarning, eventFailedGetResourceMetric, "failed to get %s utilization: %v", name, err)
+		return 0, "", autoscalingv2.MetricStatus{}, err
+	}
+	metricStatus := autoscalingv2.MetricStatus{Type: spec.Type}
+	if container != "" {
+		metricStatus.ContainerResource = &autoscalingv2.ContainerResourceMetricStatus{Name: name, Container: container, Current: value}
+	} else {
+		metricStatus.Resource = &autoscalingv2.ResourceMetricStatus{Name: name, Current: value}
+	}
+	return replicas, metricName, metricStatus, nil
+}
+
+// computeResourceReplicas returns the replicas for the usage of a resource by the pods to
+// match a target, with the current value of the usage, as in the kube-controller-manager:
+// the usage of the ready pods is compared to the target, and the replicas are changed
+// only if the pods without usage and the CPU usage of the pods which are not ready do not
+// reverse the change
+func (c *Controller) computeResourceReplicas(pods []*corev1.Pod, name corev1.ResourceName, container string,
+	target autoscalingv2.MetricTarget, current int32) (int32, autoscalingv2.MetricValueStatus, error) {
+	if name != corev1.ResourceCPU && name != corev1.ResourceMemory {
+		return 0, autoscalingv2.MetricValueStatus{}, fmt.Errorf("resource %s is not supported, only %s and %s usage are sampled from podman",
+			name, corev1.ResourceCPU, corev1.ResourceMemory)
+	}
+	// the usage is compared to the requests of the pods, or to the target average value
+	targets := map[string]int64{}
+	switch {
+	case target.Type == autoscalingv2.UtilizationMetricType && target.AverageUtilization != nil:
+		for _, pod := range pods {
+			request, err := getPodRequest(pod, name, container)
+			if err != nil {
+				return 0, autoscalingv2.MetricValueStatus{}, err
+			}
+			targets[pod.Name] = request * int64(*target.AverageUtilization) / 100
+		}
+	case target.Type == autoscalingv2.AverageValueMetricType && target.AverageValue != nil:
+		for _, pod := range pods {
+			targets[pod.Name] = quantityValue(target.AverageValue, name)
+		}
+	default:
+		return 0, autoscalingv2.MetricValueStatus{}, fmt.Errorf("invalid %s target type %q", name, target.Type)
+	}
+
+	usage, err := c.getPodsUsage(pods, name, container)
+	if err != nil {
+		return 0, autoscalingv2.MetricValueStatus{}, err
+	}
+	ready, unready, missing := groupPods(pods, usage, name)
+	if len(ready) == 0 {
+		return 0, autoscalingv2.MetricValueStatus{}, errNoMetrics
+	}
+	ratio := usageRatio(usage, targets, ready)
+	value := metricValue(usage, targets, ready, name, target)
+
+	scaleUpWithUnready := len(unready) > 0 && ratio > 1.0
+	if !scaleUpWithUnready && len(missing) == 0 {
+		if math.Abs(1.0-ratio) <= tolerance {
+			return current, value, nil
+		}
+		return int32(math.Ceil(ratio * float64(len(ready)))), value, nil
+	}
+
+	// the pods without usage are assumed to use their target when scaling down and nothing
+	// when scaling up, the pods which are not ready to use nothing
+	counted := append([]string{}, ready...)
+	if len(missing) > 0 {
+		for _, pod := range missing {
+			if ratio < 1.0 {
+				usage[pod] = targets[pod]
+			} else {
+				usage[pod] = 0
+			}
+		}
+		counted = append(counted, missing...)
+	}
+	if scaleUpWithUnready {
+		for _, pod := range unready {
+			usage[pod] = 0
+		}
+		counted = append(counted, unready...)
+	}
+	newRatio := usageRatio(usage, targets, counted)
+	if math.Abs(1.0-newRatio) <= tolerance || (ratio < 1.0 && newRatio > 1.0) || (ratio > 1.0 && newRatio < 1.0) {
+		return current, value, nil
+	}
+	replicas := int32(math.Ceil(newRatio * float64(len(counted))))
+	if (newRatio < 1.0 && replicas > current) || (newRatio > 1.0 && replicas < current) {
+		return current, value, nil
+	}
+	return replicas, value, nil
+}
+
+// groupPods returns the names of the pods whose usage is counted, of the pods whose CPU
+// usage is not counted as they are not ready, and of the pods without usage. Pods which
+// are terminating or terminated are ignored.
+func groupPods(pods []*corev1.Pod, usage map[string]int64, name corev1.ResourceName) ([]string, []string, []string) {
+	ready, unready, missing := []string{}, []string{}, []string{}
+	for _, pod := range pods {
+		if !replicaset.IsPodActive(pod) {
+			continue
+		}
+		if pod.Status.Phase == corev1.PodPending {
+			unready = append(unready, pod.Name)
+			continue
+		}
+		if _, ok := usage[pod.Name]; !ok {
+			missing = append(missing, pod.Name)
+			continue
+		}
+		// the CPU usage of pods which are starting is not representative
+		if name == corev1.ResourceCPU && !replicaset.IsPodReady(pod) {
+			unready = append(unready, pod.Name)
+			continue
+		}
+		ready = append(ready, pod.Name)
+	}
+	return ready, unready, missing
+}
+
+// usageRatio returns the ratio of the usage of the given pods to their targets
+func usageRatio(usage, targets map[string]int64, pods []string) float64 {
+	var totalUsage, totalTarget int64
+	for _, pod := range pods {
+		totalUsage += usage[pod]
+		totalTarget += targets[pod]
+	}
+	if totalTarget == 0 {
+		return 0
+	}
+	return float64(totalUsage) / float64(totalTarget)
+}
+
+// metricValue returns the current value of a resource metric: the average usage of the
+// given pods, and their average utilization of their requests for utilization targets
+func metricValue(usage, targets map[string]int64, pods []string, name corev1.ResourceName, target autoscalingv2.MetricTarget) autoscalingv2.MetricValueStatus {
+	var total int64
+	for _, pod := range pods {
+		total += usage[pod]
+	}
+	average := total / int64(len(pods))
+	value := autoscalingv2.MetricValueStatus{}
+	if name == corev1.ResourceCPU {
+		value.AverageValue = resource.NewMilliQuantity(average, resource.DecimalSI)
+	} else {
+		value.AverageValue = resource.NewQuantity(average, resource.BinarySI)
+	}
+	if target.Type == autoscalingv2.UtilizationMetricType {
+		utilization := int32(usageRatio(usage, targets, pods) * float64(*target.AverageUtilization))
+		value.AverageUtilization = &utilization
+	}
+	return value
+}
+
+// getPodRequest returns the request of a resource by the app containers of a pod, or by
+// one of its containers, in millicores for CPU and bytes for memory
+func getPodRequest(pod *corev1.Pod, name corev1.ResourceName, container string) (int64, error) {
+	var request int64
+	for _, c := range pod.Spec.Containers {
+		if container != "" && c.Name != container {
+			continue
+		}
+		quantity, ok := c.Resources.Requests[name]
+		if !ok {
+			return 0, fmt.Errorf("missing request for %s in container %s of pod %s", name, c.Name, pod.Name)
+		}
+		request += quantityValue(&quantity, name)
+	}
+	if request == 0 {
+		return 0, fmt.Errorf("missing request for %s in pod %s", name, pod.Name)
+	}
+	return request, nil
+}
+
+func quantityValue(quantity *resource.Quantity, name corev1.ResourceName) int64 {
+	if name == corev1.ResourceCPU {
+		return quantity.MilliValue()
+	}
+	return quantity.Value()
+}
+
+// getPodsUsage returns the usage of a resource by the running pods, or by one of their
+// containers, in millicores for CPU and bytes for memory. Pods for which the usage of a
+// container is not known yet are omitted.
+func (c *Controller) getPodsUsage(pods []*corev1.Pod, name corev1.ResourceName, container string) (map[string]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	usage := map[string]int64{}
+	now := time.Now()
+	for _, pod := range pods {
+		if !replicaset.IsPodActive(pod) || pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		containers, err := podman.GetPodUsage(c.runtime, pod)
+		if err != nil {
+			return nil, err
+		}
+		var total int64
+		complete := true
+		for _, spec := range pod.Spec.Containers {
+			if container != "" && spec.Name != container {
+				continue
+			}
+			sample, ok := containers[spec.Name]
+			if !ok {
+				complete = false
+				break
+			}
+			if name == corev1.ResourceMemory {
+				total += int64(sample.MemoryBytes)
+				continue
+			}
+			rate, ok := c.cpuRate(sample)
+			if !ok {
+				complete = false
+				break
+			}
+			total += rate
+		}
+		if complete {
+			usage[pod.Name] = total
+		}
+	}
+	for id, sample := range c.cpuSamples {
+		if now.Sub(sample.usage.Timestamp) > cpuSampleExpiry {
+			delete(c.cpuSamples, id)
+		}
+	}
+	return usage, nil
+}
+
+// cpuSample is the last CPU usage sample of a container, with the CPU usage rate computed
+// from the sample before it
+type cpuSample struct {
+	usage   podman.ContainerUsage
+	rate    int64
+	hasRate bool
+}
+
+// cpuRate returns the CPU usage of a container in millicores, from the CPU time it
+// consumed since its previous sample. Samples are only kept at least cpuSampleWindow
+// apart, so that the rate is not computed over the short intervals between the syncs
+// triggered by the updates of the autoscalers: the last rate is returned in between.
+func (c *Controller) cpuRate(usage podman.ContainerUsage) (int64, bool) {
+	previous, ok := c.cpuSamples[usage.ContainerID]
+	if !ok || usage.CPUNano < previous.usage.CPUNano {
+		c.cpuSamples[usage.ContainerID] = cpuSample{usage: usage}
+		return 0, false
+	}
+	elapsed := usage.Timestamp.Sub(previous.usage.Timestamp)
+	if elapsed < cpuSampleWindow {
+		return previous.rate, previous.hasRate
+	}
+	rate := int64(float64(usage.CPUNano-previous.usage.CPUNano) * 1000 / float64(elapsed.Nanoseconds()))
+	c.cpuSamples[usage.ContainerID] = cpuSample{usage: usage, rate: rate, hasRate: true}
+	return rate, true
+}
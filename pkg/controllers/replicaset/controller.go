@@ -0,0 +1,194 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replicaset
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appsv1client "k8s.io/client-go/kubernetes/typed/apps/v1"
+	appsv1lister "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	"github.com/pdettori/cymba/pkg/controllers"
+)
+
+const resyncPeriod = 30 * time.Second
+const controllerName = "replicaset"
+
+// eventSource is the component of the events recorded on replica sets
+const eventSource = "replicaset-controller"
+
+// NewController returns a new Controller which handles replica sets
+func NewController(cfg *rest.Config, stopCh <-chan struct{}) *Controller {
+	client := appsv1client.NewForConfigOrDie(cfg)
+	kubeClient := kubernetes.NewForConfigOrDie(cfg)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	c := &Controller{
+		queue:      queue,
+		client:     client,
+		kubeClient: kubeClient,
+		stopCh:     stopCh,
+		recorder:   controllers.NewEventRecorder(kubeClient, eventSource, stopCh),
+	}
+
+	sif := informers.NewSharedInformerFactoryWithOptions(kubeClient, resyncPeriod)
+	sif.Apps().V1().ReplicaSets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue(obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+	})
+	// the replica set controlling a pod is synced when the pod changes
+	sif.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueueController(obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueueController(obj) },
+		DeleteFunc: func(obj interface{}) { c.enqueueController(obj) },
+	})
+	c.indexer = sif.Apps().V1().ReplicaSets().Informer().GetIndexer()
+	c.lister = sif.Apps().V1().ReplicaSets().Lister()
+	sif.WaitForCacheSync(stopCh)
+	sif.Start(stopCh)
+
+	return c
+}
+
+// Controller defines the struct for Controller
+type Controller struct {
+	queue      workqueue.RateLimitingInterface
+	client     appsv1client.AppsV1Interface
+	kubeClient kubernetes.Interface
+	stopCh     <-chan struct{}
+	indexer    cache.Indexer
+	lister     appsv1lister.ReplicaSetLister
+	recorder   record.EventRecorder
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *Controller) enqueueAfter(obj interface{}, duration time.Duration) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.queue.AddAfter(key, duration)
+}
+
+// enqueueController enqueues the replica set controlling a pod, or the replica sets
+// which may adopt an orphan pod
+func (c *Controller) enqueueController(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	if ref := metav1.GetControllerOf(pod); ref != nil {
+		if ref.Kind == controllerKind.Kind {
+			c.queue.Add(pod.Namespace + "/" + ref.Name)
+		}
+		return
+	}
+	if pod.DeletionTimestamp != nil {
+		return
+	}
+	rsList, err := c.lister.ReplicaSets(pod.Namespace).List(labels.Everything())
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, rs := range rsList {
+		selector, err := metav1.LabelSelectorAsSelector(rs.Spec.Selector)
+		if err == nil && !selector.Empty() && selector.Matches(labels.Set(pod.Labels)) {
+			c.enqueue(rs)
+		}
+	}
+}
+
+// Start starts the controller
+func (c *Controller) Start(numThreads int) {
+	defer c.queue.ShutDown()
+	for i := 0; i < numThreads; i++ {
+		go wait.Until(c.startWorker, time.Second, c.stopCh)
+	}
+	klog.Infof("Starting replica set controller workers")
+	<-c.stopCh
+	klog.Infof("Stopping replica set controller workers")
+}
+
+func (c *Controller) startWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	// Wait until there is a new item in the working queue
+	k, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	key := k.(string)
+
+	// No matter what, tell the queue we're done with this key, to unblock
+	// other workers.
+	defer c.queue.Done(key)
+
+	if err := c.process(key); err != nil {
+		runtime.HandleError(fmt.Errorf("%q controller failed to sync %q, err: %w", controllerName, key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) process(key string) error {
+	obj, exists, err := c.indexer.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		klog.Infof("Object with key %q was deleted", key)
+		return nil
+	}
+	current := obj.(*appsv1.ReplicaSet).DeepCopy()
+
+	// reconcile updates the replica set and its pods as it changes them
+	return c.reconcile(context.TODO(), current)
+}
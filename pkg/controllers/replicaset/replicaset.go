@@ -0,0 +1,376 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replicaset
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/pdettori/cymba/pkg/controllers"
+)
+
+// controllerKind is the kind of the controller of the pods
+var controllerKind = appsv1.SchemeGroupVersion.WithKind("ReplicaSet")
+
+const (
+	replicaSetFinalizer = "controller.replicaset.kcp.dev/finalizer"
+
+	// reasons of the events recorded on replica sets, as in the kube-controller-manager
+	eventSuccessfulCreate = "SuccessfulCreate"
+	eventSuccessfulDelete = "SuccessfulDelete"
+	eventFailedCreate     = "FailedCreate"
+	eventFailedDelete     = "FailedDelete"
+)
+
+func (c *Controller) reconcile(ctx context.Context, rs *appsv1.ReplicaSet) error {
+	klog.Infof("reconciling replica set %q", rs.Name)
+
+	pods, err := c.getPods(ctx, rs)
+	if err != nil {
+		return err
+	}
+
+	// the pods of a deleted replica set are deleted before its finalizer is removed
+	if rs.DeletionTimestamp.IsZero() {
+		if !controllers.ContainsString(rs.GetFinalizers(), replicaSetFinalizer) {
+			controllerutil.AddFinalizer(rs, replicaSetFinalizer)
+			updated, err := c.client.ReplicaSets(rs.Namespace).Update(ctx, rs, metav1.UpdateOptions{})
+			if err != nil {
+				return err
+			}
+			rs = updated
+		}
+	} else {
+		if controllers.ContainsString(rs.GetFinalizers(), replicaSetFinalizer) {
+			for _, pod := range pods {
+				err := c.kubeClient.CoreV1().Pods(rs.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+				if err != nil && !apierrors.IsNotFound(err) {
+					return err
+				}
+			}
+			controllerutil.RemoveFinalizer(rs, replicaSetFinalizer)
+			_, err := c.client.ReplicaSets(rs.Namespace).Update(ctx, rs, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	pods, manageErr := c.managePods(ctx, rs, pods)
+
+	status, next := calculateStatus(rs, pods, time.Now())
+	setReplicaFailure(&status, manageErr)
+	// pods ready but not yet available are checked again once their minReadySeconds elapsed
+	if next > 0 {
+		c.enqueueAfter(rs, next)
+	}
+	if equality.Semantic.DeepEqual(rs.Status, status) {
+		return manageErr
+	}
+	rs = rs.DeepCopy()
+	rs.Status = status
+	if _, err := c.client.ReplicaSets(rs.Namespace).UpdateStatus(ctx, rs, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	return manageErr
+}
+
+// managePods creates or deletes pods until a replica set has its desired replicas, and
+// returns its active pods, with the error of the pod which could not be created or deleted.
+// Terminating pods and pods which ran to completion or failed are not replicas, so failed
+// pods are replaced. The pods which terminated are deleted, as podman keeps their containers
+// and no pod garbage collector deletes them.
+func (c *Controller) managePods(ctx context.Context, rs *appsv1.ReplicaSet, pods []*corev1.Pod) ([]*corev1.Pod, error) {
+	var deleteErr error
+	active := []*corev1.Pod{}
+	for _, pod := range pods {
+		if IsPodActive(pod) {
+			active = append(active, pod)
+		} else if pod.DeletionTimestamp == nil && deleteErr == nil {
+			deleteErr = c.deletePod(ctx, rs, pod)
+		}
+	}
+	pods = active
+
+	diff := int(GetReplicas(rs)) - len(pods)
+	if diff > 0 {
+		klog.Infof("replica set %q needs %d more pods", rs.Name, diff)
+		for i := 0; i < diff; i++ {
+			pod, err := c.kubeClient.CoreV1().Pods(rs.Namespace).Create(ctx, newPod(rs), metav1.CreateOptions{})
+			if err != nil {
+				c.recorder.Eventf(rs, corev1.EventTypeWarning, eventFailedCreate, "Error creating: %v", err)
+				return pods, &manageError{reason: eventFailedCreate, err: err}
+			}
+			c.recorder.Eventf(rs, corev1.EventTypeNormal, eventSuccessfulCreate, "Created pod: %s", pod.Name)
+			pods = append(pods, pod)
+		}
+	} else if diff < 0 {
+		klog.Infof("replica set %q has %d pods in excess", rs.Name, -diff)
+		sortPodsToDelete(pods)
+		for i, pod := range pods[:-diff] {
+			if err := c.deletePod(ctx, rs, pod); err != nil {
+				return pods[i:], err
+			}
+		}
+		pods = pods[-diff:]
+	}
+	return pods, deleteErr
+}
+
+// deletePod deletes a pod of a replica set and records the deletion on the replica set
+func (c *Controller) deletePod(ctx context.Context, rs *appsv1.ReplicaSet, pod *corev1.Pod) error {
+	err := c.kubeClient.CoreV1().Pods(rs.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		c.recorder.Eventf(rs, corev1.EventTypeWarning, eventFailedDelete, "Error deleting: %v", err)
+		return &manageError{reason: eventFailedDelete, err: err}
+	}
+	c.recorder.Eventf(rs, corev1.EventTypeNormal, eventSuccessfulDelete, "Deleted pod: %s", pod.Name)
+	return nil
+}
+
+// manageError is an error creating or deleting the pods of a replica set, with the
+// reason of its ReplicaFailure condition
+type manageError struct {
+	reason string
+	err    error
+}
+
+func (e *manageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *manageError) Unwrap() error {
+	return e.err
+}
+
+// setReplicaFailure sets the ReplicaFailure condition of a replica set when its pods
+// could not be created or deleted, and removes it once they could
+func setReplicaFailure(status *appsv1.ReplicaSetStatus, err error) {
+	conditions := []appsv1.ReplicaSetCondition{}
+	var current *appsv1.ReplicaSetCondition
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == appsv1.ReplicaSetReplicaFailure {
+			current = &status.Conditions[i]
+			continue
+		}
+		conditions = append(conditions, status.Conditions[i])
+	}
+	manageErr, ok := err.(*manageError)
+	if !ok {
+		if current != nil {
+			status.Conditions = conditions
+		}
+		return
+	}
+	if current != nil && current.Reason == manageErr.reason && current.Message == manageErr.Error() {
+		return
+	}
+	status.Conditions = append(conditions, appsv1.ReplicaSetCondition{
+		Type:               appsv1.ReplicaSetReplicaFailure,
+		Status:             corev1.ConditionTrue,
+		LastTransitionTime: metav1.Now(),
+		Reason:             manageErr.reason,
+		Message:            manageErr.Error(),
+	})
+}
+
+// getPods returns the pods controlled by a replica set, adopting the orphan pods matching
+// its selector and releasing the pods which do not match it anymore
+func (c *Controller) getPods(ctx context.Context, rs *appsv1.ReplicaSet) ([]*corev1.Pod, error) {
+	selector, err := metav1.LabelSelectorAsSelector(rs.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []metav1.Object{}
+	for _, labelSelector := range []string{selector.String(), labels.Set{controllers.OwnedByLabel: rs.Name}.String()} {
+		list, err := c.kubeClient.CoreV1().Pods(rs.Namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			candidates = append(candidates, &list.Items[i])
+		}
+	}
+	claimed, err := controllers.ClaimObjects(rs, controllerKind, selector, candidates, func(obj metav1.Object) error {
+		pod := obj.(*corev1.Pod)
+		updated, err := c.kubeClient.CoreV1().Pods(pod.Namespace).Update(ctx, pod, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		*pod = *updated
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pods := []*corev1.Pod{}
+	for _, obj := range claimed {
+		pods = append(pods, obj.(*corev1.Pod))
+	}
+	return pods, nil
+}
+
+// newPod returns a new pod from the template of a replica set, controlled by the replica set
+func newPod(rs *appsv1.ReplicaSet) *corev1.Pod {
+	template := rs.Spec.Template.DeepCopy()
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName:    rs.Name + "-",
+			Namespace:       rs.Namespace,
+			Labels:          controllers.WithLabel(template.Labels, controllers.OwnedByLabel, rs.Name),
+			Annotations:     template.Annotations,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(rs, controllerKind)},
+		},
+		Spec: template.Spec,
+	}
+}
+
+// FilterActivePods returns the pods which are not terminating and did not terminate
+func FilterActivePods(pods []*corev1.Pod) []*corev1.Pod {
+	active := []*corev1.Pod{}
+	for _, pod := range pods {
+		if IsPodActive(pod) {
+			active = append(active, pod)
+		}
+	}
+	return active
+}
+
+// IsPodActive checks if a pod is not terminating and did not terminate
+func IsPodActive(pod *corev1.Pod) bool {
+	return pod.DeletionTimestamp == nil &&
+		pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed
+}
+
+// podPhaseRank ranks the phases of the pods to delete, lowest first
+var podPhaseRank = map[corev1.PodPhase]int{corev1.PodPending: 0, corev1.PodUnknown: 1, corev1.PodRunning: 2}
+
+// sortPodsToDelete sorts pods in the order they are deleted when scaling down, as in
+// the kube-controller-manager: unscheduled before scheduled, pending before running, not
+// ready before ready, ready for less time before ready for longer, with more restarts
+// before less restarts, and newer before older, so that the healthiest pods are kept
+func sortPodsToDelete(pods []*corev1.Pod) {
+	sort.SliceStable(pods, func(i, j int) bool {
+		p1, p2 := pods[i], pods[j]
+		if (p1.Spec.NodeName == "") != (p2.Spec.NodeName == "") {
+			return p1.Spec.NodeName == ""
+		}
+		if podPhaseRank[p1.Status.Phase] != podPhaseRank[p2.Status.Phase] {
+			return podPhaseRank[p1.Status.Phase] < podPhaseRank[p2.Status.Phase]
+		}
+		if IsPodReady(p1) != IsPodReady(p2) {
+			return !IsPodReady(p1)
+		}
+		if IsPodReady(p1) && IsPodReady(p2) {
+			t1, t2 := getPodReadyCondition(p1).LastTransitionTime, getPodReadyCondition(p2).LastTransitionTime
+			if !t1.Equal(&t2) {
+				return afterOrZero(t1, t2)
+			}
+		}
+		if r1, r2 := maxContainerRestarts(p1), maxContainerRestarts(p2); r1 != r2 {
+			return r1 > r2
+		}
+		if !p1.CreationTimestamp.Equal(&p2.CreationTimestamp) {
+			return afterOrZero(p1.CreationTimestamp, p2.CreationTimestamp)
+		}
+		return false
+	})
+}
+
+// afterOrZero checks if t1 is after t2, a zero time being after any time
+func afterOrZero(t1, t2 metav1.Time) bool {
+	if t1.IsZero() || t2.IsZero() {
+		return t1.IsZero()
+	}
+	return t1.After(t2.Time)
+}
+
+// maxContainerRestarts returns the highest restart count of the containers of a pod
+func maxContainerRestarts(pod *corev1.Pod) int32 {
+	var max int32
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.RestartCount > max {
+			max = cs.RestartCount
+		}
+	}
+	return max
+}
+
+// calculateStatus returns the status of a replica set with the given pods, and the time
+// after which a ready pod becomes available, or zero if there is none
+func calculateStatus(rs *appsv1.ReplicaSet, pods []*corev1.Pod, now time.Time) (appsv1.ReplicaSetStatus, time.Duration) {
+	status := appsv1.ReplicaSetStatus{
+		Replicas:           int32(len(pods)),
+		ObservedGeneration: rs.Generation,
+		Conditions:         rs.Status.DeepCopy().Conditions,
+	}
+	templateLabels := labels.Set(rs.Spec.Template.Labels).AsSelectorPreValidated()
+	minReadySeconds := time.Duration(rs.Spec.MinReadySeconds) * time.Second
+	var next time.Duration
+	for _, pod := range pods {
+		if templateLabels.Matches(labels.Set(pod.Labels)) {
+			status.FullyLabeledReplicas++
+		}
+		ready := getPodReadyCondition(pod)
+		if ready == nil || ready.Status != corev1.ConditionTrue {
+			continue
+		}
+		status.ReadyReplicas++
+		if remaining := ready.LastTransitionTime.Add(minReadySeconds).Sub(now); minReadySeconds > 0 && remaining > 0 {
+			if next == 0 || remaining < next {
+				next = remaining
+			}
+			continue
+		}
+		status.AvailableReplicas++
+	}
+	return status, next
+}
+
+// GetReplicas returns the desired replicas of a replica set, which default to 1
+func GetReplicas(rs *appsv1.ReplicaSet) int32 {
+	if rs.Spec.Replicas == nil {
+		return 1
+	}
+	return *rs.Spec.Replicas
+}
+
+// IsPodReady checks if a pod is ready
+func IsPodReady(pod *corev1.Pod) bool {
+	ready := getPodReadyCondition(pod)
+	return ready != nil && ready.Status == corev1.ConditionTrue
+}
+
+func getPodReadyCondition(pod *corev1.Pod) *corev1.PodCondition {
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == corev1.PodReady {
+			return &pod.Status.Conditions[i]
+		}
+	}
+	return nil
+}
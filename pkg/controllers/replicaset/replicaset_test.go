@@ -0,0 +1,263 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replicaset
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/pdettori/cymba/pkg/controllers"
+	"github.com/pdettori/cymba/pkg/controllers/testutil"
+)
+
+func newTestReplicaSet(replicas int32) *appsv1.ReplicaSet {
+	labels := map[string]string{"app": "web"}
+	return &appsv1.ReplicaSet{
+		ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default", UID: "0a1b2c3d"},
+		Spec: appsv1.ReplicaSetSpec{
+			Replicas: &replicas,
+			Selector: &v1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{Labels: labels},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: "nginx"}}},
+			},
+		},
+	}
+}
+
+func newTestController(objects ...runtime.Object) *Controller {
+	kubeClient := testutil.NewClientset(objects...)
+	return &Controller{
+		queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		client:     kubeClient.AppsV1(),
+		kubeClient: kubeClient,
+		recorder:   record.NewFakeRecorder(100),
+	}
+}
+
+// reconcileReplicaSet reconciles the current version of a replica set
+func reconcileReplicaSet(t *testing.T, c *Controller) *appsv1.ReplicaSet {
+	ctx := context.TODO()
+	rs, err := c.client.ReplicaSets("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, c.reconcile(ctx, rs))
+	rs, err = c.client.ReplicaSets("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	return rs
+}
+
+func TestReconcileScalesPods(t *testing.T) {
+	c := newTestController(newTestReplicaSet(3))
+
+	rs := reconcileReplicaSet(t, c)
+	assert.Contains(t, rs.Finalizers, replicaSetFinalizer)
+	assert.Equal(t, int32(3), rs.Status.Replicas)
+	assert.Equal(t, int32(3), rs.Status.FullyLabeledReplicas)
+	assert.Equal(t, int32(0), rs.Status.ReadyReplicas)
+	pods, err := c.getPods(context.TODO(), rs)
+	assert.NoError(t, err)
+	assert.Len(t, pods, 3)
+	for _, pod := range pods {
+		assert.Equal(t, "web", pod.Labels["app"])
+		assert.Equal(t, "web", pod.Labels[controllers.OwnedByLabel])
+		assert.True(t, v1.IsControlledBy(pod, rs))
+		assert.Equal(t, "nginx", pod.Spec.Containers[0].Image)
+	}
+	events := c.recorder.(*record.FakeRecorder).Events
+	assert.Equal(t, "Normal SuccessfulCreate Created pod: web-00001", <-events)
+
+	// pods controlled by other objects are ignored
+	other := newPod(newTestReplicaSet(1))
+	other.Name, other.OwnerReferences[0].UID = "other", "4e5f6a7b"
+	_, err = c.kubeClient.CoreV1().Pods("default").Create(context.TODO(), other, v1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// pods which are not ready are deleted first when scaling down
+	testutil.SetPodsReady(t, c.kubeClient, time.Now(), "web-00001", "web-00003")
+	replicas := int32(2)
+	rs.Spec.Replicas = &replicas
+	_, err = c.client.ReplicaSets("default").Update(context.TODO(), rs, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	rs = reconcileReplicaSet(t, c)
+	assert.ElementsMatch(t, []string{"other", "web-00001", "web-00003"}, testutil.ListPodNames(t, c.kubeClient))
+	assert.Equal(t, int32(2), rs.Status.Replicas)
+	assert.Equal(t, int32(2), rs.Status.ReadyReplicas)
+	assert.Equal(t, int32(2), rs.Status.AvailableReplicas)
+
+	// the pods are deleted with the replica set
+	now := v1.Now()
+	rs.DeletionTimestamp = &now
+	_, err = c.client.ReplicaSets("default").Update(context.TODO(), rs, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	rs = reconcileReplicaSet(t, c)
+	assert.NotContains(t, rs.Finalizers, replicaSetFinalizer)
+	assert.Equal(t, []string{"other"}, testutil.ListPodNames(t, c.kubeClient))
+}
+
+func TestCalculateStatus(t *testing.T) {
+	now := time.Now()
+	rs := newTestReplicaSet(3)
+	rs.Generation = 2
+	rs.Spec.MinReadySeconds = 10
+	pods := []*corev1.Pod{newPod(rs), newPod(rs), newPod(rs)}
+	pods[0].Status.Conditions = []corev1.PodCondition{
+		{Type: corev1.PodReady, Status: corev1.ConditionTrue, LastTransitionTime: v1.NewTime(now.Add(-time.Minute))},
+	}
+	pods[1].Status.Conditions = []corev1.PodCondition{
+		{Type: corev1.PodReady, Status: corev1.ConditionTrue, LastTransitionTime: v1.NewTime(now.Add(-4 * time.Second))},
+	}
+	pods[2].Labels = map[string]string{"app": "web", "track": "canary"}
+	rs.Spec.Template.Labels = map[string]string{"app": "web", "track": "stable"}
+
+	status, next := calculateStatus(rs, pods, now)
+	assert.Equal(t, appsv1.ReplicaSetStatus{
+		Replicas:             3,
+		FullyLabeledReplicas: 0,
+		ReadyReplicas:        2,
+		AvailableReplicas:    1,
+		ObservedGeneration:   2,
+	}, status)
+	// the second pod becomes available after its minReadySeconds
+	assert.Equal(t, 6*time.Second, next)
+}
+
+func TestAdoptAndReleasePods(t *testing.T) {
+	orphan := &corev1.Pod{ObjectMeta: v1.ObjectMeta{
+		Name: "orphan", Namespace: "default", UID: "orphan",
+		Labels:      map[string]string{"app": "web"},
+		Annotations: map[string]string{"note": "kept"},
+	}}
+	c := newTestController(newTestReplicaSet(1), orphan)
+
+	// a matching orphan pod is adopted instead of creating a new pod
+	rs := reconcileReplicaSet(t, c)
+	assert.Equal(t, []string{"orphan"}, testutil.ListPodNames(t, c.kubeClient))
+	pod, err := c.kubeClient.CoreV1().Pods("default").Get(context.TODO(), "orphan", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, v1.IsControlledBy(pod, rs))
+	assert.Equal(t, "web", pod.Labels[controllers.OwnedByLabel])
+	assert.Equal(t, "kept", pod.Annotations["note"])
+
+	// a pod relabeled out of the selector is released and replaced
+	pod.Labels["app"] = "debug"
+	_, err = c.kubeClient.CoreV1().Pods("default").Update(context.TODO(), pod, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	reconcileReplicaSet(t, c)
+	assert.ElementsMatch(t, []string{"orphan", "web-00001"}, testutil.ListPodNames(t, c.kubeClient))
+	pod, err = c.kubeClient.CoreV1().Pods("default").Get(context.TODO(), "orphan", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, v1.GetControllerOf(pod))
+	assert.NotContains(t, pod.Labels, controllers.OwnedByLabel)
+}
+
+func TestReplaceInactivePods(t *testing.T) {
+	c := newTestController(newTestReplicaSet(2))
+	reconcileReplicaSet(t, c)
+
+	// failed and terminating pods are not counted as replicas and are replaced
+	ctx := context.TODO()
+	pod, err := c.kubeClient.CoreV1().Pods("default").Get(ctx, "web-00001", v1.GetOptions{})
+	assert.NoError(t, err)
+	pod.Status.Phase = corev1.PodFailed
+	_, err = c.kubeClient.CoreV1().Pods("default").UpdateStatus(ctx, pod, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	pod, err = c.kubeClient.CoreV1().Pods("default").Get(ctx, "web-00002", v1.GetOptions{})
+	assert.NoError(t, err)
+	now := v1.Now()
+	pod.DeletionTimestamp = &now
+	_, err = c.kubeClient.CoreV1().Pods("default").Update(ctx, pod, v1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	// the failed pod is deleted by the sync which replaces it
+	rs := reconcileReplicaSet(t, c)
+	assert.ElementsMatch(t, []string{"web-00002", "web-00003", "web-00004"}, testutil.ListPodNames(t, c.kubeClient))
+	assert.Equal(t, int32(2), rs.Status.Replicas)
+}
+
+func TestSortPodsToDelete(t *testing.T) {
+	now := time.Now()
+	newTestPod := func(name, nodeName string, phase corev1.PodPhase, readySince time.Time, restarts int32, created time.Time) *corev1.Pod {
+		pod := &corev1.Pod{
+			ObjectMeta: v1.ObjectMeta{Name: name, CreationTimestamp: v1.NewTime(created)},
+			Spec:       corev1.PodSpec{NodeName: nodeName},
+			Status: corev1.PodStatus{
+				Phase:             phase,
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "nginx", RestartCount: restarts}},
+			},
+		}
+		if !readySince.IsZero() {
+			pod.Status.Conditions = []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: corev1.ConditionTrue, LastTransitionTime: v1.NewTime(readySince)},
+			}
+		}
+		return pod
+	}
+	pods := []*corev1.Pod{
+		newTestPod("oldest", "host", corev1.PodRunning, now.Add(-time.Hour), 0, now.Add(-2*time.Hour)),
+		newTestPod("older", "host", corev1.PodRunning, now.Add(-time.Hour), 0, now.Add(-time.Hour)),
+		newTestPod("restarted", "host", corev1.PodRunning, now.Add(-time.Hour), 3, now.Add(-2*time.Hour)),
+		newTestPod("recently-ready", "host", corev1.PodRunning, now.Add(-time.Minute), 0, now.Add(-2*time.Hour)),
+		newTestPod("not-ready", "host", corev1.PodRunning, time.Time{}, 0, now.Add(-2*time.Hour)),
+		newTestPod("pending", "host", corev1.PodPending, time.Time{}, 0, now.Add(-2*time.Hour)),
+		newTestPod("unscheduled", "", corev1.PodPending, time.Time{}, 0, now.Add(-2*time.Hour)),
+	}
+	sortPodsToDelete(pods)
+	names := []string{}
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	assert.Equal(t, []string{"unscheduled", "pending", "not-ready", "recently-ready", "restarted", "older", "oldest"}, names)
+}
+
+func TestReplicaFailure(t *testing.T) {
+	c := newTestController(newTestReplicaSet(1))
+	c.kubeClient.(*fake.Clientset).PrependReactor("create", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("exceeded quota")
+	})
+
+	// the pods which cannot be created are reported by a condition
+	ctx := context.TODO()
+	rs, err := c.client.ReplicaSets("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.EqualError(t, c.reconcile(ctx, rs), "exceeded quota")
+	rs, err = c.client.ReplicaSets("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, rs.Status.Conditions, 1) {
+		assert.Equal(t, appsv1.ReplicaSetReplicaFailure, rs.Status.Conditions[0].Type)
+		assert.Equal(t, corev1.ConditionTrue, rs.Status.Conditions[0].Status)
+		assert.Equal(t, "FailedCreate", rs.Status.Conditions[0].Reason)
+		assert.Equal(t, "exceeded quota", rs.Status.Conditions[0].Message)
+	}
+
+	// the condition is removed once the pods are created
+	c.kubeClient.(*fake.Clientset).ReactionChain = c.kubeClient.(*fake.Clientset).ReactionChain[1:]
+	rs = reconcileReplicaSet(t, c)
+	assert.Empty(t, rs.Status.Conditions)
+	assert.Equal(t, int32(1), rs.Status.Replicas)
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statefulset
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/pdettori/cymba/pkg/controllers"
+)
+
+// getPods returns the pods controlled by a stateful set, adopting the orphan pods
+// matching its selector and releasing the pods which do not match it anymore
+func (c *Controller) getPods(ctx context.Context, set *appsv1.StatefulSet) ([]*corev1.Pod, error) {
+	selector, err := metav1.LabelSelectorAsSelector(set.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []metav1.Object{}
+	for _, labelSelector := range []string{selector.String(), labels.Set{controllers.OwnedByLabel: set.Name}.String()} {
+		list, err := c.kubeClient.CoreV1().Pods(set.Namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			candidates = append(candidates, &list.Items[i])
+		}
+	}
+	claimed, err := controllers.ClaimObjects(set, controllerKind, selector, candidates, func(obj metav1.Object) error {
+		pod := obj.(*corev1.Pod)
+		updated, err := c.kubeClient.CoreV1().Pods(pod.Namespace).Update(ctx, pod, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		*pod = *updated
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pods := []*corev1.Pod{}
+	for _, obj := range claimed {
+		pods = append(pods, obj.(*corev1.Pod))
+	}
+	return pods, nil
+}
+
+// newPod returns the pod of a stateful set with an ordinal, from a pod template of one of
+// its revisions. The pod has a stable name and hostname, and is in the subdomain of the
+// governing service of the stateful set, so that it is resolved by the other pods.
+func newPod(set *appsv1.StatefulSet, template *corev1.PodTemplateSpec, revision string, ordinal int) *corev1.Pod {
+	template = template.DeepCopy()
+	name := getPodName(set, ordinal)
+	podLabels := controllers.WithLabel(template.Labels, controllers.OwnedByLabel, set.Name)
+	podLabels[appsv1.StatefulSetPodNameLabel] = name
+	podLabels[appsv1.StatefulSetRevisionLabel] = revision
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       set.Namespace,
+			Labels:          podLabels,
+			Annotations:     template.Annotations,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(set, controllerKind)},
+		},
+		Spec: template.Spec,
+	}
+	pod.Spec.Hostname = name
+	pod.Spec.Subdomain = set.Spec.ServiceName
+
+	// the volumes of the claim templates replace the volumes of the pod with their name
+	volumes := []corev1.Volume{}
+	for _, claim := range newClaims(set, pod) {
+		volumes = append(volumes, corev1.Volume{
+			Name: claim.Annotations[claimTemplateAnnotation],
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim.Name},
+			},
+		})
+	}
+	for _, volume := range pod.Spec.Volumes {
+		if !hasClaimTemplate(set, volume.Name) {
+			volumes = append(volumes, volume)
+		}
+	}
+	if len(volumes) > 0 {
+		pod.Spec.Volumes = volumes
+	}
+	return pod
+}
+
+// claimTemplateAnnotation is the name of the volume claim template of the claims of the
+// pods of a stateful set
+const claimTemplateAnnotation = "statefulset.kcp.dev/volume-claim-template"
+
+// newClaims returns the claims of a pod of a stateful set, from its volume claim templates.
+// The claims are named after the template and the pod, as in the kube-controller-manager,
+// so that a pod created again with the same ordinal uses the same volumes. They are not
+// controlled by the stateful set, and are kept when it is scaled down or deleted.
+func newClaims(set *appsv1.StatefulSet, pod *corev1.Pod) []*corev1.PersistentVolumeClaim {
+	claims := []*corev1.PersistentVolumeClaim{}
+	for _, template := range set.Spec.VolumeClaimTemplates {
+		claim := template.DeepCopy()
+		claim.ObjectMeta = metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%s-%s", template.Name, pod.Name),
+			Namespace:   set.Namespace,
+			Labels:      map[string]string{},
+			Annotations: controllers.WithAnnotation(template.Annotations, claimTemplateAnnotation, template.Name),
+		}
+		for k, v := range template.Labels {
+			claim.Labels[k] = v
+		}
+		if set.Spec.Selector != nil {
+			for k, v := range set.Spec.Selector.MatchLabels {
+				claim.Labels[k] = v
+			}
+		}
+		claim.Status = corev1.PersistentVolumeClaimStatus{}
+		claims = append(claims, claim)
+	}
+	return claims
+}
+
+func hasClaimTemplate(set *appsv1.StatefulSet, name string) bool {
+	for _, template := range set.Spec.VolumeClaimTemplates {
+		if template.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// getPodName returns the name of the pod of a stateful set with an ordinal
+func getPodName(set *appsv1.StatefulSet, ordinal int) string {
+	return fmt.Sprintf("%s-%d", set.Name, ordinal)
+}
+
+// getOrdinal returns the ordinal of a pod of a stateful set, or -1 if its name is not the
+// name of a pod of the stateful set
+func getOrdinal(set *appsv1.StatefulSet, pod *corev1.Pod) int {
+	suffix := strings.TrimPrefix(pod.Name, set.Name+"-")
+	if suffix == pod.Name {
+		return -1
+	}
+	ordinal, err := strconv.Atoi(suffix)
+	if err != nil || ordinal < 0 || getPodName(set, ordinal) != pod.Name {
+		return -1
+	}
+	return ordinal
+}
+
+// sortByOrdinal sorts the pods of a stateful set by increasing ordinal
+func sortByOrdinal(set *appsv1.StatefulSet, pods []*corev1.Pod) {
+	sort.SliceStable(pods, func(i, j int) bool {
+		return getOrdinal(set, pods[i]) < getOrdinal(set, pods[j])
+	})
+}
+
+// getPodRevision returns the name of the controller revision a pod was created from
+func getPodRevision(pod *corev1.Pod) string {
+	return pod.Labels[appsv1.StatefulSetRevisionLabel]
+}
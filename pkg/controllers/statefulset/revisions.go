@@ -0,0 +1,254 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statefulset
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/rand"
+	hashutil "k8s.io/kubernetes/pkg/util/hash"
+
+	"github.com/pdettori/cymba/pkg/controllers"
+)
+
+// defaultRevisionHistoryLimit is the number of old revisions of a stateful set which are
+// kept by default
+const defaultRevisionHistoryLimit = 10
+
+// revisionPatch is the data of a controller revision: a strategic merge patch replacing
+// the pod template of a stateful set, as in the kube-controller-manager, which kubectl
+// rollout undo applies to the stateful set
+type revisionPatch struct {
+	Spec revisionPatchSpec `json:"spec"`
+}
+
+type revisionPatchSpec struct {
+	Template revisionTemplate `json:"template"`
+}
+
+type revisionTemplate struct {
+	corev1.PodTemplateSpec `json:",inline"`
+	Patch                  string `json:"$patch,omitempty"`
+}
+
+// getRevisions returns the controller revisions of a stateful set, oldest first, adopting
+// the orphan revisions matching its selector and releasing the revisions which do not
+// match it anymore
+func (c *Controller) getRevisions(ctx context.Context, set *appsv1.StatefulSet) ([]*appsv1.ControllerRevision, error) {
+	selector, err := metav1.LabelSelectorAsSelector(set.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	candidates := []metav1.Object{}
+	for _, labelSelector := range []string{selector.String(), labels.Set{controllers.OwnedByLabel: set.Name}.String()} {
+		list, err := c.client.ControllerRevisions(set.Namespace).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+		if err != nil {
+			return nil, err
+		}
+		for i := range list.Items {
+			candidates = append(candidates, &list.Items[i])
+		}
+	}
+	claimed, err := controllers.ClaimObjects(set, controllerKind, selector, candidates, func(obj metav1.Object) error {
+		revision := obj.(*appsv1.ControllerRevision)
+		updated, err := c.client.ControllerRevisions(revision.Namespace).Update(ctx, revision, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		*revision = *updated
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	revisions := []*appsv1.ControllerRevision{}
+	for _, obj := range claimed {
+		revisions = append(revisions, obj.(*appsv1.ControllerRevision))
+	}
+	sortRevisions(revisions)
+	return revisions, nil
+}
+
+// sortRevisions sorts controller revisions by revision number, oldest first
+func sortRevisions(revisions []*appsv1.ControllerRevision) {
+	sort.SliceStable(revisions, func(i, j int) bool {
+		if revisions[i].Revision != revisions[j].Revision {
+			return revisions[i].Revision < revisions[j].Revision
+		}
+		return revisions[i].Name < revisions[j].Name
+	})
+}
+
+// syncRevisions returns the current revision of a stateful set, which its pods below the
+// partition are created from, and its update revision, with its current pod template.
+// The update revision is created when the template changed, or becomes the latest
+// revision when the template was rolled back to it. The collision count of the status is
+// incremented when the name of a new revision is taken.
+func (c *Controller) syncRevisions(ctx context.Context, set *appsv1.StatefulSet, revisions []*appsv1.ControllerRevision,
+	status *appsv1.StatefulSetStatus) (*appsv1.ControllerRevision, *appsv1.ControllerRevision, error) {
+	var collisionCount int32
+	if status.CollisionCount != nil {
+		collisionCount = *status.CollisionCount
+	}
+	var latest int64
+	for _, revision := range revisions {
+		if revision.Revision > latest {
+			latest = revision.Revision
+		}
+	}
+
+	// templates are compared serialized, as they are stored in the revisions
+	want, err := json.Marshal(set.Spec.Template)
+	if err != nil {
+		return nil, nil, err
+	}
+	var updateRevision *appsv1.ControllerRevision
+	for i := len(revisions) - 1; i >= 0; i-- {
+		template, err := getRevisionTemplate(revisions[i])
+		if err != nil {
+			continue
+		}
+		if got, err := json.Marshal(template); err == nil && bytes.Equal(got, want) {
+			updateRevision = revisions[i]
+			break
+		}
+	}
+	switch {
+	case updateRevision == nil:
+		for {
+			revision, err := newRevision(set, latest+1, collisionCount)
+			if err != nil {
+				return nil, nil, err
+			}
+			created, err := c.client.ControllerRevisions(set.Namespace).Create(ctx, revision, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				collisionCount++
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			updateRevision = created
+			break
+		}
+	case updateRevision.Revision != latest:
+		// the template was rolled back to a previous revision, which becomes the latest
+		updateRevision = updateRevision.DeepCopy()
+		updateRevision.Revision = latest + 1
+		updated, err := c.client.ControllerRevisions(set.Namespace).Update(ctx, updateRevision, metav1.UpdateOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+		updateRevision = updated
+	}
+	if collisionCount != 0 {
+		status.CollisionCount = &collisionCount
+	}
+
+	currentRevision := updateRevision
+	for _, revision := range revisions {
+		if revision.Name == set.Status.CurrentRevision {
+			currentRevision = revision
+			break
+		}
+	}
+	return currentRevision, updateRevision, nil
+}
+
+// newRevision returns a new controller revision of a stateful set with its pod template
+func newRevision(set *appsv1.StatefulSet, number int64, collisionCount int32) (*appsv1.ControllerRevision, error) {
+	data, err := json.Marshal(revisionPatch{Spec: revisionPatchSpec{
+		Template: revisionTemplate{PodTemplateSpec: set.Spec.Template, Patch: "replace"},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	return &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf("%s-%s", set.Name, computeHash(&set.Spec.Template, collisionCount)),
+			Namespace:       set.Namespace,
+			Labels:          controllers.WithLabel(set.Spec.Template.Labels, controllers.OwnedByLabel, set.Name),
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(set, controllerKind)},
+		},
+		Data:     runtime.RawExtension{Raw: data},
+		Revision: number,
+	}, nil
+}
+
+// getRevisionTemplate returns the pod template of a controller revision
+func getRevisionTemplate(revision *appsv1.ControllerRevision) (*corev1.PodTemplateSpec, error) {
+	patch := revisionPatch{}
+	if err := json.Unmarshal(revision.Data.Raw, &patch); err != nil {
+		return nil, fmt.Errorf("invalid data of controller revision %s: %w", revision.Name, err)
+	}
+	return &patch.Spec.Template.PodTemplateSpec, nil
+}
+
+// computeHash returns the hash of a pod template, which names its controller revision.
+// The collision count changes the hash when another revision has the same name.
+func computeHash(template *corev1.PodTemplateSpec, collisionCount int32) string {
+	hasher := fnv.New32a()
+	hashutil.DeepHashObject(hasher, *template)
+	if collisionCount != 0 {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint32(b, uint32(collisionCount))
+		hasher.Write(b)
+	}
+	return rand.SafeEncodeString(fmt.Sprint(hasher.Sum32()))
+}
+
+// truncateHistory deletes the oldest revisions of a stateful set beyond its revision
+// history limit, keeping the current and update revisions and the revisions of its pods
+func (c *Controller) truncateHistory(ctx context.Context, set *appsv1.StatefulSet, revisions []*appsv1.ControllerRevision,
+	pods []*corev1.Pod, current, update *appsv1.ControllerRevision) error {
+	live := map[string]bool{current.Name: true, update.Name: true}
+	for _, pod := range pods {
+		live[getPodRevision(pod)] = true
+	}
+	history := []*appsv1.ControllerRevision{}
+	for _, revision := range revisions {
+		if !live[revision.Name] {
+			history = append(history, revision)
+		}
+	}
+	limit := defaultRevisionHistoryLimit
+	if set.Spec.RevisionHistoryLimit != nil {
+		limit = int(*set.Spec.RevisionHistoryLimit)
+	}
+	if len(history) <= limit {
+		return nil
+	}
+	for _, revision := range history[:len(history)-limit] {
+		err := c.client.ControllerRevisions(set.Namespace).Delete(ctx, revision.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,411 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statefulset
+
+import (
+	"context"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/pdettori/cymba/pkg/controllers"
+	"github.com/pdettori/cymba/pkg/controllers/replicaset"
+)
+
+// controllerKind is the kind of the controller of the pods
+var controllerKind = appsv1.SchemeGroupVersion.WithKind("StatefulSet")
+
+const (
+	statefulSetFinalizer = "controller.statefulset.kcp.dev/finalizer"
+
+	// reasons of the events recorded on stateful sets, as in the kube-controller-manager
+	eventSuccessfulCreate = "SuccessfulCreate"
+	eventSuccessfulDelete = "SuccessfulDelete"
+	eventFailedCreate     = "FailedCreate"
+	eventFailedDelete     = "FailedDelete"
+)
+
+func (c *Controller) reconcile(ctx context.Context, set *appsv1.StatefulSet) error {
+	klog.Infof("reconciling stateful set %q", set.Name)
+
+	pods, err := c.getPods(ctx, set)
+	if err != nil {
+		return err
+	}
+
+	// the pods and revisions of a deleted stateful set are deleted before its finalizer is
+	// removed, its claims are kept for the volumes of its pods to be reused
+	if set.DeletionTimestamp.IsZero() {
+		if !controllers.ContainsString(set.GetFinalizers(), statefulSetFinalizer) {
+			controllerutil.AddFinalizer(set, statefulSetFinalizer)
+			updated, err := c.client.StatefulSets(set.Namespace).Update(ctx, set, metav1.UpdateOptions{})
+			if err != nil {
+				return err
+			}
+			set = updated
+		}
+	} else {
+		if controllers.ContainsString(set.GetFinalizers(), statefulSetFinalizer) {
+			for _, pod := range pods {
+				err := c.kubeClient.CoreV1().Pods(set.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+				if err != nil && !apierrors.IsNotFound(err) {
+					return err
+				}
+			}
+			revisions, err := c.getRevisions(ctx, set)
+			if err != nil {
+				return err
+			}
+			for _, revision := range revisions {
+				err := c.client.ControllerRevisions(set.Namespace).Delete(ctx, revision.Name, metav1.DeleteOptions{})
+				if err != nil && !apierrors.IsNotFound(err) {
+					return err
+				}
+			}
+			controllerutil.RemoveFinalizer(set, statefulSetFinalizer)
+			_, err = c.client.StatefulSets(set.Namespace).Update(ctx, set, metav1.UpdateOptions{})
+			if err != nil && !apierrors.IsConflict(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	revisions, err := c.getRevisions(ctx, set)
+	if err != nil {
+		return err
+	}
+	status := appsv1.StatefulSetStatus{
+		ObservedGeneration: set.Generation,
+		CollisionCount:     set.Status.CollisionCount,
+		Conditions:         set.Status.DeepCopy().Conditions,
+	}
+	currentRevision, updateRevision, err := c.syncRevisions(ctx, set, revisions, &status)
+	if err != nil {
+		return err
+	}
+	currentTemplate, err := getRevisionTemplate(currentRevision)
+	if err != nil {
+		return err
+	}
+
+	pods, manageErr := c.managePods(ctx, set, pods, currentTemplate, currentRevision.Name, updateRevision.Name)
+
+	next := calculateStatus(set, pods, currentRevision.Name, updateRevision.Name, &status, time.Now())
+	// pods ready but not yet available are checked again once their minReadySeconds elapsed
+	if next > 0 {
+		c.enqueueAfter(set, next)
+	}
+	if err := c.truncateHistory(ctx, set, append(revisions, updateRevision), pods, currentRevision, updateRevision); err != nil {
+		return err
+	}
+	if equality.Semantic.DeepEqual(set.Status, status) {
+		return manageErr
+	}
+	set = set.DeepCopy()
+	set.Status = status
+	if _, err := c.client.StatefulSets(set.Namespace).UpdateStatus(ctx, set, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	return manageErr
+}
+
+// managePods creates, deletes and updates the pods of a stateful set until it has its
+// desired replicas from its update revision, and returns its pods. With the OrderedReady
+// pod management policy, pods are created in increasing ordinal order and deleted in
+// decreasing ordinal order, one at a time once the other pods are running and ready; with
+// the Parallel policy, they are all created or deleted at once. Rolling updates delete one
+// pod at a time in decreasing ordinal order down to the partition, and the deleted pods
+// are created again from the update revision.
+func (c *Controller) managePods(ctx context.Context, set *appsv1.StatefulSet, pods []*corev1.Pod,
+	currentTemplate *corev1.PodTemplateSpec, currentRevision, updateRevision string) ([]*corev1.Pod, error) {
+	replicaCount := int(getReplicas(set))
+	monotonic := set.Spec.PodManagementPolicy != appsv1.ParallelPodManagement
+
+	// pods are split into the replicas, by ordinal, and the condemned pods beyond them
+	replicas := make([]*corev1.Pod, replicaCount)
+	condemned := []*corev1.Pod{}
+	for _, pod := range pods {
+		ordinal := getOrdinal(set, pod)
+		switch {
+		case ordinal < 0:
+			continue
+		case ordinal < replicaCount:
+			replicas[ordinal] = pod
+		default:
+			condemned = append(condemned, pod)
+		}
+	}
+	sortByOrdinal(set, condemned)
+	result := func() []*corev1.Pod {
+		all := append([]*corev1.Pod{}, condemned...)
+		for _, pod := range replicas {
+			if pod != nil {
+				all = append(all, pod)
+			}
+		}
+		return all
+	}
+
+	for ordinal := range replicas {
+		pod := replicas[ordinal]
+		if pod != nil && isTerminated(pod) {
+			// terminated pods are deleted and created again in the same pass, as in the
+			// kube-controller-manager
+			if err := c.deletePod(ctx, set, pod); err != nil {
+				return result(), err
+			}
+			replicas[ordinal], pod = nil, nil
+		}
+		switch {
+		case pod == nil:
+			template, revision := currentTemplate, currentRevision
+			if !isCurrentOrdinal(set, ordinal) {
+				template, revision = &set.Spec.Template, updateRevision
+			}
+			created, err := c.createPod(ctx, set, newPod(set, template, revision, ordinal))
+			if apierrors.IsAlreadyExists(err) {
+				// the deleted pod is still terminating, its deletion enqueues the stateful set
+				klog.Infof("stateful set %q is waiting for pod %q to terminate", set.Name, getPodName(set, ordinal))
+				if monotonic {
+					return result(), nil
+				}
+				continue
+			}
+			if err != nil {
+				return result(), err
+			}
+			replicas[ordinal] = created
+			if monotonic {
+				return result(), nil
+			}
+		case pod.DeletionTimestamp != nil:
+			// terminating pods are created again once deleted
+			if monotonic {
+				klog.Infof("stateful set %q is waiting for pod %q to terminate", set.Name, pod.Name)
+				return result(), nil
+			}
+		case monotonic && !isRunningAndReady(pod):
+			klog.Infof("stateful set %q is waiting for pod %q to be running and ready", set.Name, pod.Name)
+			return result(), nil
+		default:
+			// claims deleted while their pod is running are created again
+			if err := c.createClaims(ctx, set, pod); err != nil {
+				return result(), err
+			}
+		}
+	}
+
+	for i := len(condemned) - 1; i >= 0; i-- {
+		pod := condemned[i]
+		if pod.DeletionTimestamp != nil {
+			if monotonic {
+				return result(), nil
+			}
+			continue
+		}
+		if monotonic && !allHealthy(result(), pod) {
+			klog.Infof("stateful set %q is waiting for its pods to be healthy to delete pod %q", set.Name, pod.Name)
+			return result(), nil
+		}
+		if err := c.deletePod(ctx, set, pod); err != nil {
+			return result(), err
+		}
+		condemned = condemned[:i]
+		if monotonic {
+			return result(), nil
+		}
+	}
+
+	if set.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+		return result(), nil
+	}
+	for ordinal := len(replicas) - 1; ordinal >= getPartition(set); ordinal-- {
+		pod := replicas[ordinal]
+		if pod == nil || pod.DeletionTimestamp != nil {
+			return result(), nil
+		}
+		if getPodRevision(pod) != updateRevision {
+			klog.Infof("stateful set %q updates pod %q to revision %s", set.Name, pod.Name, updateRevision)
+			if err := c.deletePod(ctx, set, pod); err != nil {
+				return result(), err
+			}
+			replicas[ordinal] = nil
+			return result(), nil
+		}
+		if !isRunningAndReady(pod) {
+			klog.Infof("stateful set %q is waiting for pod %q to be running and ready to update", set.Name, pod.Name)
+			return result(), nil
+		}
+	}
+	return result(), nil
+}
+
+// createPod creates the claims of a pod of a stateful set, then the pod
+func (c *Controller) createPod(ctx context.Context, set *appsv1.StatefulSet, pod *corev1.Pod) (*corev1.Pod, error) {
+	if err := c.createClaims(ctx, set, pod); err != nil {
+		return nil, err
+	}
+	created, err := c.kubeClient.CoreV1().Pods(set.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+	if err != nil {
+		c.recorder.Eventf(set, corev1.EventTypeWarning, eventFailedCreate, "create Pod %s in StatefulSet %s failed error: %v", pod.Name, set.Name, err)
+		return nil, err
+	}
+	c.recorder.Eventf(set, corev1.EventTypeNormal, eventSuccessfulCreate, "create Pod %s in StatefulSet %s successful", pod.Name, set.Name)
+	return created, nil
+}
+
+// createClaims creates the claims of a pod of a stateful set from its volume claim
+// templates, which do not exist
+func (c *Controller) createClaims(ctx context.Context, set *appsv1.StatefulSet, pod *corev1.Pod) error {
+	for _, claim := range newClaims(set, pod) {
+		_, err := c.kubeClient.CoreV1().PersistentVolumeClaims(set.Namespace).Get(ctx, claim.Name, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		_, err = c.kubeClient.CoreV1().PersistentVolumeClaims(set.Namespace).Create(ctx, claim, metav1.CreateOptions{})
+		if err != nil && !apierrors.IsAlreadyExists(err) {
+			c.recorder.Eventf(set, corev1.EventTypeWarning, eventFailedCreate, "create Claim %s for Pod %s in StatefulSet %s failed error: %v",
+				claim.Name, pod.Name, set.Name, err)
+			return err
+		}
+		c.recorder.Eventf(set, corev1.EventTypeNormal, eventSuccessfulCreate, "create Claim %s Pod %s in StatefulSet %s success",
+			claim.Name, pod.Name, set.Name)
+	}
+	return nil
+}
+
+// deletePod deletes a pod of a stateful set
+func (c *Controller) deletePod(ctx context.Context, set *appsv1.StatefulSet, pod *corev1.Pod) error {
+	err := c.kubeClient.CoreV1().Pods(set.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		c.recorder.Eventf(set, corev1.EventTypeWarning, eventFailedDelete, "delete Pod %s in StatefulSet %s failed error: %v", pod.Name, set.Name, err)
+		return err
+	}
+	c.recorder.Eventf(set, corev1.EventTypeNormal, eventSuccessfulDelete, "delete Pod %s in StatefulSet %s successful", pod.Name, set.Name)
+	return nil
+}
+
+// isCurrentOrdinal checks if the pod of a stateful set with an ordinal is created from
+// its current revision rather than from its update revision: below the partition of a
+// rolling update, or below the pods updated so far without a partition
+func isCurrentOrdinal(set *appsv1.StatefulSet, ordinal int) bool {
+	if set.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+		return false
+	}
+	if set.Spec.UpdateStrategy.RollingUpdate != nil && set.Spec.UpdateStrategy.RollingUpdate.Partition != nil {
+		return ordinal < getPartition(set)
+	}
+	return ordinal < int(set.Status.CurrentReplicas)
+}
+
+// calculateStatus sets the replica counts and revisions of the status of a stateful set
+// with the given pods, and returns the time after which a ready pod becomes available, or
+// zero if there is none. The current revision becomes the update revision once all the
+// pods are updated and ready.
+func calculateStatus(set *appsv1.StatefulSet, pods []*corev1.Pod, currentRevision, updateRevision string,
+	status *appsv1.StatefulSetStatus, now time.Time) time.Duration {
+	status.CurrentRevision, status.UpdateRevision = currentRevision, updateRevision
+	minReadySeconds := time.Duration(set.Spec.MinReadySeconds) * time.Second
+	var next time.Duration
+	for _, pod := range pods {
+		status.Replicas++
+		if getPodRevision(pod) == currentRevision {
+			status.CurrentReplicas++
+		}
+		if getPodRevision(pod) == updateRevision {
+			status.UpdatedReplicas++
+		}
+		if !isRunningAndReady(pod) {
+			continue
+		}
+		status.ReadyReplicas++
+		ready := getPodReadyCondition(pod)
+		if remaining := ready.LastTransitionTime.Add(minReadySeconds).Sub(now); minReadySeconds > 0 && remaining > 0 {
+			if next == 0 || remaining < next {
+				next = remaining
+			}
+			continue
+		}
+		status.AvailableReplicas++
+	}
+	replicas := getReplicas(set)
+	if set.Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType &&
+		status.UpdatedReplicas == replicas && status.ReadyReplicas == replicas && status.Replicas == replicas {
+		status.CurrentRevision = updateRevision
+		status.CurrentReplicas = status.UpdatedReplicas
+	}
+	return next
+}
+
+// getReplicas returns the desired replicas of a stateful set, which default to 1
+func getReplicas(set *appsv1.StatefulSet) int32 {
+	if set.Spec.Replicas == nil {
+		return 1
+	}
+	return *set.Spec.Replicas
+}
+
+// getPartition returns the ordinal from which the pods of a stateful set are updated
+func getPartition(set *appsv1.StatefulSet) int {
+	if set.Spec.UpdateStrategy.RollingUpdate == nil || set.Spec.UpdateStrategy.RollingUpdate.Partition == nil {
+		return 0
+	}
+	return int(*set.Spec.UpdateStrategy.RollingUpdate.Partition)
+}
+
+// isTerminated checks if a pod ran to completion or failed
+func isTerminated(pod *corev1.Pod) bool {
+	return pod.DeletionTimestamp == nil && !replicaset.IsPodActive(pod)
+}
+
+// isRunningAndReady checks if a pod is running and ready
+func isRunningAndReady(pod *corev1.Pod) bool {
+	return pod.Status.Phase == corev1.PodRunning && replicaset.IsPodReady(pod)
+}
+
+// allHealthy checks if the pods other than the given pod are running, ready and not
+// terminating
+func allHealthy(pods []*corev1.Pod, except *corev1.Pod) bool {
+	for _, pod := range pods {
+		if pod.Name != except.Name && (!isRunningAndReady(pod) || pod.DeletionTimestamp != nil) {
+			return false
+		}
+	}
+	return true
+}
+
+func getPodReadyCondition(pod *corev1.Pod) *corev1.PodCondition {
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == corev1.PodReady {
+			return &pod.Status.Conditions[i]
+		}
+	}
+	return nil
+}
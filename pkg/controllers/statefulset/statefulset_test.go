@@ -0,0 +1,331 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statefulset
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/pdettori/cymba/pkg/controllers"
+	"github.com/pdettori/cymba/pkg/controllers/testutil"
+)
+
+func newTestStatefulSet(replicas int32) *appsv1.StatefulSet {
+	labels := map[string]string{"app": "web"}
+	return &appsv1.StatefulSet{
+		ObjectMeta: v1.ObjectMeta{Name: "web", Namespace: "default", UID: "0a1b2c3d"},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    &replicas,
+			Selector:    &v1.LabelSelector{MatchLabels: labels},
+			ServiceName: "nginx",
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: v1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:         "nginx",
+						Image:        "nginx",
+						VolumeMounts: []corev1.VolumeMount{{Name: "www", MountPath: "/usr/share/nginx/html"}},
+					}},
+				},
+			},
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{{
+				ObjectMeta: v1.ObjectMeta{Name: "www"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					Resources: corev1.ResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+					},
+				},
+			}},
+			UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.RollingUpdateStatefulSetStrategyType},
+		},
+	}
+}
+
+func newTestController(objects ...runtime.Object) *Controller {
+	kubeClient := testutil.NewClientset(objects...)
+	return &Controller{
+		queue:      workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		client:     kubeClient.AppsV1(),
+		kubeClient: kubeClient,
+		recorder:   record.NewFakeRecorder(100),
+	}
+}
+
+// reconcileStatefulSet reconciles the current version of a stateful set
+func reconcileStatefulSet(t *testing.T, c *Controller) *appsv1.StatefulSet {
+	ctx := context.TODO()
+	set, err := c.client.StatefulSets("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, c.reconcile(ctx, set))
+	set, err = c.client.StatefulSets("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	return set
+}
+
+// updateStatefulSet updates the spec of a stateful set
+func updateStatefulSet(t *testing.T, c *Controller, update func(set *appsv1.StatefulSet)) {
+	ctx := context.TODO()
+	set, err := c.client.StatefulSets("default").Get(ctx, "web", v1.GetOptions{})
+	assert.NoError(t, err)
+	update(set)
+	_, err = c.client.StatefulSets("default").Update(ctx, set, v1.UpdateOptions{})
+	assert.NoError(t, err)
+}
+
+func listClaimNames(t *testing.T, c *Controller) []string {
+	list, err := c.kubeClient.CoreV1().PersistentVolumeClaims("default").List(context.TODO(), v1.ListOptions{})
+	assert.NoError(t, err)
+	names := []string{}
+	for _, claim := range list.Items {
+		names = append(names, claim.Name)
+	}
+	return names
+}
+
+func TestOrderedReadyPods(t *testing.T) {
+	c := newTestController(newTestStatefulSet(3))
+
+	// pods are created one at a time, once the previous pod is running and ready
+	set := reconcileStatefulSet(t, c)
+	assert.Contains(t, set.Finalizers, statefulSetFinalizer)
+	assert.Equal(t, []string{"web-0"}, testutil.ListPodNames(t, c.kubeClient))
+	assert.Equal(t, []string{"www-web-0"}, listClaimNames(t, c))
+	reconcileStatefulSet(t, c)
+	assert.Equal(t, []string{"web-0"}, testutil.ListPodNames(t, c.kubeClient))
+	events := c.recorder.(*record.FakeRecorder).Events
+	assert.Equal(t, "Normal SuccessfulCreate create Claim www-web-0 Pod web-0 in StatefulSet web success", <-events)
+	assert.Equal(t, "Normal SuccessfulCreate create Pod web-0 in StatefulSet web successful", <-events)
+
+	testutil.SetPodsReady(t, c.kubeClient, time.Now(), "web-0")
+	reconcileStatefulSet(t, c)
+	testutil.SetPodsReady(t, c.kubeClient, time.Now(), "web-1")
+	set = reconcileStatefulSet(t, c)
+	assert.Equal(t, []string{"web-0", "web-1", "web-2"}, testutil.ListPodNames(t, c.kubeClient))
+	assert.Equal(t, []string{"www-web-0", "www-web-1", "www-web-2"}, listClaimNames(t, c))
+	assert.Equal(t, int32(3), set.Status.Replicas)
+	assert.Equal(t, int32(2), set.Status.ReadyReplicas)
+	assert.Equal(t, set.Status.UpdateRevision, set.Status.CurrentRevision)
+
+	// the pods have stable hostnames in the subdomain of the service, and their own claims
+	pod := testutil.GetPod(t, c.kubeClient, "web-1")
+	assert.Equal(t, "web-1", pod.Spec.Hostname)
+	assert.Equal(t, "nginx", pod.Spec.Subdomain)
+	assert.Equal(t, "web-1", pod.Labels[appsv1.StatefulSetPodNameLabel])
+	assert.Equal(t, "web", pod.Labels[controllers.OwnedByLabel])
+	assert.Equal(t, set.Status.UpdateRevision, pod.Labels[appsv1.StatefulSetRevisionLabel])
+	assert.True(t, v1.IsControlledBy(pod, set))
+	assert.Equal(t, []corev1.Volume{{
+		Name: "www",
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "www-web-1"},
+		},
+	}}, pod.Spec.Volumes)
+
+	// pods are deleted in reverse order, and their claims are kept for their volumes
+	testutil.SetPodsReady(t, c.kubeClient, time.Now(), "web-2")
+	updateStatefulSet(t, c, func(set *appsv1.StatefulSet) {
+		replicas := int32(1)
+		set.Spec.Replicas = &replicas
+	})
+	reconcileStatefulSet(t, c)
+	assert.Equal(t, []string{"web-0", "web-1"}, testutil.ListPodNames(t, c.kubeClient))
+	set = reconcileStatefulSet(t, c)
+	assert.Equal(t, []string{"web-0"}, testutil.ListPodNames(t, c.kubeClient))
+	assert.Equal(t, []string{"www-web-0", "www-web-1", "www-web-2"}, listClaimNames(t, c))
+	assert.Equal(t, int32(1), set.Status.Replicas)
+
+	// the pods and revisions are deleted with the stateful set
+	now := v1.Now()
+	set.DeletionTimestamp = &now
+	_, err := c.client.StatefulSets("default").Update(context.TODO(), set, v1.UpdateOptions{})
+	assert.NoError(t, err)
+	set = reconcileStatefulSet(t, c)
+	assert.NotContains(t, set.Finalizers, statefulSetFinalizer)
+	assert.Empty(t, testutil.ListPodNames(t, c.kubeClient))
+	revisions, err := c.client.ControllerRevisions("default").List(context.TODO(), v1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, revisions.Items)
+}
+
+// setPodFailed marks a pod of the stateful set failed
+func setPodFailed(t *testing.T, c *Controller, name string) {
+	pod := testutil.GetPod(t, c.kubeClient, name)
+	pod.Status.Phase = corev1.PodFailed
+	_, err := c.kubeClient.CoreV1().Pods("default").UpdateStatus(context.TODO(), pod, v1.UpdateOptions{})
+	assert.NoError(t, err)
+}
+
+func TestReplaceFailedPods(t *testing.T) {
+	c := newTestController(newTestStatefulSet(2))
+	reconcileStatefulSet(t, c)
+	testutil.SetPodsReady(t, c.kubeClient, time.Now(), "web-0")
+	reconcileStatefulSet(t, c)
+	testutil.SetPodsReady(t, c.kubeClient, time.Now(), "web-1")
+
+	// a failed pod is deleted and created again in the same reconcile
+	setPodFailed(t, c, "web-0")
+	reconcileStatefulSet(t, c)
+	assert.Equal(t, []string{"web-0", "web-1"}, testutil.ListPodNames(t, c.kubeClient))
+	assert.Equal(t, corev1.PodPhase(""), testutil.GetPod(t, c.kubeClient, "web-0").Status.Phase)
+
+	// a failed pod which is still terminating is created again once it is deleted
+	testutil.SetPodsReady(t, c.kubeClient, time.Now(), "web-0")
+	setPodFailed(t, c, "web-1")
+	clientset := c.kubeClient.(*fake.Clientset)
+	clientset.PrependReactor("delete", "pods", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+	reconcileStatefulSet(t, c)
+	assert.Equal(t, corev1.PodFailed, testutil.GetPod(t, c.kubeClient, "web-1").Status.Phase)
+	clientset.ReactionChain = clientset.ReactionChain[1:]
+	assert.NoError(t, c.kubeClient.CoreV1().Pods("default").Delete(context.TODO(), "web-1", v1.DeleteOptions{}))
+	reconcileStatefulSet(t, c)
+	assert.Equal(t, []string{"web-0", "web-1"}, testutil.ListPodNames(t, c.kubeClient))
+	assert.Equal(t, corev1.PodPhase(""), testutil.GetPod(t, c.kubeClient, "web-1").Status.Phase)
+}
+
+func TestParallelPods(t *testing.T) {
+	set := newTestStatefulSet(3)
+	set.Spec.PodManagementPolicy = appsv1.ParallelPodManagement
+	c := newTestController(set)
+
+	// pods are all created at once, and created again when they fail
+	reconcileStatefulSet(t, c)
+	assert.Equal(t, []string{"web-0", "web-1", "web-2"}, testutil.ListPodNames(t, c.kubeClient))
+	setPodFailed(t, c, "web-1")
+	reconcileStatefulSet(t, c)
+	assert.Equal(t, []string{"web-0", "web-1", "web-2"}, testutil.ListPodNames(t, c.kubeClient))
+	assert.Equal(t, corev1.PodPhase(""), testutil.GetPod(t, c.kubeClient, "web-1").Status.Phase)
+
+	// pods are all deleted at once, even if they are not ready
+	updateStatefulSet(t, c, func(set *appsv1.StatefulSet) {
+		replicas := int32(1)
+		set.Spec.Replicas = &replicas
+	})
+	reconcileStatefulSet(t, c)
+	assert.Equal(t, []string{"web-0"}, testutil.ListPodNames(t, c.kubeClient))
+}
+
+func TestRollingUpdate(t *testing.T) {
+	c := newTestController(newTestStatefulSet(3))
+	for _, name := range []string{"web-0", "web-1", "web-2"} {
+		reconcileStatefulSet(t, c)
+		testutil.SetPodsReady(t, c.kubeClient, time.Now(), name)
+	}
+	set := reconcileStatefulSet(t, c)
+	oldRevision := set.Status.CurrentRevision
+	assert.Equal(t, int32(3), set.Status.ReadyReplicas)
+
+	// pods from the partition are updated one at a time, in reverse order
+	updateStatefulSet(t, c, func(set *appsv1.StatefulSet) {
+		partition := int32(1)
+		set.Spec.Template.Spec.Containers[0].Image = "nginx:1.21"
+		set.Spec.UpdateStrategy.RollingUpdate = &appsv1.RollingUpdateStatefulSetStrategy{Partition: &partition}
+	})
+	set = reconcileStatefulSet(t, c)
+	newRevision := set.Status.UpdateRevision
+	assert.NotEqual(t, oldRevision, newRevision)
+	assert.Equal(t, oldRevision, set.Status.CurrentRevision)
+	assert.Equal(t, []string{"web-0", "web-1"}, testutil.ListPodNames(t, c.kubeClient))
+	reconcileStatefulSet(t, c)
+	assert.Equal(t, "nginx:1.21", testutil.GetPod(t, c.kubeClient, "web-2").Spec.Containers[0].Image)
+	reconcileStatefulSet(t, c)
+	assert.Equal(t, oldRevision, testutil.GetPod(t, c.kubeClient, "web-1").Labels[appsv1.StatefulSetRevisionLabel])
+	testutil.SetPodsReady(t, c.kubeClient, time.Now(), "web-2")
+	reconcileStatefulSet(t, c)
+	reconcileStatefulSet(t, c)
+	testutil.SetPodsReady(t, c.kubeClient, time.Now(), "web-1")
+	set = reconcileStatefulSet(t, c)
+	assert.Equal(t, newRevision, testutil.GetPod(t, c.kubeClient, "web-1").Labels[appsv1.StatefulSetRevisionLabel])
+	assert.Equal(t, int32(2), set.Status.UpdatedReplicas)
+	assert.Equal(t, int32(1), set.Status.CurrentReplicas)
+
+	// pods below the partition are created again from the current revision
+	assert.NoError(t, c.kubeClient.CoreV1().Pods("default").Delete(context.TODO(), "web-0", v1.DeleteOptions{}))
+	reconcileStatefulSet(t, c)
+	pod := testutil.GetPod(t, c.kubeClient, "web-0")
+	assert.Equal(t, oldRevision, pod.Labels[appsv1.StatefulSetRevisionLabel])
+	assert.Equal(t, "nginx", pod.Spec.Containers[0].Image)
+
+	// the update revision becomes current once all the pods are updated and ready
+	testutil.SetPodsReady(t, c.kubeClient, time.Now(), "web-0")
+	updateStatefulSet(t, c, func(set *appsv1.StatefulSet) {
+		set.Spec.UpdateStrategy.RollingUpdate = nil
+	})
+	reconcileStatefulSet(t, c)
+	reconcileStatefulSet(t, c)
+	testutil.SetPodsReady(t, c.kubeClient, time.Now(), "web-0")
+	set = reconcileStatefulSet(t, c)
+	assert.Equal(t, newRevision, testutil.GetPod(t, c.kubeClient, "web-0").Labels[appsv1.StatefulSetRevisionLabel])
+	assert.Equal(t, newRevision, set.Status.CurrentRevision)
+	assert.Equal(t, int32(3), set.Status.CurrentReplicas)
+
+	// rolling back the template makes the previous revision the latest one
+	updateStatefulSet(t, c, func(set *appsv1.StatefulSet) {
+		set.Spec.Template.Spec.Containers[0].Image = "nginx"
+	})
+	set = reconcileStatefulSet(t, c)
+	assert.Equal(t, oldRevision, set.Status.UpdateRevision)
+	revision, err := c.client.ControllerRevisions("default").Get(context.TODO(), oldRevision, v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), revision.Revision)
+}
+
+func TestRevisionTemplate(t *testing.T) {
+	set := newTestStatefulSet(1)
+	revision, err := newRevision(set, 1, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "web", revision.Labels[controllers.OwnedByLabel])
+	assert.Contains(t, string(revision.Data.Raw), `"$patch":"replace"`)
+	template, err := getRevisionTemplate(revision)
+	assert.NoError(t, err)
+	assert.Equal(t, &set.Spec.Template, template)
+
+	// a collision changes the name of the revision
+	other, err := newRevision(set, 1, 1)
+	assert.NoError(t, err)
+	assert.NotEqual(t, revision.Name, other.Name)
+}
+
+func TestGetOrdinal(t *testing.T) {
+	set := newTestStatefulSet(1)
+	for name, ordinal := range map[string]int{
+		"web-0":     0,
+		"web-12":    12,
+		"web-01":    -1,
+		"web--1":    -1,
+		"web-x":     -1,
+		"web":       -1,
+		"website-0": -1,
+	} {
+		pod := &corev1.Pod{ObjectMeta: v1.ObjectMeta{Name: name}}
+		assert.Equal(t, ordinal, getOrdinal(set, pod), name)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package testutil holds the fake client and the pod helpers shared by the tests of the
+// controllers. The helpers work on the objects of the default namespace.
+package testutil
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// Namespace is the namespace of the objects of the tests
+const Namespace = "default"
+
+// NewClientset returns a fake clientset with the given objects, which fills the metadata
+// of the created objects as the API server does: names are generated from the generate
+// name, the UID is set from the name, and the creation time increases with each object.
+func NewClientset(objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	generated := 0
+	created := time.Now()
+	client.PrependReactor("create", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		obj := action.(clienttesting.CreateAction).GetObject().(metav1.Object)
+		if obj.GetName() == "" {
+			generated++
+			obj.SetName(fmt.Sprintf("%s%05d", obj.GetGenerateName(), generated))
+		}
+		created = created.Add(time.Second)
+		obj.SetUID(types.UID(obj.GetName()))
+		obj.SetCreationTimestamp(metav1.NewTime(created))
+		return false, nil, nil
+	})
+	return client
+}
+
+// SetPodsReady marks pods running and ready since the given time
+func SetPodsReady(t *testing.T, client kubernetes.Interface, since time.Time, names ...string) {
+	for _, name := range names {
+		pod, err := client.CoreV1().Pods(Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		pod.Status.Phase = corev1.PodRunning
+		pod.Status.Conditions = []corev1.PodCondition{
+			{Type: corev1.PodReady, Status: corev1.ConditionTrue, LastTransitionTime: metav1.NewTime(since)},
+		}
+		_, err = client.CoreV1().Pods(Namespace).UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+	}
+}
+
+// GetPod returns a pod
+func GetPod(t *testing.T, client kubernetes.Interface, name string) *corev1.Pod {
+	pod, err := client.CoreV1().Pods(Namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	return pod
+}
+
+// ListPodNames returns the names of the pods
+func ListPodNames(t *testing.T, client kubernetes.Interface) []string {
+	list, err := client.CoreV1().Pods(Namespace).List(context.TODO(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	names := []string{}
+	for _, pod := range list.Items {
+		names = append(names, pod.Name)
+	}
+	return names
+}
@@ -0,0 +1,409 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/pdettori/cymba/pkg/controllers"
+	"github.com/pdettori/cymba/pkg/podman"
+)
+
+const (
+	claimFinalizer = "controller.persistentvolumeclaim.kcp.dev/finalizer"
+
+	// StorageClassName is the storage class of the volumes provisioned by the controller.
+	// Claims without a storage class are provisioned with it.
+	StorageClassName = "podman"
+
+	annBindCompleted = "pv.kubernetes.io/bind-completed"
+	annProvisionedBy = "pv.kubernetes.io/provisioned-by"
+)
+
+func (c *Controller) reconcile(ctx context.Context, claim *corev1.PersistentVolumeClaim) error {
+	klog.Infof("reconciling persistent volume claim %q", claim.Name)
+
+	// examine DeletionTimestamp to determine if object is under deletion
+	if claim.ObjectMeta.DeletionTimestamp.IsZero() {
+		// The object is not being deleted, so if it does not have our finalizer,
+		// then lets add the finalizer and update the object. This is equivalent
+		// registering our finalizer.
+		if !controllers.ContainsString(claim.GetFinalizers(), claimFinalizer) {
+			controllerutil.AddFinalizer(claim, claimFinalizer)
+			updated, err := c.client.PersistentVolumeClaims(claim.Namespace).Update(ctx, claim, v1.UpdateOptions{})
+			if err != nil {
+				return err
+			}
+			updated.DeepCopyInto(claim)
+		}
+	} else {
+		// The object is being deleted
+		if controllers.ContainsString(claim.GetFinalizers(), claimFinalizer) {
+			// the claim is protected while pods are using it
+			inUse, err := c.isClaimInUse(ctx, claim)
+			if err != nil {
+				return err
+			}
+			if inUse {
+				klog.Infof("persistent volume claim %q is in use, waiting for its pods to be deleted", claim.Name)
+				return nil
+			}
+			if err := c.releaseVolume(ctx, claim); err != nil {
+				return err
+			}
+
+			// remove our finalizer from the list and update it.
+			controllerutil.RemoveFinalizer(claim, claimFinalizer)
+			_, err = c.client.PersistentVolumeClaims(claim.Namespace).Update(ctx, claim, v1.UpdateOptions{})
+			if err != nil {
+				return err
+			}
+		}
+
+		// Stop reconciliation as the item is being deleted
+		return nil
+	}
+
+	if claim.Status.Phase == corev1.ClaimBound {
+		// check that the bound volume still exists
+		_, err := c.client.PersistentVolumes().Get(ctx, claim.Spec.VolumeName, v1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			claim.Status.Phase = corev1.ClaimLost
+			return c.updateClaimStatus(ctx, claim)
+		}
+		return err
+	}
+
+	pv, err := c.findVolume(ctx, claim)
+	if err != nil {
+		return err
+	}
+	if pv == nil && claim.Spec.VolumeName == "" && canProvision(claim) {
+		pv, err = c.provisionVolume(ctx, claim)
+		if err != nil {
+			return err
+		}
+	}
+	if pv == nil {
+		klog.Infof("no persistent volume available for claim %q", claim.Name)
+		if claim.Status.Phase != corev1.ClaimPending {
+			claim.Status.Phase = corev1.ClaimPending
+			return c.updateClaimStatus(ctx, claim)
+		}
+		return nil
+	}
+	return c.bind(ctx, claim, pv)
+}
+
+// findVolume returns the volume the claim is pre-bound to, or the smallest available
+// volume matching the claim, or nil if there is none
+func (c *Controller) findVolume(ctx context.Context, claim *corev1.PersistentVolumeClaim) (*corev1.PersistentVolume, error) {
+	if claim.Spec.VolumeName != "" {
+		pv, err := c.client.PersistentVolumes().Get(ctx, claim.Spec.VolumeName, v1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pv.Spec.ClaimRef != nil && !isClaimRef(pv.Spec.ClaimRef, claim) {
+			return nil, nil
+		}
+		return pv, nil
+	}
+
+	pvs, err := c.client.PersistentVolumes().List(ctx, v1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var best *corev1.PersistentVolume
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		match, err := volumeMatches(pv, claim)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+		// volumes pre-bound to the claim take precedence
+		if pv.Spec.ClaimRef != nil {
+			return pv, nil
+		}
+		if best == nil || pv.Spec.Capacity.Storage().Cmp(*best.Spec.Capacity.Storage()) < 0 {
+			best = pv
+		}
+	}
+	return best, nil
+}
+
+// volumeMatches checks if an available volume satisfies a claim
+func volumeMatches(pv *corev1.PersistentVolume, claim *corev1.PersistentVolumeClaim) (bool, error) {
+	if pv.Status.Phase != "" && pv.Status.Phase != corev1.VolumeAvailable {
+		return false, nil
+	}
+	if !pv.DeletionTimestamp.IsZero() {
+		return false, nil
+	}
+	if pv.Spec.ClaimRef != nil && !isClaimRef(pv.Spec.ClaimRef, claim) {
+		return false, nil
+	}
+	if pv.Spec.StorageClassName != getClaimClass(claim) {
+		return false, nil
+	}
+	if getVolumeMode(pv.Spec.VolumeMode) != getVolumeMode(claim.Spec.VolumeMode) {
+		return false, nil
+	}
+	for _, mode := range claim.Spec.AccessModes {
+		if !containsAccessMode(pv.Spec.AccessModes, mode) {
+			return false, nil
+		}
+	}
+	if request, ok := claim.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+		if pv.Spec.Capacity.Storage().Cmp(request) < 0 {
+			return false, nil
+		}
+	}
+	if claim.Spec.Selector != nil {
+		selector, err := v1.LabelSelectorAsSelector(claim.Spec.Selector)
+		if err != nil {
+			return false, err
+		}
+		if !selector.Matches(labels.Set(pv.Labels)) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// provisionVolume creates a podman named volume for a claim and the persistent volume
+// representing it
+func (c *Controller) provisionVolume(ctx context.Context, claim *corev1.PersistentVolumeClaim) (*corev1.PersistentVolume, error) {
+	name := "pvc-" + string(claim.UID)
+	klog.Infof("provisioning persistent volume %q for claim %q", name, claim.Name)
+	if err := podman.CreatePersistentVolume(c.runtime, name); err != nil {
+		return nil, err
+	}
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{annProvisionedBy: podman.PersistentVolumeDriver},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity:                      corev1.ResourceList{},
+			AccessModes:                   claim.Spec.AccessModes,
+			ClaimRef:                      getClaimRef(claim),
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+			StorageClassName:              getClaimClass(claim),
+			VolumeMode:                    claim.Spec.VolumeMode,
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       podman.PersistentVolumeDriver,
+					VolumeHandle: name,
+				},
+			},
+		},
+	}
+	// podman named volumes are not size limited, the requested size is recorded as
+	// the volume capacity
+	if request, ok := claim.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+		pv.Spec.Capacity[corev1.ResourceStorage] = request
+	}
+	created, err := c.client.PersistentVolumes().Create(ctx, pv, v1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return c.client.PersistentVolumes().Get(ctx, name, v1.GetOptions{})
+	}
+	return created, err
+}
+
+// bind binds a claim and a volume to each other
+func (c *Controller) bind(ctx context.Context, claim *corev1.PersistentVolumeClaim, pv *corev1.PersistentVolume) error {
+	var err error
+	if pv.Spec.ClaimRef == nil || pv.Spec.ClaimRef.UID != claim.UID {
+		pv.Spec.ClaimRef = getClaimRef(claim)
+		pv, err = c.client.PersistentVolumes().Update(ctx, pv, v1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+	if pv.Status.Phase != corev1.VolumeBound {
+		pv.Status = corev1.PersistentVolumeStatus{Phase: corev1.VolumeBound}
+		if _, err := c.client.PersistentVolumes().UpdateStatus(ctx, pv, v1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	if claim.Spec.VolumeName != pv.Name || claim.Annotations[annBindCompleted] != "yes" {
+		claim.Spec.VolumeName = pv.Name
+		if claim.Annotations == nil {
+			claim.Annotations = map[string]string{}
+		}
+		claim.Annotations[annBindCompleted] = "yes"
+		updated, err := c.client.PersistentVolumeClaims(claim.Namespace).Update(ctx, claim, v1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		updated.DeepCopyInto(claim)
+	}
+	claim.Status.Phase = corev1.ClaimBound
+	claim.Status.AccessModes = pv.Spec.AccessModes
+	claim.Status.Capacity = pv.Spec.Capacity
+	klog.Infof("persistent volume claim %q bound to volume %q", claim.Name, pv.Name)
+	return c.updateClaimStatus(ctx, claim)
+}
+
+// releaseVolume releases the volume bound to a deleted claim, applying its reclaim policy
+func (c *Controller) releaseVolume(ctx context.Context, claim *corev1.PersistentVolumeClaim) error {
+	if claim.Spec.VolumeName == "" {
+		return nil
+	}
+	pv, err := c.client.PersistentVolumes().Get(ctx, claim.Spec.VolumeName, v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if pv.Spec.ClaimRef == nil || !isClaimRef(pv.Spec.ClaimRef, claim) {
+		return nil
+	}
+
+	provisioned := pv.Spec.CSI != nil && pv.Spec.CSI.Driver == podman.PersistentVolumeDriver
+	switch pv.Spec.PersistentVolumeReclaimPolicy {
+	case corev1.PersistentVolumeReclaimDelete:
+		if !provisioned {
+			return c.failVolume(ctx, pv, "volume has no deleter, only podman volumes can be deleted")
+		}
+		klog.Infof("deleting persistent volume %q released by claim %q", pv.Name, claim.Name)
+		if err := podman.RemovePersistentVolume(c.runtime, pv.Spec.CSI.VolumeHandle); err != nil {
+			return err
+		}
+		err := c.client.PersistentVolumes().Delete(ctx, pv.Name, v1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	case corev1.PersistentVolumeReclaimRecycle:
+		if !provisioned {
+			return c.failVolume(ctx, pv, "volume has no recycler, only podman volumes can be recycled")
+		}
+		klog.Infof("recycling persistent volume %q released by claim %q", pv.Name, claim.Name)
+		if err := podman.RecyclePersistentVolume(c.runtime, pv.Spec.CSI.VolumeHandle); err != nil {
+			return err
+		}
+		pv.Spec.ClaimRef = nil
+		pv, err = c.client.PersistentVolumes().Update(ctx, pv, v1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+		pv.Status = corev1.PersistentVolumeStatus{Phase: corev1.VolumeAvailable}
+	default:
+		// retained volumes keep their data and claim reference until an admin reclaims them
+		pv.Status = corev1.PersistentVolumeStatus{Phase: corev1.VolumeReleased}
+	}
+	_, err = c.client.PersistentVolumes().UpdateStatus(ctx, pv, v1.UpdateOptions{})
+	return err
+}
+
+func (c *Controller) failVolume(ctx context.Context, pv *corev1.PersistentVolume, message string) error {
+	klog.Infof("persistent volume %q failed: %s", pv.Name, message)
+	pv.Status = corev1.PersistentVolumeStatus{Phase: corev1.VolumeFailed, Message: message}
+	_, err := c.client.PersistentVolumes().UpdateStatus(ctx, pv, v1.UpdateOptions{})
+	return err
+}
+
+// isClaimInUse checks if a claim is used by pods that did not terminate
+func (c *Controller) isClaimInUse(ctx context.Context, claim *corev1.PersistentVolumeClaim) (bool, error) {
+	pods, err := c.client.Pods(claim.Namespace).List(ctx, v1.ListOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == claim.Name {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (c *Controller) updateClaimStatus(ctx context.Context, claim *corev1.PersistentVolumeClaim) error {
+	_, err := c.client.PersistentVolumeClaims(claim.Namespace).UpdateStatus(ctx, claim, v1.UpdateOptions{})
+	return err
+}
+
+// canProvision checks if a volume can be provisioned for a claim
+func canProvision(claim *corev1.PersistentVolumeClaim) bool {
+	if claim.Spec.StorageClassName != nil && *claim.Spec.StorageClassName != StorageClassName {
+		return false
+	}
+	// named volumes are filesystems
+	return getVolumeMode(claim.Spec.VolumeMode) == corev1.PersistentVolumeFilesystem
+}
+
+// getClaimClass returns the storage class of a claim, with claims without a class using
+// the class of the provisioned volumes
+func getClaimClass(claim *corev1.PersistentVolumeClaim) string {
+	if claim.Spec.StorageClassName == nil {
+		return StorageClassName
+	}
+	return *claim.Spec.StorageClassName
+}
+
+func getVolumeMode(mode *corev1.PersistentVolumeMode) corev1.PersistentVolumeMode {
+	if mode == nil {
+		return corev1.PersistentVolumeFilesystem
+	}
+	return *mode
+}
+
+func getClaimRef(claim *corev1.PersistentVolumeClaim) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:            "PersistentVolumeClaim",
+		APIVersion:      "v1",
+		Namespace:       claim.Namespace,
+		Name:            claim.Name,
+		UID:             claim.UID,
+		ResourceVersion: claim.ResourceVersion,
+	}
+}
+
+// isClaimRef checks if a volume claim reference points to a claim, with references
+// without UID pre-binding the volume to a claim by name
+func isClaimRef(ref *corev1.ObjectReference, claim *corev1.PersistentVolumeClaim) bool {
+	return ref.Namespace == claim.Namespace && ref.Name == claim.Name && (ref.UID == "" || ref.UID == claim.UID)
+}
+
+func containsAccessMode(modes []corev1.PersistentVolumeAccessMode, mode corev1.PersistentVolumeAccessMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
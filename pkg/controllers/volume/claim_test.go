@@ -0,0 +1,166 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/pdettori/cymba/pkg/podman"
+)
+
+func newTestClaim(size string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      "data",
+			Namespace: "default",
+			UID:       "0a1b2c3d",
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+			},
+		},
+	}
+}
+
+func newTestController(rt podman.PodmanRuntime, objects ...runtime.Object) *Controller {
+	kubeClient := fake.NewSimpleClientset(objects...)
+	return &Controller{
+		client:     kubeClient.CoreV1(),
+		kubeClient: kubeClient,
+		runtime:    rt,
+	}
+}
+
+// reconcileClaim reconciles the current version of a claim
+func reconcileClaim(t *testing.T, c *Controller, name string) *corev1.PersistentVolumeClaim {
+	ctx := context.TODO()
+	claim, err := c.client.PersistentVolumeClaims("default").Get(ctx, name, v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, c.reconcile(ctx, claim))
+	claim, err = c.client.PersistentVolumeClaims("default").Get(ctx, name, v1.GetOptions{})
+	assert.NoError(t, err)
+	return claim
+}
+
+func deleteClaim(t *testing.T, c *Controller, name string) {
+	ctx := context.TODO()
+	claim, err := c.client.PersistentVolumeClaims("default").Get(ctx, name, v1.GetOptions{})
+	assert.NoError(t, err)
+	now := v1.Now()
+	claim.DeletionTimestamp = &now
+	_, err = c.client.PersistentVolumeClaims("default").Update(ctx, claim, v1.UpdateOptions{})
+	assert.NoError(t, err)
+}
+
+func TestProvisionAndDeleteVolume(t *testing.T) {
+	ctx := context.TODO()
+	rt := podman.NewFakeRuntime()
+	c := newTestController(rt, newTestClaim("1Gi"))
+
+	claim := reconcileClaim(t, c, "data")
+	assert.Contains(t, claim.Finalizers, claimFinalizer)
+	assert.Equal(t, corev1.ClaimBound, claim.Status.Phase)
+	assert.Equal(t, "pvc-0a1b2c3d", claim.Spec.VolumeName)
+	assert.Equal(t, "1Gi", claim.Status.Capacity.Storage().String())
+	assert.Equal(t, []string{"pvc-0a1b2c3d"}, rt.Volumes())
+
+	pv, err := c.client.PersistentVolumes().Get(ctx, claim.Spec.VolumeName, v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.VolumeBound, pv.Status.Phase)
+	assert.Equal(t, corev1.PersistentVolumeReclaimDelete, pv.Spec.PersistentVolumeReclaimPolicy)
+	assert.Equal(t, claim.UID, pv.Spec.ClaimRef.UID)
+
+	// the claim is not released while a pod uses it
+	pod := &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: "mypod", Namespace: "default"},
+		Spec: corev1.PodSpec{Volumes: []corev1.Volume{{Name: "data", VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}}}},
+	}
+	_, err = c.client.Pods("default").Create(ctx, pod, v1.CreateOptions{})
+	assert.NoError(t, err)
+	deleteClaim(t, c, "data")
+	claim = reconcileClaim(t, c, "data")
+	assert.Contains(t, claim.Finalizers, claimFinalizer)
+
+	assert.NoError(t, c.client.Pods("default").Delete(ctx, "mypod", v1.DeleteOptions{}))
+	claim = reconcileClaim(t, c, "data")
+	assert.NotContains(t, claim.Finalizers, claimFinalizer)
+	_, err = c.client.PersistentVolumes().Get(ctx, claim.Spec.VolumeName, v1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	assert.Empty(t, rt.Volumes())
+}
+
+func TestBindLocalVolume(t *testing.T) {
+	ctx := context.TODO()
+	class := ""
+	claim := newTestClaim("1Gi")
+	claim.Spec.StorageClassName = &class
+	newVolume := func(name, size string) *corev1.PersistentVolume {
+		return &corev1.PersistentVolume{
+			ObjectMeta: v1.ObjectMeta{Name: name},
+			Spec: corev1.PersistentVolumeSpec{
+				Capacity:                      corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(size)},
+				AccessModes:                   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+				PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+				PersistentVolumeSource: corev1.PersistentVolumeSource{
+					Local: &corev1.LocalVolumeSource{Path: "/mnt/" + name},
+				},
+			},
+		}
+	}
+	rt := podman.NewFakeRuntime()
+	c := newTestController(rt, claim, newVolume("small", "500Mi"), newVolume("large", "10Gi"), newVolume("medium", "2Gi"))
+
+	// the smallest matching volume is bound, and no volume is provisioned
+	claim = reconcileClaim(t, c, "data")
+	assert.Equal(t, corev1.ClaimBound, claim.Status.Phase)
+	assert.Equal(t, "medium", claim.Spec.VolumeName)
+	assert.Equal(t, "2Gi", claim.Status.Capacity.Storage().String())
+	assert.Empty(t, rt.Volumes())
+
+	// a retained volume is released with its data on claim deletion
+	deleteClaim(t, c, "data")
+	reconcileClaim(t, c, "data")
+	pv, err := c.client.PersistentVolumes().Get(ctx, "medium", v1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.VolumeReleased, pv.Status.Phase)
+	assert.NotNil(t, pv.Spec.ClaimRef)
+}
+
+func TestClaimPending(t *testing.T) {
+	class := "other"
+	claim := newTestClaim("1Gi")
+	claim.Spec.StorageClassName = &class
+	rt := podman.NewFakeRuntime()
+	c := newTestController(rt, claim)
+
+	claim = reconcileClaim(t, c, "data")
+	assert.Equal(t, corev1.ClaimPending, claim.Status.Phase)
+	assert.Empty(t, claim.Spec.VolumeName)
+	assert.Empty(t, rt.Volumes())
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2021 The KCP Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volume
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	corev1lister "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	"github.com/pdettori/cymba/pkg/podman"
+)
+
+const resyncPeriod = 30 * time.Second
+const controllerName = "persistentvolumeclaim"
+
+// NewController returns a new Controller which binds persistent volume claims, provisioning
+// podman named volumes for them
+func NewController(cfg *rest.Config, rt podman.PodmanRuntime, stopCh <-chan struct{}) *Controller {
+	client := corev1client.NewForConfigOrDie(cfg)
+	kubeClient := kubernetes.NewForConfigOrDie(cfg)
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	c := &Controller{
+		queue:      queue,
+		client:     client,
+		kubeClient: kubeClient,
+		stopCh:     stopCh,
+		runtime:    rt,
+	}
+
+	sif := informers.NewSharedInformerFactoryWithOptions(kubeClient, resyncPeriod)
+	sif.Core().V1().PersistentVolumeClaims().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { c.enqueue(obj) },
+		UpdateFunc: func(_, obj interface{}) { c.enqueue(obj) },
+	})
+	// claims being deleted wait for the pods using them to go away
+	sif.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) { c.enqueuePodClaims(obj) },
+		DeleteFunc: func(obj interface{}) { c.enqueuePodClaims(obj) },
+	})
+	sif.WaitForCacheSync(stopCh)
+	sif.Start(stopCh)
+
+	c.indexer = sif.Core().V1().PersistentVolumeClaims().Informer().GetIndexer()
+	c.lister = sif.Core().V1().PersistentVolumeClaims().Lister()
+
+	return c
+}
+
+// Controller defines the struct for Controller
+type Controller struct {
+	queue      workqueue.RateLimitingInterface
+	client     corev1client.CoreV1Interface
+	kubeClient kubernetes.Interface
+	stopCh     <-chan struct{}
+	indexer    cache.Indexer
+	lister     corev1lister.PersistentVolumeClaimLister
+	runtime    podman.PodmanRuntime
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *Controller) enqueuePodClaims(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	for _, vol := range pod.Spec.Volumes {
+		if vol.PersistentVolumeClaim != nil {
+			c.queue.Add(pod.Namespace + "/" + vol.PersistentVolumeClaim.ClaimName)
+		}
+	}
+}
+
+// Start starts the controller
+func (c *Controller) Start(numThreads int) {
+	defer c.queue.ShutDown()
+	for i := 0; i < numThreads; i++ {
+		go wait.Until(c.startWorker, time.Second, c.stopCh)
+	}
+	klog.Infof("Starting persistent volume claim controller workers")
+	<-c.stopCh
+	klog.Infof("Stopping persistent volume claim controller workers")
+}
+
+func (c *Controller) startWorker() {
+	for c.processNextWorkItem() {
+	}
+}
+
+func (c *Controller) processNextWorkItem() bool {
+	// Wait until there is a new item in the working queue
+	k, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	key := k.(string)
+
+	// No matter what, tell the queue we're done with this key, to unblock
+	// other workers.
+	defer c.queue.Done(key)
+
+	if err := c.process(key); err != nil {
+		runtime.HandleError(fmt.Errorf("%q controller failed to sync %q, err: %w", controllerName, key, err))
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) process(key string) error {
+	obj, exists, err := c.indexer.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		klog.Infof("Object with key %q was deleted", key)
+		return nil
+	}
+	current := obj.(*corev1.PersistentVolumeClaim).DeepCopy()
+
+	// reconcile updates the claim and its volume as it changes them
+	return c.reconcile(context.TODO(), current)
+}
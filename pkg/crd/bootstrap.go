@@ -63,10 +63,34 @@ func ApplyCRDs(ctx context.Context, config *rest.Config) error {
 			Group: "",
 			Kind:  "pods",
 		},
+		{
+			Group: "",
+			Kind:  "persistentvolumeclaims",
+		},
+		{
+			Group: "",
+			Kind:  "persistentvolumes",
+		},
 		{
 			Group: "apps",
 			Kind:  "deployments",
 		},
+		{
+			Group: "apps",
+			Kind:  "replicasets",
+		},
+		{
+			Group: "apps",
+			Kind:  "statefulsets",
+		},
+		{
+			Group: "apps",
+			Kind:  "controllerrevisions",
+		},
+		{
+			Group: "autoscaling",
+			Kind:  "horizontalpodautoscalers",
+		},
 	}
 	err = BootstrapCustomResourceDefinitions(ctx, apiExtensionsClient, gks)
 	if err != nil {
@@ -110,7 +134,9 @@ func BootstrapCustomResourceDefinitions(ctx context.Context, client apiextension
 func BootstrapCustomResourceDefinition(ctx context.Context, client apiextensionsv1client.CustomResourceDefinitionInterface, gk metav1.GroupKind) error {
 	start := time.Now()
 	klog.Infof("bootstrapping %v", gk.String())
-	defer klog.Infof("bootstrapped %v after %s", gk.String(), time.Since(start).String())
+	defer func() {
+		klog.Infof("bootstrapped %v after %s", gk.String(), time.Since(start).String())
+	}()
 	raw, err := rawCustomResourceDefinitions.ReadFile(fmt.Sprintf("%s_%s.yaml", gk.Group, gk.Kind))
 	if err != nil {
 		return fmt.Errorf("could not read CRD %s: %w", gk.String(), err)
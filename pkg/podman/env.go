@@ -0,0 +1,263 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+
+	"github.com/containers/podman/v3/pkg/specgen"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// setContainerProcess sets entrypoint, command, working dir and environment of a
+// container spec, using the Kubernetes semantics: command replaces the image
+// entrypoint, args replace the image cmd, and $(VAR) references to the container
+// environment are expanded in env values, command and args
+func setContainerProcess(s *specgen.SpecGenerator, p *corev1.Pod, container *corev1.Container, resolved map[string]bool, podIP, hostIP string) error {
+	env, err := getContainerEnv(p, container, resolved, podIP, hostIP)
+	if err != nil {
+		return err
+	}
+	s.Env = map[string]string{}
+	for _, e := range env {
+		s.Env[e.Name] = e.Value
+	}
+	mapping := mappingFuncFor(s.Env)
+
+	if len(container.Command) > 0 {
+		s.Entrypoint = expandAll(container.Command, mapping)
+	}
+	if len(container.Args) > 0 {
+		s.Command = expandAll(container.Args, mapping)
+	}
+	s.WorkDir = container.WorkingDir
+	return nil
+}
+
+// ResolvedEnv holds the names of the env entries of the containers of a pod whose values
+// were resolved from ConfigMaps and Secrets, by container name. Their values are set in
+// the container environment as is: as in the kubelet, only literal values are expanded,
+// so that $$ and $(VAR) in ConfigMap and Secret data are kept.
+type ResolvedEnv map[string]map[string]bool
+
+// getContainerEnv returns the environment of a container, in definition order, with
+// literal values expanded and downward API references resolved. ConfigMap and Secret
+// references must have been replaced by their values by the caller, with the names of
+// these entries in resolved.
+func getContainerEnv(p *corev1.Pod, container *corev1.Container, resolved map[string]bool, podIP, hostIP string) ([]corev1.EnvVar, error) {
+	env := []corev1.EnvVar{}
+	values := map[string]string{}
+	mapping := mappingFuncFor(values)
+	for i := range container.Env {
+		e := &container.Env[i]
+		value := e.Value
+		if e.ValueFrom == nil {
+			if !resolved[e.Name] {
+				value = expand(value, mapping)
+			}
+		} else {
+			var err error
+			switch {
+			case e.ValueFrom.FieldRef != nil:
+				value, err = getFieldRefValue(p, e.ValueFrom.FieldRef, podIP, hostIP)
+			case e.ValueFrom.ResourceFieldRef != nil:
+				value, err = getResourceFieldRefValue(p, container, e.ValueFrom.ResourceFieldRef)
+			default:
+				err = fmt.Errorf("env var %s of container %s references a ConfigMap or Secret that was not resolved", e.Name, container.Name)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		values[e.Name] = value
+		env = append(env, corev1.EnvVar{Name: e.Name, Value: value})
+	}
+	return env, nil
+}
+
+// getFieldRefValue resolves a downward API reference to a pod field
+func getFieldRefValue(p *corev1.Pod, fs *corev1.ObjectFieldSelector, podIP, hostIP string) (string, error) {
+	path := fs.FieldPath
+	if key, ok := fieldPathKey(path, "metadata.labels"); ok {
+		return p.Labels[key], nil
+	}
+	if key, ok := fieldPathKey(path, "metadata.annotations"); ok {
+		return p.Annotations[key], nil
+	}
+	switch path {
+	case "metadata.name":
+		return p.Name, nil
+	case "metadata.namespace":
+		return p.Namespace, nil
+	case "metadata.uid":
+		return string(p.UID), nil
+	case "spec.nodeName":
+		return p.Spec.NodeName, nil
+	case "spec.serviceAccountName":
+		return p.Spec.ServiceAccountName, nil
+	case "status.hostIP":
+		return hostIP, nil
+	case "status.podIP", "status.podIPs":
+		return podIP, nil
+	}
+	return "", fmt.Errorf("unsupported fieldPath: %s", path)
+}
+
+// fieldPathKey extracts the key from a field path such as metadata.labels['key']
+func fieldPathKey(path, prefix string) (string, bool) {
+	if !strings.HasPrefix(path, prefix+"['") || !strings.HasSuffix(path, "']") {
+		return "", false
+	}
+	return path[len(prefix)+2 : len(path)-2], true
+}
+
+// getResourceFieldRefValue resolves a downward API reference to a container resource,
+// using the host capacity for limits that are not set
+func getResourceFieldRefValue(p *corev1.Pod, container *corev1.Container, fs *corev1.ResourceFieldSelector) (string, error) {
+	if fs.ContainerName != "" && fs.ContainerName != container.Name {
+		container = nil
+		for _, c := range podContainers(p) {
+			if c.Name == fs.ContainerName {
+				container = c
+			}
+		}
+		if container == nil {
+			return "", fmt.Errorf("container %s not found", fs.ContainerName)
+		}
+	}
+	divisor := resource.MustParse("1")
+	if !fs.Divisor.IsZero() {
+		divisor = fs.Divisor
+	}
+	limits, requests := container.Resources.Limits, container.Resources.Requests
+
+	switch fs.Resource {
+	case "limits.cpu":
+		return convertCPU(resourceOrDefault(limits, nil, corev1.ResourceCPU, hostCPU()), divisor), nil
+	case "requests.cpu":
+		return convertCPU(resourceOrDefault(requests, limits, corev1.ResourceCPU, resource.Quantity{}), divisor), nil
+	case "limits.memory":
+		return convertQuantity(resourceOrDefault(limits, nil, corev1.ResourceMemory, hostMemory()), divisor), nil
+	case "requests.memory":
+		return convertQuantity(resourceOrDefault(requests, limits, corev1.ResourceMemory, resource.Quantity{}), divisor), nil
+	case "limits.ephemeral-storage":
+		return convertQuantity(resourceOrDefault(limits, nil, corev1.ResourceEphemeralStorage, resource.Quantity{}), divisor), nil
+	case "requests.ephemeral-storage":
+		return convertQuantity(resourceOrDefault(requests, limits, corev1.ResourceEphemeralStorage, resource.Quantity{}), divisor), nil
+	}
+	return "", fmt.Errorf("unsupported container resource: %s", fs.Resource)
+}
+
+// resourceOrDefault returns a resource from the list, or from the fallback list (as
+// requests default to limits), or the default value
+func resourceOrDefault(list, fallback corev1.ResourceList, name corev1.ResourceName, def resource.Quantity) resource.Quantity {
+	if q, ok := list[name]; ok {
+		return q
+	}
+	if q, ok := fallback[name]; ok {
+		return q
+	}
+	return def
+}
+
+func convertCPU(q, divisor resource.Quantity) string {
+	return strconv.FormatInt(int64(math.Ceil(float64(q.MilliValue())/float64(divisor.MilliValue()))), 10)
+}
+
+func convertQuantity(q, divisor resource.Quantity) string {
+	return strconv.FormatInt(int64(math.Ceil(float64(q.Value())/float64(divisor.Value()))), 10)
+}
+
+// hostCPU returns the number of CPUs of the host
+func hostCPU() resource.Quantity {
+	return *resource.NewQuantity(int64(goruntime.NumCPU()), resource.DecimalSI)
+}
+
+// hostMemory returns the total memory of the host, or zero if it cannot be read
+func hostMemory() resource.Quantity {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return resource.Quantity{}
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				break
+			}
+			return *resource.NewQuantity(kb*1024, resource.BinarySI)
+		}
+	}
+	return resource.Quantity{}
+}
+
+// mappingFuncFor returns a mapping function for expand, which leaves references to
+// undefined variables unchanged
+func mappingFuncFor(values map[string]string) func(string) string {
+	return func(name string) string {
+		if v, ok := values[name]; ok {
+			return v
+		}
+		return "$(" + name + ")"
+	}
+}
+
+func expandAll(in []string, mapping func(string) string) []string {
+	out := make([]string, 0, len(in))
+	for _, s := range in {
+		out = append(out, expand(s, mapping))
+	}
+	return out
+}
+
+// expand replaces $(VAR) references in the input using the mapping function, with
+// $$ escaping a $, as in Kubernetes
+func expand(input string, mapping func(string) string) string {
+	var b strings.Builder
+	for i := 0; i < len(input); i++ {
+		if input[i] != '$' || i+1 >= len(input) {
+			b.WriteByte(input[i])
+			continue
+		}
+		switch next := input[i+1]; {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+		case next == '(':
+			end := strings.IndexByte(input[i+2:], ')')
+			if end < 0 {
+				b.WriteString(input[i:])
+				return b.String()
+			}
+			b.WriteString(mapping(input[i+2 : i+2+end]))
+			i += end + 2
+		default:
+			b.WriteByte('$')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"testing"
+
+	"github.com/containers/podman/v3/pkg/specgen"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestExpand(t *testing.T) {
+	mapping := mappingFuncFor(map[string]string{"FOO": "foo", "BAR": "bar"})
+	tests := map[string]string{
+		"$(FOO)":          "foo",
+		"$(FOO)-$(BAR)":   "foo-bar",
+		"$$(FOO)":         "$(FOO)",
+		"$(UNDEFINED)":    "$(UNDEFINED)",
+		"$FOO":            "$FOO",
+		"no refs":         "no refs",
+		"unterminated $(": "unterminated $(",
+		"trailing $":      "trailing $",
+	}
+	for in, expected := range tests {
+		assert.Equal(t, expected, expand(in, mapping), in)
+	}
+}
+
+func TestSetContainerProcess(t *testing.T) {
+	pod := newStatusTestPod()
+	pod.Labels = map[string]string{"app": "web"}
+	container := &corev1.Container{
+		Name:       "c",
+		Command:    []string{"/bin/sh", "-c"},
+		Args:       []string{"echo $(GREETING) from $(POD_NAME)"},
+		WorkingDir: "/tmp",
+		Resources: corev1.ResourceRequirements{
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("500m"),
+				corev1.ResourceMemory: resource.MustParse("128Mi"),
+			},
+		},
+		Env: []corev1.EnvVar{
+			{Name: "NAME", Value: "world"},
+			{Name: "GREETING", Value: "hello $(NAME)"},
+			{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+			{Name: "POD_IP", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"}}},
+			{Name: "APP", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels['app']"}}},
+			{Name: "CPU", ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: &corev1.ResourceFieldSelector{Resource: "limits.cpu"}}},
+			{Name: "MEM", ValueFrom: &corev1.EnvVarSource{ResourceFieldRef: &corev1.ResourceFieldSelector{Resource: "limits.memory", Divisor: resource.MustParse("1Mi")}}},
+		},
+	}
+
+	s := specgen.NewSpecGenerator(image, false)
+	assert.NoError(t, setContainerProcess(s, pod, container, nil, "10.88.0.2", "192.168.1.10"))
+	assert.Equal(t, []string{"/bin/sh", "-c"}, s.Entrypoint)
+	assert.Equal(t, []string{"echo hello world from " + podName}, s.Command)
+	assert.Equal(t, "/tmp", s.WorkDir)
+	assert.Equal(t, map[string]string{
+		"NAME":     "world",
+		"GREETING": "hello world",
+		"POD_NAME": podName,
+		"POD_IP":   "10.88.0.2",
+		"APP":      "web",
+		"CPU":      "1",
+		"MEM":      "128",
+	}, s.Env)
+
+	// args only keep the image entrypoint
+	container = &corev1.Container{Name: "c", Args: []string{"-v"}}
+	s = specgen.NewSpecGenerator(image, false)
+	assert.NoError(t, setContainerProcess(s, pod, container, nil, "", ""))
+	assert.Empty(t, s.Entrypoint)
+	assert.Equal(t, []string{"-v"}, s.Command)
+
+	// unresolved ConfigMap references are an error
+	container.Env = []corev1.EnvVar{{Name: "X", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{Key: "x"}}}}
+	assert.Error(t, setContainerProcess(s, pod, container, nil, "", ""))
+}
+
+func TestSetContainerProcessResolvedEnv(t *testing.T) {
+	pod := newStatusTestPod()
+	container := &corev1.Container{
+		Name: "c",
+		Args: []string{"--password=$(PASSWORD)"},
+		Env: []corev1.EnvVar{
+			{Name: "NAME", Value: "world"},
+			{Name: "PASSWORD", Value: "pa$$word"},
+			{Name: "TEMPLATE", Value: "hello $(NAME)"},
+			{Name: "URL", Value: "user:$(PASSWORD)@host"},
+		},
+	}
+
+	// values resolved from ConfigMaps and Secrets are not expanded, the literal values
+	// referencing them are
+	resolved := map[string]bool{"PASSWORD": true, "TEMPLATE": true}
+	s := specgen.NewSpecGenerator(image, false)
+	assert.NoError(t, setContainerProcess(s, pod, container, resolved, "", ""))
+	assert.Equal(t, map[string]string{
+		"NAME":     "world",
+		"PASSWORD": "pa$$word",
+		"TEMPLATE": "hello $(NAME)",
+		"URL":      "user:pa$$word@host",
+	}, s.Env)
+	assert.Equal(t, []string{"--password=pa$$word"}, s.Command)
+
+	// an empty value source is not a resolved value
+	container.Env = []corev1.EnvVar{{Name: "PASSWORD", ValueFrom: &corev1.EnvVarSource{}}}
+	assert.Error(t, setContainerProcess(s, pod, container, resolved, "", ""))
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/reference"
+	"k8s.io/klog/v2"
+)
+
+// reasons of the events recorded on pods, as in the kubelet
+const (
+	EventScheduled           = "Scheduled"
+	EventPulling             = "Pulling"
+	EventPulled              = "Pulled"
+	EventCreated             = "Created"
+	EventStarted             = "Started"
+	EventKilling             = "Killing"
+	EventFailed              = "Failed"
+	EventBackOff             = "BackOff"
+	EventUnhealthy           = "Unhealthy"
+	EventInspectFailed       = "InspectFailed"
+	EventErrImageNeverPull   = "ErrImageNeverPull"
+	EventFailedPostStartHook = "FailedPostStartHook"
+	EventFailedPreStopHook   = "FailedPreStopHook"
+	EventDNSConfigForming    = "DNSConfigForming"
+)
+
+// containerEvent records an event on a container of a pod, referenced by its field path
+// in the pod as in the kubelet
+func (m *PodManager) containerEvent(p *corev1.Pod, container *corev1.Container, eventType, reason, messageFmt string, args ...interface{}) {
+	ref, err := reference.GetReference(scheme.Scheme, p)
+	if err != nil {
+		klog.Errorf("error getting reference of pod %s/%s: %v", p.Namespace, p.Name, err)
+		return
+	}
+	if isInitContainer(p, container) {
+		ref.FieldPath = fmt.Sprintf("spec.initContainers{%s}", container.Name)
+	} else {
+		ref.FieldPath = fmt.Sprintf("spec.containers{%s}", container.Name)
+	}
+	m.recorder.Eventf(ref, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// recordedEvents returns the events recorded so far
+func recordedEvents(r *record.FakeRecorder) []string {
+	events := []string{}
+	for {
+		select {
+		case e := <-r.Events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestContainerEvents(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	events := record.NewFakeRecorder(100)
+	rt := NewFakeRuntime()
+	m := NewPodManager(rt, events)
+	m.pullFailures = newImagePullFailures(flowcontrol.NewFakeBackOff(imagePullBackOffPeriod, maxImagePullBackOff, fakeClock))
+
+	rt.PullErrors = map[string]error{"docker.io/library/" + image: errors.New("manifest unknown")}
+	pod := newStatusTestPod()
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		`Normal Pulling Pulling image "busybox:1.25"`,
+		`Warning Failed Failed to pull image "busybox:1.25": manifest unknown`,
+	}, recordedEvents(events))
+
+	delete(rt.PullErrors, "docker.io/library/"+image)
+	assert.NoError(t, m.CreateContainers(pod, nil, nil))
+	assert.Equal(t, []string{`Normal BackOff Back-off pulling image "busybox:1.25"`}, recordedEvents(events))
+
+	fakeClock.Step(imagePullBackOffPeriod + time.Second)
+	assert.NoError(t, m.CreateContainers(pod, nil, nil))
+	recorded := recordedEvents(events)
+	if assert.Len(t, recorded, 4) {
+		assert.Equal(t, `Normal Pulling Pulling image "busybox:1.25"`, recorded[0])
+		assert.Contains(t, recorded[1], `Normal Pulled Successfully pulled image "busybox:1.25" in `)
+		assert.Equal(t, []string{"Normal Created Created container busybox", "Normal Started Started container busybox"}, recorded[2:])
+	}
+
+	assert.NoError(t, m.stopPodContainers(pod))
+	assert.Equal(t, []string{"Normal Killing Stopping container busybox"}, recordedEvents(events))
+}
+
+func TestContainerEventReference(t *testing.T) {
+	broadcaster := record.NewBroadcaster()
+	defer broadcaster.Shutdown()
+	recorded := make(chan *corev1.Event, 1)
+	broadcaster.StartEventWatcher(func(e *corev1.Event) { recorded <- e })
+	m := NewPodManager(NewFakeRuntime(), broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "cymba"}))
+
+	pod := newStatusTestPod()
+	pod.UID = "1234"
+	pod.Spec.InitContainers = []corev1.Container{{Name: "init", Image: image}}
+	m.containerEvent(pod, &pod.Spec.InitContainers[0], corev1.EventTypeNormal, EventStarted, "Started container %s", "init")
+
+	select {
+	case e := <-recorded:
+		assert.Equal(t, "Pod", e.InvolvedObject.Kind)
+		assert.Equal(t, podName, e.InvolvedObject.Name)
+		assert.Equal(t, pod.UID, e.InvolvedObject.UID)
+		assert.Equal(t, "spec.initContainers{init}", e.InvolvedObject.FieldPath)
+		assert.Equal(t, "Started container init", e.Message)
+	case <-time.After(time.Second):
+		t.Fatal("event not recorded")
+	}
+}
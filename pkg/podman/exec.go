@@ -0,0 +1,91 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	utilexec "k8s.io/utils/exec"
+)
+
+// ExecInContainer runs a command in a container of a pod attached to the given streams.
+// As in the kubelet, a non-zero exit code is returned as a utilexec.ExitError.
+func ExecInContainer(ctx context.Context, rt PodmanRuntime, p *corev1.Pod, containerName string, cmd []string, streams *Streams) error {
+	container, err := getContainer(p, containerName)
+	if err != nil {
+		return err
+	}
+	exitCode, err := rt.ExecStreams(ctx, podmanContainerName(p, container.Name), cmd, streams)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return utilexec.CodeExitError{
+			Err:  fmt.Errorf("command '%s' exited with %d", strings.Join(cmd, " "), exitCode),
+			Code: exitCode,
+		}
+	}
+	return nil
+}
+
+// AttachToContainer attaches the given streams to a container of a pod. The container
+// has a TTY and stdin only if its spec requests them.
+func AttachToContainer(ctx context.Context, rt PodmanRuntime, p *corev1.Pod, containerName string, streams *Streams) error {
+	container, err := getContainer(p, containerName)
+	if err != nil {
+		return err
+	}
+	attach := *streams
+	attach.TTY = container.TTY
+	if !container.Stdin {
+		attach.Stdin = nil
+	}
+	return rt.AttachContainer(ctx, podmanContainerName(p, container.Name), &attach)
+}
+
+// PortForward copies the data of a stream to and from a port of a pod, in the network
+// namespace of its infra container. The stream is closed once the port is.
+func PortForward(ctx context.Context, rt PodmanRuntime, p *corev1.Pod, port int32, stream io.ReadWriteCloser) error {
+	defer stream.Close()
+	pr, err := rt.InspectPod(podmanPodName(p))
+	if err != nil {
+		return err
+	}
+	if pr.InfraContainerID == "" {
+		return fmt.Errorf("pod %s has no network namespace", p.Name)
+	}
+	conn, err := rt.DialContainer(ctx, pr.InfraContainerID, port)
+	if err != nil {
+		return fmt.Errorf("failed to connect to port %d of pod %s: %s", port, p.Name, err)
+	}
+	defer conn.Close()
+
+	go func() {
+		if _, err := io.Copy(conn, stream); err != nil {
+			return
+		}
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	_, err = io.Copy(stream, conn)
+	return err
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/utils/exec"
+)
+
+func TestExecInContainer(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	rt.ExecOutputs["hostname"] = "mypod\n"
+
+	var stdout bytes.Buffer
+	assert.NoError(t, ExecInContainer(context.TODO(), rt, pod, "", []string{"hostname"}, &Streams{Stdout: &stdout}))
+	assert.Equal(t, "mypod\n", stdout.String())
+
+	// stdin is attached, and the terminal is resized
+	stdout.Reset()
+	sizes := make(chan remotecommand.TerminalSize, 1)
+	sizes <- remotecommand.TerminalSize{Width: 80, Height: 24}
+	close(sizes)
+	streams := &Streams{Stdin: strings.NewReader("hello\n"), Stdout: &stdout, TTY: true, Resize: sizes}
+	assert.NoError(t, ExecInContainer(context.TODO(), rt, pod, containerName, []string{"cat"}, streams))
+	assert.Equal(t, "hello\n", stdout.String())
+	assert.Eventually(t, func() bool {
+		sizes, err := rt.TerminalSizes(podmanContainerName(pod, containerName))
+		return err == nil && len(sizes) == 1 && sizes[0].Width == 80
+	}, time.Second, 10*time.Millisecond)
+
+	// a failed command is reported with its exit code
+	rt.ExecExitCodes["false"] = 1
+	err = ExecInContainer(context.TODO(), rt, pod, "", []string{"false"}, &Streams{Stdout: &stdout})
+	exitErr, ok := err.(utilexec.ExitError)
+	if assert.True(t, ok, "%v", err) {
+		assert.Equal(t, 1, exitErr.ExitStatus())
+	}
+
+	err = ExecInContainer(context.TODO(), rt, pod, "nginx", []string{"true"}, &Streams{})
+	assert.EqualError(t, err, "container nginx is not valid for pod mypod")
+}
+
+func TestAttachToContainer(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	pod.Spec.Containers[0].Stdin = true
+	pod.Spec.Containers[0].TTY = true
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	s, err := rt.ContainerSpec(podmanContainerName(pod, containerName))
+	assert.NoError(t, err)
+	assert.True(t, s.Terminal)
+	assert.True(t, s.Stdin)
+
+	var stdout bytes.Buffer
+	streams := &Streams{Stdin: strings.NewReader("ls\n"), Stdout: &stdout}
+	assert.NoError(t, AttachToContainer(context.TODO(), rt, pod, "", streams))
+	assert.Equal(t, "ls\n", stdout.String())
+
+	// stdin is not attached to containers without stdin
+	pod.Spec.Containers[0].Stdin = false
+	stdout.Reset()
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	assert.NoError(t, AttachToContainer(ctx, rt, pod, "", streams))
+	assert.Empty(t, stdout.String())
+}
+
+// pipeStream is a stream of a port forwarding, written to by the test
+type pipeStream struct {
+	io.Reader
+	io.Writer
+}
+
+func (pipeStream) Close() error { return nil }
+
+func TestPortForward(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	rt.PortHandlers[8080] = func(c net.Conn) {
+		defer c.Close()
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err == nil {
+			c.Write([]byte("pong"))
+		}
+	}
+
+	var out bytes.Buffer
+	stream := pipeStream{Reader: strings.NewReader("ping"), Writer: &out}
+	assert.NoError(t, PortForward(context.TODO(), rt, pod, 8080, stream))
+	assert.Equal(t, "pong", out.String())
+
+	err = PortForward(context.TODO(), rt, pod, 9090, stream)
+	assert.EqualError(t, err, "failed to connect to port 9090 of pod mypod: dial tcp4 127.0.0.1:9090: connect: connection refused")
+}
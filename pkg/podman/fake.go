@@ -0,0 +1,967 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containers/podman/v3/libpod/define"
+	"github.com/containers/podman/v3/libpod/network/types"
+	"github.com/containers/podman/v3/pkg/bindings/containers"
+	"github.com/containers/podman/v3/pkg/bindings/images"
+	"github.com/containers/podman/v3/pkg/domain/entities"
+	"github.com/containers/podman/v3/pkg/inspect"
+	"github.com/containers/podman/v3/pkg/specgen"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// lastFakeID makes the IDs of the fake objects unique across runtimes, as podman IDs are
+var lastFakeID uint64
+
+// FakeRuntime is an in-memory PodmanRuntime. It keeps track of pods, containers
+// and images and emulates podman state transitions, so that code using a
+// PodmanRuntime can be tested without a podman service.
+type FakeRuntime struct {
+	mu         sync.Mutex
+	pods       map[string]*fakePod
+	containers map[string]*fakeContainer
+	images     map[string]string
+	volumes    map[string]*entities.VolumeConfigResponse
+	networks   map[string]map[string]string
+
+	lastHostPort uint16
+
+	// PullErrors makes PullImage fail for the given image names
+	PullErrors map[string]error
+	// PullAuth makes PullImage require credentials for the given image names
+	PullAuth map[string]RegistryAuth
+	// ExecExitCodes sets the exit code of the given commands, joined with spaces, run
+	// in any container
+	ExecExitCodes map[string]int
+	// ExecOutputs sets the output of the given commands, joined with spaces, run with
+	// ExecStreams in any container. Commands with stdin also echo it.
+	ExecOutputs map[string]string
+	// PortHandlers serve the connections to the given ports of any container
+	PortHandlers map[int32]func(net.Conn)
+	// ImageUsers sets the user of the given images, by fully qualified name
+	ImageUsers map[string]string
+	// HostInfo is returned by Info, it describes a rootful host by default
+	HostInfo define.Info
+}
+
+type fakePod struct {
+	id         string
+	name       string
+	created    time.Time
+	spec       specgen.PodSpecGenerator
+	infraID    string
+	containers []string
+}
+
+type fakeContainer struct {
+	id           string
+	name         string
+	podID        string
+	imageName    string
+	imageID      string
+	isInfra      bool
+	spec         *specgen.SpecGenerator
+	created      time.Time
+	state        define.ContainerStatus
+	exitCode     int32
+	startedAt    time.Time
+	finishedAt   time.Time
+	restartCount int32
+	size         int64
+	cpuNano      uint64
+	memUsage     uint64
+	networks     map[string][]string
+	execExitCode int
+	execs        []string
+	stopTimeout  uint
+	logs         []fakeLogLine
+	sizes        []remotecommand.TerminalSize
+}
+
+type fakeLogLine struct {
+	time   time.Time
+	stderr bool
+	line   string
+}
+
+// NewFakeRuntime returns an empty FakeRuntime
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		pods:       map[string]*fakePod{},
+		containers: map[string]*fakeContainer{},
+		images:     map[string]string{},
+		volumes:    map[string]*entities.VolumeConfigResponse{},
+		networks:   map[string]map[string]string{},
+		PullErrors: map[string]error{},
+		PullAuth:   map[string]RegistryAuth{},
+
+		ExecExitCodes: map[string]int{},
+		ExecOutputs:   map[string]string{},
+		PortHandlers:  map[int32]func(net.Conn){},
+		ImageUsers:    map[string]string{},
+		HostInfo:      define.Info{Host: &define.HostInfo{}},
+
+		lastHostPort: 40000,
+	}
+}
+
+// AddImage adds an image to the fake local storage and returns its ID
+func (f *FakeRuntime) AddImage(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addImage(name)
+}
+
+// Images returns the names of the images in the fake local storage
+func (f *FakeRuntime) Images() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := []string{}
+	for name := range f.images {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Volumes returns the names of the named volumes
+func (f *FakeRuntime) Volumes() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := []string{}
+	for name := range f.volumes {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Networks returns the names of the networks
+func (f *FakeRuntime) Networks() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := []string{}
+	for name := range f.networks {
+		names = append(names, name)
+	}
+	return names
+}
+
+// ContainerSpec returns the spec a container was created with
+func (f *FakeRuntime) ContainerSpec(nameOrID string) (*specgen.SpecGenerator, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	return c.spec, nil
+}
+
+// SetContainerExited emulates the main process of a running container exiting
+// with the given exit code
+func (f *FakeRuntime) SetContainerExited(nameOrID string, exitCode int32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return err
+	}
+	if c.state != define.ContainerStateRunning {
+		return errors.Wrapf(define.ErrCtrStateInvalid, "container %s is not running", c.name)
+	}
+	f.stopContainer(c, exitCode)
+	return nil
+}
+
+// SetContainerSize sets the size of the writable layer of a container
+func (f *FakeRuntime) SetContainerSize(nameOrID string, size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return err
+	}
+	c.size = size
+	return nil
+}
+
+// SetContainerUsage sets the CPU time in nanoseconds consumed by a container since it
+// was started, and the memory in bytes it uses
+func (f *FakeRuntime) SetContainerUsage(nameOrID string, cpuNano, memUsage uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return err
+	}
+	c.cpuNano = cpuNano
+	c.memUsage = memUsage
+	return nil
+}
+
+// SetExecExitCode sets the exit code of the commands run in a container
+func (f *FakeRuntime) SetExecExitCode(nameOrID string, exitCode int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return err
+	}
+	c.execExitCode = exitCode
+	return nil
+}
+
+// WriteContainerLog emulates a container writing a line to its stdout or stderr
+func (f *FakeRuntime) WriteContainerLog(nameOrID string, stderr bool, line string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return err
+	}
+	c.logs = append(c.logs, fakeLogLine{time: time.Now(), stderr: stderr, line: line + "\n"})
+	return nil
+}
+
+// ExecCommands returns the commands run in a container, joined with spaces
+func (f *FakeRuntime) ExecCommands(nameOrID string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{}, c.execs...), nil
+}
+
+// StopTimeout returns the timeout of the last stop of a container
+func (f *FakeRuntime) StopTimeout(nameOrID string) (uint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return c.stopTimeout, nil
+}
+
+// TerminalSizes returns the sizes of the terminals of the exec sessions of a container,
+// and of the container, in the order they were resized
+func (f *FakeRuntime) TerminalSizes(nameOrID string) ([]remotecommand.TerminalSize, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	return append([]remotecommand.TerminalSize{}, c.sizes...), nil
+}
+
+func (f *FakeRuntime) CreatePod(spec *entities.PodSpec) (*entities.PodCreateReport, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := spec.PodSpecGen.Name
+	if _, err := f.lookupPod(name); err == nil {
+		return nil, errors.Wrapf(define.ErrPodExists, "pod %s", name)
+	}
+	p := &fakePod{
+		id:      f.newID(),
+		name:    name,
+		created: time.Now(),
+		spec:    spec.PodSpecGen,
+	}
+	// random host ports are allocated when the pod is created, as podman does
+	p.spec.PortMappings = append([]types.PortMapping{}, spec.PodSpecGen.PortMappings...)
+	for i := range p.spec.PortMappings {
+		if p.spec.PortMappings[i].HostPort == 0 {
+			f.lastHostPort++
+			p.spec.PortMappings[i].HostPort = f.lastHostPort
+		}
+	}
+	if !spec.PodSpecGen.NoInfra {
+		infra := &fakeContainer{
+			id:      f.newID(),
+			podID:   p.id,
+			isInfra: true,
+			created: p.created,
+			state:   define.ContainerStateCreated,
+		}
+		infra.name = infra.id[:12] + "-infra"
+		f.containers[infra.id] = infra
+		p.infraID = infra.id
+		p.containers = append(p.containers, infra.id)
+	}
+	f.pods[p.id] = p
+	return &entities.PodCreateReport{Id: p.id}, nil
+}
+
+func (f *FakeRuntime) StartPod(nameOrID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.lookupPod(nameOrID)
+	if err != nil {
+		return err
+	}
+	for _, id := range p.containers {
+		f.startContainer(f.containers[id])
+	}
+	return nil
+}
+
+func (f *FakeRuntime) InspectPod(nameOrID string) (*entities.PodInspectReport, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.lookupPod(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	data := &define.InspectPodData{
+		ID:               p.id,
+		Name:             p.name,
+		Created:          p.created,
+		Hostname:         p.spec.Hostname,
+		Labels:           p.spec.Labels,
+		CreateInfra:      p.infraID != "",
+		InfraContainerID: p.infraID,
+		NumContainers:    uint(len(p.containers)),
+	}
+	if p.infraID != "" {
+		data.InfraConfig = &define.InspectPodInfraConfig{
+			PortBindings: map[string][]define.InspectHostPort{},
+			HostNetwork:  p.spec.NetNS.NSMode == specgen.Host,
+			DNSSearch:    p.spec.DNSSearch,
+			DNSOption:    p.spec.DNSOption,
+			HostAdd:      p.spec.HostAdd,
+		}
+		for _, ip := range p.spec.DNSServer {
+			data.InfraConfig.DNSServer = append(data.InfraConfig.DNSServer, ip.String())
+		}
+		for _, pm := range p.spec.PortMappings {
+			key := fmt.Sprintf("%d/%s", pm.ContainerPort, pm.Protocol)
+			data.InfraConfig.PortBindings[key] = append(data.InfraConfig.PortBindings[key],
+				define.InspectHostPort{HostIP: pm.HostIP, HostPort: fmt.Sprintf("%d", pm.HostPort)})
+		}
+	}
+	statuses := map[string]define.ContainerStatus{}
+	for _, id := range p.containers {
+		c := f.containers[id]
+		statuses[id] = c.state
+		data.Containers = append(data.Containers, define.InspectPodContainerInfo{
+			ID:    c.id,
+			Name:  c.name,
+			State: c.state.String(),
+		})
+	}
+	data.State = fakePodState(statuses)
+	return &entities.PodInspectReport{InspectPodData: data}, nil
+}
+
+func (f *FakeRuntime) KillPod(nameOrID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.lookupPod(nameOrID)
+	if err != nil {
+		return err
+	}
+	for _, id := range p.containers {
+		c := f.containers[id]
+		if c.state == define.ContainerStateRunning {
+			// killed by SIGKILL
+			f.stopContainer(c, 137)
+		}
+	}
+	return nil
+}
+
+func (f *FakeRuntime) RemovePod(nameOrID string, force bool) (*entities.PodRmReport, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, err := f.lookupPod(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range p.containers {
+		if f.containers[id].state == define.ContainerStateRunning && !force {
+			return nil, errors.Wrapf(define.ErrCtrStateInvalid, "pod %s contains running containers", p.name)
+		}
+	}
+	for _, id := range p.containers {
+		delete(f.containers, id)
+	}
+	delete(f.pods, p.id)
+	return &entities.PodRmReport{Id: p.id}, nil
+}
+
+func (f *FakeRuntime) CreateContainer(s *specgen.SpecGenerator) (entities.ContainerCreateResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.lookupContainer(s.Name); err == nil {
+		return entities.ContainerCreateResponse{}, errors.Wrapf(define.ErrCtrExists, "container %s", s.Name)
+	}
+	imageID, ok := f.images[s.Image]
+	if !ok {
+		return entities.ContainerCreateResponse{}, errors.Errorf("%s: image not known", s.Image)
+	}
+	c := &fakeContainer{
+		id:        f.newID(),
+		name:      s.Name,
+		imageName: s.Image,
+		imageID:   imageID,
+		spec:      s,
+		created:   time.Now(),
+		state:     define.ContainerStateCreated,
+	}
+	for _, v := range s.Volumes {
+		if _, ok := f.volumes[v.Name]; !ok && v.Name != "" {
+			// podman creates missing named volumes
+			f.volumes[v.Name] = &entities.VolumeConfigResponse{InspectVolumeData: define.InspectVolumeData{
+				Name:       v.Name,
+				Mountpoint: "/var/lib/containers/storage/volumes/" + v.Name + "/_data",
+				CreatedAt:  time.Now(),
+				Scope:      "local",
+			}}
+		}
+	}
+	if s.Pod != "" {
+		p, err := f.lookupPod(s.Pod)
+		if err != nil {
+			return entities.ContainerCreateResponse{}, err
+		}
+		c.podID = p.id
+		p.containers = append(p.containers, c.id)
+	}
+	f.containers[c.id] = c
+	return entities.ContainerCreateResponse{ID: c.id}, nil
+}
+
+func (f *FakeRuntime) StartContainer(nameOrID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return err
+	}
+	// podman starts the infra container a container depends on
+	if p, ok := f.pods[c.podID]; ok && p.infraID != "" {
+		f.startContainer(f.containers[p.infraID])
+	}
+	f.startContainer(c)
+	return nil
+}
+
+func (f *FakeRuntime) StopContainer(nameOrID string, timeout uint) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return err
+	}
+	c.stopTimeout = timeout
+	if c.state == define.ContainerStateRunning {
+		// the fake processes do not handle SIGTERM, they are killed
+		f.stopContainer(c, 137)
+	}
+	return nil
+}
+
+func (f *FakeRuntime) ExecContainer(nameOrID string, cmd []string, timeout time.Duration) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	if c.state != define.ContainerStateRunning {
+		return 0, errors.Wrapf(define.ErrCtrStateInvalid, "can only create exec sessions on running containers")
+	}
+	command := strings.Join(cmd, " ")
+	c.execs = append(c.execs, command)
+	if exitCode, ok := f.ExecExitCodes[command]; ok {
+		return exitCode, nil
+	}
+	return c.execExitCode, nil
+}
+
+func (f *FakeRuntime) InspectContainer(nameOrID string) (*define.InspectContainerData, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	data := &define.InspectContainerData{
+		ID:      c.id,
+		Name:    c.name,
+		Created: c.created,
+		State: &define.InspectContainerState{
+			Status:     c.state.String(),
+			Running:    c.state == define.ContainerStateRunning,
+			ExitCode:   c.exitCode,
+			StartedAt:  c.startedAt,
+			FinishedAt: c.finishedAt,
+		},
+		Image:        c.imageID,
+		ImageName:    c.imageName,
+		Pod:          c.podID,
+		RestartCount: c.restartCount,
+		IsInfra:      c.isInfra,
+		Config:       &define.InspectContainerConfig{Image: c.imageName},
+	}
+	if c.spec != nil {
+		data.Config.Cmd = c.spec.Command
+	}
+	if p, ok := f.pods[c.podID]; ok && c.isInfra && p.spec.NetNS.NSMode != specgen.Host && c.state == define.ContainerStateRunning {
+		data.NetworkSettings = &define.InspectNetworkSettings{
+			InspectBasicNetworkConfig: define.InspectBasicNetworkConfig{IPAddress: fakeIP(p.id)},
+		}
+		// containers connected to networks have an address on each of them
+		if len(c.networks) > 0 {
+			data.NetworkSettings.IPAddress = ""
+			data.NetworkSettings.Networks = map[string]*define.InspectAdditionalNetwork{}
+			data.NetworkSettings.Networks["podman"] = &define.InspectAdditionalNetwork{
+				InspectBasicNetworkConfig: define.InspectBasicNetworkConfig{IPAddress: fakeIP(p.id)},
+				NetworkID:                 "podman",
+			}
+			for name, aliases := range c.networks {
+				data.NetworkSettings.Networks[name] = &define.InspectAdditionalNetwork{
+					InspectBasicNetworkConfig: define.InspectBasicNetworkConfig{IPAddress: strings.Replace(fakeIP(p.id), "10.88.", "10.89.", 1)},
+					NetworkID:                 name,
+					Aliases:                   aliases,
+				}
+			}
+		}
+	}
+	return data, nil
+}
+
+func (f *FakeRuntime) ContainerSize(nameOrID string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	return c.size, nil
+}
+
+func (f *FakeRuntime) ContainerStats(nameOrID string) (*define.ContainerStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	if c.state != define.ContainerStateRunning {
+		return nil, errors.Wrapf(define.ErrCtrStateInvalid, "container %s is not running", c.name)
+	}
+	return &define.ContainerStats{
+		ContainerID: c.id,
+		Name:        c.name,
+		CPUNano:     c.cpuNano,
+		SystemNano:  uint64(time.Now().UnixNano()),
+		MemUsage:    c.memUsage,
+	}, nil
+}
+
+// ContainerLogs sends the log lines of a container matching the since, until and tail
+// options. Logs are not followed.
+func (f *FakeRuntime) ContainerLogs(ctx context.Context, nameOrID string, options *containers.LogOptions, stdout, stderr chan string) error {
+	f.mu.Lock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		f.mu.Unlock()
+		return err
+	}
+	lines := []fakeLogLine{}
+	for _, l := range c.logs {
+		if options.Since != nil && !afterTime(l.time, *options.Since) ||
+			options.Until != nil && afterTime(l.time, *options.Until) {
+			continue
+		}
+		lines = append(lines, l)
+	}
+	f.mu.Unlock()
+
+	if options.Tail != nil {
+		if tail, err := strconv.Atoi(*options.Tail); err == nil && tail >= 0 && tail < len(lines) {
+			lines = lines[len(lines)-tail:]
+		}
+	}
+	for _, l := range lines {
+		line := l.line
+		if options.GetTimestamps() {
+			line = l.time.Format(time.RFC3339Nano) + " " + line
+		}
+		ch := stdout
+		if l.stderr {
+			ch = stderr
+		}
+		select {
+		case ch <- line:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// ExecStreams writes the output set for the command, then echoes stdin until it is
+// closed
+func (f *FakeRuntime) ExecStreams(ctx context.Context, nameOrID string, cmd []string, streams *Streams) (int, error) {
+	f.mu.Lock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		f.mu.Unlock()
+		return 0, err
+	}
+	if c.state != define.ContainerStateRunning {
+		f.mu.Unlock()
+		return 0, errors.Wrapf(define.ErrCtrStateInvalid, "can only create exec sessions on running containers")
+	}
+	command := strings.Join(cmd, " ")
+	c.execs = append(c.execs, command)
+	exitCode, ok := f.ExecExitCodes[command]
+	if !ok {
+		exitCode = c.execExitCode
+	}
+	output := f.ExecOutputs[command]
+	f.mu.Unlock()
+
+	if streams.Stdout != nil {
+		if _, err := io.WriteString(streams.Stdout, output); err != nil {
+			return 0, err
+		}
+	}
+	if err := f.echoStreams(ctx, c, streams); err != nil {
+		return 0, err
+	}
+	return exitCode, nil
+}
+
+// AttachContainer echoes stdin until it is closed, or waits for ctx to be done without
+// stdin
+func (f *FakeRuntime) AttachContainer(ctx context.Context, nameOrID string, streams *Streams) error {
+	f.mu.Lock()
+	c, err := f.lookupContainer(nameOrID)
+	if err == nil && c.state != define.ContainerStateRunning {
+		err = errors.Wrapf(define.ErrCtrStateInvalid, "can only attach to created or running containers")
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if streams.Stdin == nil {
+		<-ctx.Done()
+		return nil
+	}
+	return f.echoStreams(ctx, c, streams)
+}
+
+// DialContainer connects to the handler of the port
+func (f *FakeRuntime) DialContainer(ctx context.Context, nameOrID string, port int32) (net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	if c.state != define.ContainerStateRunning {
+		return nil, fmt.Errorf("container %s is not running", nameOrID)
+	}
+	handler, ok := f.PortHandlers[port]
+	if !ok {
+		return nil, fmt.Errorf("dial tcp4 127.0.0.1:%d: connect: connection refused", port)
+	}
+	client, server := net.Pipe()
+	go handler(server)
+	return client, nil
+}
+
+// echoStreams records the terminal sizes, and copies stdin to stdout
+func (f *FakeRuntime) echoStreams(ctx context.Context, c *fakeContainer, streams *Streams) error {
+	if streams.Resize != nil {
+		go handleResize(ctx, streams.Resize, func(size remotecommand.TerminalSize) error {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			c.sizes = append(c.sizes, size)
+			return nil
+		})
+	}
+	if streams.Stdin == nil {
+		return nil
+	}
+	out := streams.Stdout
+	if out == nil {
+		out = io.Discard
+	}
+	_, err := io.Copy(out, streams.Stdin)
+	return err
+}
+
+func afterTime(t time.Time, value string) bool {
+	v, err := time.Parse(time.RFC3339Nano, value)
+	return err == nil && t.After(v)
+}
+
+func (f *FakeRuntime) PullImage(name string, options *images.PullOptions) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err, ok := f.PullErrors[name]; ok {
+		return nil, err
+	}
+	if auth, ok := f.PullAuth[name]; ok {
+		if options == nil || options.GetUsername() != auth.Username || options.GetPassword() != auth.Password {
+			return nil, errors.Errorf("initializing source docker://%s: reading manifest: unauthorized: authentication required", name)
+		}
+	}
+	return []string{f.addImage(name)}, nil
+}
+
+func (f *FakeRuntime) ImageExists(name string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.images[name]
+	return ok, nil
+}
+
+func (f *FakeRuntime) InspectImage(name string) (*entities.ImageInspectReport, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for n, id := range f.images {
+		if n == name || id == name {
+			repoDigest := repository(n) + "@sha256:" + id
+			if strings.Contains(n, "@") {
+				repoDigest = n
+			}
+			return &entities.ImageInspectReport{ImageData: &inspect.ImageData{
+				ID:          id,
+				Digest:      digest.Digest("sha256:" + id),
+				RepoTags:    []string{n},
+				RepoDigests: []string{repoDigest},
+				User:        f.ImageUsers[n],
+			}}, nil
+		}
+	}
+	return nil, errors.Errorf("%s: image not known", name)
+}
+
+func (f *FakeRuntime) CreateVolume(options entities.VolumeCreateOptions) (*entities.VolumeConfigResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	name := options.Name
+	if name == "" {
+		name = f.newID()
+	}
+	if _, ok := f.volumes[name]; ok {
+		return nil, errors.Wrapf(define.ErrVolumeExists, "volume with name %s", name)
+	}
+	v := &entities.VolumeConfigResponse{InspectVolumeData: define.InspectVolumeData{
+		Name:       name,
+		Driver:     options.Driver,
+		Mountpoint: "/var/lib/containers/storage/volumes/" + name + "/_data",
+		CreatedAt:  time.Now(),
+		Labels:     options.Label,
+		Options:    options.Options,
+		Scope:      "local",
+	}}
+	f.volumes[name] = v
+	return v, nil
+}
+
+func (f *FakeRuntime) InspectVolume(name string) (*entities.VolumeConfigResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.volumes[name]
+	if !ok {
+		return nil, errors.Wrapf(define.ErrNoSuchVolume, "unable to find volume %q", name)
+	}
+	return v, nil
+}
+
+func (f *FakeRuntime) RemoveVolume(name string, force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.volumes[name]; !ok {
+		return errors.Wrapf(define.ErrNoSuchVolume, "unable to find volume %q", name)
+	}
+	for _, c := range f.containers {
+		if c.spec == nil {
+			continue
+		}
+		for _, v := range c.spec.Volumes {
+			if v.Name == name && !force {
+				return errors.Wrapf(define.ErrVolumeBeingUsed, "volume %s is being used by container %s", name, c.name)
+			}
+		}
+	}
+	delete(f.volumes, name)
+	return nil
+}
+
+func (f *FakeRuntime) NetworkExists(name string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.networks[name]
+	return ok, nil
+}
+
+func (f *FakeRuntime) CreateNetwork(name string, labels map[string]string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.networks[name]; ok {
+		return errors.Wrapf(define.ErrNetworkExists, "network name %s", name)
+	}
+	f.networks[name] = labels
+	return nil
+}
+
+func (f *FakeRuntime) ConnectNetwork(name, nameOrID string, aliases []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.networks[name]; !ok {
+		return errors.Wrapf(define.ErrNoSuchNetwork, "unable to find network with name or ID %s", name)
+	}
+	c, err := f.lookupContainer(nameOrID)
+	if err != nil {
+		return err
+	}
+	// only the bridge network mode supports networks, rootless pods use slirp4netns
+	p, ok := f.pods[c.podID]
+	if (ok && p.spec.NetNS.NSMode == specgen.Host) || (f.HostInfo.Host != nil && f.HostInfo.Host.Security.Rootless) {
+		return errors.Wrapf(define.ErrNetworkModeInvalid, "container %s is not in bridge network mode", c.name)
+	}
+	if _, ok := c.networks[name]; ok {
+		return errors.Errorf("container %s is already connected to network %q", c.id, name)
+	}
+	if c.networks == nil {
+		c.networks = map[string][]string{}
+	}
+	c.networks[name] = aliases
+	return nil
+}
+
+func (f *FakeRuntime) Info() (*define.Info, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info := f.HostInfo
+	return &info, nil
+}
+
+func (f *FakeRuntime) newID() string {
+	return fmt.Sprintf("%064x", atomic.AddUint64(&lastFakeID, 1))
+}
+
+func (f *FakeRuntime) addImage(name string) string {
+	if id, ok := f.images[name]; ok {
+		return id
+	}
+	id := f.newID()
+	f.images[name] = id
+	return id
+}
+
+func (f *FakeRuntime) lookupPod(nameOrID string) (*fakePod, error) {
+	for _, p := range f.pods {
+		if p.id == nameOrID || p.name == nameOrID {
+			return p, nil
+		}
+	}
+	return nil, errors.Wrapf(define.ErrNoSuchPod, "unable to find pod %q", nameOrID)
+}
+
+func (f *FakeRuntime) lookupContainer(nameOrID string) (*fakeContainer, error) {
+	for _, c := range f.containers {
+		if c.id == nameOrID || c.name == nameOrID {
+			return c, nil
+		}
+	}
+	return nil, errors.Wrapf(define.ErrNoSuchCtr, "unable to find container %q", nameOrID)
+}
+
+func (f *FakeRuntime) startContainer(c *fakeContainer) {
+	if c.state == define.ContainerStateRunning {
+		return
+	}
+	c.state = define.ContainerStateRunning
+	c.exitCode = 0
+	c.startedAt = time.Now()
+}
+
+func (f *FakeRuntime) stopContainer(c *fakeContainer, exitCode int32) {
+	c.state = define.ContainerStateExited
+	c.exitCode = exitCode
+	c.finishedAt = time.Now()
+}
+
+// fakeIP returns a stable IP address for a pod
+func fakeIP(id string) string {
+	var n int
+	fmt.Sscanf(id[len(id)-4:], "%x", &n)
+	return fmt.Sprintf("10.88.%d.%d", n/250, n%250+2)
+}
+
+// fakePodState computes the pod state from the state of its containers, following
+// the same rules as libpod
+func fakePodState(statuses map[string]define.ContainerStatus) string {
+	if len(statuses) == 0 {
+		return define.PodStateCreated
+	}
+	var running, paused, stopped, errored int
+	for _, s := range statuses {
+		switch s {
+		case define.ContainerStateExited, define.ContainerStateStopped:
+			stopped++
+		case define.ContainerStateRunning:
+			running++
+		case define.ContainerStatePaused:
+			paused++
+		case define.ContainerStateCreated, define.ContainerStateConfigured:
+		default:
+			errored++
+		}
+	}
+	switch {
+	case running == len(statuses):
+		return define.PodStateRunning
+	case running > 0:
+		return define.PodStateDegraded
+	case paused == len(statuses):
+		return define.PodStatePaused
+	case stopped == len(statuses):
+		return define.PodStateExited
+	case stopped > 0:
+		return define.PodStateStopped
+	case errored > 0:
+		return define.PodStateErrored
+	default:
+		return define.PodStateCreated
+	}
+}
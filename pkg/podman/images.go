@@ -0,0 +1,201 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/containers/podman/v3/pkg/bindings/images"
+	"github.com/docker/distribution/reference"
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+	// waiting reasons of containers whose image could not be pulled, as in the kubelet
+	reasonErrImagePull      = "ErrImagePull"
+	reasonImagePullBackOff  = "ImagePullBackOff"
+	reasonErrImageNeverPull = "ErrImageNeverPull"
+	reasonInvalidImageName  = "InvalidImageName"
+
+	// image pulls are retried with the same back-off as in the kubelet
+	imagePullBackOffPeriod = 10 * time.Second
+	maxImagePullBackOff    = 300 * time.Second
+)
+
+// imagePullFailures records the failed image pulls of containers, so that they are
+// reported in the container statuses and retried with an exponential back-off
+type imagePullFailures struct {
+	mu      sync.Mutex
+	backOff *flowcontrol.Backoff
+	// failures holds the waiting state of the containers whose image is not available,
+	// or whose configuration could not be honored
+	failures map[string]*corev1.ContainerStateWaiting
+}
+
+func newImagePullFailures(backOff *flowcontrol.Backoff) *imagePullFailures {
+	return &imagePullFailures{
+		backOff:  backOff,
+		failures: map[string]*corev1.ContainerStateWaiting{},
+	}
+}
+
+// imagePullKey identifies the image of a container of a pod instance
+func imagePullKey(p *corev1.Pod, container *corev1.Container) string {
+	return fmt.Sprintf("%s_%s_%s", p.UID, podmanContainerName(p, container.Name), container.Image)
+}
+
+func (f *imagePullFailures) set(key, reason, message string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[key] = &corev1.ContainerStateWaiting{Reason: reason, Message: message}
+}
+
+func (f *imagePullFailures) get(key string) *corev1.ContainerStateWaiting {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if w, ok := f.failures[key]; ok {
+		return w.DeepCopy()
+	}
+	return nil
+}
+
+func (f *imagePullFailures) clear(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.failures, key)
+	f.backOff.DeleteEntry(key)
+}
+
+// getImagePullPolicy returns the pull policy of a container, defaulting it as the API
+// server does: Always for images without a tag or with the latest tag, and
+// IfNotPresent otherwise, including images pinned by digest
+func getImagePullPolicy(container *corev1.Container) corev1.PullPolicy {
+	if container.ImagePullPolicy != "" {
+		return container.ImagePullPolicy
+	}
+	named, err := reference.ParseNormalizedNamed(container.Image)
+	if err != nil {
+		return corev1.PullAlways
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return corev1.PullIfNotPresent
+	}
+	if tagged, ok := named.(reference.Tagged); ok && tagged.Tag() != "latest" {
+		return corev1.PullIfNotPresent
+	}
+	return corev1.PullAlways
+}
+
+// ensureImage makes sure that the image of a container is present according to its pull
+// policy, and returns the name of the local image. The image name is resolved with the
+// registries configuration and each of its pull sources is tried in turn, with the
+// credentials of the keyring. Failures are recorded to be reported in the container
+// status, and failed pulls are retried only once their back-off expired.
+func (m *PodManager) ensureImage(p *corev1.Pod, container *corev1.Container, config *registriesConfig, keyring *Keyring) (string, bool) {
+	key := imagePullKey(p, container)
+	names, err := config.resolveImage(container.Image)
+	if err != nil {
+		message := fmt.Sprintf("Failed to resolve image %q: %v", container.Image, err)
+		m.pullFailures.set(key, reasonInvalidImageName, message)
+		m.containerEvent(p, container, corev1.EventTypeWarning, EventInspectFailed, message)
+		return "", false
+	}
+	sources := []string{}
+	for _, name := range names {
+		sources = append(sources, config.pullSources(name)...)
+	}
+
+	policy := getImagePullPolicy(container)
+	if policy != corev1.PullAlways {
+		for _, source := range sources {
+			if present, err := m.rt.ImageExists(source); err == nil && present {
+				m.pullFailures.clear(key)
+				m.containerEvent(p, container, corev1.EventTypeNormal, EventPulled,
+					"Container image %q already present on machine", container.Image)
+				return source, true
+			}
+		}
+		if policy == corev1.PullNever {
+			message := fmt.Sprintf("Container image %q is not present with pull policy of Never", container.Image)
+			m.pullFailures.set(key, reasonErrImageNeverPull, message)
+			m.containerEvent(p, container, corev1.EventTypeWarning, EventErrImageNeverPull, message)
+			return "", false
+		}
+	}
+
+	now := m.pullFailures.backOff.Clock.Now()
+	if m.pullFailures.backOff.IsInBackOffSinceUpdate(key, now) {
+		message := fmt.Sprintf("Back-off pulling image %q", container.Image)
+		m.pullFailures.set(key, reasonImagePullBackOff, message)
+		m.containerEvent(p, container, corev1.EventTypeNormal, EventBackOff, message)
+		return "", false
+	}
+	m.containerEvent(p, container, corev1.EventTypeNormal, EventPulling, "Pulling image %q", container.Image)
+	errs := []error{}
+	for _, source := range sources {
+		start := time.Now()
+		if err := pullImage(m.rt, source, keyring.Lookup(source)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		m.pullFailures.clear(key)
+		m.containerEvent(p, container, corev1.EventTypeNormal, EventPulled,
+			"Successfully pulled image %q in %v", container.Image, time.Since(start))
+		return source, true
+	}
+	m.pullFailures.backOff.Next(key, now)
+	err = utilerrors.NewAggregate(errs)
+	m.pullFailures.set(key, reasonErrImagePull, err.Error())
+	m.containerEvent(p, container, corev1.EventTypeWarning, EventFailed, "Failed to pull image %q: %v", container.Image, err)
+	return "", false
+}
+
+// pullImage pulls an image, trying the matching credentials in turn, or anonymously if
+// there is none. Credentials are sent with the request, not written to an auth file.
+func pullImage(rt PodmanRuntime, image string, auths []RegistryAuth) error {
+	if len(auths) == 0 {
+		_, err := rt.PullImage(image, &images.PullOptions{})
+		return err
+	}
+	var err error
+	for _, auth := range auths {
+		options := new(images.PullOptions).WithUsername(auth.Username).WithPassword(auth.Password)
+		if _, err = rt.PullImage(image, options); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// getCreatingState returns the waiting state of a container which was not created yet
+func (m *PodManager) getCreatingState(p *corev1.Pod, container *corev1.Container) *corev1.ContainerStateWaiting {
+	if w := m.pullFailures.get(imagePullKey(p, container)); w != nil {
+		return w
+	}
+	return &corev1.ContainerStateWaiting{Reason: reasonContainerCreating}
+}
+
+// forgetImagePulls drops the image pull failures recorded for a pod
+func (m *PodManager) forgetImagePulls(p *corev1.Pod) {
+	for _, container := range podContainers(p) {
+		m.pullFailures.clear(imagePullKey(p, container))
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func TestGetImagePullPolicy(t *testing.T) {
+	tests := []struct {
+		image    string
+		policy   corev1.PullPolicy
+		expected corev1.PullPolicy
+	}{
+		{"busybox", "", corev1.PullAlways},
+		{"busybox:latest", "", corev1.PullAlways},
+		{"busybox:1.25", "", corev1.PullIfNotPresent},
+		{"localhost:5000/busybox", "", corev1.PullAlways},
+		{"busybox@sha256:9f1003c480699be56815db0f8146ad2e22efea85129b5b5983d0e0fb52d9ab70", "", corev1.PullIfNotPresent},
+		{"busybox:latest", corev1.PullNever, corev1.PullNever},
+	}
+	for _, tt := range tests {
+		container := &corev1.Container{Image: tt.image, ImagePullPolicy: tt.policy}
+		assert.Equal(t, tt.expected, getImagePullPolicy(container), tt.image)
+	}
+}
+
+func TestImagePullPolicy(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	rt.AddImage("docker.io/library/" + image)
+	rt.PullErrors = map[string]error{"docker.io/library/" + image: errors.New("registry unavailable")}
+
+	// present images are not pulled with IfNotPresent
+	pod := newStatusTestPod()
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.NotNil(t, pod.Status.ContainerStatuses[0].State.Running)
+
+	// missing images are not pulled with Never
+	pod = newStatusTestPod()
+	pod.Name = "never"
+	pod.Spec.Containers[0].Image = "busybox:1.26"
+	pod.Spec.Containers[0].ImagePullPolicy = corev1.PullNever
+	_, err = m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.Equal(t, reasonErrImageNeverPull, pod.Status.ContainerStatuses[0].State.Waiting.Reason)
+	assert.NotContains(t, rt.Images(), "docker.io/library/busybox:1.26")
+}
+
+func TestImagePullBackOff(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	m.pullFailures = newImagePullFailures(flowcontrol.NewFakeBackOff(imagePullBackOffPeriod, maxImagePullBackOff, fakeClock))
+	rt.PullErrors = map[string]error{"docker.io/library/" + image: errors.New("manifest unknown")}
+	pod := newStatusTestPod()
+
+	// a failed pull does not fail the pod creation
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	waiting := pod.Status.ContainerStatuses[0].State.Waiting
+	assert.Equal(t, reasonErrImagePull, waiting.Reason)
+	assert.Equal(t, "manifest unknown", waiting.Message)
+	assert.Equal(t, corev1.PodPending, pod.Status.Phase)
+
+	// the pull is not retried during the back-off
+	delete(rt.PullErrors, "docker.io/library/"+image)
+	assert.NoError(t, m.CreateContainers(pod, nil, nil))
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.Equal(t, reasonImagePullBackOff, pod.Status.ContainerStatuses[0].State.Waiting.Reason)
+
+	fakeClock.Step(imagePullBackOffPeriod + time.Second)
+	assert.NoError(t, m.CreateContainers(pod, nil, nil))
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.NotNil(t, pod.Status.ContainerStatuses[0].State.Running)
+	assert.Equal(t, corev1.PodRunning, pod.Status.Phase)
+}
+
+func TestImageDigestPinning(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	pinned := "busybox@sha256:9f1003c480699be56815db0f8146ad2e22efea85129b5b5983d0e0fb52d9ab70"
+	pod.Spec.Containers[0].Image = pinned
+
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.Equal(t, "docker.io/library/"+pinned, pod.Status.ContainerStatuses[0].ImageID)
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func newInitTestPod() *corev1.Pod {
+	pod := newStatusTestPod()
+	pod.Spec.InitContainers = []corev1.Container{
+		{Name: "init-1", Image: image, Command: []string{"true"}},
+		{Name: "init-2", Image: image, Command: []string{"true"}},
+	}
+	return pod
+}
+
+func TestInitContainersRunSequentially(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newInitTestPod()
+
+	// only the first init container is created with the pod
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.Equal(t, corev1.PodPending, pod.Status.Phase)
+	assert.Len(t, pod.Status.InitContainerStatuses, 2)
+	assert.NotNil(t, pod.Status.InitContainerStatuses[0].State.Running)
+	assert.Equal(t, reasonPodInitializing, pod.Status.InitContainerStatuses[1].State.Waiting.Reason)
+	assert.Equal(t, reasonPodInitializing, pod.Status.ContainerStatuses[0].State.Waiting.Reason)
+	initialized := getPodCondition(pod.Status.Conditions, corev1.PodInitialized)
+	assert.Equal(t, corev1.ConditionFalse, initialized.Status)
+	assert.Equal(t, reasonContainersNotInitialized, initialized.Reason)
+	assert.Equal(t, "containers with incomplete status: [init-1 init-2]", initialized.Message)
+
+	// the next init container is created once the previous one completed
+	assert.NoError(t, rt.SetContainerExited(podmanContainerName(pod, "init-1"), 0))
+	assert.NoError(t, m.CreateContainers(pod, nil, nil))
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.True(t, pod.Status.InitContainerStatuses[0].Ready)
+	assert.Equal(t, reasonCompleted, pod.Status.InitContainerStatuses[0].State.Terminated.Reason)
+	assert.NotNil(t, pod.Status.InitContainerStatuses[1].State.Running)
+	assert.Equal(t, reasonPodInitializing, pod.Status.ContainerStatuses[0].State.Waiting.Reason)
+	assert.Equal(t, "containers with incomplete status: [init-2]",
+		getPodCondition(pod.Status.Conditions, corev1.PodInitialized).Message)
+
+	// the app containers are created once all init containers completed
+	assert.NoError(t, rt.SetContainerExited(podmanContainerName(pod, "init-2"), 0))
+	assert.NoError(t, m.CreateContainers(pod, nil, nil))
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.NotNil(t, pod.Status.ContainerStatuses[0].State.Running)
+	assert.Equal(t, corev1.PodRunning, pod.Status.Phase)
+	assert.Equal(t, corev1.ConditionTrue, getPodCondition(pod.Status.Conditions, corev1.PodInitialized).Status)
+
+	// completed init containers are not restarted with the Always policy
+	next, err := m.RestartContainers(pod)
+	assert.NoError(t, err)
+	assert.Zero(t, next)
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.NotNil(t, pod.Status.InitContainerStatuses[0].State.Terminated)
+	assert.Zero(t, pod.Status.InitContainerStatuses[0].RestartCount)
+}
+
+func TestInitContainerFailure(t *testing.T) {
+
+	tests := []struct {
+		policy corev1.RestartPolicy
+		phase  corev1.PodPhase
+		retry  bool
+	}{
+		{corev1.RestartPolicyAlways, corev1.PodPending, true},
+		{corev1.RestartPolicyOnFailure, corev1.PodPending, true},
+		{corev1.RestartPolicyNever, corev1.PodFailed, false},
+	}
+	for _, tt := range tests {
+		rt := NewFakeRuntime()
+		m := newTestPodManager(rt)
+		pod := newInitTestPod()
+		pod.Spec.RestartPolicy = tt.policy
+		_, err := m.CreatePod(pod, nil, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, rt.SetContainerExited(podmanContainerName(pod, "init-1"), 1))
+		assert.NoError(t, m.GetPodStatus(pod))
+		assert.Equal(t, tt.phase, pod.Status.Phase, "policy %q", tt.policy)
+
+		// a failed init container does not let the next containers be created
+		assert.NoError(t, m.CreateContainers(pod, nil, nil))
+		_, err = rt.InspectContainer(podmanContainerName(pod, "init-2"))
+		assert.True(t, IsContainerNotFound(err))
+
+		_, err = m.RestartContainers(pod)
+		assert.NoError(t, err)
+		assert.NoError(t, m.GetPodStatus(pod))
+		cs := pod.Status.InitContainerStatuses[0]
+		assert.Equal(t, tt.retry, cs.State.Running != nil, "policy %q", tt.policy)
+		if tt.retry {
+			assert.Equal(t, int32(1), cs.RestartCount)
+			assert.Equal(t, int32(1), cs.LastTerminationState.Terminated.ExitCode)
+		}
+		assert.Equal(t, corev1.ConditionFalse, getPodCondition(pod.Status.Conditions, corev1.PodInitialized).Status)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// RegistryAuth is a credential for an image registry
+type RegistryAuth struct {
+	Username string
+	Password string
+}
+
+// Keyring holds the registry credentials of a pod, read from its pull secrets. The
+// credentials are kept in memory and passed to podman with the pull requests, so that
+// they are never written to disk.
+type Keyring struct {
+	entries []keyringEntry
+}
+
+type keyringEntry struct {
+	// host may contain wildcards, as *.example.com
+	host string
+	// path is a repository path prefix
+	path string
+	auth RegistryAuth
+}
+
+// dockerConfigEntry is an entry of a .dockercfg or .dockerconfigjson file
+type dockerConfigEntry struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+}
+
+// NewKeyring returns an empty Keyring
+func NewKeyring() *Keyring {
+	return &Keyring{}
+}
+
+// Add adds a credential for a registry location, which is a registry host optionally
+// followed by a repository path prefix
+func (k *Keyring) Add(location string, auth RegistryAuth) {
+	host, path := parseRegistryLocation(location)
+	k.entries = append(k.entries, keyringEntry{host: host, path: path, auth: auth})
+	// the most specific locations are tried first
+	sort.SliceStable(k.entries, func(i, j int) bool {
+		return len(k.entries[i].host)+len(k.entries[i].path) > len(k.entries[j].host)+len(k.entries[j].path)
+	})
+}
+
+// AddSecret adds the credentials of a kubernetes.io/dockerconfigjson or
+// kubernetes.io/dockercfg secret. Secrets of other types are ignored.
+func (k *Keyring) AddSecret(secret *corev1.Secret) error {
+	var entries map[string]dockerConfigEntry
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		config := struct {
+			Auths map[string]dockerConfigEntry `json:"auths"`
+		}{}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return fmt.Errorf("invalid %s in secret %s: %w", corev1.DockerConfigJsonKey, secret.Name, err)
+		}
+		entries = config.Auths
+	case corev1.SecretTypeDockercfg:
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &entries); err != nil {
+			return fmt.Errorf("invalid %s in secret %s: %w", corev1.DockerConfigKey, secret.Name, err)
+		}
+	default:
+		return nil
+	}
+
+	locations := make([]string, 0, len(entries))
+	for location := range entries {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	for _, location := range locations {
+		entry := entries[location]
+		auth := RegistryAuth{Username: entry.Username, Password: entry.Password}
+		if auth.Username == "" && entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return fmt.Errorf("invalid auth for %s in secret %s: %w", location, secret.Name, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid auth for %s in secret %s: expected username:password", location, secret.Name)
+			}
+			auth = RegistryAuth{Username: parts[0], Password: parts[1]}
+		}
+		k.Add(location, auth)
+	}
+	return nil
+}
+
+// Lookup returns the credentials matching a fully qualified image name, most specific first
+func (k *Keyring) Lookup(image string) []RegistryAuth {
+	if k == nil {
+		return nil
+	}
+	host, repo := parseRegistryLocation(repository(image))
+	auths := []RegistryAuth{}
+	for _, e := range k.entries {
+		if hostMatches(e.host, host) && (e.path == "" || repo == e.path || strings.HasPrefix(repo, e.path+"/")) {
+			auths = append(auths, e.auth)
+		}
+	}
+	return auths
+}
+
+// parseRegistryLocation splits a registry location in host and path, dropping the
+// scheme and normalizing the Docker Hub aliases
+func parseRegistryLocation(location string) (string, string) {
+	location = strings.TrimPrefix(strings.TrimPrefix(location, "https://"), "http://")
+	location = strings.TrimSuffix(location, "/")
+	host, path := location, ""
+	if i := strings.Index(location, "/"); i >= 0 {
+		host, path = location[:i], location[i+1:]
+	}
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		host = dockerHubDomain
+		// the legacy Docker Hub location is https://index.docker.io/v1/
+		if path == "v1" {
+			path = ""
+		}
+	}
+	return strings.ToLower(host), path
+}
+
+// hostMatches matches a registry host against a pattern, which may contain wildcards
+// in its domain labels. Ports must match exactly.
+func hostMatches(pattern, host string) bool {
+	patternLabels, hostLabels := strings.Split(pattern, "."), strings.Split(host, ".")
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+	for i := range patternLabels {
+		if ok, err := path.Match(patternLabels[i], hostLabels[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestKeyringAddSecret(t *testing.T) {
+	keyring := NewKeyring()
+	assert.NoError(t, keyring.AddSecret(&corev1.Secret{
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths": {
+			"https://index.docker.io/v1/": {"auth": "aHViOnNlY3JldA=="},
+			"quay.io/myorg": {"username": "org", "password": "orgpass"},
+			"quay.io": {"username": "quay", "password": "quaypass"}}}`)},
+	}))
+	assert.NoError(t, keyring.AddSecret(&corev1.Secret{
+		Type: corev1.SecretTypeDockercfg,
+		Data: map[string][]byte{corev1.DockerConfigKey: []byte(`{"*.example.com:5000": {"username": "ex", "password": "expass"}}`)},
+	}))
+	assert.NoError(t, keyring.AddSecret(&corev1.Secret{Type: corev1.SecretTypeOpaque}))
+	assert.Error(t, keyring.AddSecret(&corev1.Secret{
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(`not json`)},
+	}))
+
+	assert.Equal(t, []RegistryAuth{{"hub", "secret"}}, keyring.Lookup("docker.io/library/busybox:1.25"))
+	assert.Equal(t, []RegistryAuth{{"org", "orgpass"}, {"quay", "quaypass"}}, keyring.Lookup("quay.io/myorg/app:v1"))
+	assert.Equal(t, []RegistryAuth{{"quay", "quaypass"}}, keyring.Lookup("quay.io/myorganization/app"))
+	assert.Equal(t, []RegistryAuth{{"ex", "expass"}}, keyring.Lookup("registry.example.com:5000/app@sha256:abc"))
+	assert.Empty(t, keyring.Lookup("registry.example.com/app"))
+	assert.Empty(t, keyring.Lookup("ghcr.io/app"))
+	assert.Empty(t, (*Keyring)(nil).Lookup("quay.io/myorg/app"))
+}
+
+func TestCreatePodWithPullCredentials(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	private := "quay.io/myorg/app:v1"
+	rt.PullAuth[private] = RegistryAuth{Username: "org", Password: "orgpass"}
+	pod := newStatusTestPod()
+	pod.Spec.Containers[0].Image = private
+
+	keyring := NewKeyring()
+	keyring.Add("quay.io", RegistryAuth{Username: "wrong", Password: "wrong"})
+	keyring.Add("quay.io/myorg", RegistryAuth{Username: "org", Password: "orgpass"})
+	_, err := m.CreatePod(pod, nil, keyring)
+	assert.NoError(t, err)
+	assert.Contains(t, rt.Images(), private)
+}
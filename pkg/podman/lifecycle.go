@@ -0,0 +1,174 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/podman/v3/libpod/define"
+	corev1 "k8s.io/api/core/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// terminated reason of containers killed because their postStart hook failed
+	reasonPostStartHookError = "PostStartHookError"
+
+	// containers get at least this grace period after their preStop hook, as in the kubelet
+	minimumGracePeriodSeconds = 2
+)
+
+// hookFailures records the postStart hook failures of containers by podman container
+// ID, for the run of the container started at the given time
+type hookFailures struct {
+	mu      sync.Mutex
+	entries map[string]hookFailure
+}
+
+type hookFailure struct {
+	startedAt time.Time
+	message   string
+}
+
+func (h *hookFailures) set(id string, startedAt time.Time, message string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries[id] = hookFailure{startedAt: startedAt, message: message}
+}
+
+// get returns the hook failure message of a run of a container, if its hook failed
+func (h *hookFailures) get(id string, startedAt time.Time) (string, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if entry, ok := h.entries[id]; ok && entry.startedAt.Equal(startedAt) {
+		return entry.message, true
+	}
+	return "", false
+}
+
+func (h *hookFailures) clear(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.entries, id)
+}
+
+// getPodTerminationGracePeriod returns the grace period of the containers of a pod, which
+// is overridden by the grace period of the delete options once the pod is deleted
+func getPodTerminationGracePeriod(p *corev1.Pod) int64 {
+	if p.DeletionGracePeriodSeconds != nil {
+		return *p.DeletionGracePeriodSeconds
+	}
+	if p.Spec.TerminationGracePeriodSeconds != nil {
+		return *p.Spec.TerminationGracePeriodSeconds
+	}
+	return defaultTerminationGracePeriodSeconds
+}
+
+// startContainer starts a container and runs its postStart hook. As in the kubelet, a
+// container whose hook fails is killed, and restarted according to the restart policy.
+func (m *PodManager) startContainer(p *corev1.Pod, container *corev1.Container, name string) error {
+	if err := m.rt.StartContainer(name); err != nil {
+		m.containerEvent(p, container, corev1.EventTypeWarning, EventFailed, "Error: %v", err)
+		return err
+	}
+	m.containerEvent(p, container, corev1.EventTypeNormal, EventStarted, "Started container %s", container.Name)
+	if container.Lifecycle == nil || container.Lifecycle.PostStart == nil {
+		return nil
+	}
+	gracePeriod := getPodTerminationGracePeriod(p)
+	ok, message := runHandler(m.rt, p, container, container.Lifecycle.PostStart, time.Duration(gracePeriod)*time.Second)
+	if ok {
+		return nil
+	}
+	klog.Infof("postStart hook of container %s failed, will be killed: %s", name, message)
+	m.containerEvent(p, container, corev1.EventTypeWarning, EventFailedPostStartHook,
+		"PostStartHook failed: %s", message)
+	data, err := m.rt.InspectContainer(name)
+	if err != nil {
+		return err
+	}
+	if data.State != nil {
+		m.postStartFailures.set(data.ID, data.State.StartedAt, "PostStartHook failed: "+message)
+	}
+	return m.stopContainer(p, container, gracePeriod, "FailedPostStartHook")
+}
+
+// stopContainer stops a running container within a grace period. The preStop hook of
+// the container runs first, then podman sends the stop signal of the image and kills
+// the container if it did not exit in the rest of the grace period. The reason of the
+// stop is reported in the Killing event of the container.
+func (m *PodManager) stopContainer(p *corev1.Pod, container *corev1.Container, gracePeriod int64, reason string) error {
+	name := podmanContainerName(p, container.Name)
+	data, err := m.rt.InspectContainer(name)
+	if err != nil {
+		if IsContainerNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if data.State == nil || data.State.Status != define.ContainerStateRunning.String() {
+		return nil
+	}
+	m.containerEvent(p, container, corev1.EventTypeNormal, EventKilling, "%s", reason)
+	if container.Lifecycle != nil && container.Lifecycle.PreStop != nil && gracePeriod > 0 {
+		start := time.Now()
+		if ok, message := runHandler(m.rt, p, container, container.Lifecycle.PreStop, time.Duration(gracePeriod)*time.Second); !ok {
+			klog.Infof("preStop hook of container %s failed: %s", name, message)
+			m.containerEvent(p, container, corev1.EventTypeWarning, EventFailedPreStopHook,
+				"PreStopHook failed: %s", message)
+		}
+		gracePeriod -= int64(time.Since(start).Seconds())
+		if gracePeriod < minimumGracePeriodSeconds {
+			gracePeriod = minimumGracePeriodSeconds
+		}
+	}
+	if gracePeriod < 0 {
+		gracePeriod = 0
+	}
+	return m.rt.StopContainer(name, uint(gracePeriod))
+}
+
+// stopPodContainers stops the running containers of a pod in parallel, within the
+// termination grace period of the pod
+func (m *PodManager) stopPodContainers(p *corev1.Pod) error {
+	gracePeriod := getPodTerminationGracePeriod(p)
+	containers := podContainers(p)
+	errs := make([]error, len(containers))
+	var wg sync.WaitGroup
+	for i, container := range containers {
+		wg.Add(1)
+		go func(i int, container *corev1.Container) {
+			defer wg.Done()
+			errs[i] = m.stopContainer(p, container, gracePeriod, fmt.Sprintf("Stopping container %s", container.Name))
+		}(i, container)
+	}
+	wg.Wait()
+	return utilerrors.NewAggregate(errs)
+}
+
+// forgetHookFailures drops the hook failures recorded for the containers of a pod
+func (m *PodManager) forgetHookFailures(p *corev1.Pod) {
+	for _, statuses := range [][]corev1.ContainerStatus{p.Status.InitContainerStatuses, p.Status.ContainerStatuses} {
+		for _, cs := range statuses {
+			m.postStartFailures.clear(strings.TrimPrefix(cs.ContainerID, containerIDPrefix))
+		}
+	}
+}
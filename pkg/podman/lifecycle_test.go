@@ -0,0 +1,103 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestPostStartHook(t *testing.T) {
+
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	pod.Spec.RestartPolicy = corev1.RestartPolicyNever
+	pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{
+		PostStart: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"touch", "/ready"}}},
+	}
+	name := podmanContainerName(pod, containerName)
+
+	// a successful hook runs after the container started
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	execs, err := rt.ExecCommands(name)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"touch /ready"}, execs)
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.NotNil(t, pod.Status.ContainerStatuses[0].State.Running)
+	_, err = m.RemovePod(pod)
+	assert.NoError(t, err)
+
+	// the container is killed when its hook fails
+	rt.ExecExitCodes["touch /ready"] = 1
+	pod.Status = corev1.PodStatus{}
+	_, err = m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	terminated := pod.Status.ContainerStatuses[0].State.Terminated
+	if assert.NotNil(t, terminated) {
+		assert.Equal(t, reasonPostStartHookError, terminated.Reason)
+		assert.Equal(t, `PostStartHook failed: command ["touch" "/ready"] exited with 1`, terminated.Message)
+	}
+	assert.Equal(t, corev1.PodFailed, pod.Status.Phase)
+	_, err = m.RemovePod(pod)
+	assert.NoError(t, err)
+}
+
+func TestStopPodContainers(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	gracePeriod := int64(60)
+	pod.Spec.TerminationGracePeriodSeconds = &gracePeriod
+	pod.Spec.Containers[0].Lifecycle = &corev1.Lifecycle{
+		PreStop: &corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"nginx", "-s", "quit"}}},
+	}
+	name := podmanContainerName(pod, containerName)
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+
+	// the preStop hook runs before the container is stopped within the grace period
+	assert.NoError(t, m.stopPodContainers(pod))
+	execs, err := rt.ExecCommands(name)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nginx -s quit"}, execs)
+	timeout, err := rt.StopTimeout(name)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(60), timeout)
+
+	// the grace period of the delete options overrides the one of the pod
+	assert.NoError(t, rt.StartContainer(name))
+	override := int64(5)
+	pod.DeletionGracePeriodSeconds = &override
+	assert.NoError(t, m.stopPodContainers(pod))
+	timeout, err = rt.StopTimeout(name)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(5), timeout)
+
+	// stopped containers are not stopped again
+	assert.NoError(t, m.stopPodContainers(pod))
+	execs, err = rt.ExecCommands(name)
+	assert.NoError(t, err)
+	assert.Len(t, execs, 2)
+
+	_, err = m.RemovePod(pod)
+	assert.NoError(t, err)
+}
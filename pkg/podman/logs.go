@@ -0,0 +1,169 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/containers/podman/v3/pkg/bindings/containers"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// errLogLimitReached stops the streaming of logs once limitBytes were written
+var errLogLimitReached = errors.New("log limit reached")
+
+// CheckLogOptions checks that the logs of a pod can be served with the given options,
+// returning the name of the container whose logs are requested. The container may be
+// omitted for pods with a single container.
+func CheckLogOptions(p *corev1.Pod, opts *corev1.PodLogOptions) (string, error) {
+	container, err := getContainer(p, opts.Container)
+	if err != nil {
+		return "", err
+	}
+	name := container.Name
+	if opts.SinceSeconds != nil && opts.SinceTime != nil {
+		return "", errors.New("at most one of sinceTime or sinceSeconds may be specified")
+	}
+	for _, v := range []*int64{opts.SinceSeconds, opts.TailLines, opts.LimitBytes} {
+		if v != nil && *v < 0 {
+			return "", errors.New("sinceSeconds, tailLines and limitBytes must not be negative")
+		}
+	}
+	if opts.Previous && getLastTermination(p, name) == nil {
+		return "", fmt.Errorf("previous terminated container %q in pod %q not found", name, p.Name)
+	}
+	return name, nil
+}
+
+// GetContainerLogs writes the logs of a container of a pod to w, following them until
+// ctx is done if requested. Podman keeps the logs of all the runs of a container, so
+// the logs of the previous run are those written between its start and its exit.
+func GetContainerLogs(ctx context.Context, rt PodmanRuntime, p *corev1.Pod, opts *corev1.PodLogOptions, w io.Writer) error {
+	name, err := CheckLogOptions(p, opts)
+	if err != nil {
+		return err
+	}
+	options := new(containers.LogOptions).WithStdout(true).WithStderr(true).WithTimestamps(opts.Timestamps)
+	var since time.Time
+	switch {
+	case opts.SinceSeconds != nil:
+		since = time.Now().Add(-time.Duration(*opts.SinceSeconds) * time.Second)
+	case opts.SinceTime != nil:
+		since = opts.SinceTime.Time
+	}
+	if opts.Previous {
+		last := getLastTermination(p, name)
+		if last.StartedAt.After(since) {
+			since = last.StartedAt.Time
+		}
+		options.WithUntil(last.FinishedAt.Format(time.RFC3339Nano))
+	} else {
+		options.WithFollow(opts.Follow)
+	}
+	if !since.IsZero() {
+		options.WithSince(since.Format(time.RFC3339Nano))
+	}
+	if opts.TailLines != nil {
+		options.WithTail(strconv.FormatInt(*opts.TailLines, 10))
+	}
+	if opts.LimitBytes != nil {
+		w = &limitWriter{w: w, remaining: *opts.LimitBytes}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stdout, stderr := make(chan string), make(chan string)
+	done := make(chan error, 1)
+	go func() {
+		done <- rt.ContainerLogs(ctx, podmanContainerName(p, name), options, stdout, stderr)
+	}()
+	for {
+		var line string
+		select {
+		case line = <-stdout:
+		case line = <-stderr:
+		case err := <-done:
+			return err
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			if errors.Is(err, errLogLimitReached) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// getContainer returns a container of a pod by name, or its only container if the name
+// is empty
+func getContainer(p *corev1.Pod, name string) (*corev1.Container, error) {
+	if name == "" {
+		if len(p.Spec.Containers) != 1 {
+			names := []string{}
+			for _, container := range p.Spec.Containers {
+				names = append(names, container.Name)
+			}
+			return nil, fmt.Errorf("a container name must be specified for pod %s, choose one of: %v", p.Name, names)
+		}
+		return &p.Spec.Containers[0], nil
+	}
+	container := getContainerByName(p.Spec.Containers, name)
+	if container == nil {
+		container = getContainerByName(p.Spec.InitContainers, name)
+	}
+	if container == nil {
+		return nil, fmt.Errorf("container %s is not valid for pod %s", name, p.Name)
+	}
+	return container, nil
+}
+
+// getLastTermination returns the last termination state of a container of a pod
+func getLastTermination(p *corev1.Pod, name string) *corev1.ContainerStateTerminated {
+	cs := getContainerStatusByName(p.Status.ContainerStatuses, name)
+	if cs == nil {
+		cs = getContainerStatusByName(p.Status.InitContainerStatuses, name)
+	}
+	if cs == nil {
+		return nil
+	}
+	return cs.LastTerminationState.Terminated
+}
+
+// limitWriter writes up to a number of bytes, truncating the last write
+type limitWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (l *limitWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) <= l.remaining {
+		n, err := l.w.Write(b)
+		l.remaining -= int64(n)
+		return n, err
+	}
+	n, err := l.w.Write(b[:l.remaining])
+	l.remaining -= int64(n)
+	if err == nil {
+		err = errLogLimitReached
+	}
+	return n, err
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func getLogs(t *testing.T, rt PodmanRuntime, pod *corev1.Pod, opts *corev1.PodLogOptions) string {
+	var b bytes.Buffer
+	assert.NoError(t, GetContainerLogs(context.TODO(), rt, pod, opts, &b))
+	return b.String()
+}
+
+func TestGetContainerLogs(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	name := podmanContainerName(pod, containerName)
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, rt.WriteContainerLog(name, false, "one"))
+	assert.NoError(t, rt.WriteContainerLog(name, true, "two"))
+	assert.NoError(t, rt.WriteContainerLog(name, false, "three"))
+
+	assert.Equal(t, "one\ntwo\nthree\n", getLogs(t, rt, pod, &corev1.PodLogOptions{}))
+	tail := int64(2)
+	assert.Equal(t, "two\nthree\n", getLogs(t, rt, pod, &corev1.PodLogOptions{Container: containerName, TailLines: &tail}))
+	limit := int64(6)
+	assert.Equal(t, "one\ntw", getLogs(t, rt, pod, &corev1.PodLogOptions{LimitBytes: &limit}))
+	since := int64(60)
+	assert.Equal(t, "one\ntwo\nthree\n", getLogs(t, rt, pod, &corev1.PodLogOptions{SinceSeconds: &since}))
+
+	logs := getLogs(t, rt, pod, &corev1.PodLogOptions{Timestamps: true})
+	lines := strings.Split(strings.TrimSuffix(logs, "\n"), "\n")
+	if assert.Len(t, lines, 3) {
+		fields := strings.SplitN(lines[0], " ", 2)
+		_, err := time.Parse(time.RFC3339Nano, fields[0])
+		assert.NoError(t, err)
+		assert.Equal(t, "one", fields[1])
+	}
+}
+
+func TestGetPreviousContainerLogs(t *testing.T) {
+
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	name := podmanContainerName(pod, containerName)
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	_, err = CheckLogOptions(pod, &corev1.PodLogOptions{Previous: true})
+	assert.EqualError(t, err, `previous terminated container "busybox" in pod "mypod" not found`)
+
+	assert.NoError(t, rt.WriteContainerLog(name, false, "first run"))
+	assert.NoError(t, rt.SetContainerExited(name, 1))
+	assert.NoError(t, m.GetPodStatus(pod))
+	_, err = m.RestartContainers(pod)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.NoError(t, rt.WriteContainerLog(name, false, "second run"))
+
+	assert.Equal(t, "first run\n", getLogs(t, rt, pod, &corev1.PodLogOptions{Previous: true}))
+	assert.Equal(t, "first run\nsecond run\n", getLogs(t, rt, pod, &corev1.PodLogOptions{}))
+}
+
+func TestCheckLogOptions(t *testing.T) {
+	pod := newInitTestPod()
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "sidecar", Image: image})
+
+	_, err := CheckLogOptions(pod, &corev1.PodLogOptions{})
+	assert.EqualError(t, err, "a container name must be specified for pod mypod, choose one of: [busybox sidecar]")
+	_, err = CheckLogOptions(pod, &corev1.PodLogOptions{Container: "missing"})
+	assert.EqualError(t, err, "container missing is not valid for pod mypod")
+	name, err := CheckLogOptions(pod, &corev1.PodLogOptions{Container: "init-1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "init-1", name)
+	tail := int64(-1)
+	_, err = CheckLogOptions(pod, &corev1.PodLogOptions{Container: "sidecar", TailLines: &tail})
+	assert.Error(t, err)
+}
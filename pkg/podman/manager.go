@@ -20,20 +20,14 @@ import (
 	"context"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/containers/podman/v3/pkg/bindings"
-	"github.com/containers/podman/v3/pkg/bindings/containers"
-	"github.com/containers/podman/v3/pkg/bindings/images"
-	"github.com/containers/podman/v3/pkg/bindings/pods"
 	"github.com/containers/podman/v3/pkg/domain/entities"
 	"github.com/containers/podman/v3/pkg/specgen"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-)
-
-const (
-	dockerRegistry = "docker.io"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
 )
 
 // GetConnection - gets a connection to the podman server via socket
@@ -49,113 +43,328 @@ func GetConnection() (context.Context, error) {
 	return bindings.NewConnection(context.Background(), socket)
 }
 
-// Gets FQ name for images such as images from docker hub
-func getImageFQName(name string) string {
-	fqname := name
-	if !strings.Contains(name, "/") {
-		fqname = dockerRegistry + "/" + name
+// podmanPodName returns the name of the podman pod backing a corev1.Pod
+func podmanPodName(p *corev1.Pod) string {
+	return p.Namespace + "_" + p.Name
+}
+
+// podmanContainerName returns the name of the podman container backing a container of a corev1.Pod
+func podmanContainerName(p *corev1.Pod, name string) string {
+	return podmanPodName(p) + "_" + name
+}
+
+// repository returns an image name without its tag or digest
+func repository(name string) string {
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name
+}
+
+// PodManager runs pods with a podman runtime. It keeps the state of the pods which podman
+// does not keep, as the kubelet does: the failed image pulls, the restarts of the
+// containers with their back-off, the failed postStart hooks and the results of the probes.
+// The events of the pods are recorded with the recorder of the manager.
+type PodManager struct {
+	rt       PodmanRuntime
+	recorder record.EventRecorder
+
+	pullFailures *imagePullFailures
+	// restartBackOff tracks the restart back-off of containers by podman container ID
+	restartBackOff    *flowcontrol.Backoff
+	restarts          *restarts
+	postStartFailures *hookFailures
+	probeResults      *probeResults
+}
+
+// NewPodManager returns a PodManager running pods with the given runtime, and recording
+// their events with the given recorder
+func NewPodManager(rt PodmanRuntime, recorder record.EventRecorder) *PodManager {
+	return &PodManager{
+		rt:                rt,
+		recorder:          recorder,
+		pullFailures:      newImagePullFailures(flowcontrol.NewBackOff(imagePullBackOffPeriod, maxImagePullBackOff)),
+		restartBackOff:    flowcontrol.NewBackOff(containerBackOffPeriod, maxContainerBackOff),
+		restarts:          &restarts{entries: map[string]restartEntry{}},
+		postStartFailures: &hookFailures{entries: map[string]hookFailure{}},
+		probeResults:      &probeResults{results: map[string]probeResult{}},
 	}
-	return fqname
 }
 
-// CreatePod creates and runs a pod with podman from a corev1.PodSpec
-func CreatePod(ctx context.Context, p *corev1.Pod) (*entities.PodCreateReport, error) {
+// CreatePod creates and runs a pod with podman from a corev1.PodSpec, with the env
+// entries resolved from ConfigMaps and Secrets in env, and pulling images with the
+// credentials of the keyring. Both may be nil.
+func (m *PodManager) CreatePod(p *corev1.Pod, env ResolvedEnv, keyring *Keyring) (*entities.PodCreateReport, error) {
 	ps := entities.PodSpec{PodSpecGen: specgen.PodSpecGenerator{InfraContainerSpec: &specgen.SpecGenerator{}}}
-	ps.PodSpecGen.Name = p.Namespace + "_" + p.Name
-	pr, err := pods.CreatePodFromSpec(ctx, &ps)
+	ps.PodSpecGen.Name = podmanPodName(p)
+	ps.PodSpecGen.Labels = map[string]string{podLabel: podmanPodName(p)}
+	info, err := m.rt.Info()
 	if err != nil {
 		return nil, err
 	}
-	_, err = pods.Start(ctx, pr.Id, nil)
+	if err := setPodNetwork(&ps.PodSpecGen, p, info.Host != nil && info.Host.Security.Rootless); err != nil {
+		return nil, err
+	}
+	setPodResources(&ps.PodSpecGen, p)
+	if err := createPodVolumes(m.rt, p); err != nil {
+		return nil, err
+	}
+	pr, err := m.rt.CreatePod(&ps)
+	if err != nil {
+		return nil, err
+	}
+	ir, err := m.rt.InspectPod(pr.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.connectPodNetwork(p, ir.InfraContainerID); err != nil {
+		return nil, err
+	}
+	err = m.rt.StartPod(pr.Id)
 	if err != nil {
 		return nil, err
 	}
+	if err := m.createContainers(p, pr.Id, env, keyring); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
 
-	for _, container := range p.Spec.Containers {
-		image := getImageFQName(container.Image)
-		// TBD - add correct handling for IfNotPresent policy
-		if container.ImagePullPolicy != "Never" {
-			_, err := images.Pull(ctx, image, &images.PullOptions{})
-			if err != nil {
-				return nil, err
-			}
-		}
+// CreateContainers creates and starts the containers of an existing pod which were not
+// created yet, such as containers whose image could not be pulled
+func (m *PodManager) CreateContainers(p *corev1.Pod, env ResolvedEnv, keyring *Keyring) error {
+	pr, err := GetPod(m.rt, p)
+	if err != nil {
+		return err
+	}
+	return m.createContainers(p, pr.ID, env, keyring)
+}
+
+// createContainers creates and starts the containers of a pod that do not exist. Containers
+// whose image is not available are skipped, their status reports the pull failure.
+func (m *PodManager) createContainers(p *corev1.Pod, podID string, env ResolvedEnv, keyring *Keyring) error {
+	// the pod IP is known once the infra container is started, and it may be
+	// referenced by the containers environment
+	hostIP := getHostIP()
+	ir, err := m.rt.InspectPod(podID)
+	if err != nil {
+		return err
+	}
+	podIP, err := getPodIP(m.rt, ir, hostIP)
+	if err != nil {
+		return err
+	}
+	config, err := loadRegistriesConfig()
+	if err != nil {
+		return err
+	}
 
-		// Container create
-		s := specgen.NewSpecGenerator(image, false)
-		s.Terminal = false
-		s.Name = ps.PodSpecGen.Name + "_" + container.Name
-		s.Pod = pr.Id
-		s.Command = container.Command
-		// TODO look into networking & ports setup
-		r, err := containers.CreateWithSpec(ctx, s, &containers.CreateOptions{})
+	// init containers run one at a time, each one to completion before the next one is
+	// created, and the app containers are created once all of them completed
+	for i := range p.Spec.InitContainers {
+		container := &p.Spec.InitContainers[i]
+		data, err := m.rt.InspectContainer(podmanContainerName(p, container.Name))
 		if err != nil {
-			return nil, err
+			if !IsContainerNotFound(err) {
+				return err
+			}
+			return m.createContainer(p, container, podID, podIP, hostIP, env, config, keyring)
+		}
+		if !isCompleted(data) {
+			return nil
 		}
+	}
 
-		// Container start
-		err = containers.Start(ctx, r.ID, nil)
-		if err != nil {
-			return nil, err
+	for i := range p.Spec.Containers {
+		container := &p.Spec.Containers[i]
+		if _, err := m.rt.InspectContainer(podmanContainerName(p, container.Name)); err == nil {
+			continue
+		} else if !IsContainerNotFound(err) {
+			return err
+		}
+		if err := m.createContainer(p, container, podID, podIP, hostIP, env, config, keyring); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	return pr, nil
+// createContainer creates and starts a container of a pod, unless its image is not available
+func (m *PodManager) createContainer(p *corev1.Pod, container *corev1.Container, podID, podIP, hostIP string,
+	env ResolvedEnv, config *registriesConfig, keyring *Keyring) error {
+	image, ok := m.ensureImage(p, container, config, keyring)
+	if !ok {
+		return nil
+	}
+	imageUser, err := getImageUser(m.rt, image)
+	if err != nil {
+		return err
+	}
+	if err := verifyRunAsNonRoot(p, container, imageUser); err != nil {
+		m.pullFailures.set(imagePullKey(p, container), reasonCreateContainerConfigError, err.Error())
+		m.containerEvent(p, container, corev1.EventTypeWarning, EventFailed, "Error: %v", err)
+		return nil
+	}
+
+	// Container create
+	s := specgen.NewSpecGenerator(image, false)
+	s.Terminal = container.TTY
+	s.Stdin = container.Stdin
+	s.Name = podmanContainerName(p, container.Name)
+	s.Pod = podID
+	if err := setContainerProcess(s, p, container, env[container.Name], podIP, hostIP); err != nil {
+		return err
+	}
+	if err := setContainerMounts(m.rt, s, p, container); err != nil {
+		return err
+	}
+	if err := setContainerResources(s, container); err != nil {
+		return err
+	}
+	setContainerSecurity(s, p, container, imageUser)
+	r, err := m.rt.CreateContainer(s)
+	if err != nil {
+		m.containerEvent(p, container, corev1.EventTypeWarning, EventFailed, "Error: %v", err)
+		return err
+	}
+	m.containerEvent(p, container, corev1.EventTypeNormal, EventCreated, "Created container %s", container.Name)
+
+	// Container start
+	return m.startContainer(p, container, r.ID)
+}
+
+// podContainers returns the init containers and the app containers of a pod
+func podContainers(p *corev1.Pod) []*corev1.Container {
+	containers := []*corev1.Container{}
+	for i := range p.Spec.InitContainers {
+		containers = append(containers, &p.Spec.InitContainers[i])
+	}
+	for i := range p.Spec.Containers {
+		containers = append(containers, &p.Spec.Containers[i])
+	}
+	return containers
+}
+
+// isInitContainer checks if a container is an init container of a pod
+func isInitContainer(p *corev1.Pod, container *corev1.Container) bool {
+	for i := range p.Spec.InitContainers {
+		if p.Spec.InitContainers[i].Name == container.Name {
+			return true
+		}
+	}
+	return false
 }
 
 // GetPod gets info about a pod
-func GetPod(ctx context.Context, p *corev1.Pod) (*entities.PodInspectReport, error) {
-	name := p.Namespace + "_" + p.Name
-	return pods.Inspect(ctx, name, &pods.InspectOptions{})
+func GetPod(rt PodmanRuntime, p *corev1.Pod) (*entities.PodInspectReport, error) {
+	return rt.InspectPod(podmanPodName(p))
 }
 
 // GetPodStatus gets pod info and fills corev1.Pod
-func GetPodStatus(ctx context.Context, p *corev1.Pod) error {
-	pr, err := GetPod(ctx, p)
+func (m *PodManager) GetPodStatus(p *corev1.Pod) error {
+	pr, err := GetPod(m.rt, p)
 	if err != nil {
 		return err
 	}
-	p.Status.Phase = corev1.PodPhase(pr.State)
 	t := metav1.NewTime(pr.Created)
 	p.Status.StartTime = &t
-	p.Status.ContainerStatuses = []corev1.ContainerStatus{}
-	for _, c := range pr.Containers {
-		cStatus := corev1.ContainerStatus{
-			Name: c.Name,
-			// TODO - this would require a function and more work
-			State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{
-				StartedAt: metav1.NewTime(pr.Created), // TODO
-			}},
-			ContainerID: c.ID,
-			Image:       "tbd",
-			ImageID:     "tbd",
+	p.Status.HostIP = getHostIP()
+	podIP, err := getPodIP(m.rt, pr, p.Status.HostIP)
+	if err != nil {
+		return err
+	}
+	p.Status.PodIP = podIP
+	p.Status.PodIPs = nil
+	if podIP != "" {
+		p.Status.PodIPs = []corev1.PodIP{{IP: podIP}}
+	}
+	// the status of init containers which completed is ready
+	initialized := true
+	var initStatuses []corev1.ContainerStatus
+	for i := range p.Spec.InitContainers {
+		status, err := m.getPodContainerStatus(p, &p.Spec.InitContainers[i], p.Status.InitContainerStatuses, !initialized)
+		if err != nil {
+			return err
 		}
-		p.Status.ContainerStatuses = append(p.Status.ContainerStatuses, cStatus)
+		status.Ready = status.State.Terminated != nil && status.State.Terminated.ExitCode == 0
+		initialized = initialized && status.Ready
+		initStatuses = append(initStatuses, status)
 	}
-	// TODO - this requires much more work, currently just a mock
-	p.Status.Conditions = []corev1.PodCondition{
-		{
-			Type:               corev1.PodReady,
-			Status:             corev1.ConditionTrue,
-			LastTransitionTime: metav1.NewTime(pr.Created),
-			LastProbeTime:      metav1.NewTime(time.Now()),
-		},
+	statuses := []corev1.ContainerStatus{}
+	for i := range p.Spec.Containers {
+		status, err := m.getPodContainerStatus(p, &p.Spec.Containers[i], p.Status.ContainerStatuses, !initialized)
+		if err != nil {
+			return err
+		}
+		m.setProbeStatus(&status, &p.Spec.Containers[i])
+		statuses = append(statuses, status)
 	}
+	p.Status.InitContainerStatuses = initStatuses
+	p.Status.ContainerStatuses = statuses
+	p.Status.Phase = getPodPhase(&p.Spec, initStatuses, statuses, pr.State)
+	p.Status.QOSClass = getPodQOSClass(p)
+	p.Status.Conditions = getPodConditions(p, pr.Created, pr.State)
 	return nil
 }
 
-// RemovePod deletes a pod and all containers in the pod
-func RemovePod(ctx context.Context, p *corev1.Pod) (*entities.PodRmReport, error) {
-	name := p.Namespace + "_" + p.Name
-	_, err := pods.Kill(ctx, name, &pods.KillOptions{})
+// getPodContainerStatus returns the status of a container of a pod. Containers which
+// were not created yet are waiting for their creation, or for the pod initialization.
+func (m *PodManager) getPodContainerStatus(p *corev1.Pod, container *corev1.Container,
+	previousStatuses []corev1.ContainerStatus, initializing bool) (corev1.ContainerStatus, error) {
+	data, err := m.rt.InspectContainer(podmanContainerName(p, container.Name))
 	if err != nil {
+		if !IsContainerNotFound(err) {
+			return corev1.ContainerStatus{}, err
+		}
+		waiting := &corev1.ContainerStateWaiting{Reason: reasonPodInitializing}
+		if !initializing {
+			waiting = m.getCreatingState(p, container)
+		}
+		return corev1.ContainerStatus{
+			Name:  container.Name,
+			Image: container.Image,
+			State: corev1.ContainerState{Waiting: waiting},
+		}, nil
+	}
+	status := m.getContainerStatus(container.Name, data, getContainerStatusByName(previousStatuses, container.Name))
+	m.setRestartStatus(p, container, &status)
+	return status, nil
+}
+
+// RemovePod deletes a pod, all containers in the pod and the pod volumes
+func (m *PodManager) RemovePod(p *corev1.Pod) (*entities.PodRmReport, error) {
+	// containers are stopped gracefully first, then the pod is killed and removed
+	if err := m.stopPodContainers(p); err != nil {
+		return nil, err
+	}
+	name := podmanPodName(p)
+	rr := &entities.PodRmReport{}
+	err := m.rt.KillPod(name)
+	switch {
+	case err == nil:
+		rr, err = m.rt.RemovePod(name, true)
+		if err != nil {
+			return nil, err
+		}
+	case !IsPodNotFound(err):
 		return nil, err
 	}
-	forceRm := true
-	return pods.Remove(ctx, name, &pods.RemoveOptions{Force: &forceRm})
+	m.forgetImagePulls(p)
+	m.forgetRestarts(p)
+	m.forgetHookFailures(p)
+	// volumes are removed also when the pod was never created
+	return rr, removePodVolumes(m.rt, p)
 }
 
 // IsPodNotFound parses podman error message to check if a pod was not found
 func IsPodNotFound(err error) bool {
 	return strings.Contains(err.Error(), "no such pod")
 }
+
+// IsContainerNotFound parses podman error message to check if a container was not found
+func IsContainerNotFound(err error) bool {
+	return strings.Contains(err.Error(), "no such container")
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
@@ -33,28 +34,23 @@ const (
 	image         = "busybox:1.25"
 )
 
+// newTestPodManager returns a PodManager running pods with the given runtime, which
+// drops the events of the pods
+func newTestPodManager(rt PodmanRuntime) *PodManager {
+	return NewPodManager(rt, &record.FakeRecorder{})
+}
+
 func TestGetConnection(t *testing.T) {
 	conn, err := GetConnection()
-
-	assert.NoError(t, err)
+	if err != nil {
+		t.Skipf("podman service not available: %s", err)
+	}
 	assert.NotNil(t, conn)
 }
 
-func TestGetImageFQName(t *testing.T) {
-	image1 := "busybox:1.25"
-	image2 := "registry.fedoraproject.org/fedora:latest"
-
-	expFq1 := "docker.io/busybox:1.25"
-	expoFq2 := image2
-
-	assert.Equal(t, expFq1, getImageFQName(image1))
-	assert.Equal(t, expoFq2, getImageFQName(image2))
-}
-
 func TestCreatePod(t *testing.T) {
-	conn, err := GetConnection()
-
-	assert.NoError(t, err)
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
 
 	pod := &corev1.Pod{
 		ObjectMeta: v1.ObjectMeta{
@@ -75,22 +71,27 @@ func TestCreatePod(t *testing.T) {
 		},
 	}
 
-	_, err = CreatePod(conn, pod)
+	_, err := m.CreatePod(pod, nil, nil)
 	assert.NoError(t, err)
+	assert.Contains(t, rt.Images(), "docker.io/library/"+image)
 
-	pr, err := GetPod(conn, pod)
+	pr, err := GetPod(rt, pod)
 	assert.NoError(t, err)
+	assert.Equal(t, "Running", pr.State)
 
 	x, _ := json.Marshal(pr)
 	fmt.Printf(">>> %s\n", string(x))
 
-	err = GetPodStatus(conn, pod)
+	err = m.GetPodStatus(pod)
 	assert.NoError(t, err)
 
 	x, _ = json.Marshal(pod)
 	fmt.Printf(">>> %s\n", string(x))
 
-	_, err = RemovePod(conn, pod)
+	_, err = m.RemovePod(pod)
 	assert.NoError(t, err)
 
+	_, err = GetPod(rt, pod)
+	assert.Error(t, err)
+	assert.True(t, IsPodNotFound(err))
 }
@@ -0,0 +1,38 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+// dialInNetNS connects to a TCP port on localhost in a network namespace. The socket
+// stays in the namespace once connected.
+func dialInNetNS(ctx context.Context, nsPath string, port int32) (net.Conn, error) {
+	var conn net.Conn
+	err := ns.WithNetNSPath(nsPath, func(ns.NetNS) error {
+		var d net.Dialer
+		var err error
+		conn, err = d.DialContext(ctx, "tcp4", fmt.Sprintf("127.0.0.1:%d", port))
+		return err
+	})
+	return conn, err
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/containers/podman/v3/libpod/define"
+	"github.com/containers/podman/v3/libpod/network/types"
+	"github.com/containers/podman/v3/pkg/domain/entities"
+	"github.com/containers/podman/v3/pkg/specgen"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// hostIPEnvVar may be set to override the host IP reported in the pod status
+	hostIPEnvVar = "HOST_IP"
+
+	// podNetworkPrefix prefixes the names of the podman networks of the namespaces
+	podNetworkPrefix = "cymba_"
+	// namespaceLabel labels the podman networks with the namespace they belong to
+	namespaceLabel = "cymba.kcp.dev/namespace"
+
+	// PublishedPortsAnnotation records the host addresses of the container ports of a pod
+	// without a hostPort, which are published on the loopback address of rootless hosts
+	PublishedPortsAnnotation = "cymba.kcp.dev/published-ports"
+
+	loopbackIP = "127.0.0.1"
+)
+
+// setPodNetwork maps the networking settings of a corev1.Pod onto a podman pod spec:
+// container ports with a hostPort are published by the infra container, hostNetwork
+// selects the host network namespace, and hostname, host aliases and DNS settings are
+// applied to the pod's /etc/hosts and /etc/resolv.conf
+func setPodNetwork(ps *specgen.PodSpecGenerator, p *corev1.Pod, rootless bool) error {
+	ps.Hostname = getPodHostname(p)
+
+	if p.Spec.HostNetwork {
+		ps.NetNS = specgen.Namespace{NSMode: specgen.Host}
+	} else {
+		ps.PortMappings = getPortMappings(p, rootless)
+	}
+
+	for _, alias := range p.Spec.HostAliases {
+		for _, hostname := range alias.Hostnames {
+			ps.HostAdd = append(ps.HostAdd, hostname+":"+alias.IP)
+		}
+	}
+
+	if p.Spec.DNSPolicy == corev1.DNSNone && p.Spec.DNSConfig == nil {
+		return fmt.Errorf("pod %s/%s: dnsConfig must be set when dnsPolicy is %s", p.Namespace, p.Name, corev1.DNSNone)
+	}
+	// there is no cluster DNS on a podman host, so the ClusterFirst policies use the
+	// host resolv.conf as the Default policy does; dnsConfig is merged on top of it
+	if p.Spec.DNSConfig != nil {
+		for _, server := range p.Spec.DNSConfig.Nameservers {
+			ip := net.ParseIP(server)
+			if ip == nil {
+				return fmt.Errorf("pod %s/%s: invalid nameserver %q", p.Namespace, p.Name, server)
+			}
+			ps.DNSServer = append(ps.DNSServer, ip)
+		}
+		ps.DNSSearch = append(ps.DNSSearch, p.Spec.DNSConfig.Searches...)
+		for _, option := range p.Spec.DNSConfig.Options {
+			o := option.Name
+			if option.Value != nil {
+				o += ":" + *option.Value
+			}
+			ps.DNSOption = append(ps.DNSOption, o)
+		}
+	}
+	return nil
+}
+
+// getPodHostname returns the hostname of a pod, following the kubelet rules
+func getPodHostname(p *corev1.Pod) string {
+	hostname := p.Name
+	if p.Spec.Hostname != "" {
+		hostname = p.Spec.Hostname
+	}
+	if p.Spec.Subdomain != "" && p.Spec.SetHostnameAsFQDN != nil && *p.Spec.SetHostnameAsFQDN {
+		hostname = fmt.Sprintf("%s.%s.%s.svc.cluster.local", hostname, p.Spec.Subdomain, p.Namespace)
+	}
+	return hostname
+}
+
+// podNetworkName returns the name of the podman network of the namespace of a pod
+func podNetworkName(p *corev1.Pod) string {
+	return podNetworkPrefix + p.Namespace
+}
+
+// getPodAliases returns the names a pod with a subdomain is resolved by on the network
+// of its namespace: its hostname, alone and qualified with its subdomain as in the
+// cluster DNS
+func getPodAliases(p *corev1.Pod) []string {
+	hostname := p.Name
+	if p.Spec.Hostname != "" {
+		hostname = p.Spec.Hostname
+	}
+	qualified := hostname + "." + p.Spec.Subdomain
+	return []string{
+		hostname,
+		qualified,
+		fmt.Sprintf("%s.%s.svc", qualified, p.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", qualified, p.Namespace),
+	}
+}
+
+// connectPodNetwork connects a pod with a subdomain to the podman network of its
+// namespace, created with name resolution, so that the other pods of the namespace with
+// a subdomain resolve its hostname. The infra container joins the network when the pod
+// starts; it must be in the bridge network mode of rootful podman, the pod runs without
+// a resolvable hostname otherwise.
+func (m *PodManager) connectPodNetwork(p *corev1.Pod, infraID string) error {
+	if p.Spec.Subdomain == "" || p.Spec.HostNetwork || infraID == "" {
+		return nil
+	}
+	name := podNetworkName(p)
+	exists, err := m.rt.NetworkExists(name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// the network may have been created for another pod in the meantime
+		if err := m.rt.CreateNetwork(name, map[string]string{namespaceLabel: p.Namespace}); err != nil && !isNetworkExists(err) {
+			return err
+		}
+	}
+	if err := m.rt.ConnectNetwork(name, infraID, getPodAliases(p)); err != nil {
+		m.recorder.Eventf(p, corev1.EventTypeWarning, EventDNSConfigForming,
+			"Hostname %s.%s is not resolvable by the other pods: %v", getPodAliases(p)[0], p.Spec.Subdomain, err)
+	}
+	return nil
+}
+
+// isNetworkExists checks if an error is returned for a network which already exists,
+// locally or through the API
+func isNetworkExists(err error) bool {
+	return errors.Is(err, define.ErrNetworkExists) || strings.Contains(err.Error(), define.ErrNetworkExists.Error())
+}
+
+// getPortMappings maps the container ports with a hostPort to port mappings. As in
+// Kubernetes, the other container ports are not exposed on the host, except on rootless
+// hosts, where the pod IP is not routable: they are published on a random port of the
+// loopback address, recorded by PublishedPortsAnnotation.
+func getPortMappings(p *corev1.Pod, rootless bool) []types.PortMapping {
+	mappings := []types.PortMapping{}
+	for _, container := range p.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.HostPort == 0 && !rootless {
+				continue
+			}
+			protocol := corev1.ProtocolTCP
+			if port.Protocol != "" {
+				protocol = port.Protocol
+			}
+			hostIP := port.HostIP
+			if port.HostPort == 0 {
+				hostIP = loopbackIP
+			}
+			mappings = append(mappings, types.PortMapping{
+				HostIP:        hostIP,
+				ContainerPort: uint16(port.ContainerPort),
+				HostPort:      uint16(port.HostPort),
+				Protocol:      strings.ToLower(string(protocol)),
+			})
+		}
+	}
+	return mappings
+}
+
+// GetPublishedPorts returns the value of PublishedPortsAnnotation for a pod: the
+// loopback addresses of its container ports without a hostPort, such as
+// 80/tcp=127.0.0.1:41234, or an empty string if there is none
+func GetPublishedPorts(rt PodmanRuntime, p *corev1.Pod) (string, error) {
+	pr, err := GetPod(rt, p)
+	if err != nil {
+		return "", err
+	}
+	if pr.InfraConfig == nil {
+		return "", nil
+	}
+	published := []string{}
+	for port, bindings := range pr.InfraConfig.PortBindings {
+		for _, binding := range bindings {
+			if binding.HostIP == loopbackIP {
+				published = append(published, fmt.Sprintf("%s=%s", port, net.JoinHostPort(binding.HostIP, binding.HostPort)))
+			}
+		}
+	}
+	sort.Strings(published)
+	return strings.Join(published, ","), nil
+}
+
+// getPodIP returns the IP of the pod infra container, or the host IP for pods
+// without a network namespace of their own
+func getPodIP(rt PodmanRuntime, pr *entities.PodInspectReport, hostIP string) (string, error) {
+	if pr.InfraContainerID == "" {
+		return hostIP, nil
+	}
+	data, err := rt.InspectContainer(pr.InfraContainerID)
+	if err != nil {
+		return "", err
+	}
+	if data.NetworkSettings != nil {
+		if data.NetworkSettings.IPAddress != "" {
+			return data.NetworkSettings.IPAddress, nil
+		}
+		// the address on the first network by name, so that it does not change
+		names := []string{}
+		for name := range data.NetworkSettings.Networks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if n := data.NetworkSettings.Networks[name]; n != nil && n.IPAddress != "" {
+				return n.IPAddress, nil
+			}
+		}
+	}
+	return hostIP, nil
+}
+
+// getHostIP returns the IP of the podman host: the value of the HOST_IP environment
+// variable if set, or else the first global unicast address of the host
+func getHostIP() string {
+	if ip, present := os.LookupEnv(hostIPEnvVar); present {
+		return ip
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+	return ""
+}
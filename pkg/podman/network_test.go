@@ -0,0 +1,171 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"os"
+	"testing"
+
+	"github.com/containers/podman/v3/libpod/define"
+	"github.com/containers/podman/v3/pkg/specgen"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestCreatePodNetwork(t *testing.T) {
+	os.Setenv(hostIPEnvVar, "192.168.1.10")
+	defer os.Unsetenv(hostIPEnvVar)
+
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	ndots := "2"
+	pod.Spec.Hostname = "web"
+	pod.Spec.Containers[0].Ports = []corev1.ContainerPort{
+		{ContainerPort: 80, HostPort: 8080},
+		{ContainerPort: 53, Protocol: corev1.ProtocolUDP},
+	}
+	pod.Spec.HostAliases = []corev1.HostAlias{{IP: "10.0.0.1", Hostnames: []string{"foo", "bar"}}}
+	pod.Spec.DNSConfig = &corev1.PodDNSConfig{
+		Nameservers: []string{"1.1.1.1"},
+		Searches:    []string{"example.com"},
+		Options:     []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndots}, {Name: "edns0"}},
+	}
+
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	pr, err := GetPod(rt, pod)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "web", pr.Hostname)
+	ic := pr.InfraConfig
+	assert.False(t, ic.HostNetwork)
+	assert.Equal(t, "8080", ic.PortBindings["80/tcp"][0].HostPort)
+	// container ports without a hostPort are not published, as in Kubernetes
+	assert.NotContains(t, ic.PortBindings, "53/udp")
+	assert.Equal(t, []string{"foo:10.0.0.1", "bar:10.0.0.1"}, ic.HostAdd)
+	assert.Equal(t, []string{"1.1.1.1"}, ic.DNSServer)
+	assert.Equal(t, []string{"example.com"}, ic.DNSSearch)
+	assert.Equal(t, []string{"ndots:2", "edns0"}, ic.DNSOption)
+
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.Equal(t, "192.168.1.10", pod.Status.HostIP)
+	assert.NotEmpty(t, pod.Status.PodIP)
+	assert.NotEqual(t, pod.Status.HostIP, pod.Status.PodIP)
+}
+
+func TestCreatePodHostNetwork(t *testing.T) {
+	os.Setenv(hostIPEnvVar, "192.168.1.10")
+	defer os.Unsetenv(hostIPEnvVar)
+
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	pod.Spec.HostNetwork = true
+	pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 80, HostPort: 80}}
+
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	pr, err := GetPod(rt, pod)
+	assert.NoError(t, err)
+	assert.True(t, pr.InfraConfig.HostNetwork)
+	assert.Empty(t, pr.InfraConfig.PortBindings)
+
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.Equal(t, "192.168.1.10", pod.Status.PodIP)
+}
+
+func TestSetPodNetworkDNSNone(t *testing.T) {
+	pod := newStatusTestPod()
+	pod.Spec.DNSPolicy = corev1.DNSNone
+
+	ps := specgen.PodSpecGenerator{}
+	assert.Error(t, setPodNetwork(&ps, pod, false))
+
+	pod.Spec.DNSConfig = &corev1.PodDNSConfig{Nameservers: []string{"not-an-ip"}}
+	assert.Error(t, setPodNetwork(&ps, pod, false))
+}
+
+func TestCreatePodRootlessPorts(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	rt.HostInfo.Host.Security.Rootless = true
+	pod := newStatusTestPod()
+	pod.Spec.Containers[0].Ports = []corev1.ContainerPort{
+		{ContainerPort: 80, HostPort: 8080},
+		{ContainerPort: 53, Protocol: corev1.ProtocolUDP},
+	}
+
+	// on rootless hosts, ports without a hostPort are published only on the loopback
+	// address, never on all the interfaces
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	pr, err := GetPod(rt, pod)
+	assert.NoError(t, err)
+	ic := pr.InfraConfig
+	assert.Equal(t, []define.InspectHostPort{{HostIP: "", HostPort: "8080"}}, ic.PortBindings["80/tcp"])
+	if assert.Len(t, ic.PortBindings["53/udp"], 1) {
+		binding := ic.PortBindings["53/udp"][0]
+		assert.Equal(t, "127.0.0.1", binding.HostIP)
+		assert.NotEqual(t, "0", binding.HostPort)
+
+		ports, err := GetPublishedPorts(rt, pod)
+		assert.NoError(t, err)
+		assert.Equal(t, "53/udp=127.0.0.1:"+binding.HostPort, ports)
+	}
+}
+
+func TestCreatePodSubdomainNetwork(t *testing.T) {
+	events := record.NewFakeRecorder(100)
+	rt := NewFakeRuntime()
+	m := NewPodManager(rt, events)
+	pod := newStatusTestPod()
+	pod.Spec.Hostname = "web-0"
+	pod.Spec.Subdomain = "nginx"
+
+	// the pod is resolved by its hostname on the network of its namespace
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cymba_default"}, rt.Networks())
+	pr, err := GetPod(rt, pod)
+	assert.NoError(t, err)
+	infra, err := rt.InspectContainer(pr.InfraContainerID)
+	assert.NoError(t, err)
+	if assert.Contains(t, infra.NetworkSettings.Networks, "cymba_default") {
+		assert.Equal(t, []string{"web-0", "web-0.nginx", "web-0.nginx.default.svc", "web-0.nginx.default.svc.cluster.local"},
+			infra.NetworkSettings.Networks["cymba_default"].Aliases)
+	}
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.Equal(t, infra.NetworkSettings.Networks["cymba_default"].IPAddress, pod.Status.PodIP)
+
+	// the network is shared by the pods of the namespace
+	peer := newStatusTestPod()
+	peer.Name, peer.Spec.Hostname, peer.Spec.Subdomain = "peer", "web-1", "nginx"
+	_, err = m.CreatePod(peer, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cymba_default"}, rt.Networks())
+
+	// rootless pods are not in the bridge network mode, they run without the network
+	rt.HostInfo.Host.Security.Rootless = true
+	rootless := newStatusTestPod()
+	rootless.Name, rootless.Spec.Hostname, rootless.Spec.Subdomain = "rootless", "web-2", "nginx"
+	_, err = m.CreatePod(rootless, nil, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, recordedEvents(events), "Warning DNSConfigForming Hostname web-2.nginx is not resolvable by the other pods: "+
+		"container 000000000000-infra is not in bridge network mode: invalid network mode")
+}
@@ -0,0 +1,450 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/podman/v3/libpod/define"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// probe defaults, as set by the API server
+	defaultProbePeriodSeconds    = 10
+	defaultProbeTimeoutSeconds   = 1
+	defaultProbeSuccessThreshold = 1
+	defaultProbeFailureThreshold = 3
+
+	defaultTerminationGracePeriodSeconds = 30
+)
+
+type probeType string
+
+const (
+	livenessProbe  probeType = "Liveness"
+	readinessProbe probeType = "Readiness"
+	startupProbe   probeType = "Startup"
+)
+
+// probeResults holds the results of the readiness and startup probes of containers.
+// Results are kept for a run of a container, so that a restarted container starts
+// again as not ready and not started.
+type probeResults struct {
+	mu      sync.Mutex
+	results map[string]probeResult
+}
+
+type probeResult struct {
+	startedAt time.Time
+	success   bool
+}
+
+func probeResultKey(containerID string, t probeType) string {
+	return containerID + "_" + string(t)
+}
+
+// set records the result of a probe, and returns true if the result changed
+func (r *probeResults) set(containerID string, t probeType, startedAt time.Time, success bool) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := probeResultKey(containerID, t)
+	old, ok := r.results[key]
+	r.results[key] = probeResult{startedAt: startedAt, success: success}
+	return !ok || old.success != success || !old.startedAt.Equal(startedAt)
+}
+
+// get returns true if the last result of a probe for the run of a container started
+// at startedAt is a success
+func (r *probeResults) get(containerID string, t probeType, startedAt time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result, ok := r.results[probeResultKey(containerID, t)]
+	return ok && result.success && result.startedAt.Equal(startedAt)
+}
+
+func (r *probeResults) remove(containerID string, t probeType) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.results, probeResultKey(containerID, t))
+}
+
+// setProbeStatus sets the started and ready fields of the status of a running container
+// from the results of its probes. Containers without a startup probe are started once
+// running, and containers without a readiness probe are ready once started.
+func (m *PodManager) setProbeStatus(cs *corev1.ContainerStatus, container *corev1.Container) {
+	if cs.State.Running == nil {
+		return
+	}
+	id := strings.TrimPrefix(cs.ContainerID, containerIDPrefix)
+	startedAt := cs.State.Running.StartedAt.Time
+	started := container.StartupProbe == nil || m.probeResults.get(id, startupProbe, startedAt)
+	cs.Started = &started
+	cs.Ready = cs.Ready && started &&
+		(container.ReadinessProbe == nil || m.probeResults.get(id, readinessProbe, startedAt))
+}
+
+// ProbeManager runs the liveness, readiness and startup probes of the containers of
+// pods, with a worker per probe as in the kubelet. Containers failing their liveness
+// or startup probe are killed, and the results of readiness and startup probes are
+// reported by GetPodStatus.
+type ProbeManager struct {
+	pods *PodManager
+	// onChange is called when a probe result changes the status of a pod
+	onChange func(p *corev1.Pod)
+
+	mu      sync.Mutex
+	workers map[probeKey]*probeWorker
+}
+
+type probeKey struct {
+	podUID        types.UID
+	containerName string
+	probeType     probeType
+}
+
+// NewProbeManager returns a ProbeManager probing the containers of the pods run by the
+// given PodManager, which reports the results of the probes
+func NewProbeManager(pods *PodManager, onChange func(p *corev1.Pod)) *ProbeManager {
+	return &ProbeManager{
+		pods:     pods,
+		onChange: onChange,
+		workers:  map[probeKey]*probeWorker{},
+	}
+}
+
+// UpdatePod starts the probe workers of the containers of a pod, and stops them once
+// the pod terminated
+func (m *ProbeManager) UpdatePod(p *corev1.Pod) {
+	if p.Status.Phase == corev1.PodSucceeded || p.Status.Phase == corev1.PodFailed {
+		m.RemovePod(p)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range p.Spec.Containers {
+		container := &p.Spec.Containers[i]
+		probes := []struct {
+			t     probeType
+			probe *corev1.Probe
+		}{
+			{livenessProbe, container.LivenessProbe},
+			{readinessProbe, container.ReadinessProbe},
+			{startupProbe, container.StartupProbe},
+		}
+		for _, probe := range probes {
+			key := probeKey{podUID: p.UID, containerName: container.Name, probeType: probe.t}
+			if probe.probe == nil || m.workers[key] != nil {
+				continue
+			}
+			w := newProbeWorker(m, p, container, probe.t, probe.probe)
+			m.workers[key] = w
+			go w.run()
+		}
+	}
+}
+
+// RemovePod stops the probe workers of the containers of a pod
+func (m *ProbeManager) RemovePod(p *corev1.Pod) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, w := range m.workers {
+		if key.podUID == p.UID {
+			close(w.stopCh)
+			delete(m.workers, key)
+		}
+	}
+}
+
+// probeWorker periodically runs a probe of a container, and applies its result once
+// the success or failure threshold is reached
+type probeWorker struct {
+	manager   *ProbeManager
+	pod       *corev1.Pod
+	container *corev1.Container
+	probeType probeType
+	probe     *corev1.Probe
+	stopCh    chan struct{}
+
+	// containerID and startedAt identify the run of the container being probed
+	containerID string
+	startedAt   time.Time
+	lastResult  bool
+	resultRun   int
+}
+
+func newProbeWorker(m *ProbeManager, p *corev1.Pod, container *corev1.Container, t probeType, probe *corev1.Probe) *probeWorker {
+	pod := p.DeepCopy()
+	return &probeWorker{
+		manager:   m,
+		pod:       pod,
+		container: getContainerByName(pod.Spec.Containers, container.Name),
+		probeType: t,
+		probe:     probe.DeepCopy(),
+		stopCh:    make(chan struct{}),
+	}
+}
+
+func (w *probeWorker) run() {
+	ticker := time.NewTicker(time.Duration(getProbeValue(w.probe.PeriodSeconds, defaultProbePeriodSeconds)) * time.Second)
+	defer ticker.Stop()
+	defer func() { w.manager.pods.probeResults.remove(w.containerID, w.probeType) }()
+	for {
+		w.doProbe()
+		select {
+		case <-w.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// doProbe probes the container once if it is running and past its initial delay.
+// Liveness and readiness probes wait for the startup probe to succeed, which is not
+// run anymore once it did.
+func (w *probeWorker) doProbe() {
+	rt := w.manager.pods.rt
+	name := podmanContainerName(w.pod, w.container.Name)
+	data, err := rt.InspectContainer(name)
+	if err != nil {
+		if !IsContainerNotFound(err) {
+			klog.Errorf("%s probe of container %s: %v", w.probeType, name, err)
+		}
+		return
+	}
+	if data.State == nil || data.State.Status != define.ContainerStateRunning.String() {
+		return
+	}
+	if data.ID != w.containerID || !data.State.StartedAt.Equal(w.startedAt) {
+		w.manager.pods.probeResults.remove(w.containerID, w.probeType)
+		w.containerID, w.startedAt = data.ID, data.State.StartedAt
+		w.resultRun = 0
+	}
+
+	started := w.manager.pods.probeResults.get(w.containerID, startupProbe, w.startedAt)
+	if w.probeType == startupProbe && started || w.probeType != startupProbe && w.container.StartupProbe != nil && !started {
+		return
+	}
+	if time.Since(w.startedAt) < time.Duration(w.probe.InitialDelaySeconds)*time.Second {
+		return
+	}
+
+	success, message := runProbe(rt, w.pod, w.container, w.probe)
+	if !success {
+		w.manager.pods.containerEvent(w.pod, w.container, corev1.EventTypeWarning, EventUnhealthy, "%s probe failed: %s", w.probeType, message)
+	}
+	if success == w.lastResult {
+		w.resultRun++
+	} else {
+		w.lastResult, w.resultRun = success, 1
+	}
+	if !success && w.resultRun < int(getProbeValue(w.probe.FailureThreshold, defaultProbeFailureThreshold)) ||
+		success && w.resultRun < int(getProbeValue(w.probe.SuccessThreshold, defaultProbeSuccessThreshold)) {
+		return
+	}
+
+	if w.probeType != livenessProbe && w.manager.pods.probeResults.set(w.containerID, w.probeType, w.startedAt, success) {
+		w.manager.onChange(w.pod)
+	}
+	if !success && w.probeType != readinessProbe {
+		klog.Infof("container %s failed %s probe, will be killed: %s", name, strings.ToLower(string(w.probeType)), message)
+		w.killContainer(name, fmt.Sprintf("Container %s failed %s probe, will be restarted",
+			w.container.Name, strings.ToLower(string(w.probeType))))
+	}
+}
+
+// killContainer kills a container which failed its liveness or startup probe, running
+// its preStop hook first. It is then restarted according to the pod restart policy, as
+// any exited container.
+func (w *probeWorker) killContainer(name, reason string) {
+	w.resultRun = 0
+	if err := w.manager.pods.stopContainer(w.pod, w.container, getTerminationGracePeriod(w.pod, w.probe), reason); err != nil {
+		klog.Errorf("stopping container %s: %v", name, err)
+		return
+	}
+	w.manager.onChange(w.pod)
+}
+
+// runProbe runs the exec, httpGet or tcpSocket action of a probe, and returns its
+// result with a message describing failures
+func runProbe(rt PodmanRuntime, p *corev1.Pod, container *corev1.Container, probe *corev1.Probe) (bool, string) {
+	timeout := time.Duration(getProbeValue(probe.TimeoutSeconds, defaultProbeTimeoutSeconds)) * time.Second
+	return runHandler(rt, p, container, &probe.Handler, timeout)
+}
+
+// runHandler runs the action of a probe or of a lifecycle hook in a container
+func runHandler(rt PodmanRuntime, p *corev1.Pod, container *corev1.Container, handler *corev1.Handler, timeout time.Duration) (bool, string) {
+	switch {
+	case handler.Exec != nil:
+		exitCode, err := rt.ExecContainer(podmanContainerName(p, container.Name), handler.Exec.Command, timeout)
+		if err != nil {
+			return false, err.Error()
+		}
+		if exitCode != 0 {
+			return false, fmt.Sprintf("command %q exited with %d", handler.Exec.Command, exitCode)
+		}
+		return true, ""
+	case handler.HTTPGet != nil:
+		return runHTTPGetProbe(rt, p, container, handler.HTTPGet, timeout)
+	case handler.TCPSocket != nil:
+		address, err := getProbeAddress(rt, p, container, handler.TCPSocket.Host, handler.TCPSocket.Port)
+		if err != nil {
+			return false, err.Error()
+		}
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err != nil {
+			return false, err.Error()
+		}
+		conn.Close()
+		return true, ""
+	default:
+		return false, "handler has no action"
+	}
+}
+
+// runHTTPGetProbe sends the request of an httpGet probe. As in the kubelet, the
+// certificates of HTTPS endpoints are not verified, and any status code between 200
+// and 399 is a success.
+func runHTTPGetProbe(rt PodmanRuntime, p *corev1.Pod, container *corev1.Container, action *corev1.HTTPGetAction, timeout time.Duration) (bool, string) {
+	address, err := getProbeAddress(rt, p, container, action.Host, action.Port)
+	if err != nil {
+		return false, err.Error()
+	}
+	scheme := strings.ToLower(string(action.Scheme))
+	if scheme == "" {
+		scheme = "http"
+	}
+	u := &url.URL{Scheme: scheme, Host: address, Path: action.Path}
+	if i := strings.Index(action.Path, "?"); i >= 0 {
+		u.Path, u.RawQuery = action.Path[:i], action.Path[i+1:]
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err.Error()
+	}
+	for _, h := range action.HTTPHeaders {
+		if strings.EqualFold(h.Name, "Host") {
+			req.Host = h.Value
+			continue
+		}
+		req.Header.Add(h.Name, h.Value)
+	}
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err.Error()
+	}
+	resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return false, fmt.Sprintf("HTTP probe failed with statuscode: %d", resp.StatusCode)
+	}
+	return true, ""
+}
+
+// getProbeAddress returns the address probed for a port of a container. Without an
+// explicit host, the port published on the host for the container port is used if
+// there is one, as the pod IP is not routable on rootless hosts, or else the pod IP.
+func getProbeAddress(rt PodmanRuntime, p *corev1.Pod, container *corev1.Container, host string, port intstr.IntOrString) (string, error) {
+	number, err := getProbePort(container, port)
+	if err != nil {
+		return "", err
+	}
+	if host != "" {
+		return net.JoinHostPort(host, strconv.Itoa(number)), nil
+	}
+	pr, err := GetPod(rt, p)
+	if err != nil {
+		return "", err
+	}
+	if pr.InfraContainerID != "" {
+		data, err := rt.InspectContainer(pr.InfraContainerID)
+		if err != nil {
+			return "", err
+		}
+		if data.NetworkSettings != nil {
+			for _, binding := range data.NetworkSettings.Ports[fmt.Sprintf("%d/tcp", number)] {
+				hostIP := binding.HostIP
+				if hostIP == "" || hostIP == "0.0.0.0" {
+					hostIP = "127.0.0.1"
+				}
+				return net.JoinHostPort(hostIP, binding.HostPort), nil
+			}
+		}
+	}
+	podIP, err := getPodIP(rt, pr, getHostIP())
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(podIP, strconv.Itoa(number)), nil
+}
+
+// getProbePort resolves a probe port, which may be the name of a container port
+func getProbePort(container *corev1.Container, port intstr.IntOrString) (int, error) {
+	if port.Type == intstr.String {
+		for _, p := range container.Ports {
+			if p.Name == port.StrVal {
+				return int(p.ContainerPort), nil
+			}
+		}
+		return 0, fmt.Errorf("port %q not found in container %s", port.StrVal, container.Name)
+	}
+	if port.IntVal <= 0 || port.IntVal > 65535 {
+		return 0, fmt.Errorf("invalid port %d", port.IntVal)
+	}
+	return int(port.IntVal), nil
+}
+
+// getTerminationGracePeriod returns the grace period of a container killed on a probe
+// failure, which may be overridden by the probe
+func getTerminationGracePeriod(p *corev1.Pod, probe *corev1.Probe) int64 {
+	if probe.TerminationGracePeriodSeconds != nil {
+		return *probe.TerminationGracePeriodSeconds
+	}
+	return getPodTerminationGracePeriod(p)
+}
+
+// getProbeValue returns a probe setting, or its default when it is not set
+func getProbeValue(value, defaultValue int32) int32 {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// getContainerByName returns the named container, or nil if not found
+func getContainerByName(containers []corev1.Container, name string) *corev1.Container {
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func newProbeTestWorker(pods *PodManager, p *corev1.Pod, t probeType, probe *corev1.Probe) (*probeWorker, *int) {
+	changes := 0
+	m := NewProbeManager(pods, func(*corev1.Pod) { changes++ })
+	return newProbeWorker(m, p, &p.Spec.Containers[0], t, probe), &changes
+}
+
+func execProbe(failureThreshold int32) *corev1.Probe {
+	return &corev1.Probe{
+		Handler:          corev1.Handler{Exec: &corev1.ExecAction{Command: []string{"true"}}},
+		FailureThreshold: failureThreshold,
+	}
+}
+
+func TestReadinessProbe(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	pod.Spec.Containers[0].ReadinessProbe = execProbe(1)
+	name := podmanContainerName(pod, containerName)
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	w, changes := newProbeTestWorker(m, pod, readinessProbe, pod.Spec.Containers[0].ReadinessProbe)
+
+	// containers with a readiness probe are not ready until it succeeds
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.False(t, pod.Status.ContainerStatuses[0].Ready)
+	assert.True(t, *pod.Status.ContainerStatuses[0].Started)
+	assert.Equal(t, corev1.ConditionFalse, getPodCondition(pod.Status.Conditions, corev1.PodReady).Status)
+
+	w.doProbe()
+	assert.Equal(t, 1, *changes)
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.True(t, pod.Status.ContainerStatuses[0].Ready)
+	assert.Equal(t, corev1.ConditionTrue, getPodCondition(pod.Status.Conditions, corev1.PodReady).Status)
+
+	assert.NoError(t, rt.SetExecExitCode(name, 1))
+	w.doProbe()
+	assert.Equal(t, 2, *changes)
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.False(t, pod.Status.ContainerStatuses[0].Ready)
+	assert.Equal(t, corev1.ConditionFalse, getPodCondition(pod.Status.Conditions, corev1.PodReady).Status)
+	assert.Equal(t, int32(0), pod.Status.ContainerStatuses[0].RestartCount)
+}
+
+func TestLivenessProbeRestartsContainer(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	grace := int64(0)
+	pod.Spec.TerminationGracePeriodSeconds = &grace
+	pod.Spec.Containers[0].LivenessProbe = execProbe(2)
+	name := podmanContainerName(pod, containerName)
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	w, changes := newProbeTestWorker(m, pod, livenessProbe, pod.Spec.Containers[0].LivenessProbe)
+
+	assert.NoError(t, rt.SetExecExitCode(name, 1))
+	w.doProbe()
+	assert.Equal(t, 0, *changes)
+	w.doProbe()
+	assert.Equal(t, 1, *changes)
+
+	// the killed container is restarted according to the restart policy
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.Equal(t, int32(137), pod.Status.ContainerStatuses[0].State.Terminated.ExitCode)
+	_, err = m.RestartContainers(pod)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	cs := pod.Status.ContainerStatuses[0]
+	assert.NotNil(t, cs.State.Running)
+	assert.True(t, cs.Ready)
+	assert.Equal(t, int32(1), cs.RestartCount)
+	if assert.NotNil(t, cs.LastTerminationState.Terminated) {
+		assert.Equal(t, int32(137), cs.LastTerminationState.Terminated.ExitCode)
+	}
+}
+
+func TestStartupProbe(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	pod.Spec.RestartPolicy = corev1.RestartPolicyNever
+	pod.Spec.Containers[0].StartupProbe = execProbe(1)
+	pod.Spec.Containers[0].LivenessProbe = execProbe(1)
+	name := podmanContainerName(pod, containerName)
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	startup, _ := newProbeTestWorker(m, pod, startupProbe, pod.Spec.Containers[0].StartupProbe)
+	liveness, _ := newProbeTestWorker(m, pod, livenessProbe, pod.Spec.Containers[0].LivenessProbe)
+
+	// the liveness probe waits for the container to be started
+	assert.NoError(t, rt.SetExecExitCode(name, 1))
+	liveness.doProbe()
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.NotNil(t, pod.Status.ContainerStatuses[0].State.Running)
+	assert.False(t, *pod.Status.ContainerStatuses[0].Started)
+	assert.False(t, pod.Status.ContainerStatuses[0].Ready)
+
+	assert.NoError(t, rt.SetExecExitCode(name, 0))
+	startup.doProbe()
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.True(t, *pod.Status.ContainerStatuses[0].Started)
+	assert.True(t, pod.Status.ContainerStatuses[0].Ready)
+
+	// with the Never restart policy a container failing its liveness probe is not restarted
+	assert.NoError(t, rt.SetExecExitCode(name, 1))
+	liveness.doProbe()
+	_, err = m.RestartContainers(pod)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.NotNil(t, pod.Status.ContainerStatuses[0].State.Terminated)
+	assert.Equal(t, corev1.PodFailed, pod.Status.Phase)
+}
+
+func TestNetworkProbes(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+	container := &pod.Spec.Containers[0]
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Header.Get("X-Probe") != "cymba" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	httpGet := &corev1.Probe{Handler: corev1.Handler{HTTPGet: &corev1.HTTPGetAction{
+		Host:        host,
+		Port:        intstr.FromInt(portNumber),
+		Path:        "/healthz",
+		HTTPHeaders: []corev1.HTTPHeader{{Name: "X-Probe", Value: "cymba"}},
+	}}}
+	success, _ := runProbe(rt, pod, container, httpGet)
+	assert.True(t, success)
+	status = http.StatusInternalServerError
+	success, message := runProbe(rt, pod, container, httpGet)
+	assert.False(t, success)
+	assert.Contains(t, message, "500")
+
+	tcpSocket := &corev1.Probe{Handler: corev1.Handler{TCPSocket: &corev1.TCPSocketAction{Host: host, Port: intstr.FromInt(portNumber)}}}
+	success, _ = runProbe(rt, pod, container, tcpSocket)
+	assert.True(t, success)
+	server.Close()
+	success, _ = runProbe(rt, pod, container, tcpSocket)
+	assert.False(t, success)
+
+	address, err := getProbeAddress(rt, pod, container, "", intstr.FromString("http"))
+	assert.NoError(t, err)
+	assert.Equal(t, pod.Status.PodIP+":8080", address)
+	_, err = getProbeAddress(rt, pod, container, "", intstr.FromString("metrics"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,202 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/docker/distribution/reference"
+)
+
+const (
+	// registriesConfEnvVar may be set to the path of a registries.conf file configuring
+	// the search registries, short-name aliases and mirrors used to resolve images
+	registriesConfEnvVar = "CYMBA_REGISTRIES_CONF"
+
+	// dockerHubDomain is the domain of Docker Hub, searched for unqualified images
+	// when no search registries are configured
+	dockerHubDomain = "docker.io"
+)
+
+// registriesConfig is the subset of the containers-registries.conf(5) format used to
+// resolve image names. The configuration is read by cymba rather than by the podman
+// service, which may run on another host.
+type registriesConfig struct {
+	// UnqualifiedSearchRegistries are tried in order for images without a registry
+	UnqualifiedSearchRegistries []string `toml:"unqualified-search-registries"`
+	// Aliases map short names to fully qualified repositories
+	Aliases map[string]string `toml:"aliases"`
+	// Registries rewrite the location of image references matching their prefix
+	Registries []registryConfig `toml:"registry"`
+}
+
+type registryConfig struct {
+	// Prefix is matched against fully qualified references, it defaults to Location
+	Prefix string `toml:"prefix"`
+	// Location replaces the prefix of matching references
+	Location string `toml:"location"`
+	// Mirrors are tried in order before the location
+	Mirrors []registryMirror `toml:"mirror"`
+	// MirrorByDigestOnly restricts the mirrors to references pinned by digest
+	MirrorByDigestOnly bool `toml:"mirror-by-digest-only"`
+}
+
+type registryMirror struct {
+	Location string `toml:"location"`
+}
+
+// loadRegistriesConfig reads the registries configuration from the file set in
+// CYMBA_REGISTRIES_CONF. Without configuration, unqualified images are searched on
+// Docker Hub only.
+func loadRegistriesConfig() (*registriesConfig, error) {
+	config := &registriesConfig{}
+	path := os.Getenv(registriesConfEnvVar)
+	if path == "" {
+		config.UnqualifiedSearchRegistries = []string{dockerHubDomain}
+		return config, nil
+	}
+	md, err := toml.DecodeFile(path, config)
+	if err != nil {
+		return nil, fmt.Errorf("loading registries configuration %s: %w", path, err)
+	}
+	if !md.IsDefined("unqualified-search-registries") {
+		config.UnqualifiedSearchRegistries = []string{dockerHubDomain}
+	}
+	for i := range config.Registries {
+		r := &config.Registries[i]
+		if r.Prefix == "" {
+			r.Prefix = r.Location
+		}
+		if r.Prefix == "" {
+			return nil, fmt.Errorf("loading registries configuration %s: registry without prefix or location", path)
+		}
+	}
+	return config, nil
+}
+
+// isShortName returns true if an image name does not start with a registry domain.
+// As in docker/distribution, the first component of a name is a domain if it is
+// localhost or if it contains a dot or a port.
+func isShortName(image string) bool {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return true
+	}
+	domain := image[:i]
+	return domain != "localhost" && !strings.ContainsAny(domain, ".:")
+}
+
+// normalizeImage returns the normalized form of a fully qualified image name, adding
+// the library namespace of Docker Hub official images and the latest tag if the name
+// has neither a tag nor a digest
+func normalizeImage(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", err
+	}
+	return reference.TagNameOnly(named).String(), nil
+}
+
+// resolveImage returns the fully qualified names an image may refer to, in the order
+// they should be tried. Qualified names resolve to themselves, short names resolve to
+// their alias if there is one, or else to each of the search registries.
+func (c *registriesConfig) resolveImage(image string) ([]string, error) {
+	if _, err := reference.ParseNormalizedNamed(image); err != nil {
+		return nil, err
+	}
+	if !isShortName(image) {
+		name, err := normalizeImage(image)
+		if err != nil {
+			return nil, err
+		}
+		return []string{name}, nil
+	}
+
+	repo := repository(image)
+	if alias, ok := c.Aliases[repo]; ok {
+		name, err := normalizeImage(alias + image[len(repo):])
+		if err != nil {
+			return nil, fmt.Errorf("invalid alias %q for %q: %w", alias, repo, err)
+		}
+		return []string{name}, nil
+	}
+	if len(c.UnqualifiedSearchRegistries) == 0 {
+		return nil, fmt.Errorf("short name %q does not resolve: no unqualified-search registries are configured", image)
+	}
+	names := []string{}
+	for _, registry := range c.UnqualifiedSearchRegistries {
+		name, err := normalizeImage(registry + "/" + image)
+		if err != nil {
+			return nil, fmt.Errorf("invalid search registry %q: %w", registry, err)
+		}
+		names = appendUnique(names, name)
+	}
+	return names, nil
+}
+
+// pullSources returns the references a fully qualified image is pulled from, in order:
+// the mirrors of the registry with the longest matching prefix, then its location
+func (c *registriesConfig) pullSources(image string) []string {
+	var registry *registryConfig
+	for i := range c.Registries {
+		r := &c.Registries[i]
+		if prefixMatches(r.Prefix, image) && (registry == nil || len(r.Prefix) > len(registry.Prefix)) {
+			registry = r
+		}
+	}
+	if registry == nil {
+		return []string{image}
+	}
+
+	rest := image[len(registry.Prefix):]
+	sources := []string{}
+	if !registry.MirrorByDigestOnly || strings.Contains(image, "@") {
+		for _, m := range registry.Mirrors {
+			sources = appendUnique(sources, m.Location+rest)
+		}
+	}
+	location := image
+	if registry.Location != "" {
+		location = registry.Location + rest
+	}
+	return appendUnique(sources, location)
+}
+
+// prefixMatches returns true if a registries.conf prefix matches an image at the
+// boundary of a path component, or of the tag or digest for repository prefixes
+func prefixMatches(prefix, image string) bool {
+	if !strings.HasPrefix(image, prefix) {
+		return false
+	}
+	rest := image[len(prefix):]
+	if rest == "" || rest[0] == '/' || strings.HasSuffix(prefix, "/") {
+		return true
+	}
+	return strings.Contains(prefix, "/") && (rest[0] == ':' || rest[0] == '@')
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, e := range list {
+		if e == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
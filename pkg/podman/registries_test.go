@@ -0,0 +1,136 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRegistriesConf = `
+unqualified-search-registries = ["quay.io", "docker.io"]
+
+[aliases]
+"fedora" = "registry.fedoraproject.org/fedora"
+
+[[registry]]
+location = "docker.io"
+[[registry.mirror]]
+location = "localhost:5000"
+
+[[registry]]
+prefix = "quay.io/myorg"
+location = "registry.example.com/quay/myorg"
+mirror-by-digest-only = true
+[[registry.mirror]]
+location = "mirror.example.com/myorg"
+`
+
+func writeRegistriesConf(t *testing.T, data string) {
+	path := filepath.Join(t.TempDir(), "registries.conf")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	os.Setenv(registriesConfEnvVar, path)
+	t.Cleanup(func() { os.Unsetenv(registriesConfEnvVar) })
+}
+
+func TestResolveImageDefaults(t *testing.T) {
+	config, err := loadRegistriesConfig()
+	assert.NoError(t, err)
+
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{"busybox:1.25", "docker.io/library/busybox:1.25"},
+		{"nginx", "docker.io/library/nginx:latest"},
+		{"library/nginx", "docker.io/library/nginx:latest"},
+		{"myorg/app:v1", "docker.io/myorg/app:v1"},
+		{"docker.io/nginx", "docker.io/library/nginx:latest"},
+		{"index.docker.io/library/nginx:1.21", "docker.io/library/nginx:1.21"},
+		{"localhost/app", "localhost/app:latest"},
+		{"localhost:5000/app", "localhost:5000/app:latest"},
+		{"registry.fedoraproject.org/fedora:latest", "registry.fedoraproject.org/fedora:latest"},
+		{"busybox@sha256:9f1003c480699be56815db0f8146ad2e22efea85129b5b5983d0e0fb52d9ab70",
+			"docker.io/library/busybox@sha256:9f1003c480699be56815db0f8146ad2e22efea85129b5b5983d0e0fb52d9ab70"},
+	}
+	for _, tt := range tests {
+		names, err := config.resolveImage(tt.image)
+		assert.NoError(t, err, tt.image)
+		assert.Equal(t, []string{tt.expected}, names, tt.image)
+		assert.Equal(t, []string{tt.expected}, config.pullSources(tt.expected), tt.image)
+	}
+
+	_, err = config.resolveImage("Busybox")
+	assert.Error(t, err)
+	_, err = config.resolveImage("busybox:")
+	assert.Error(t, err)
+}
+
+func TestResolveImageWithRegistriesConf(t *testing.T) {
+	writeRegistriesConf(t, testRegistriesConf)
+	config, err := loadRegistriesConfig()
+	assert.NoError(t, err)
+
+	names, err := config.resolveImage("busybox:1.25")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"quay.io/busybox:1.25", "docker.io/library/busybox:1.25"}, names)
+	names, err = config.resolveImage("fedora:35")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"registry.fedoraproject.org/fedora:35"}, names)
+
+	assert.Equal(t, []string{"localhost:5000/library/busybox:1.25", "docker.io/library/busybox:1.25"},
+		config.pullSources("docker.io/library/busybox:1.25"))
+	assert.Equal(t, []string{"registry.example.com/quay/myorg/app:v1"},
+		config.pullSources("quay.io/myorg/app:v1"))
+	assert.Equal(t, []string{"mirror.example.com/myorg/app@sha256:abc", "registry.example.com/quay/myorg/app@sha256:abc"},
+		config.pullSources("quay.io/myorg/app@sha256:abc"))
+	assert.Equal(t, []string{"quay.io/myorganization/app:v1"}, config.pullSources("quay.io/myorganization/app:v1"))
+
+	writeRegistriesConf(t, "unqualified-search-registries = []")
+	config, err = loadRegistriesConfig()
+	assert.NoError(t, err)
+	_, err = config.resolveImage("busybox")
+	assert.Error(t, err)
+	names, err = config.resolveImage("docker.io/busybox")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker.io/library/busybox:latest"}, names)
+
+	writeRegistriesConf(t, "[[registry]]\nmirror-by-digest-only = true")
+	_, err = loadRegistriesConfig()
+	assert.Error(t, err)
+}
+
+func TestCreatePodWithRegistryMirror(t *testing.T) {
+	writeRegistriesConf(t, testRegistriesConf)
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	rt.PullErrors["quay.io/"+image] = errors.New("manifest unknown")
+	pod := newStatusTestPod()
+
+	// the search registries are tried in order, with the mirrors before the registry
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"localhost:5000/library/" + image}, rt.Images())
+	s, err := rt.ContainerSpec(podmanContainerName(pod, pod.Spec.Containers[0].Name))
+	assert.NoError(t, err)
+	assert.Equal(t, "localhost:5000/library/"+image, s.Image)
+}
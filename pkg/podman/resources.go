@@ -0,0 +1,231 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/containers/podman/v3/pkg/specgen"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+const (
+	// cgroupParentEnvVar may be set to override the cgroup under which pods are
+	// created, or to an empty value to use the podman default
+	cgroupParentEnvVar = "CYMBA_CGROUP_PARENT"
+	// podPidsLimitEnvVar may be set to limit the number of processes of each container
+	podPidsLimitEnvVar = "CYMBA_POD_PIDS_LIMIT"
+
+	defaultCgroupParent = "cymba.slice"
+
+	// as in the kubelet
+	minShares     = 2
+	maxShares     = 262144
+	sharesPerCPU  = 1024
+	milliCPUToCPU = 1000
+	quotaPeriod   = 100000
+	minQuota      = 1000
+
+	// EvictedReason is the pod status reason of pods evicted for exceeding their
+	// ephemeral storage limits
+	EvictedReason = "Evicted"
+)
+
+// setPodResources sets the cgroup parent of a pod. As the kubelet, pods are grouped
+// in cgroups by QoS class: Guaranteed pods are created directly under the parent
+// cgroup, Burstable and BestEffort pods under a cgroup for their class.
+func setPodResources(ps *specgen.PodSpecGenerator, p *corev1.Pod) {
+	ps.CgroupParent = getPodCgroupParent(getPodQOSClass(p))
+}
+
+// getPodCgroupParent returns the cgroup parent for pods of a QoS class, as a systemd
+// slice if the parent is a slice, or else as a cgroupfs path
+func getPodCgroupParent(qos corev1.PodQOSClass) string {
+	parent, present := os.LookupEnv(cgroupParentEnvVar)
+	if !present {
+		parent = defaultCgroupParent
+	}
+	if parent == "" || qos == corev1.PodQOSGuaranteed {
+		return parent
+	}
+	class := strings.ToLower(string(qos))
+	if strings.HasSuffix(parent, ".slice") {
+		return strings.TrimSuffix(parent, ".slice") + "-" + class + ".slice"
+	}
+	return path.Join(parent, class)
+}
+
+// setContainerResources maps the resources of a container onto the cgroup limits of
+// its podman container: memory limit, CPU quota for the CPU limit and CPU shares for
+// the CPU request, and the pids limit configured for the host
+func setContainerResources(s *specgen.SpecGenerator, container *corev1.Container) error {
+	limits := container.Resources.Limits
+	requests := getContainerRequests(container)
+	resources := &spec.LinuxResources{}
+
+	if memory, ok := limits[corev1.ResourceMemory]; ok && !memory.IsZero() {
+		limit := memory.Value()
+		// swap is not available to containers, as with the kubelet
+		resources.Memory = &spec.LinuxMemory{Limit: &limit, Swap: &limit}
+	}
+
+	cpuRequest := requests[corev1.ResourceCPU]
+	shares := milliCPUToShares(cpuRequest.MilliValue())
+	resources.CPU = &spec.LinuxCPU{Shares: &shares}
+	if cpu, ok := limits[corev1.ResourceCPU]; ok && !cpu.IsZero() {
+		quota, period := milliCPUToQuota(cpu.MilliValue()), uint64(quotaPeriod)
+		resources.CPU.Quota = &quota
+		resources.CPU.Period = &period
+	}
+
+	if value, present := os.LookupEnv(podPidsLimitEnvVar); present && value != "" {
+		pids, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", podPidsLimitEnvVar, err)
+		}
+		resources.Pids = &spec.LinuxPids{Limit: pids}
+	}
+
+	s.ResourceLimits = resources
+	return nil
+}
+
+// getContainerRequests returns the requests of a container, defaulting to the limits
+// as the API server does for pods
+func getContainerRequests(container *corev1.Container) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	for name, q := range container.Resources.Limits {
+		requests[name] = q
+	}
+	for name, q := range container.Resources.Requests {
+		requests[name] = q
+	}
+	return requests
+}
+
+func milliCPUToShares(milliCPU int64) uint64 {
+	shares := milliCPU * sharesPerCPU / milliCPUToCPU
+	if shares < minShares {
+		return minShares
+	}
+	if shares > maxShares {
+		return maxShares
+	}
+	return uint64(shares)
+}
+
+func milliCPUToQuota(milliCPU int64) int64 {
+	quota := milliCPU * quotaPeriod / milliCPUToCPU
+	if quota < minQuota {
+		return minQuota
+	}
+	return quota
+}
+
+// getPodQOSClass returns the QoS class of a pod, following the kubelet rules: pods
+// where all containers have equal CPU and memory requests and limits are Guaranteed,
+// pods without any request or limit are BestEffort, and the others are Burstable
+func getPodQOSClass(p *corev1.Pod) corev1.PodQOSClass {
+	requests, limits := corev1.ResourceList{}, corev1.ResourceList{}
+	guaranteed := true
+	containers := append(append([]corev1.Container{}, p.Spec.InitContainers...), p.Spec.Containers...)
+	for i := range containers {
+		for name, q := range getContainerRequests(&containers[i]) {
+			if isQOSResource(name) && q.Sign() > 0 {
+				addQuantity(requests, name, q)
+			}
+		}
+		found := 0
+		for name, q := range containers[i].Resources.Limits {
+			if isQOSResource(name) && q.Sign() > 0 {
+				found++
+				addQuantity(limits, name, q)
+			}
+		}
+		if found < 2 {
+			guaranteed = false
+		}
+	}
+	if len(requests) == 0 && len(limits) == 0 {
+		return corev1.PodQOSBestEffort
+	}
+	if guaranteed {
+		for name, request := range requests {
+			if limit, ok := limits[name]; !ok || limit.Cmp(request) != 0 {
+				guaranteed = false
+			}
+		}
+	}
+	if guaranteed && len(requests) == len(limits) {
+		return corev1.PodQOSGuaranteed
+	}
+	return corev1.PodQOSBurstable
+}
+
+func isQOSResource(name corev1.ResourceName) bool {
+	return name == corev1.ResourceCPU || name == corev1.ResourceMemory
+}
+
+func addQuantity(list corev1.ResourceList, name corev1.ResourceName, q resource.Quantity) {
+	if total, ok := list[name]; ok {
+		total.Add(q)
+		list[name] = total
+		return
+	}
+	list[name] = q.DeepCopy()
+}
+
+// CheckEphemeralStorage checks the writable layers of the containers of a pod against
+// their ephemeral-storage limits, returning an eviction message if a limit is exceeded.
+// Cgroups cannot limit disk usage, so the limits are enforced by eviction as in the kubelet.
+func CheckEphemeralStorage(rt PodmanRuntime, p *corev1.Pod) (string, error) {
+	for _, container := range podContainers(p) {
+		limit, ok := container.Resources.Limits[corev1.ResourceEphemeralStorage]
+		if !ok {
+			continue
+		}
+		size, err := rt.ContainerSize(podmanContainerName(p, container.Name))
+		if err != nil {
+			if IsContainerNotFound(err) {
+				continue
+			}
+			return "", err
+		}
+		if size > limit.Value() {
+			return fmt.Sprintf("Container %s exceeded its local ephemeral storage limit %q. ", container.Name, limit.String()), nil
+		}
+	}
+	return "", nil
+}
+
+// EvictPod kills the containers of a pod and sets its status to Failed with the
+// Evicted reason. Evicted pods are not restarted.
+func EvictPod(rt PodmanRuntime, p *corev1.Pod, message string) error {
+	if err := rt.KillPod(podmanPodName(p)); err != nil && !IsPodNotFound(err) {
+		return err
+	}
+	p.Status.Phase = corev1.PodFailed
+	p.Status.Reason = EvictedReason
+	p.Status.Message = message
+	return nil
+}
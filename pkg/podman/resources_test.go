@@ -0,0 +1,123 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"os"
+	"testing"
+
+	"github.com/containers/podman/v3/pkg/specgen"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func resourceList(cpu, memory string) corev1.ResourceList {
+	list := corev1.ResourceList{}
+	if cpu != "" {
+		list[corev1.ResourceCPU] = resource.MustParse(cpu)
+	}
+	if memory != "" {
+		list[corev1.ResourceMemory] = resource.MustParse(memory)
+	}
+	return list
+}
+
+func TestGetPodQOSClass(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources []corev1.ResourceRequirements
+		expected  corev1.PodQOSClass
+	}{
+		{"no resources", []corev1.ResourceRequirements{{}}, corev1.PodQOSBestEffort},
+		{"limits only", []corev1.ResourceRequirements{{Limits: resourceList("500m", "128Mi")}}, corev1.PodQOSGuaranteed},
+		{"equal requests and limits", []corev1.ResourceRequirements{
+			{Requests: resourceList("500m", "128Mi"), Limits: resourceList("500m", "128Mi")},
+			{Limits: resourceList("1", "1Gi")},
+		}, corev1.PodQOSGuaranteed},
+		{"lower requests", []corev1.ResourceRequirements{{Requests: resourceList("100m", "128Mi"), Limits: resourceList("500m", "128Mi")}}, corev1.PodQOSBurstable},
+		{"memory limit only", []corev1.ResourceRequirements{{Limits: resourceList("", "128Mi")}}, corev1.PodQOSBurstable},
+		{"one container without resources", []corev1.ResourceRequirements{{Limits: resourceList("500m", "128Mi")}, {}}, corev1.PodQOSBurstable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newStatusTestPod()
+			pod.Spec.Containers = nil
+			for _, r := range tt.resources {
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "c", Resources: r})
+			}
+			assert.Equal(t, tt.expected, getPodQOSClass(pod))
+		})
+	}
+}
+
+func TestSetContainerResources(t *testing.T) {
+	os.Setenv(podPidsLimitEnvVar, "1024")
+	defer os.Unsetenv(podPidsLimitEnvVar)
+
+	s := specgen.NewSpecGenerator("busybox", false)
+	container := &corev1.Container{Resources: corev1.ResourceRequirements{
+		Requests: resourceList("250m", ""),
+		Limits:   resourceList("500m", "128Mi"),
+	}}
+	assert.NoError(t, setContainerResources(s, container))
+	assert.Equal(t, int64(128*1024*1024), *s.ResourceLimits.Memory.Limit)
+	assert.Equal(t, uint64(256), *s.ResourceLimits.CPU.Shares)
+	assert.Equal(t, int64(50000), *s.ResourceLimits.CPU.Quota)
+	assert.Equal(t, uint64(100000), *s.ResourceLimits.CPU.Period)
+	assert.Equal(t, int64(1024), s.ResourceLimits.Pids.Limit)
+
+	// best effort containers get the minimum shares and no limits
+	s = specgen.NewSpecGenerator("busybox", false)
+	assert.NoError(t, setContainerResources(s, &corev1.Container{}))
+	assert.Equal(t, uint64(2), *s.ResourceLimits.CPU.Shares)
+	assert.Nil(t, s.ResourceLimits.CPU.Quota)
+	assert.Nil(t, s.ResourceLimits.Memory)
+}
+
+func TestGetPodCgroupParent(t *testing.T) {
+	assert.Equal(t, "cymba.slice", getPodCgroupParent(corev1.PodQOSGuaranteed))
+	assert.Equal(t, "cymba-burstable.slice", getPodCgroupParent(corev1.PodQOSBurstable))
+
+	os.Setenv(cgroupParentEnvVar, "/cymba")
+	defer os.Unsetenv(cgroupParentEnvVar)
+	assert.Equal(t, "/cymba/besteffort", getPodCgroupParent(corev1.PodQOSBestEffort))
+	os.Setenv(cgroupParentEnvVar, "")
+	assert.Equal(t, "", getPodCgroupParent(corev1.PodQOSBestEffort))
+}
+
+func TestCheckEphemeralStorage(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	pod.Spec.Containers[0].Resources.Limits = corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse("1Mi")}
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+
+	message, err := CheckEphemeralStorage(rt, pod)
+	assert.NoError(t, err)
+	assert.Empty(t, message)
+
+	assert.NoError(t, rt.SetContainerSize(podmanContainerName(pod, pod.Spec.Containers[0].Name), 2*1024*1024))
+	message, err = CheckEphemeralStorage(rt, pod)
+	assert.NoError(t, err)
+	assert.Contains(t, message, "exceeded its local ephemeral storage limit")
+
+	assert.NoError(t, EvictPod(rt, pod, message))
+	assert.Equal(t, corev1.PodFailed, pod.Status.Phase)
+	assert.Equal(t, EvictedReason, pod.Status.Reason)
+}
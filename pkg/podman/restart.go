@@ -0,0 +1,184 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containers/podman/v3/libpod/define"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// waiting reason of containers waiting to be restarted, as in the kubelet
+	reasonCrashLoopBackOff = "CrashLoopBackOff"
+
+	// exited containers are restarted with the same back-off as in the kubelet
+	containerBackOffPeriod = 10 * time.Second
+	maxContainerBackOff    = 300 * time.Second
+)
+
+// shouldRestart checks if the restart policy of a pod restarts a container which
+// exited with the given exit code. Init containers are restarted only on failure.
+func shouldRestart(p *corev1.Pod, container *corev1.Container, exitCode int32) bool {
+	switch {
+	case p.Spec.RestartPolicy == corev1.RestartPolicyNever:
+		return false
+	case p.Spec.RestartPolicy == corev1.RestartPolicyOnFailure || isInitContainer(p, container):
+		return exitCode != 0
+	default:
+		return true
+	}
+}
+
+// RestartContainers restarts the exited containers of a pod according to its restart
+// policy. As in the kubelet, a container is restarted right away the first time, and
+// then with an exponential back-off. It returns the time after which a container in
+// back-off is due to restart, or zero if there is none.
+func (m *PodManager) RestartContainers(p *corev1.Pod) (time.Duration, error) {
+	var next time.Duration
+	for _, container := range podContainers(p) {
+		name := podmanContainerName(p, container.Name)
+		data, err := m.rt.InspectContainer(name)
+		if err != nil {
+			if IsContainerNotFound(err) {
+				continue
+			}
+			return 0, err
+		}
+		state := data.State
+		if state == nil || state.Status != define.ContainerStateExited.String() || !shouldRestart(p, container, state.ExitCode) {
+			continue
+		}
+
+		key := data.ID
+		now := m.restartBackOff.Clock.Now()
+		if m.restartBackOff.IsInBackOffSince(key, state.FinishedAt) {
+			remaining := m.restartBackOff.Get(key) - now.Sub(state.FinishedAt)
+			if next == 0 || remaining < next {
+				next = remaining
+			}
+			m.containerEvent(p, container, corev1.EventTypeWarning, EventBackOff, "Back-off restarting failed container")
+			continue
+		}
+		statuses := p.Status.ContainerStatuses
+		if isInitContainer(p, container) {
+			statuses = p.Status.InitContainerStatuses
+		}
+		if err := m.recordRestart(name, getContainerStatusByName(statuses, container.Name)); err != nil {
+			return 0, err
+		}
+		if err := m.startContainer(p, container, name); err != nil {
+			return 0, err
+		}
+		m.restartBackOff.Next(key, now)
+	}
+	return next, nil
+}
+
+// setRestartStatus reports the containers waiting for their restart back-off to expire
+// as waiting with the CrashLoopBackOff reason, their exit as last termination state
+func (m *PodManager) setRestartStatus(p *corev1.Pod, container *corev1.Container, cs *corev1.ContainerStatus) {
+	terminated := cs.State.Terminated
+	if terminated == nil || !shouldRestart(p, container, terminated.ExitCode) {
+		return
+	}
+	key := strings.TrimPrefix(cs.ContainerID, containerIDPrefix)
+	if !m.restartBackOff.IsInBackOffSince(key, terminated.FinishedAt.Time) {
+		return
+	}
+	cs.LastTerminationState = corev1.ContainerState{Terminated: terminated}
+	cs.State = corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+		Reason: reasonCrashLoopBackOff,
+		Message: fmt.Sprintf("back-off %s restarting failed container=%s pod=%s_%s(%s)",
+			m.restartBackOff.Get(key), container.Name, p.Name, p.Namespace, p.UID),
+	}}
+}
+
+// restarts records the restarts of containers done by cymba. Podman counts only the
+// restarts done by its own restart policy, and resets the exit code of a container
+// when it is started again, so the restart count and the terminated state of the last
+// run are kept here, by podman container name.
+type restarts struct {
+	mu      sync.Mutex
+	entries map[string]restartEntry
+}
+
+type restartEntry struct {
+	count      int32
+	terminated *corev1.ContainerStateTerminated
+}
+
+func (r *restarts) set(name string, entry restartEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[name] = entry
+}
+
+// get returns the last restart of a container, if it is the given podman container
+func (r *restarts) get(name, id string) *restartEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.entries[name]; ok && entry.terminated.ContainerID == containerIDPrefix+id {
+		return &restartEntry{count: entry.count, terminated: entry.terminated.DeepCopy()}
+	}
+	return nil
+}
+
+func (r *restarts) clear(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, name)
+}
+
+// recordRestart records the restart of an exited container, before it is started
+// again. The restart count follows the count reported in the status of the container.
+func (m *PodManager) recordRestart(name string, cs *corev1.ContainerStatus) error {
+	data, err := m.rt.InspectContainer(name)
+	if err != nil {
+		return err
+	}
+	if data.State == nil {
+		return nil
+	}
+	count := data.RestartCount
+	if cs != nil && cs.ContainerID == containerIDPrefix+data.ID && cs.RestartCount > count {
+		count = cs.RestartCount
+	}
+	if last := m.restarts.get(name, data.ID); last != nil && last.count > count {
+		count = last.count
+	}
+	m.restarts.set(name, restartEntry{count: count + 1, terminated: m.getTerminatedState(data.ID, data.State)})
+	return nil
+}
+
+// forgetRestarts drops the restarts recorded for the containers of a pod, and their
+// restart back-off
+func (m *PodManager) forgetRestarts(p *corev1.Pod) {
+	for _, container := range podContainers(p) {
+		m.restarts.clear(podmanContainerName(p, container.Name))
+	}
+	for _, cs := range p.Status.InitContainerStatuses {
+		m.restartBackOff.DeleteEntry(strings.TrimPrefix(cs.ContainerID, containerIDPrefix))
+	}
+	for _, cs := range p.Status.ContainerStatuses {
+		m.restartBackOff.DeleteEntry(strings.TrimPrefix(cs.ContainerID, containerIDPrefix))
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+func TestRestartContainers(t *testing.T) {
+
+	tests := []struct {
+		policy   corev1.RestartPolicy
+		exitCode int32
+		restart  bool
+	}{
+		{"", 0, true},
+		{corev1.RestartPolicyAlways, 1, true},
+		{corev1.RestartPolicyOnFailure, 0, false},
+		{corev1.RestartPolicyOnFailure, 1, true},
+		{corev1.RestartPolicyNever, 1, false},
+	}
+	for _, tt := range tests {
+		rt := NewFakeRuntime()
+		m := newTestPodManager(rt)
+		pod := newStatusTestPod()
+		pod.Spec.RestartPolicy = tt.policy
+		_, err := m.CreatePod(pod, nil, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, rt.SetContainerExited(podmanContainerName(pod, containerName), tt.exitCode))
+		assert.NoError(t, m.GetPodStatus(pod))
+
+		_, err = m.RestartContainers(pod)
+		assert.NoError(t, err)
+		assert.NoError(t, m.GetPodStatus(pod))
+		cs := pod.Status.ContainerStatuses[0]
+		assert.Equal(t, tt.restart, cs.State.Running != nil, "policy %q exit code %d", tt.policy, tt.exitCode)
+		if tt.restart {
+			assert.Equal(t, int32(1), cs.RestartCount)
+			assert.Equal(t, tt.exitCode, cs.LastTerminationState.Terminated.ExitCode)
+		}
+		_, err = m.RemovePod(pod)
+		assert.NoError(t, err)
+	}
+}
+
+func TestCrashLoopBackOff(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	m.restartBackOff = flowcontrol.NewFakeBackOff(containerBackOffPeriod, maxContainerBackOff, fakeClock)
+	pod := newStatusTestPod()
+	name := podmanContainerName(pod, containerName)
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+
+	// the first restart is immediate
+	assert.NoError(t, rt.SetContainerExited(name, 1))
+	assert.NoError(t, m.GetPodStatus(pod))
+	next, err := m.RestartContainers(pod)
+	assert.NoError(t, err)
+	assert.Zero(t, next)
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.NotNil(t, pod.Status.ContainerStatuses[0].State.Running)
+
+	// the next ones wait for the back-off
+	assert.NoError(t, rt.SetContainerExited(name, 2))
+	fakeClock.SetTime(time.Now())
+	next, err = m.RestartContainers(pod)
+	assert.NoError(t, err)
+	assert.True(t, next > 0 && next <= containerBackOffPeriod)
+	assert.NoError(t, m.GetPodStatus(pod))
+	cs := pod.Status.ContainerStatuses[0]
+	if assert.NotNil(t, cs.State.Waiting) {
+		assert.Equal(t, reasonCrashLoopBackOff, cs.State.Waiting.Reason)
+		assert.Contains(t, cs.State.Waiting.Message, "back-off 10s restarting failed container=busybox")
+	}
+	assert.Equal(t, int32(2), cs.LastTerminationState.Terminated.ExitCode)
+	assert.Equal(t, int32(1), cs.RestartCount)
+	assert.Equal(t, corev1.PodRunning, pod.Status.Phase)
+	assert.Equal(t, corev1.ConditionFalse, getPodCondition(pod.Status.Conditions, corev1.PodReady).Status)
+
+	fakeClock.Step(containerBackOffPeriod)
+	next, err = m.RestartContainers(pod)
+	assert.NoError(t, err)
+	assert.Zero(t, next)
+	assert.NoError(t, m.GetPodStatus(pod))
+	cs = pod.Status.ContainerStatuses[0]
+	assert.NotNil(t, cs.State.Running)
+	assert.Equal(t, int32(2), cs.RestartCount)
+	assert.Equal(t, int32(2), cs.LastTerminationState.Terminated.ExitCode)
+
+	// the back-off doubles on each restart
+	assert.NoError(t, rt.SetContainerExited(name, 2))
+	assert.NoError(t, m.GetPodStatus(pod))
+	assert.Contains(t, pod.Status.ContainerStatuses[0].State.Waiting.Message, "back-off 20s")
+}
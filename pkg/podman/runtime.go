@@ -0,0 +1,559 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/containers/podman/v3/libpod/define"
+	"github.com/containers/podman/v3/pkg/api/handlers"
+	"github.com/containers/podman/v3/pkg/bindings"
+	"github.com/containers/podman/v3/pkg/bindings/containers"
+	"github.com/containers/podman/v3/pkg/bindings/images"
+	"github.com/containers/podman/v3/pkg/bindings/network"
+	"github.com/containers/podman/v3/pkg/bindings/pods"
+	"github.com/containers/podman/v3/pkg/bindings/system"
+	"github.com/containers/podman/v3/pkg/bindings/volumes"
+	"github.com/containers/podman/v3/pkg/domain/entities"
+	"github.com/containers/podman/v3/pkg/specgen"
+	"github.com/containers/podman/v3/version"
+	dockertypes "github.com/docker/docker/api/types"
+	"k8s.io/client-go/tools/remotecommand"
+	"k8s.io/klog/v2"
+)
+
+// execPollInterval is the interval at which exec sessions are checked for completion
+const execPollInterval = 100 * time.Millisecond
+
+// PodmanRuntime abstracts the podman operations used by cymba, so that controllers
+// can run against a live podman service or against an in-memory fake
+type PodmanRuntime interface {
+	// CreatePod creates a pod (and its infra container) from a pod spec
+	CreatePod(spec *entities.PodSpec) (*entities.PodCreateReport, error)
+	// StartPod starts all containers in a pod
+	StartPod(nameOrID string) error
+	// InspectPod returns info about a pod and its containers
+	InspectPod(nameOrID string) (*entities.PodInspectReport, error)
+	// KillPod sends SIGKILL to all containers in a pod
+	KillPod(nameOrID string) error
+	// RemovePod removes a pod and all its containers
+	RemovePod(nameOrID string, force bool) (*entities.PodRmReport, error)
+
+	// CreateContainer creates a container from a spec generator
+	CreateContainer(s *specgen.SpecGenerator) (entities.ContainerCreateResponse, error)
+	// StartContainer starts a created or exited container
+	StartContainer(nameOrID string) error
+	// StopContainer stops a container, killing it if it does not exit within the timeout in seconds
+	StopContainer(nameOrID string, timeout uint) error
+	// ExecContainer runs a command in a running container and returns its exit code. The
+	// command is abandoned after the timeout if it is not zero.
+	ExecContainer(nameOrID string, cmd []string, timeout time.Duration) (int, error)
+	// InspectContainer returns info about a container
+	InspectContainer(nameOrID string) (*define.InspectContainerData, error)
+	// ContainerSize returns the size of the writable layer of a container
+	ContainerSize(nameOrID string) (int64, error)
+	// ContainerStats returns the resource usage of a running container
+	ContainerStats(nameOrID string) (*define.ContainerStats, error)
+	// ContainerLogs sends the log lines of a container to the stdout and stderr channels,
+	// until the logs end or ctx is done
+	ContainerLogs(ctx context.Context, nameOrID string, options *containers.LogOptions, stdout, stderr chan string) error
+	// ExecStreams runs a command in a running container attached to the given streams and
+	// returns its exit code
+	ExecStreams(ctx context.Context, nameOrID string, cmd []string, streams *Streams) (int, error)
+	// AttachContainer attaches the given streams to a running container until it exits,
+	// stdin is closed for a TTY, or ctx is done
+	AttachContainer(ctx context.Context, nameOrID string, streams *Streams) error
+	// DialContainer connects to a TCP port on localhost in the network namespace of a
+	// running container
+	DialContainer(ctx context.Context, nameOrID string, port int32) (net.Conn, error)
+
+	// PullImage pulls an image, returning the IDs of the pulled images
+	PullImage(name string, options *images.PullOptions) ([]string, error)
+	// ImageExists checks if an image is present in local storage
+	ImageExists(name string) (bool, error)
+	// InspectImage returns info about an image in local storage
+	InspectImage(name string) (*entities.ImageInspectReport, error)
+
+	// CreateVolume creates a named volume
+	CreateVolume(options entities.VolumeCreateOptions) (*entities.VolumeConfigResponse, error)
+	// InspectVolume returns info about a named volume
+	InspectVolume(name string) (*entities.VolumeConfigResponse, error)
+	// RemoveVolume removes a named volume
+	RemoveVolume(name string, force bool) error
+
+	// NetworkExists checks if a network exists
+	NetworkExists(name string) (bool, error)
+	// CreateNetwork creates a bridge network whose containers are resolved by name by the
+	// dnsname plugin
+	CreateNetwork(name string, labels map[string]string) error
+	// ConnectNetwork connects a container to a network, where it is also resolved by the
+	// given aliases. A created container joins the network when it starts.
+	ConnectNetwork(name, nameOrID string, aliases []string) error
+
+	// Info returns info about the podman host
+	Info() (*define.Info, error)
+}
+
+// Streams are the standard streams attached to a container or an exec session. Nil streams
+// are not attached. With a TTY, stderr is merged into stdout and the terminal is resized
+// to the sizes received on Resize.
+type Streams struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	TTY    bool
+	Resize <-chan remotecommand.TerminalSize
+}
+
+// podmanRuntime implements PodmanRuntime with the podman bindings
+type podmanRuntime struct {
+	conn context.Context
+}
+
+// NewRuntime connects to the podman service and returns a PodmanRuntime backed by it
+func NewRuntime() (PodmanRuntime, error) {
+	conn, err := GetConnection()
+	if err != nil {
+		return nil, err
+	}
+	return NewPodmanRuntime(conn), nil
+}
+
+// NewPodmanRuntime returns a PodmanRuntime using an existing podman connection
+func NewPodmanRuntime(conn context.Context) PodmanRuntime {
+	return &podmanRuntime{conn: conn}
+}
+
+func (r *podmanRuntime) CreatePod(spec *entities.PodSpec) (*entities.PodCreateReport, error) {
+	return pods.CreatePodFromSpec(r.conn, spec)
+}
+
+func (r *podmanRuntime) StartPod(nameOrID string) error {
+	_, err := pods.Start(r.conn, nameOrID, nil)
+	return err
+}
+
+func (r *podmanRuntime) InspectPod(nameOrID string) (*entities.PodInspectReport, error) {
+	return pods.Inspect(r.conn, nameOrID, &pods.InspectOptions{})
+}
+
+func (r *podmanRuntime) KillPod(nameOrID string) error {
+	_, err := pods.Kill(r.conn, nameOrID, &pods.KillOptions{})
+	return err
+}
+
+func (r *podmanRuntime) RemovePod(nameOrID string, force bool) (*entities.PodRmReport, error) {
+	return pods.Remove(r.conn, nameOrID, &pods.RemoveOptions{Force: &force})
+}
+
+func (r *podmanRuntime) CreateContainer(s *specgen.SpecGenerator) (entities.ContainerCreateResponse, error) {
+	return containers.CreateWithSpec(r.conn, s, &containers.CreateOptions{})
+}
+
+func (r *podmanRuntime) StartContainer(nameOrID string) error {
+	return containers.Start(r.conn, nameOrID, nil)
+}
+
+func (r *podmanRuntime) StopContainer(nameOrID string, timeout uint) error {
+	return containers.Stop(r.conn, nameOrID, new(containers.StopOptions).WithTimeout(timeout))
+}
+
+func (r *podmanRuntime) ExecContainer(nameOrID string, cmd []string, timeout time.Duration) (int, error) {
+	config := &handlers.ExecCreateConfig{ExecConfig: dockertypes.ExecConfig{Cmd: cmd}}
+	id, err := containers.ExecCreate(r.conn, nameOrID, config)
+	if err != nil {
+		return 0, err
+	}
+	if err := containers.ExecStart(r.conn, id, nil); err != nil {
+		return 0, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		session, err := containers.ExecInspect(r.conn, id, nil)
+		if err != nil {
+			return 0, err
+		}
+		if !session.Running {
+			return session.ExitCode, nil
+		}
+		if timeout > 0 && time.Now().After(deadline) {
+			return 0, fmt.Errorf("command %q timed out after %s", cmd, timeout)
+		}
+		time.Sleep(execPollInterval)
+	}
+}
+
+func (r *podmanRuntime) InspectContainer(nameOrID string) (*define.InspectContainerData, error) {
+	return containers.Inspect(r.conn, nameOrID, &containers.InspectOptions{})
+}
+
+func (r *podmanRuntime) ContainerSize(nameOrID string) (int64, error) {
+	data, err := containers.Inspect(r.conn, nameOrID, new(containers.InspectOptions).WithSize(true))
+	if err != nil {
+		return 0, err
+	}
+	if data.SizeRw == nil {
+		return 0, nil
+	}
+	return *data.SizeRw, nil
+}
+
+// ContainerStats requests a single sample of the stats of a container, the stream of
+// stats being closed once it is received
+func (r *podmanRuntime) ContainerStats(nameOrID string) (*define.ContainerStats, error) {
+	ch, err := containers.Stats(r.conn, []string{nameOrID}, new(containers.StatsOptions).WithStream(false))
+	if err != nil {
+		return nil, err
+	}
+	for report := range ch {
+		if report.Error != nil {
+			return nil, report.Error
+		}
+		for i := range report.Stats {
+			return &report.Stats[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no stats received for container %s", nameOrID)
+}
+
+// ContainerLogs requests the logs as the bindings do, with a request bound to ctx so that
+// followed logs are not streamed anymore once ctx is done
+func (r *podmanRuntime) ContainerLogs(ctx context.Context, nameOrID string, options *containers.LogOptions, stdout, stderr chan string) error {
+	conn, err := bindings.GetClient(r.conn)
+	if err != nil {
+		return err
+	}
+	params, err := options.ToParams()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, libpodURL("/containers/%s/logs", nameOrID), nil)
+	if err != nil {
+		return err
+	}
+	req.URL.RawQuery = params.Encode()
+	resp, err := conn.Client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return bindings.APIResponse{Response: resp, Request: req}.Process(nil)
+	}
+
+	buffer := make([]byte, 1024)
+	for {
+		fd, l, err := containers.DemuxHeader(resp.Body, buffer)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		frame, err := containers.DemuxFrame(resp.Body, buffer, l)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		ch := stdout
+		switch fd {
+		case 0, 1:
+		case 2:
+			ch = stderr
+		case 3:
+			return fmt.Errorf("error from service in stream: %s", frame)
+		default:
+			return fmt.Errorf("unrecognized input header: %d", fd)
+		}
+		select {
+		case ch <- string(frame):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// ExecStreams starts the exec session on a dedicated connection, as the bindings attach
+// to the session with the terminal of the process
+func (r *podmanRuntime) ExecStreams(ctx context.Context, nameOrID string, cmd []string, streams *Streams) (int, error) {
+	config := &handlers.ExecCreateConfig{ExecConfig: dockertypes.ExecConfig{
+		Cmd:          cmd,
+		Tty:          streams.TTY,
+		AttachStdin:  streams.Stdin != nil,
+		AttachStdout: streams.Stdout != nil,
+		AttachStderr: streams.Stderr != nil && !streams.TTY,
+	}}
+	id, err := containers.ExecCreate(r.conn, nameOrID, config)
+	if err != nil {
+		return 0, err
+	}
+	body, err := json.Marshal(struct {
+		Detach bool `json:"Detach"`
+		TTY    bool `json:"Tty"`
+	}{TTY: streams.TTY})
+	if err != nil {
+		return 0, err
+	}
+	c, br, err := r.hijack(ctx, libpodURL("/exec/%s/start", id), bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	go handleResize(ctx, streams.Resize, func(size remotecommand.TerminalSize) error {
+		return containers.ResizeExecTTY(r.conn, id, new(containers.ResizeExecTTYOptions).WithHeight(int(size.Height)).WithWidth(int(size.Width)))
+	})
+	if err := copyStreams(c, br, streams); err != nil {
+		return 0, err
+	}
+	for {
+		session, err := containers.ExecInspect(r.conn, id, nil)
+		if err != nil {
+			return 0, err
+		}
+		if !session.Running {
+			return session.ExitCode, nil
+		}
+		select {
+		case <-time.After(execPollInterval):
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// AttachContainer attaches on a dedicated connection, as the bindings attach with the
+// terminal of the process
+func (r *podmanRuntime) AttachContainer(ctx context.Context, nameOrID string, streams *Streams) error {
+	params := url.Values{}
+	params.Set("stream", "true")
+	params.Set("stdin", strconv.FormatBool(streams.Stdin != nil))
+	params.Set("stdout", strconv.FormatBool(streams.Stdout != nil))
+	params.Set("stderr", strconv.FormatBool(streams.Stderr != nil))
+	c, br, err := r.hijack(ctx, libpodURL("/containers/%s/attach", nameOrID)+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	go handleResize(ctx, streams.Resize, func(size remotecommand.TerminalSize) error {
+		return containers.ResizeContainerTTY(r.conn, nameOrID, new(containers.ResizeTTYOptions).WithHeight(int(size.Height)).WithWidth(int(size.Width)))
+	})
+	return copyStreams(c, br, streams)
+}
+
+// DialContainer connects from the network namespace of the container, which requires
+// the podman service to run on this host with the privileges of cymba
+func (r *podmanRuntime) DialContainer(ctx context.Context, nameOrID string, port int32) (net.Conn, error) {
+	data, err := containers.Inspect(r.conn, nameOrID, &containers.InspectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if data.State == nil || !data.State.Running || data.State.Pid == 0 {
+		return nil, fmt.Errorf("container %s is not running", nameOrID)
+	}
+	return dialInNetNS(ctx, fmt.Sprintf("/proc/%d/ns/net", data.State.Pid), port)
+}
+
+// hijack sends a request to the podman service on a dedicated connection, which the
+// service hijacks to stream the standard streams of a container
+func (r *podmanRuntime) hijack(ctx context.Context, uri string, body io.Reader) (net.Conn, *bufio.Reader, error) {
+	conn, err := bindings.GetClient(r.conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	transport, ok := conn.Client.Transport.(*http.Transport)
+	if !ok || transport.DialContext == nil {
+		return nil, nil, errors.New("the podman connection does not support streaming")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	c, err := transport.DialContext(ctx, "tcp", req.URL.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode/100 != 2 {
+		defer c.Close()
+		return nil, nil, bindings.APIResponse{Response: resp, Request: req}.Process(nil)
+	}
+	// the connection is not closed with ctx once hijacked
+	go func() {
+		<-ctx.Done()
+		c.Close()
+	}()
+	return c, br, nil
+}
+
+// libpodURL returns the URL of a path of the libpod API, for the requests which the
+// bindings cannot send
+func libpodURL(format string, args ...string) string {
+	v := version.APIVersion[version.Libpod][version.CurrentAPI]
+	escaped := make([]interface{}, len(args))
+	for i, arg := range args {
+		escaped[i] = url.PathEscape(arg)
+	}
+	return fmt.Sprintf("http://d/v%d.%d.%d/libpod", v.Major, v.Minor, v.Patch) + fmt.Sprintf(format, escaped...)
+}
+
+// copyStreams copies stdin to a hijacked connection, and the output of the connection to
+// stdout and stderr until it is closed. Without a TTY, the output is multiplexed.
+func copyStreams(c net.Conn, br *bufio.Reader, streams *Streams) error {
+	if streams.Stdin != nil {
+		go func() {
+			if _, err := io.Copy(c, streams.Stdin); err != nil {
+				return
+			}
+			if cw, ok := c.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+		}()
+	}
+	if streams.TTY {
+		out := streams.Stdout
+		if out == nil {
+			out = io.Discard
+		}
+		_, err := io.Copy(out, br)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		return err
+	}
+
+	buffer := make([]byte, 1024)
+	for {
+		fd, l, err := containers.DemuxHeader(br, buffer)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		frame, err := containers.DemuxFrame(br, buffer, l)
+		if err != nil {
+			return err
+		}
+		var w io.Writer
+		switch fd {
+		case 0:
+		case 1:
+			w = streams.Stdout
+		case 2:
+			w = streams.Stderr
+		case 3:
+			return fmt.Errorf("error from service in stream: %s", frame)
+		default:
+			return fmt.Errorf("unrecognized input header: %d", fd)
+		}
+		if w != nil {
+			if _, err := w.Write(frame); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handleResize resizes a terminal to the sizes received until the channel is closed or
+// ctx is done
+func handleResize(ctx context.Context, sizes <-chan remotecommand.TerminalSize, resize func(remotecommand.TerminalSize) error) {
+	if sizes == nil {
+		return
+	}
+	for {
+		select {
+		case size, ok := <-sizes:
+			if !ok {
+				return
+			}
+			if err := resize(size); err != nil {
+				klog.Warningf("error resizing terminal: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *podmanRuntime) PullImage(name string, options *images.PullOptions) ([]string, error) {
+	return images.Pull(r.conn, name, options)
+}
+
+func (r *podmanRuntime) ImageExists(name string) (bool, error) {
+	return images.Exists(r.conn, name, nil)
+}
+
+func (r *podmanRuntime) InspectImage(name string) (*entities.ImageInspectReport, error) {
+	return images.GetImage(r.conn, name, &images.GetOptions{})
+}
+
+func (r *podmanRuntime) CreateVolume(options entities.VolumeCreateOptions) (*entities.VolumeConfigResponse, error) {
+	return volumes.Create(r.conn, options, &volumes.CreateOptions{})
+}
+
+func (r *podmanRuntime) InspectVolume(name string) (*entities.VolumeConfigResponse, error) {
+	return volumes.Inspect(r.conn, name, &volumes.InspectOptions{})
+}
+
+func (r *podmanRuntime) RemoveVolume(name string, force bool) error {
+	return volumes.Remove(r.conn, name, &volumes.RemoveOptions{Force: &force})
+}
+
+func (r *podmanRuntime) NetworkExists(name string) (bool, error) {
+	return network.Exists(r.conn, name, nil)
+}
+
+func (r *podmanRuntime) CreateNetwork(name string, labels map[string]string) error {
+	_, err := network.Create(r.conn, new(network.CreateOptions).WithName(name).WithLabels(labels).WithDisableDNS(false))
+	return err
+}
+
+func (r *podmanRuntime) ConnectNetwork(name, nameOrID string, aliases []string) error {
+	return network.Connect(r.conn, name, nameOrID, new(network.ConnectOptions).WithAliases(aliases))
+}
+
+func (r *podmanRuntime) Info() (*define.Info, error) {
+	return system.Info(r.conn, nil)
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containers/podman/v3/pkg/specgen"
+	"github.com/containers/storage/pkg/idtools"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// UnsupportedSecurityContextReason is the pod status reason of pods rejected because
+	// their security context cannot be honored on the podman host
+	UnsupportedSecurityContextReason = "UnsupportedSecurityContext"
+
+	// waiting reason of containers whose configuration is invalid, as in the kubelet
+	reasonCreateContainerConfigError = "CreateContainerConfigError"
+
+	// seccompProfileRoot is the directory of the localhost seccomp profiles, as in the kubelet
+	seccompProfileRoot = "/var/lib/kubelet/seccomp"
+)
+
+// CheckSecurityContext checks that the security context of a pod can be honored on the
+// podman host, returning a rejection message if it cannot. Sysctls must be namespaced,
+// and on rootless hosts the user and group IDs must be mapped in the user namespace of
+// the podman service.
+func CheckSecurityContext(rt PodmanRuntime, p *corev1.Pod) (string, error) {
+	psc := getPodSecurityContext(p)
+	for _, sysctl := range psc.Sysctls {
+		if !isNamespacedSysctl(sysctl.Name) {
+			return fmt.Sprintf("sysctl %q is not namespaced and cannot be set in a pod", sysctl.Name), nil
+		}
+	}
+
+	info, err := rt.Info()
+	if err != nil {
+		return "", err
+	}
+	if info.Host == nil || !info.Host.Security.Rootless {
+		return "", nil
+	}
+	uids, gids := info.Host.IDMappings.UIDMap, info.Host.IDMappings.GIDMap
+	type podID struct {
+		field string
+		id    *int64
+		idMap []idtools.IDMap
+	}
+	ids := []podID{
+		{"runAsUser", psc.RunAsUser, uids},
+		{"runAsGroup", psc.RunAsGroup, gids},
+		{"fsGroup", psc.FSGroup, gids},
+	}
+	for i := range psc.SupplementalGroups {
+		ids = append(ids, podID{"supplementalGroups", &psc.SupplementalGroups[i], gids})
+	}
+	for _, id := range ids {
+		if id.id != nil && !isMappedID(id.idMap, *id.id) {
+			return fmt.Sprintf("%s %d of the pod is not mapped in the user namespace of the rootless podman host", id.field, *id.id), nil
+		}
+	}
+	for _, container := range podContainers(p) {
+		if sc := container.SecurityContext; sc != nil {
+			if sc.RunAsUser != nil && !isMappedID(uids, *sc.RunAsUser) {
+				return fmt.Sprintf("runAsUser %d of container %s is not mapped in the user namespace of the rootless podman host", *sc.RunAsUser, container.Name), nil
+			}
+			if sc.RunAsGroup != nil && !isMappedID(gids, *sc.RunAsGroup) {
+				return fmt.Sprintf("runAsGroup %d of container %s is not mapped in the user namespace of the rootless podman host", *sc.RunAsGroup, container.Name), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// RejectPod sets the status of a pod which cannot run on the podman host to Failed.
+// Rejected pods are not created.
+func RejectPod(p *corev1.Pod, message string) {
+	p.Status.Phase = corev1.PodFailed
+	p.Status.Reason = UnsupportedSecurityContextReason
+	p.Status.Message = message
+}
+
+// isNamespacedSysctl checks if a sysctl is isolated by the IPC or network namespace of
+// a pod, as only those can be set for a pod without affecting the host
+func isNamespacedSysctl(name string) bool {
+	return name == "kernel.sem" || strings.HasPrefix(name, "kernel.shm") || strings.HasPrefix(name, "kernel.msg") ||
+		strings.HasPrefix(name, "fs.mqueue.") || strings.HasPrefix(name, "net.")
+}
+
+// isMappedID checks if an ID is mapped in a user namespace
+func isMappedID(idMap []idtools.IDMap, id int64) bool {
+	for _, m := range idMap {
+		if id >= int64(m.ContainerID) && id < int64(m.ContainerID)+int64(m.Size) {
+			return true
+		}
+	}
+	return false
+}
+
+// setContainerSecurity sets the security settings of a container from its security
+// context and from the security context of its pod, the container settings taking
+// precedence. The fsGroup is added to the supplemental groups, volume ownership is not
+// changed.
+func setContainerSecurity(s *specgen.SpecGenerator, p *corev1.Pod, container *corev1.Container, imageUser string) {
+	psc := getPodSecurityContext(p)
+	csc := getSecurityContext(container)
+
+	runAsUser, runAsGroup := getRunAsUser(p, container), csc.RunAsGroup
+	if runAsGroup == nil {
+		runAsGroup = psc.RunAsGroup
+	}
+	switch {
+	case runAsUser != nil && runAsGroup != nil:
+		s.User = fmt.Sprintf("%d:%d", *runAsUser, *runAsGroup)
+	case runAsUser != nil:
+		s.User = strconv.FormatInt(*runAsUser, 10)
+	case runAsGroup != nil:
+		user := getUserName(imageUser)
+		if user == "" {
+			user = "0"
+		}
+		s.User = fmt.Sprintf("%s:%d", user, *runAsGroup)
+	}
+	for _, g := range psc.SupplementalGroups {
+		s.Groups = append(s.Groups, strconv.FormatInt(g, 10))
+	}
+	if psc.FSGroup != nil {
+		s.Groups = append(s.Groups, strconv.FormatInt(*psc.FSGroup, 10))
+	}
+
+	// capabilities conflict with privileged, which grants all of them
+	if csc.Privileged != nil && *csc.Privileged {
+		s.Privileged = true
+	} else if csc.Capabilities != nil {
+		for _, c := range csc.Capabilities.Add {
+			s.CapAdd = append(s.CapAdd, string(c))
+		}
+		for _, c := range csc.Capabilities.Drop {
+			s.CapDrop = append(s.CapDrop, string(c))
+		}
+	}
+	if csc.ReadOnlyRootFilesystem != nil {
+		s.ReadOnlyFilesystem = *csc.ReadOnlyRootFilesystem
+	}
+	if csc.AllowPrivilegeEscalation != nil {
+		s.NoNewPrivileges = !*csc.AllowPrivilegeEscalation
+	}
+
+	seccomp := csc.SeccompProfile
+	if seccomp == nil {
+		seccomp = psc.SeccompProfile
+	}
+	if seccomp != nil {
+		switch seccomp.Type {
+		case corev1.SeccompProfileTypeUnconfined:
+			s.SeccompProfilePath = "unconfined"
+		case corev1.SeccompProfileTypeLocalhost:
+			if seccomp.LocalhostProfile != nil {
+				s.SeccompProfilePath = filepath.Join(seccompProfileRoot, *seccomp.LocalhostProfile)
+			}
+		}
+	}
+
+	seLinux := csc.SELinuxOptions
+	if seLinux == nil {
+		seLinux = psc.SELinuxOptions
+	}
+	if seLinux != nil {
+		for _, opt := range []struct{ key, value string }{
+			{"user", seLinux.User}, {"role", seLinux.Role}, {"type", seLinux.Type}, {"level", seLinux.Level},
+		} {
+			if opt.value != "" {
+				s.SelinuxOpts = append(s.SelinuxOpts, opt.key+":"+opt.value)
+			}
+		}
+	}
+
+	if len(psc.Sysctls) > 0 {
+		s.Sysctl = map[string]string{}
+		for _, sysctl := range psc.Sysctls {
+			s.Sysctl[sysctl.Name] = sysctl.Value
+		}
+	}
+}
+
+// verifyRunAsNonRoot checks that a container which must run as non-root does not run
+// as root, with its runAsUser or else with the user of its image. As in the kubelet,
+// images with a non-numeric user cannot be verified.
+func verifyRunAsNonRoot(p *corev1.Pod, container *corev1.Container, imageUser string) error {
+	runAsNonRoot := getSecurityContext(container).RunAsNonRoot
+	if runAsNonRoot == nil {
+		runAsNonRoot = getPodSecurityContext(p).RunAsNonRoot
+	}
+	if runAsNonRoot == nil || !*runAsNonRoot {
+		return nil
+	}
+	pod := fmt.Sprintf("%s_%s(%s)", p.Name, p.Namespace, p.UID)
+	if runAsUser := getRunAsUser(p, container); runAsUser != nil {
+		if *runAsUser == 0 {
+			return fmt.Errorf("container's runAsUser breaks non-root policy (pod: %q, container: %s)", pod, container.Name)
+		}
+		return nil
+	}
+	user := getUserName(imageUser)
+	if user == "" {
+		user = "0"
+	}
+	uid, err := strconv.ParseInt(user, 10, 64)
+	if err != nil {
+		return fmt.Errorf("container has runAsNonRoot and image has non-numeric user (%s), cannot verify user is non-root (pod: %q, container: %s)",
+			user, pod, container.Name)
+	}
+	if uid == 0 {
+		return fmt.Errorf("container has runAsNonRoot and image will run as root (pod: %q, container: %s)", pod, container.Name)
+	}
+	return nil
+}
+
+// getImageUser returns the user an image runs as, which may include a group
+func getImageUser(rt PodmanRuntime, image string) (string, error) {
+	ir, err := rt.InspectImage(image)
+	if err != nil {
+		return "", err
+	}
+	if ir.User != "" {
+		return ir.User, nil
+	}
+	if ir.Config != nil {
+		return ir.Config.User, nil
+	}
+	return "", nil
+}
+
+// getUserName returns the user part of a user[:group] specification
+func getUserName(user string) string {
+	if i := strings.Index(user, ":"); i >= 0 {
+		return user[:i]
+	}
+	return user
+}
+
+// getRunAsUser returns the user a container runs as, if it is set by its security
+// context or by the security context of its pod
+func getRunAsUser(p *corev1.Pod, container *corev1.Container) *int64 {
+	if sc := container.SecurityContext; sc != nil && sc.RunAsUser != nil {
+		return sc.RunAsUser
+	}
+	return getPodSecurityContext(p).RunAsUser
+}
+
+func getPodSecurityContext(p *corev1.Pod) *corev1.PodSecurityContext {
+	if p.Spec.SecurityContext == nil {
+		return &corev1.PodSecurityContext{}
+	}
+	return p.Spec.SecurityContext
+}
+
+func getSecurityContext(container *corev1.Container) *corev1.SecurityContext {
+	if container.SecurityContext == nil {
+		return &corev1.SecurityContext{}
+	}
+	return container.SecurityContext
+}
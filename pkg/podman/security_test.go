@@ -0,0 +1,171 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"testing"
+
+	"github.com/containers/storage/pkg/idtools"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func int64Ptr(i int64) *int64 { return &i }
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestSetContainerSecurity(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	profile := "profiles/audit.json"
+	pod.Spec.SecurityContext = &corev1.PodSecurityContext{
+		RunAsUser:          int64Ptr(1000),
+		RunAsGroup:         int64Ptr(3000),
+		FSGroup:            int64Ptr(2000),
+		SupplementalGroups: []int64{4000},
+		SeccompProfile:     &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &profile},
+		SELinuxOptions:     &corev1.SELinuxOptions{Level: "s0:c123,c456"},
+		Sysctls:            []corev1.Sysctl{{Name: "net.ipv4.ip_unprivileged_port_start", Value: "0"}},
+	}
+	pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
+		RunAsUser:                int64Ptr(1001),
+		Capabilities:             &corev1.Capabilities{Add: []corev1.Capability{"NET_ADMIN"}, Drop: []corev1.Capability{"ALL"}},
+		ReadOnlyRootFilesystem:   boolPtr(true),
+		AllowPrivilegeEscalation: boolPtr(false),
+		SELinuxOptions:           &corev1.SELinuxOptions{Type: "spc_t"},
+	}
+
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	s, err := rt.ContainerSpec(podmanContainerName(pod, containerName))
+	assert.NoError(t, err)
+	assert.Equal(t, "1001:3000", s.User)
+	assert.Equal(t, []string{"4000", "2000"}, s.Groups)
+	assert.Equal(t, []string{"NET_ADMIN"}, s.CapAdd)
+	assert.Equal(t, []string{"ALL"}, s.CapDrop)
+	assert.False(t, s.Privileged)
+	assert.True(t, s.ReadOnlyFilesystem)
+	assert.True(t, s.NoNewPrivileges)
+	assert.Equal(t, "/var/lib/kubelet/seccomp/profiles/audit.json", s.SeccompProfilePath)
+	assert.Equal(t, []string{"type:spc_t"}, s.SelinuxOpts)
+	assert.Equal(t, map[string]string{"net.ipv4.ip_unprivileged_port_start": "0"}, s.Sysctl)
+}
+
+func TestPrivilegedContainer(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	pod.Spec.SecurityContext = &corev1.PodSecurityContext{
+		RunAsGroup:     int64Ptr(3000),
+		SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined},
+	}
+	pod.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
+		Privileged:   boolPtr(true),
+		Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_ADMIN"}},
+	}
+	rt.ImageUsers["docker.io/library/"+image] = "nginx:nginx"
+
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	s, err := rt.ContainerSpec(podmanContainerName(pod, containerName))
+	assert.NoError(t, err)
+	assert.Equal(t, "nginx:3000", s.User)
+	assert.True(t, s.Privileged)
+	assert.Empty(t, s.CapAdd)
+	assert.Equal(t, "unconfined", s.SeccompProfilePath)
+}
+
+func TestRunAsNonRoot(t *testing.T) {
+	tests := []struct {
+		name      string
+		runAsUser *int64
+		imageUser string
+		message   string
+	}{
+		{"image user", nil, "1000", ""},
+		{"runAsUser", int64Ptr(1000), "", ""},
+		{"root image", nil, "", "container has runAsNonRoot and image will run as root"},
+		{"root image user", nil, "0:0", "container has runAsNonRoot and image will run as root"},
+		{"root runAsUser", int64Ptr(0), "1000", "container's runAsUser breaks non-root policy"},
+		{"non-numeric user", nil, "nginx", "container has runAsNonRoot and image has non-numeric user (nginx), cannot verify user is non-root"},
+	}
+	for _, tt := range tests {
+		rt := NewFakeRuntime()
+		m := newTestPodManager(rt)
+		rt.ImageUsers["docker.io/library/"+image] = tt.imageUser
+		pod := newStatusTestPod()
+		pod.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsNonRoot: boolPtr(true), RunAsUser: tt.runAsUser}
+
+		_, err := m.CreatePod(pod, nil, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, m.GetPodStatus(pod))
+		cs := pod.Status.ContainerStatuses[0]
+		if tt.message == "" {
+			assert.NotNil(t, cs.State.Running, tt.name)
+		} else if assert.NotNil(t, cs.State.Waiting, tt.name) {
+			assert.Equal(t, reasonCreateContainerConfigError, cs.State.Waiting.Reason, tt.name)
+			assert.Contains(t, cs.State.Waiting.Message, tt.message, tt.name)
+		}
+		_, err = m.RemovePod(pod)
+		assert.NoError(t, err)
+	}
+}
+
+func TestCheckSecurityContext(t *testing.T) {
+	rootless := NewFakeRuntime()
+	rootless.HostInfo.Host.Security.Rootless = true
+	rootless.HostInfo.Host.IDMappings.UIDMap = []idtools.IDMap{{ContainerID: 0, HostID: 1000, Size: 1}, {ContainerID: 1, HostID: 100000, Size: 65536}}
+	rootless.HostInfo.Host.IDMappings.GIDMap = rootless.HostInfo.Host.IDMappings.UIDMap
+
+	tests := []struct {
+		name    string
+		rt      *FakeRuntime
+		pod     func(*corev1.Pod)
+		message string
+	}{
+		{"no security context", rootless, func(p *corev1.Pod) {}, ""},
+		{"mapped user", rootless, func(p *corev1.Pod) {
+			p.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: int64Ptr(65536), FSGroup: int64Ptr(2000)}
+		}, ""},
+		{"unmapped user", rootless, func(p *corev1.Pod) {
+			p.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: int64Ptr(65537)}
+		}, "runAsUser 65537 of the pod is not mapped in the user namespace of the rootless podman host"},
+		{"unmapped supplemental group", rootless, func(p *corev1.Pod) {
+			p.Spec.SecurityContext = &corev1.PodSecurityContext{SupplementalGroups: []int64{100, 70000}}
+		}, "supplementalGroups 70000 of the pod is not mapped in the user namespace of the rootless podman host"},
+		{"unmapped container group", rootless, func(p *corev1.Pod) {
+			p.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{RunAsGroup: int64Ptr(100000)}
+		}, "runAsGroup 100000 of container busybox is not mapped in the user namespace of the rootless podman host"},
+		{"rootful host", NewFakeRuntime(), func(p *corev1.Pod) {
+			p.Spec.SecurityContext = &corev1.PodSecurityContext{RunAsUser: int64Ptr(100000)}
+		}, ""},
+		{"namespaced sysctl", NewFakeRuntime(), func(p *corev1.Pod) {
+			p.Spec.SecurityContext = &corev1.PodSecurityContext{Sysctls: []corev1.Sysctl{{Name: "kernel.shm_rmid_forced", Value: "1"}}}
+		}, ""},
+		{"host sysctl", NewFakeRuntime(), func(p *corev1.Pod) {
+			p.Spec.SecurityContext = &corev1.PodSecurityContext{Sysctls: []corev1.Sysctl{{Name: "vm.swappiness", Value: "10"}}}
+		}, `sysctl "vm.swappiness" is not namespaced and cannot be set in a pod`},
+	}
+	for _, tt := range tests {
+		pod := newStatusTestPod()
+		tt.pod(pod)
+		message, err := CheckSecurityContext(tt.rt, pod)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.message, message, tt.name)
+	}
+}
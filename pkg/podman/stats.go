@@ -0,0 +1,67 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/containers/podman/v3/libpod/define"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ContainerUsage is a sample of the resource usage of a container
+type ContainerUsage struct {
+	// ContainerID is the ID of the podman container, which changes when the container is
+	// recreated and its CPU time is reset
+	ContainerID string
+	// CPUNano is the CPU time consumed by the container since it started, in nanoseconds
+	CPUNano uint64
+	// Timestamp is the time the sample was taken at
+	Timestamp time.Time
+	// MemoryBytes is the memory used by the container
+	MemoryBytes uint64
+}
+
+// GetPodUsage returns a sample of the resource usage of the app containers of a pod, by
+// container name. The containers which are not running have no usage and are omitted.
+func GetPodUsage(rt PodmanRuntime, p *corev1.Pod) (map[string]ContainerUsage, error) {
+	usage := map[string]ContainerUsage{}
+	for _, container := range p.Spec.Containers {
+		stats, err := rt.ContainerStats(podmanContainerName(p, container.Name))
+		if err != nil {
+			if IsContainerNotFound(err) || isNotRunning(err) {
+				continue
+			}
+			return nil, err
+		}
+		usage[container.Name] = ContainerUsage{
+			ContainerID: stats.ContainerID,
+			CPUNano:     stats.CPUNano,
+			Timestamp:   time.Unix(0, int64(stats.SystemNano)),
+			MemoryBytes: stats.MemUsage,
+		}
+	}
+	return usage, nil
+}
+
+// isNotRunning parses podman error message to check if the stats of a container could not
+// be read because it is not running
+func isNotRunning(err error) bool {
+	return errors.Is(err, define.ErrCtrStateInvalid) || strings.Contains(err.Error(), define.ErrCtrStateInvalid.Error())
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPodUsage(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	name := podmanContainerName(pod, containerName)
+
+	// the containers of a pod which was not created have no usage
+	usage, err := GetPodUsage(rt, pod)
+	assert.NoError(t, err)
+	assert.Empty(t, usage)
+
+	_, err = m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, rt.SetContainerUsage(name, 2000000000, 64*1024*1024))
+	usage, err = GetPodUsage(rt, pod)
+	assert.NoError(t, err)
+	if assert.Contains(t, usage, containerName) {
+		data, err := rt.InspectContainer(name)
+		assert.NoError(t, err)
+		assert.Equal(t, data.ID, usage[containerName].ContainerID)
+		assert.Equal(t, uint64(2000000000), usage[containerName].CPUNano)
+		assert.Equal(t, uint64(64*1024*1024), usage[containerName].MemoryBytes)
+		assert.False(t, usage[containerName].Timestamp.IsZero())
+	}
+
+	// exited containers have no usage
+	assert.NoError(t, rt.SetContainerExited(name, 0))
+	usage, err = GetPodUsage(rt, pod)
+	assert.NoError(t, err)
+	assert.Empty(t, usage)
+}
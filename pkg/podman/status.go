@@ -0,0 +1,304 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"strings"
+	"time"
+
+	"github.com/containers/podman/v3/libpod/define"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	containerIDPrefix = "podman://"
+
+	reasonContainerCreating  = "ContainerCreating"
+	reasonCompleted          = "Completed"
+	reasonError              = "Error"
+	reasonOOMKilled          = "OOMKilled"
+	reasonContainersNotReady = "ContainersNotReady"
+
+	// reasons of pods and containers waiting for the init containers to complete
+	reasonPodInitializing          = "PodInitializing"
+	reasonContainersNotInitialized = "ContainersNotInitialized"
+
+	// PodmanStateCondition is the type of the pod condition reporting the raw podman pod
+	// state in its reason, for debugging purposes
+	PodmanStateCondition corev1.PodConditionType = "PodmanState"
+)
+
+// getContainerStatus builds the status of a container from the podman inspect data,
+// carrying over the last termination state from the previous status if any
+func (m *PodManager) getContainerStatus(name string, data *define.InspectContainerData, previous *corev1.ContainerStatus) corev1.ContainerStatus {
+	status := corev1.ContainerStatus{
+		Name:         name,
+		ContainerID:  containerIDPrefix + data.ID,
+		Image:        data.ImageName,
+		ImageID:      getImageID(m.rt, data),
+		RestartCount: m.getRestartCount(data, previous),
+	}
+	if previous != nil {
+		status.LastTerminationState = previous.LastTerminationState
+	}
+
+	state := data.State
+	if state == nil {
+		state = &define.InspectContainerState{Status: define.ContainerStateUnknown.String()}
+	}
+	switch state.Status {
+	case define.ContainerStateRunning.String(), define.ContainerStatePaused.String(), define.ContainerStateStopping.String():
+		status.State.Running = &corev1.ContainerStateRunning{StartedAt: metav1.NewTime(state.StartedAt)}
+		status.Ready = state.Status == define.ContainerStateRunning.String()
+		status.LastTerminationState = m.getLastTerminationState(data, state, previous, status.LastTerminationState)
+	case define.ContainerStateExited.String(), define.ContainerStateStopped.String(), define.ContainerStateRemoving.String():
+		status.State.Terminated = m.getTerminatedState(data.ID, state)
+	default:
+		status.State.Waiting = &corev1.ContainerStateWaiting{Reason: reasonContainerCreating}
+	}
+	started := status.State.Running != nil
+	status.Started = &started
+	return status
+}
+
+// getTerminatedState maps the exit info of a podman container to a terminated state
+func (m *PodManager) getTerminatedState(id string, state *define.InspectContainerState) *corev1.ContainerStateTerminated {
+	t := &corev1.ContainerStateTerminated{
+		ExitCode:    state.ExitCode,
+		Reason:      reasonCompleted,
+		Message:     state.Error,
+		StartedAt:   metav1.NewTime(state.StartedAt),
+		FinishedAt:  metav1.NewTime(state.FinishedAt),
+		ContainerID: containerIDPrefix + id,
+	}
+	message, hookFailed := m.postStartFailures.get(id, state.StartedAt)
+	switch {
+	case state.OOMKilled:
+		t.Reason = reasonOOMKilled
+	case hookFailed:
+		t.Reason = reasonPostStartHookError
+		t.Message = message
+	case state.ExitCode != 0:
+		t.Reason = reasonError
+	}
+	return t
+}
+
+// getRestartCount returns the restart count of a container, which is the highest of
+// the count of podman, the count of the previous status and the count of the restarts
+// done by cymba
+func (m *PodManager) getRestartCount(data *define.InspectContainerData, previous *corev1.ContainerStatus) int32 {
+	count := data.RestartCount
+	if previous != nil && previous.ContainerID == containerIDPrefix+data.ID && previous.RestartCount > count {
+		count = previous.RestartCount
+	}
+	if last := m.restarts.get(data.Name, data.ID); last != nil && last.count > count {
+		count = last.count
+	}
+	return count
+}
+
+// getLastTerminationState returns the last termination state of a running container:
+// the state recorded when cymba restarted it, or the state the container was seen in
+// before being restarted, or else the state rebuilt from the last exit recorded by podman
+func (m *PodManager) getLastTerminationState(data *define.InspectContainerData, state *define.InspectContainerState,
+	previous *corev1.ContainerStatus, last corev1.ContainerState) corev1.ContainerState {
+	if r := m.restarts.get(data.Name, data.ID); r != nil && r.terminated.FinishedAt.Time.Equal(state.FinishedAt) {
+		return corev1.ContainerState{Terminated: r.terminated}
+	}
+	if previous != nil && previous.State.Terminated != nil && previous.ContainerID == containerIDPrefix+data.ID {
+		return corev1.ContainerState{Terminated: previous.State.Terminated}
+	}
+	if last.Terminated == nil && data.RestartCount > 0 && !state.FinishedAt.IsZero() && state.FinishedAt.Before(state.StartedAt) {
+		return corev1.ContainerState{Terminated: m.getTerminatedState(data.ID, state)}
+	}
+	return last
+}
+
+// getImageID returns the digest reference of the image used by a container, falling
+// back to the image ID when the image has no repo digest
+func getImageID(rt PodmanRuntime, data *define.InspectContainerData) string {
+	if data.Image == "" {
+		return ""
+	}
+	ir, err := rt.InspectImage(data.Image)
+	if err != nil || ir.ImageData == nil {
+		return "sha256:" + data.Image
+	}
+	// images pinned by digest report the digest they were pulled with
+	for _, d := range ir.RepoDigests {
+		if d == data.ImageName {
+			return d
+		}
+	}
+	repo := repository(data.ImageName)
+	for _, d := range ir.RepoDigests {
+		if strings.HasPrefix(d, repo+"@") {
+			return d
+		}
+	}
+	if len(ir.RepoDigests) > 0 {
+		return ir.RepoDigests[0]
+	}
+	return "sha256:" + ir.ID
+}
+
+// isCompleted checks if a container exited successfully
+func isCompleted(data *define.InspectContainerData) bool {
+	return data.State != nil && data.State.Status == define.ContainerStateExited.String() && data.State.ExitCode == 0
+}
+
+// getPodPhase computes the pod phase from the container statuses and the pod restart
+// policy, following the same rules as the kubelet. Pods are pending until their init
+// containers completed, and failed if an init container failed and is not restarted.
+func getPodPhase(spec *corev1.PodSpec, initStatuses, statuses []corev1.ContainerStatus, podmanState string) corev1.PodPhase {
+	if podmanState == define.PodStateErrored {
+		return corev1.PodUnknown
+	}
+	for _, container := range spec.InitContainers {
+		cs := getContainerStatusByName(initStatuses, container.Name)
+		if cs != nil && cs.Ready {
+			continue
+		}
+		if cs != nil && cs.State.Terminated != nil && spec.RestartPolicy == corev1.RestartPolicyNever {
+			return corev1.PodFailed
+		}
+		return corev1.PodPending
+	}
+	var running, waiting, stopped, succeeded, unknown int
+	for _, container := range spec.Containers {
+		cs := getContainerStatusByName(statuses, container.Name)
+		switch {
+		case cs == nil:
+			unknown++
+		case cs.State.Running != nil:
+			running++
+		case cs.State.Terminated != nil:
+			stopped++
+			if cs.State.Terminated.ExitCode == 0 {
+				succeeded++
+			}
+		case cs.State.Waiting != nil:
+			if cs.LastTerminationState.Terminated != nil {
+				stopped++
+			} else {
+				waiting++
+			}
+		default:
+			unknown++
+		}
+	}
+
+	switch {
+	case waiting > 0:
+		return corev1.PodPending
+	case running > 0 && unknown == 0:
+		return corev1.PodRunning
+	case running == 0 && stopped > 0 && unknown == 0:
+		// containers are restarted with Always, and failed ones with OnFailure
+		if spec.RestartPolicy == corev1.RestartPolicyAlways || spec.RestartPolicy == "" {
+			return corev1.PodRunning
+		}
+		if stopped == succeeded {
+			return corev1.PodSucceeded
+		}
+		if spec.RestartPolicy == corev1.RestartPolicyNever {
+			return corev1.PodFailed
+		}
+		return corev1.PodRunning
+	default:
+		return corev1.PodPending
+	}
+}
+
+// getPodConditions computes the pod conditions from the container statuses
+func getPodConditions(p *corev1.Pod, created time.Time, podmanState string) []corev1.PodCondition {
+	initialized := corev1.PodCondition{Type: corev1.PodInitialized, Status: corev1.ConditionTrue}
+	notInitialized := []string{}
+	for _, container := range p.Spec.InitContainers {
+		if cs := getContainerStatusByName(p.Status.InitContainerStatuses, container.Name); cs == nil || !cs.Ready {
+			notInitialized = append(notInitialized, container.Name)
+		}
+	}
+	if len(notInitialized) > 0 {
+		initialized.Status = corev1.ConditionFalse
+		initialized.Reason = reasonContainersNotInitialized
+		initialized.Message = "containers with incomplete status: [" + strings.Join(notInitialized, " ") + "]"
+	}
+
+	ready := len(p.Status.ContainerStatuses) > 0
+	notReady := []string{}
+	for _, cs := range p.Status.ContainerStatuses {
+		if !cs.Ready {
+			ready = false
+			notReady = append(notReady, cs.Name)
+		}
+	}
+
+	containersReady := corev1.PodCondition{Type: corev1.ContainersReady, Status: corev1.ConditionTrue}
+	if !ready {
+		containersReady.Status = corev1.ConditionFalse
+		containersReady.Reason = reasonContainersNotReady
+		containersReady.Message = "containers with unready status: [" + strings.Join(notReady, " ") + "]"
+	}
+	podReady := containersReady
+	podReady.Type = corev1.PodReady
+
+	conditions := []corev1.PodCondition{
+		initialized,
+		podReady,
+		containersReady,
+		{Type: corev1.PodScheduled, Status: corev1.ConditionTrue, LastTransitionTime: metav1.NewTime(created)},
+		{
+			Type:    PodmanStateCondition,
+			Status:  corev1.ConditionTrue,
+			Reason:  podmanState,
+			Message: "podman pod is in state " + podmanState,
+		},
+	}
+	now := metav1.NewTime(time.Now())
+	for i := range conditions {
+		c := &conditions[i]
+		if old := getPodCondition(p.Status.Conditions, c.Type); old != nil && old.Status == c.Status && old.Reason == c.Reason {
+			c.LastTransitionTime = old.LastTransitionTime
+		} else if c.LastTransitionTime.IsZero() {
+			c.LastTransitionTime = now
+		}
+	}
+	return conditions
+}
+
+// getPodCondition returns the condition with the given type, or nil if not found
+func getPodCondition(conditions []corev1.PodCondition, t corev1.PodConditionType) *corev1.PodCondition {
+	for i := range conditions {
+		if conditions[i].Type == t {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// getContainerStatusByName returns the status of the named container, or nil if not found
+func getContainerStatusByName(statuses []corev1.ContainerStatus, name string) *corev1.ContainerStatus {
+	for i := range statuses {
+		if statuses[i].Name == name {
+			return &statuses[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newStatusTestPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:      podName,
+			Namespace: podNamespacce,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name:    containerName,
+					Image:   image,
+					Command: []string{"sleep", "86400"},
+				},
+			},
+		},
+	}
+}
+
+func TestGetPodStatusRunning(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, m.GetPodStatus(pod))
+
+	assert.Len(t, pod.Status.ContainerStatuses, 1)
+	cs := pod.Status.ContainerStatuses[0]
+	assert.Equal(t, containerName, cs.Name)
+	assert.NotNil(t, cs.State.Running)
+	assert.True(t, cs.Ready)
+	assert.True(t, *cs.Started)
+	assert.Equal(t, "docker.io/library/"+image, cs.Image)
+	assert.Contains(t, cs.ImageID, "docker.io/library/busybox@sha256:")
+
+	for _, ct := range []corev1.PodConditionType{corev1.PodInitialized, corev1.PodReady, corev1.ContainersReady, corev1.PodScheduled} {
+		c := getPodCondition(pod.Status.Conditions, ct)
+		if assert.NotNil(t, c, "condition %s", ct) {
+			assert.Equal(t, corev1.ConditionTrue, c.Status, "condition %s", ct)
+		}
+	}
+	assert.Equal(t, corev1.PodRunning, pod.Status.Phase)
+	assert.Equal(t, corev1.PodQOSBestEffort, pod.Status.QOSClass)
+	assert.Equal(t, "Running", getPodCondition(pod.Status.Conditions, PodmanStateCondition).Reason)
+}
+
+func TestGetPodStatusTerminated(t *testing.T) {
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, rt.SetContainerExited(podmanContainerName(pod, containerName), 2))
+	assert.NoError(t, m.GetPodStatus(pod))
+
+	cs := pod.Status.ContainerStatuses[0]
+	assert.False(t, cs.Ready)
+	if assert.NotNil(t, cs.State.Terminated) {
+		assert.Equal(t, int32(2), cs.State.Terminated.ExitCode)
+		assert.Equal(t, reasonError, cs.State.Terminated.Reason)
+		assert.False(t, cs.State.Terminated.FinishedAt.IsZero())
+	}
+	assert.Equal(t, corev1.ConditionFalse, getPodCondition(pod.Status.Conditions, corev1.PodReady).Status)
+
+	// restarting the container moves the terminated state to the last termination state
+	assert.NoError(t, rt.StartContainer(podmanContainerName(pod, containerName)))
+	assert.NoError(t, m.GetPodStatus(pod))
+	cs = pod.Status.ContainerStatuses[0]
+	assert.NotNil(t, cs.State.Running)
+	if assert.NotNil(t, cs.LastTerminationState.Terminated) {
+		assert.Equal(t, int32(2), cs.LastTerminationState.Terminated.ExitCode)
+	}
+}
+
+func TestGetPodPhase(t *testing.T) {
+	running := corev1.ContainerStatus{Name: "c", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}
+	waiting := corev1.ContainerStatus{Name: "c", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{}}}
+	succeeded := corev1.ContainerStatus{Name: "c", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}}
+	failed := corev1.ContainerStatus{Name: "c", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}}}
+
+	tests := []struct {
+		name          string
+		restartPolicy corev1.RestartPolicy
+		status        *corev1.ContainerStatus
+		podmanState   string
+		expected      corev1.PodPhase
+	}{
+		{"running", corev1.RestartPolicyAlways, &running, "Running", corev1.PodRunning},
+		{"waiting", corev1.RestartPolicyAlways, &waiting, "Created", corev1.PodPending},
+		{"missing", corev1.RestartPolicyAlways, nil, "Created", corev1.PodPending},
+		{"exited always", corev1.RestartPolicyAlways, &failed, "Exited", corev1.PodRunning},
+		{"exited default", "", &succeeded, "Exited", corev1.PodRunning},
+		{"succeeded never", corev1.RestartPolicyNever, &succeeded, "Exited", corev1.PodSucceeded},
+		{"succeeded on failure", corev1.RestartPolicyOnFailure, &succeeded, "Exited", corev1.PodSucceeded},
+		{"failed never", corev1.RestartPolicyNever, &failed, "Exited", corev1.PodFailed},
+		{"failed on failure", corev1.RestartPolicyOnFailure, &failed, "Exited", corev1.PodRunning},
+		{"errored", corev1.RestartPolicyAlways, &running, "Error", corev1.PodUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &corev1.PodSpec{
+				RestartPolicy: tt.restartPolicy,
+				Containers:    []corev1.Container{{Name: "c"}},
+			}
+			statuses := []corev1.ContainerStatus{}
+			if tt.status != nil {
+				statuses = append(statuses, *tt.status)
+			}
+			assert.Equal(t, tt.expected, getPodPhase(spec, nil, statuses, tt.podmanState))
+		})
+	}
+}
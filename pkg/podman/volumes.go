@@ -0,0 +1,489 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/podman/v3/pkg/domain/entities"
+	"github.com/containers/podman/v3/pkg/specgen"
+	spec "github.com/opencontainers/runtime-spec/specs-go"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// volumesDirEnvVar may be set to override the directory where ConfigMap and Secret
+	// volumes are projected on the host
+	volumesDirEnvVar = "CYMBA_VOLUMES_DIR"
+	// podLabel is set on the podman objects created for a pod
+	podLabel = "cymba.dev/pod"
+	// persistentVolumeLabel is set on the named volumes backing persistent volumes
+	persistentVolumeLabel = "cymba.dev/persistent-volume"
+
+	// PersistentVolumeDriver is the CSI driver name of the persistent volumes backed
+	// by podman named volumes. Pod volumes using it are mounted from the named volume
+	// in their VolumeHandleAttribute attribute.
+	PersistentVolumeDriver = "podman.cymba.dev"
+	// VolumeHandleAttribute is the CSI volume attribute holding the named volume name
+	VolumeHandleAttribute = "volumeHandle"
+
+	dataDirName    = "..data"
+	dataDirTmpName = "..data_tmp"
+)
+
+// ProjectedFile is a file of a ConfigMap or Secret volume
+type ProjectedFile struct {
+	// Path is the path of the file relative to the volume root
+	Path string
+	Data []byte
+	Mode int32
+}
+
+// volumesRootDir returns the host directory where pod volumes are projected. By
+// default it is in the user runtime dir, which is a tmpfs, so that secrets are not
+// written to persistent storage.
+func volumesRootDir() string {
+	if dir, present := os.LookupEnv(volumesDirEnvVar); present {
+		return dir
+	}
+	runDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runDir == "" {
+		runDir = "/run"
+	}
+	return filepath.Join(runDir, "cymba", "pods")
+}
+
+// VolumeDir returns the host directory where a ConfigMap or Secret volume of a pod is projected
+func VolumeDir(p *corev1.Pod, volume string) string {
+	return filepath.Join(volumesRootDir(), podmanPodName(p), "volumes", volume)
+}
+
+// emptyDirVolumeName returns the name of the podman named volume backing an emptyDir volume
+func emptyDirVolumeName(p *corev1.Pod, volume string) string {
+	return podmanPodName(p) + "_" + volume
+}
+
+// createPodVolumes creates the named volumes backing the emptyDir volumes of a pod and
+// validates its hostPath volumes
+func createPodVolumes(rt PodmanRuntime, p *corev1.Pod) error {
+	for _, vol := range p.Spec.Volumes {
+		switch {
+		case vol.EmptyDir != nil:
+			name := emptyDirVolumeName(p, vol.Name)
+			if _, err := rt.InspectVolume(name); err == nil {
+				continue
+			}
+			options := entities.VolumeCreateOptions{
+				Name:  name,
+				Label: map[string]string{podLabel: podmanPodName(p)},
+			}
+			if vol.EmptyDir.Medium == corev1.StorageMediumMemory {
+				options.Options = map[string]string{"type": "tmpfs", "device": "tmpfs"}
+				if vol.EmptyDir.SizeLimit != nil && !vol.EmptyDir.SizeLimit.IsZero() {
+					options.Options["o"] = fmt.Sprintf("size=%d", vol.EmptyDir.SizeLimit.Value())
+				}
+			}
+			if _, err := rt.CreateVolume(options); err != nil {
+				return err
+			}
+		case vol.HostPath != nil:
+			if err := checkHostPath(vol.HostPath); err != nil {
+				return fmt.Errorf("hostPath volume %s: %w", vol.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// removePodVolumes removes the named volumes and the projected files of a pod
+func removePodVolumes(rt PodmanRuntime, p *corev1.Pod) error {
+	for _, vol := range p.Spec.Volumes {
+		if vol.EmptyDir == nil {
+			continue
+		}
+		err := rt.RemoveVolume(emptyDirVolumeName(p, vol.Name), true)
+		if err != nil && !IsVolumeNotFound(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(volumesRootDir(), podmanPodName(p)))
+}
+
+// setContainerMounts maps the volume mounts of a container to named volumes and bind mounts
+func setContainerMounts(rt PodmanRuntime, s *specgen.SpecGenerator, p *corev1.Pod, container *corev1.Container) error {
+	for _, vm := range container.VolumeMounts {
+		vol := getVolume(p, vm.Name)
+		if vol == nil {
+			return fmt.Errorf("container %s mounts volume %s which is not defined in the pod", container.Name, vm.Name)
+		}
+		options := []string{}
+		if vm.ReadOnly {
+			options = append(options, "ro")
+		}
+
+		var source string
+		switch {
+		case vol.EmptyDir != nil, isPersistentVolume(vol):
+			name := emptyDirVolumeName(p, vol.Name)
+			if vol.EmptyDir == nil {
+				name = vol.CSI.VolumeAttributes[VolumeHandleAttribute]
+			}
+			if vm.SubPath == "" {
+				s.Volumes = append(s.Volumes, &specgen.NamedVolume{Name: name, Dest: vm.MountPath, Options: options})
+				continue
+			}
+			if vol.EmptyDir != nil && vol.EmptyDir.Medium == corev1.StorageMediumMemory {
+				return fmt.Errorf("subPath is not supported for memory emptyDir volume %s", vol.Name)
+			}
+			vr, err := rt.InspectVolume(name)
+			if err != nil {
+				return err
+			}
+			source = vr.Mountpoint
+		case vol.HostPath != nil:
+			source = vol.HostPath.Path
+		case vol.ConfigMap != nil, vol.Secret != nil:
+			source = VolumeDir(p, vol.Name)
+			// projected volumes are always read-only
+			if !vm.ReadOnly {
+				options = append(options, "ro")
+			}
+		case vol.PersistentVolumeClaim != nil:
+			return fmt.Errorf("volume %s references claim %s which was not resolved", vol.Name, vol.PersistentVolumeClaim.ClaimName)
+		default:
+			return fmt.Errorf("volume %s has an unsupported volume type", vol.Name)
+		}
+
+		if vm.SubPath != "" {
+			subPath, err := getSubPath(source, vm.SubPath, vol.EmptyDir != nil || isPersistentVolume(vol))
+			if err != nil {
+				return fmt.Errorf("volume mount %s of container %s: %w", vm.Name, container.Name, err)
+			}
+			source = subPath
+			// the subPath of a projected volume is mounted through the ..data symlink, which
+			// is resolved when the container starts, as the timestamped data dir it resolves
+			// to now is removed by the next update of the volume
+			if vol.ConfigMap != nil || vol.Secret != nil {
+				source = filepath.Join(VolumeDir(p, vol.Name), dataDirName, filepath.Clean(vm.SubPath))
+			}
+		}
+		s.Mounts = append(s.Mounts, spec.Mount{
+			Type:        "bind",
+			Source:      source,
+			Destination: vm.MountPath,
+			Options:     append([]string{"rbind"}, options...),
+		})
+	}
+	return nil
+}
+
+// isPersistentVolume checks if a pod volume is a persistent volume backed by a named volume
+func isPersistentVolume(vol *corev1.Volume) bool {
+	return vol.CSI != nil && vol.CSI.Driver == PersistentVolumeDriver && vol.CSI.VolumeAttributes[VolumeHandleAttribute] != ""
+}
+
+// CreatePersistentVolume creates the named volume backing a persistent volume, if it
+// does not exist yet
+func CreatePersistentVolume(rt PodmanRuntime, name string) error {
+	if _, err := rt.InspectVolume(name); err == nil {
+		return nil
+	}
+	_, err := rt.CreateVolume(entities.VolumeCreateOptions{
+		Name:  name,
+		Label: map[string]string{persistentVolumeLabel: name},
+	})
+	return err
+}
+
+// RemovePersistentVolume removes the named volume backing a persistent volume
+func RemovePersistentVolume(rt PodmanRuntime, name string) error {
+	if err := rt.RemoveVolume(name, false); err != nil && !IsVolumeNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// RecyclePersistentVolume scrubs the data of a persistent volume by recreating its
+// named volume
+func RecyclePersistentVolume(rt PodmanRuntime, name string) error {
+	if err := RemovePersistentVolume(rt, name); err != nil {
+		return err
+	}
+	return CreatePersistentVolume(rt, name)
+}
+
+// getVolume returns the named volume of a pod, or nil if not found
+func getVolume(p *corev1.Pod, name string) *corev1.Volume {
+	for i := range p.Spec.Volumes {
+		if p.Spec.Volumes[i].Name == name {
+			return &p.Spec.Volumes[i]
+		}
+	}
+	return nil
+}
+
+// getSubPath returns the host path of a subPath of a volume, resolving symlinks so that
+// the file projected by the atomic writer is mounted, and creating it if required
+func getSubPath(source, subPath string, create bool) (string, error) {
+	if filepath.IsAbs(subPath) || hasBackSteps(subPath) {
+		return "", fmt.Errorf("invalid subPath %q", subPath)
+	}
+	path := filepath.Join(source, subPath)
+	if create {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return "", err
+		}
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(resolved, filepath.Clean(source)+string(os.PathSeparator)) {
+		// the link may be relative to the volume root, as for projected files
+		if real, err := filepath.EvalSymlinks(source); err != nil || !strings.HasPrefix(resolved, real+string(os.PathSeparator)) {
+			return "", fmt.Errorf("subPath %q resolves outside of the volume", subPath)
+		}
+	}
+	return resolved, nil
+}
+
+// checkHostPath checks that a hostPath matches its type, creating it for the
+// DirectoryOrCreate and FileOrCreate types
+func checkHostPath(hp *corev1.HostPathVolumeSource) error {
+	pathType := corev1.HostPathUnset
+	if hp.Type != nil {
+		pathType = *hp.Type
+	}
+	if pathType == corev1.HostPathUnset {
+		return nil
+	}
+	switch pathType {
+	case corev1.HostPathDirectoryOrCreate:
+		return os.MkdirAll(hp.Path, 0755)
+	case corev1.HostPathFileOrCreate:
+		if _, err := os.Stat(hp.Path); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(hp.Path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(hp.Path, os.O_CREATE, 0644)
+			if err != nil {
+				return err
+			}
+			return f.Close()
+		}
+		pathType = corev1.HostPathFile
+	}
+
+	info, err := os.Stat(hp.Path)
+	if err != nil {
+		return err
+	}
+	mode := info.Mode()
+	var ok bool
+	switch pathType {
+	case corev1.HostPathDirectory:
+		ok = mode.IsDir()
+	case corev1.HostPathFile:
+		ok = mode.IsRegular()
+	case corev1.HostPathSocket:
+		ok = mode&os.ModeSocket != 0
+	case corev1.HostPathCharDev:
+		ok = mode&os.ModeDevice != 0 && mode&os.ModeCharDevice != 0
+	case corev1.HostPathBlockDev:
+		ok = mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0
+	default:
+		return fmt.Errorf("unsupported hostPath type %q", pathType)
+	}
+	if !ok {
+		return fmt.Errorf("%s is not of type %s", hp.Path, pathType)
+	}
+	return nil
+}
+
+// WriteVolumeFiles writes the files of a ConfigMap or Secret volume of a pod in its host
+// directory. As the kubelet atomic writer, files are written in a new directory which
+// replaces the previous one by swapping the ..data symlink, so that containers never
+// see a partial update. Nothing is written if the files did not change.
+func WriteVolumeFiles(p *corev1.Pod, volume string, files []ProjectedFile) error {
+	dir := VolumeDir(p, volume)
+	tops := map[string]bool{}
+	for _, f := range files {
+		if f.Path == "" || filepath.IsAbs(f.Path) || hasBackSteps(f.Path) || strings.HasPrefix(f.Path, "..") {
+			return fmt.Errorf("invalid path %q for volume %s", f.Path, volume)
+		}
+		tops[strings.SplitN(filepath.Clean(f.Path), string(os.PathSeparator), 2)[0]] = true
+	}
+	if err := makePrivateDirs(volumesRootDir(), filepath.Join(volumesRootDir(), podmanPodName(p))); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fsGroup := getPodSecurityContext(p).FSGroup
+	if err := setGroupOwnership(dir, fsGroup); err != nil {
+		return err
+	}
+
+	dataLink := filepath.Join(dir, dataDirName)
+	oldDataDir, err := os.Readlink(dataLink)
+	if err == nil && sameFiles(filepath.Join(dir, oldDataDir), files) {
+		return nil
+	}
+
+	tsDir, err := ioutil.TempDir(dir, "..")
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tsDir, 0755); err != nil {
+		return err
+	}
+	if err := setGroupOwnership(tsDir, fsGroup); err != nil {
+		return err
+	}
+	for _, f := range files {
+		path := filepath.Join(tsDir, f.Path)
+		for sub := filepath.Dir(f.Path); sub != "."; sub = filepath.Dir(sub) {
+			if err := os.MkdirAll(filepath.Join(tsDir, sub), 0755); err != nil {
+				return err
+			}
+			if err := setGroupOwnership(filepath.Join(tsDir, sub), fsGroup); err != nil {
+				return err
+			}
+		}
+		if err := ioutil.WriteFile(path, f.Data, os.FileMode(f.Mode)); err != nil {
+			return err
+		}
+		// the file mode is subject to the umask when the file is created
+		if err := os.Chmod(path, os.FileMode(f.Mode)); err != nil {
+			return err
+		}
+		if fsGroup != nil {
+			if err := os.Chown(path, -1, int(*fsGroup)); err != nil && !os.IsPermission(err) {
+				return err
+			}
+		}
+	}
+
+	tmpLink := filepath.Join(dir, dataDirTmpName)
+	os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Base(tsDir), tmpLink); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpLink, dataLink); err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "..") && !tops[e.Name()] {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	for top := range tops {
+		link := filepath.Join(dir, top)
+		if _, err := os.Lstat(link); os.IsNotExist(err) {
+			if err := os.Symlink(filepath.Join(dataDirName, top), link); err != nil {
+				return err
+			}
+		}
+	}
+	if oldDataDir != "" {
+		return os.RemoveAll(filepath.Join(dir, oldDataDir))
+	}
+	return nil
+}
+
+// makePrivateDirs creates directories accessible only by the user running cymba, or
+// restricts the access to existing ones. The volumes of the pods are projected below
+// them, so that their secrets are not readable by the other users of the host, even in
+// the rootful default /run/cymba/pods.
+func makePrivateDirs(dirs ...string) error {
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		if err := os.Chmod(dir, 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setGroupOwnership restricts a directory of a projected volume to the fsGroup of its
+// pod, as the kubelet does, when the pod has one: the directory is owned by the group
+// and is not accessible by the others. Rootless hosts cannot change the group, and the
+// directory stays accessible to the containers in the private volumes root.
+func setGroupOwnership(dir string, fsGroup *int64) error {
+	if fsGroup == nil {
+		return nil
+	}
+	if err := os.Chown(dir, -1, int(*fsGroup)); err != nil {
+		if os.IsPermission(err) {
+			return nil
+		}
+		return err
+	}
+	return os.Chmod(dir, 0750)
+}
+
+// sameFiles checks if a directory contains exactly the given files
+func sameFiles(dir string, files []ProjectedFile) bool {
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			count++
+		}
+		return err
+	})
+	if err != nil || count != len(files) {
+		return false
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.Path)
+		info, err := os.Stat(path)
+		if err != nil || info.Mode().Perm() != os.FileMode(f.Mode).Perm() {
+			return false
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil || !bytes.Equal(data, f.Data) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasBackSteps(path string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// IsVolumeNotFound parses podman error message to check if a volume was not found
+func IsVolumeNotFound(err error) bool {
+	return strings.Contains(err.Error(), "no such volume")
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package podman
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCreatePodVolumes(t *testing.T) {
+	os.Setenv(volumesDirEnvVar, t.TempDir())
+	defer os.Unsetenv(volumesDirEnvVar)
+	hostDir := t.TempDir()
+
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	directory := corev1.HostPathDirectory
+	pod.Spec.Volumes = []corev1.Volume{
+		{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		{Name: "host", VolumeSource: corev1.VolumeSource{HostPath: &corev1.HostPathVolumeSource{Path: hostDir, Type: &directory}}},
+		{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}},
+	}
+	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+		{Name: "cache", MountPath: "/cache"},
+		{Name: "host", MountPath: "/host", ReadOnly: true},
+		{Name: "config", MountPath: "/etc/config"},
+	}
+
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{emptyDirVolumeName(pod, "cache")}, rt.Volumes())
+
+	s, err := rt.ContainerSpec(podmanContainerName(pod, pod.Spec.Containers[0].Name))
+	assert.NoError(t, err)
+	assert.Len(t, s.Volumes, 1)
+	assert.Equal(t, "/cache", s.Volumes[0].Dest)
+	assert.Len(t, s.Mounts, 2)
+	assert.Equal(t, hostDir, s.Mounts[0].Source)
+	assert.Equal(t, []string{"rbind", "ro"}, s.Mounts[0].Options)
+	assert.Equal(t, VolumeDir(pod, "config"), s.Mounts[1].Source)
+	assert.Equal(t, []string{"rbind", "ro"}, s.Mounts[1].Options)
+
+	_, err = m.RemovePod(pod)
+	assert.NoError(t, err)
+	assert.Empty(t, rt.Volumes())
+}
+
+func TestCheckHostPath(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("x"), 0644))
+
+	hostPathType := func(t corev1.HostPathType) *corev1.HostPathType { return &t }
+	assert.NoError(t, checkHostPath(&corev1.HostPathVolumeSource{Path: dir, Type: hostPathType(corev1.HostPathDirectory)}))
+	assert.NoError(t, checkHostPath(&corev1.HostPathVolumeSource{Path: file, Type: hostPathType(corev1.HostPathFile)}))
+	assert.Error(t, checkHostPath(&corev1.HostPathVolumeSource{Path: file, Type: hostPathType(corev1.HostPathDirectory)}))
+	assert.Error(t, checkHostPath(&corev1.HostPathVolumeSource{Path: filepath.Join(dir, "missing"), Type: hostPathType(corev1.HostPathFile)}))
+
+	created := filepath.Join(dir, "created")
+	assert.NoError(t, checkHostPath(&corev1.HostPathVolumeSource{Path: created, Type: hostPathType(corev1.HostPathDirectoryOrCreate)}))
+	assert.DirExists(t, created)
+}
+
+func TestWriteVolumeFiles(t *testing.T) {
+	os.Setenv(volumesDirEnvVar, t.TempDir())
+	defer os.Unsetenv(volumesDirEnvVar)
+
+	pod := newStatusTestPod()
+	dir := VolumeDir(pod, "config")
+	assert.NoError(t, WriteVolumeFiles(pod, "config", []ProjectedFile{
+		{Path: "a", Data: []byte("1"), Mode: 0644},
+		{Path: "sub/b", Data: []byte("2"), Mode: 0600},
+	}))
+	data, err := ioutil.ReadFile(filepath.Join(dir, "a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(data))
+	info, err := os.Stat(filepath.Join(dir, "sub", "b"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// an update swaps the data dir and removes stale files
+	assert.NoError(t, WriteVolumeFiles(pod, "config", []ProjectedFile{{Path: "a", Data: []byte("3"), Mode: 0644}}))
+	data, err = ioutil.ReadFile(filepath.Join(dir, "a"))
+	assert.NoError(t, err)
+	assert.Equal(t, "3", string(data))
+	assert.NoFileExists(t, filepath.Join(dir, "sub"))
+	entries, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3) // a, ..data and the timestamped dir
+
+	assert.Error(t, WriteVolumeFiles(pod, "config", []ProjectedFile{{Path: "../escape", Mode: 0644}}))
+}
+
+func TestWriteVolumeFilesPermissions(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "pods")
+	os.Setenv(volumesDirEnvVar, root)
+	defer os.Unsetenv(volumesDirEnvVar)
+
+	// the volumes root and the pod directory are private to the user running cymba, so
+	// that the projected secrets are not readable by the other users of the host
+	pod := newStatusTestPod()
+	assert.NoError(t, os.MkdirAll(root, 0755))
+	assert.NoError(t, WriteVolumeFiles(pod, "secret", []ProjectedFile{{Path: "password", Data: []byte("s3cr3t"), Mode: 0644}}))
+	for _, dir := range []string{root, filepath.Join(root, podmanPodName(pod))} {
+		info, err := os.Stat(dir)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm(), dir)
+	}
+
+	// with an fsGroup, the data directories belong to its group and are not accessible
+	// by the others
+	gid := int64(os.Getgid())
+	pod.Spec.SecurityContext = &corev1.PodSecurityContext{FSGroup: &gid}
+	assert.NoError(t, WriteVolumeFiles(pod, "config", []ProjectedFile{{Path: "sub/a", Data: []byte("1"), Mode: 0644}}))
+	dir := VolumeDir(pod, "config")
+	for _, path := range []string{dir, filepath.Join(dir, dataDirName), filepath.Join(dir, dataDirName, "sub")} {
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0750), info.Mode().Perm(), path)
+	}
+}
+
+func TestProjectedSubPathMount(t *testing.T) {
+	os.Setenv(volumesDirEnvVar, t.TempDir())
+	defer os.Unsetenv(volumesDirEnvVar)
+
+	rt := NewFakeRuntime()
+	m := newTestPodManager(rt)
+	pod := newStatusTestPod()
+	pod.Spec.Volumes = []corev1.Volume{{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}}}
+	pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "config", MountPath: "/etc/app.conf", SubPath: "app.conf"}}
+	assert.NoError(t, WriteVolumeFiles(pod, "config", []ProjectedFile{{Path: "app.conf", Data: []byte("v1"), Mode: 0644}}))
+	_, err := m.CreatePod(pod, nil, nil)
+	assert.NoError(t, err)
+
+	// the subPath is mounted through the ..data symlink, so that the mount source still
+	// exists after an update, with the updated file, when the container restarts
+	s, err := rt.ContainerSpec(podmanContainerName(pod, pod.Spec.Containers[0].Name))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(VolumeDir(pod, "config"), dataDirName, "app.conf"), s.Mounts[0].Source)
+	assert.NoError(t, WriteVolumeFiles(pod, "config", []ProjectedFile{{Path: "app.conf", Data: []byte("v2"), Mode: 0644}}))
+	data, err := ioutil.ReadFile(s.Mounts[0].Source)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", string(data))
+
+	// subPaths resolving outside of the volume are rejected
+	pod.Spec.Containers[0].VolumeMounts[0].SubPath = "../../other"
+	assert.Error(t, setContainerMounts(rt, s, pod, &pod.Spec.Containers[0]))
+}